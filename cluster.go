@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	//ClusterGrid 按网格聚合
+	ClusterGrid = "grid"
+	//ClusterDistance 按距离聚合
+	ClusterDistance = "distance"
+)
+
+//ClusterOptions 点聚合参数,Mode为空时不聚合,MaxZoom及以下级别输出聚合点,
+//Radius为聚合半径(256瓦片像素),Field为汇总的数值字段,输出 字段_sum 与 字段_avg
+type ClusterOptions struct {
+	Mode    string `json:"mode" form:"cluster_mode"`
+	MaxZoom uint   `json:"max_zoom" form:"cluster_maxzoom"`
+	Radius  uint   `json:"radius" form:"cluster_radius"`
+	Field   string `json:"field" form:"cluster_field"`
+}
+
+//Validate 校验聚合参数
+func (opts *ClusterOptions) Validate() error {
+	switch opts.Mode {
+	case "", ClusterGrid, ClusterDistance:
+	default:
+		return fmt.Errorf("invalid cluster mode %s, grid or distance", opts.Mode)
+	}
+	if opts.MaxZoom > 22 {
+		return fmt.Errorf("invalid cluster maxzoom %d", opts.MaxZoom)
+	}
+	if opts.Radius > 256 {
+		return fmt.Errorf("invalid cluster radius %d, 0-256", opts.Radius)
+	}
+	return nil
+}
+
+//Enabled z级是否输出聚合点
+func (opts *ClusterOptions) Enabled(z uint) bool {
+	return opts.Mode != "" && z <= opts.MaxZoom
+}
+
+func (opts *ClusterOptions) radius() float64 {
+	if opts.Radius == 0 {
+		return 40
+	}
+	return float64(opts.Radius)
+}
+
+//cluster 聚合点,X/Y为Web墨卡托归一化坐标[0,1]
+type cluster struct {
+	X, Y    float64
+	Count   int
+	Sum     float64
+	Numbers int //参与汇总的要素数
+	Feature *geojson.Feature
+}
+
+func (cl *cluster) merge(o *cluster) {
+	n := float64(cl.Count + o.Count)
+	cl.X = (cl.X*float64(cl.Count) + o.X*float64(o.Count)) / n
+	cl.Y = (cl.Y*float64(cl.Count) + o.Y*float64(o.Count)) / n
+	cl.Count += o.Count
+	cl.Sum += o.Sum
+	cl.Numbers += o.Numbers
+	cl.Feature = nil
+}
+
+//clusterIndex 各级聚合结果,按所在瓦片索引,每个聚合点只属于一个瓦片,跨瓦片不重复计数
+type clusterIndex struct {
+	opts   ClusterOptions
+	levels map[uint][]*cluster
+	tiles  map[uint]map[uint64][]int
+}
+
+//clusterIndexes 图层聚合索引,键为图层缓存ID,数据编辑时随缓存失效
+var clusterIndexes sync.Map
+
+//dropClusterIndex 删除图层聚合索引
+func dropClusterIndex(id string) {
+	clusterIndexes.Delete(id)
+}
+
+//clusterLocks 聚合索引构建锁,按图层缓存ID,并发请求只构建一次
+var clusterLocks sync.Map
+
+//cachedClusterIndex 参数一致的已有聚合索引
+func cachedClusterIndex(id string, opts ClusterOptions) *clusterIndex {
+	if v, ok := clusterIndexes.Load(id); ok {
+		ci := v.(*clusterIndex)
+		if ci.opts == opts {
+			return ci
+		}
+	}
+	return nil
+}
+
+//loadClusterIndex 获取或创建图层聚合索引,同一图层的并发请求等待首个请求构建完成
+func loadClusterIndex(ctx context.Context, id string, src tileSource, opts ClusterOptions) (*clusterIndex, error) {
+	if ci := cachedClusterIndex(id, opts); ci != nil {
+		return ci, nil
+	}
+	v, _ := clusterLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+	if ci := cachedClusterIndex(id, opts); ci != nil {
+		return ci, nil
+	}
+	ci, err := newClusterIndex(ctx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	clusterIndexes.Store(id, ci)
+	return ci, nil
+}
+
+//newClusterIndex 读取数据源全部点要素,逐级聚合
+func newClusterIndex(ctx context.Context, src tileSource, opts ClusterOptions) (*clusterIndex, error) {
+	var points []*cluster
+	world := orb.Bound{Min: orb.Point{-180, -85.051129}, Max: orb.Point{180, 85.051129}}
+	err := src.Features(ctx, world, 1, func(f *geojson.Feature) error {
+		var pts []orb.Point
+		switch g := f.Geometry.(type) {
+		case orb.Point:
+			pts = append(pts, g)
+		case orb.MultiPoint:
+			pts = append(pts, g...)
+		}
+		for _, p := range pts {
+			c := &cluster{Count: 1, Feature: f}
+			fp := maptile.Fraction(clampBound(p.Bound()).Min, 0)
+			c.X, c.Y = fp.X(), fp.Y()
+			if opts.Field != "" {
+				if v, ok := clusterNumber(f.Properties[opts.Field]); ok {
+					c.Sum, c.Numbers = v, 1
+				}
+			}
+			points = append(points, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ci := &clusterIndex{
+		opts:   opts,
+		levels: make(map[uint][]*cluster),
+		tiles:  make(map[uint]map[uint64][]int),
+	}
+	items := points
+	for z := int(opts.MaxZoom); z >= 0; z-- {
+		if opts.Mode == ClusterGrid {
+			items = gridCluster(points, uint(z), opts.radius())
+		} else {
+			items = distanceCluster(items, uint(z), opts.radius())
+		}
+		ci.levels[uint(z)] = items
+		n := float64(uint64(1) << uint(z))
+		index := make(map[uint64][]int)
+		for i, c := range items {
+			x := uint64(math.Min(c.X*n, n-1))
+			y := uint64(math.Min(c.Y*n, n-1))
+			index[x<<32|y] = append(index[x<<32|y], i)
+		}
+		ci.tiles[uint(z)] = index
+	}
+	return ci, nil
+}
+
+//gridCluster 按z级radius像素网格聚合原始点
+func gridCluster(points []*cluster, z uint, radius float64) []*cluster {
+	size := 256 * float64(uint64(1)<<z) / radius
+	cells := make(map[[2]int64]*cluster)
+	var out []*cluster
+	for _, p := range points {
+		key := [2]int64{int64(p.X * size), int64(p.Y * size)}
+		c, ok := cells[key]
+		if !ok {
+			c = &cluster{}
+			*c = *p
+			cells[key] = c
+			out = append(out, c)
+			continue
+		}
+		c.merge(p)
+	}
+	return out
+}
+
+//distanceCluster 将上一级的聚合点按距离合并,依次以未合并的点为中心吸收半径内的点
+func distanceCluster(items []*cluster, z uint, radius float64) []*cluster {
+	r := radius / (256 * float64(uint64(1)<<z))
+	grid := make(map[[2]int64][]int)
+	for i, c := range items {
+		key := [2]int64{int64(c.X / r), int64(c.Y / r)}
+		grid[key] = append(grid[key], i)
+	}
+	used := make([]bool, len(items))
+	var out []*cluster
+	for i, seed := range items {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		c := &cluster{}
+		*c = *seed
+		cx, cy := int64(seed.X/r), int64(seed.Y/r)
+		for dx := int64(-1); dx <= 1; dx++ {
+			for dy := int64(-1); dy <= 1; dy++ {
+				for _, j := range grid[[2]int64{cx + dx, cy + dy}] {
+					o := items[j]
+					if used[j] || math.Hypot(o.X-seed.X, o.Y-seed.Y) > r {
+						continue
+					}
+					used[j] = true
+					c.merge(o)
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+//Features 瓦片内的聚合点,单点输出原要素属性
+func (ci *clusterIndex) Features(t maptile.Tile) []*geojson.Feature {
+	z := uint(t.Z)
+	items := ci.levels[z]
+	var out []*geojson.Feature
+	for _, i := range ci.tiles[z][uint64(t.X)<<32|uint64(t.Y)] {
+		c := items[i]
+		pt := fractionToLonLat(c.X, c.Y)
+		if c.Count == 1 && c.Feature != nil {
+			f := geojson.NewFeature(pt)
+			f.ID = c.Feature.ID
+			f.Properties = c.Feature.Properties
+			out = append(out, f)
+			continue
+		}
+		f := geojson.NewFeature(pt)
+		f.Properties["cluster"] = true
+		f.Properties["cluster_id"] = int64(z)<<32 | int64(i)
+		f.Properties["point_count"] = c.Count
+		f.Properties["point_count_abbreviated"] = abbreviateCount(c.Count)
+		if ci.opts.Field != "" {
+			f.Properties[ci.opts.Field+"_sum"] = c.Sum
+			if c.Numbers > 0 {
+				f.Properties[ci.opts.Field+"_avg"] = c.Sum / float64(c.Numbers)
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+//Encode 编码聚合瓦片
+func (ci *clusterIndex) Encode(name string, t maptile.Tile) ([]byte, error) {
+	layer := mvt.NewLayer(name, &geojson.FeatureCollection{Features: ci.Features(t)})
+	layer.ProjectToTile(t)
+	return mvt.MarshalGzipped(mvt.Layers{layer})
+}
+
+//fractionToLonLat 归一化Web墨卡托坐标转经纬度
+func fractionToLonLat(x, y float64) orb.Point {
+	lon := x*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi
+	return orb.Point{lon, lat}
+}
+
+//abbreviateCount 缩写计数,如 1.2k, 35k, 1.5m
+func abbreviateCount(n int) string {
+	switch {
+	case n >= 1000000:
+		return strconv.FormatFloat(math.Round(float64(n)/100000)/10, 'f', -1, 64) + "m"
+	case n >= 10000:
+		return strconv.Itoa(int(math.Round(float64(n)/1000))) + "k"
+	case n >= 1000:
+		return strconv.FormatFloat(math.Round(float64(n)/100)/10, 'f', -1, 64) + "k"
+	}
+	return strconv.Itoa(n)
+}
+
+//clusterNumber 属性值转为数值
+func clusterNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestClusterIndex(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	//跨越瓦片边界的点群,0度经线两侧
+	for i := 0; i < 400; i++ {
+		f := geojson.NewFeature(orb.Point{-0.5 + float64(i%20)*0.05, 30 + float64(i/20)*0.05})
+		f.ID = i
+		f.Properties["amount"] = int64(2)
+		fc.Append(f)
+	}
+	far := geojson.NewFeature(orb.Point{120, -30})
+	far.ID = 1000
+	far.Properties["amount"] = "7"
+	far.Properties["name"] = "far"
+	fc.Append(far)
+
+	for _, mode := range []string{ClusterGrid, ClusterDistance} {
+		opts := ClusterOptions{Mode: mode, MaxZoom: 8, Field: "amount"}
+		if err := opts.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		ci, err := newClusterIndex(context.Background(), newMemorySource(fc), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for z := uint(0); z <= opts.MaxZoom; z++ {
+			total, sum, singles := 0, 0.0, 0
+			n := uint32(1) << z
+			for x := uint32(0); x < n; x++ {
+				for y := uint32(0); y < n; y++ {
+					for _, f := range ci.Features(maptile.New(x, y, maptile.Zoom(z))) {
+						if !maptile.New(x, y, maptile.Zoom(z)).Bound().Contains(f.Point()) {
+							t.Errorf("%s: z%d cluster outside of its tile", mode, z)
+						}
+						if f.Properties["cluster"] == true {
+							total += f.Properties["point_count"].(int)
+							sum += f.Properties["amount_sum"].(float64)
+							continue
+						}
+						total++
+						singles++
+						v, _ := clusterNumber(f.Properties["amount"])
+						sum += v
+					}
+				}
+			}
+			if total != 401 || sum != 807 {
+				t.Errorf("%s: z%d counted %d points with sum %v, want 401 and 807", mode, z, total, sum)
+			}
+			if z < 4 && singles != 1 {
+				t.Errorf("%s: z%d should cluster the group, got %d single points", mode, z, singles)
+			}
+		}
+
+		tile := maptile.At(orb.Point{120, -30}, 5)
+		data, err := ci.Encode("pois", tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := mvt.UnmarshalGzipped(data)
+		if err != nil || len(layers[0].Features) != 1 || layers[0].Features[0].Properties["name"] != "far" {
+			t.Errorf("%s: single point should keep its properties, %v", mode, err)
+		}
+	}
+
+	if (&ClusterOptions{Mode: "kmeans"}).Validate() == nil {
+		t.Errorf("unknown cluster mode should be rejected")
+	}
+	if (&ClusterOptions{Mode: ClusterGrid, MaxZoom: 10}).Enabled(11) {
+		t.Errorf("cluster should stop above maxzoom")
+	}
+	for n, want := range map[int]string{999: "999", 1234: "1.2k", 35400: "35k", 1560000: "1.6m"} {
+		if got := abbreviateCount(n); got != want {
+			t.Errorf("abbreviate %d should be %s, got %s", n, want, got)
+		}
+	}
+}
+
+//countingSource 记录要素读取次数的数据源
+type countingSource struct {
+	*memorySource
+	reads int32
+}
+
+func (s *countingSource) Features(ctx context.Context, b orb.Bound, skip int, fn func(f *geojson.Feature) error) error {
+	atomic.AddInt32(&s.reads, 1)
+	return s.memorySource.Features(ctx, b, skip, fn)
+}
+
+func TestLoadClusterIndexOnce(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	for i := 0; i < 100; i++ {
+		fc.Append(geojson.NewFeature(orb.Point{float64(i), 10}))
+	}
+	src := &countingSource{memorySource: newMemorySource(fc)}
+	opts := ClusterOptions{Mode: ClusterGrid, MaxZoom: 4}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	id := "test_cluster_once"
+	defer dropClusterIndex(id)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := loadClusterIndex(context.Background(), id, src, opts); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&src.reads); n != 1 {
+		t.Errorf("concurrent loads read the source %d times, want 1", n)
+	}
+}
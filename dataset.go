@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
+	"database/sql"
 	"encoding/json"
 
 	"fmt"
+	"os"
 	"sort"
 	"strings"
 	"time"
@@ -20,9 +20,11 @@ import (
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/encoding/wkb"
 	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
 
 	geopkg "github.com/atlasdatatech/go-gpkg/gpkg"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	// "github.com/paulmach/orb/encoding/wkb"
 )
 
@@ -305,10 +307,56 @@ func (dt *Dataset) NewTileLayer() (*TileLayer, error) {
 	}
 	tlayer.Provider = prd //layer持有了provider
 	tlayer.ProviderLayerID = dt.ID
+	saved := &TileLayer{}
+	if db.Where("id = ?", dt.ID).First(saved).Error == nil {
+		tlayer.Cluster = saved.Cluster
+		tlayer.Rules = saved.Rules
+	}
+	if src, err := dt.tileSource(); err == nil {
+		tlayer.source = src
+	}
 	dt.tlayer = tlayer
 	return tlayer, nil
 }
 
+//Tile 获取服务层瓦片,优先读取图层缓存,返回缓存状态
+func (dt *Dataset) Tile(ctx context.Context, z, x, y uint) ([]byte, string, error) {
+	tl := dt.tlayer
+	if tl == nil {
+		return nil, "", fmt.Errorf("dataset (%s) has no tile layer", dt.ID)
+	}
+	tile := slippy.NewTile(z, x, y)
+	return layerTile(dsCacheID(dt.ID), uint32(z), uint32(x), uint32(y), func() ([]byte, error) {
+		if tl.Cluster.Enabled(z) {
+			return tl.ClusterEncode(ctx, maptile.New(uint32(x), uint32(y), maptile.Zoom(z)))
+		}
+		if tl.Provider.Std != nil {
+			return tl.Encode(ctx, tile)
+		}
+		return tl.MVTEncode(ctx, tile)
+	})
+}
+
+//MatrixTile 按瓦片矩阵集获取瓦片,行号自上而下,WebMercatorQuad使用服务层瓦片,
+//其他矩阵集直接读取要素编码,不缓存
+func (dt *Dataset) MatrixTile(ctx context.Context, ms *TileMatrixSet, z int, x, y uint32) ([]byte, error) {
+	if dt.tlayer == nil {
+		if _, err := dt.NewTileLayer(); err != nil {
+			return nil, err
+		}
+	}
+	if ms == WebMercatorQuad {
+		data, _, err := dt.Tile(ctx, uint(z), uint(x), uint(y))
+		return data, err
+	}
+	if dt.tlayer.source == nil {
+		return nil, fmt.Errorf("dataset (%s) has no feature source for %s", dt.ID, ms.ID)
+	}
+	tl := NewTiler(dt.tlayer.MVTName(), z, z)
+	tl.Matrix = ms
+	return tl.renderTile(ctx, dt.tlayer.source, maptile.New(x, y, maptile.Zoom(z)))
+}
+
 //Encode TODO (arolek): support for max zoom
 func (dt *Dataset) Encode(ctx context.Context, tile *slippy.Tile) ([]byte, error) {
 
@@ -383,23 +431,8 @@ func (dt *Dataset) Encode(ctx context.Context, tile *slippy.Tile) ([]byte, error
 		return nil, err
 	}
 
-	// buffer to store our compressed bytes
-	var gzipBuf bytes.Buffer
-
-	// compress the encoded bytes
-	w := gzip.NewWriter(&gzipBuf)
-	_, err = w.Write(tileBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	// flush and close the writer
-	if err = w.Close(); err != nil {
-		return nil, err
-	}
-
-	// return encoded, gzipped tile
-	return gzipBuf.Bytes(), nil
+	// apply zoom rules and compress
+	return dt.tlayer.generalize(tile.Z, tileBytes)
 }
 
 // Dump2GeoJSON 缓存服务层
@@ -415,96 +448,182 @@ func (dt *Dataset) Dump2GeoJSON() (*geojson.FeatureCollection, error) {
 			return nil, err
 		}
 		defer rows.Close()
-		cols, err := rows.Columns()
+		fc := geojson.NewFeatureCollection()
+		err = scanGpkgFeatures(rows, func(f *geojson.Feature) error {
+			fc.Append(f)
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
-		fc := geojson.NewFeatureCollection()
-		for rows.Next() {
-			// check if the context cancelled or timed out
-			vals := make([]interface{}, len(cols))
-			valPtrs := make([]interface{}, len(cols))
-			for i := 0; i < len(cols); i++ {
-				valPtrs[i] = &vals[i]
-			}
+		return fc, nil
+	case Postgres:
+	case Spatialite:
+	default:
+	}
+	return nil, fmt.Errorf("unsupported dirver")
+}
 
-			if err = rows.Scan(valPtrs...); err != nil {
-				log.Errorf("err reading row values: %v", err)
-				return nil, err
-			}
+//scanGpkgFeatures 逐行读取GeoPackage要素
+func scanGpkgFeatures(rows *sql.Rows, fn func(f *geojson.Feature) error) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		// check if the context cancelled or timed out
+		vals := make([]interface{}, len(cols))
+		valPtrs := make([]interface{}, len(cols))
+		for i := 0; i < len(cols); i++ {
+			valPtrs[i] = &vals[i]
+		}
 
-			f := geojson.NewFeature(nil)
-			for i := range cols {
-				if vals[i] == nil {
-					continue
+		if err = rows.Scan(valPtrs...); err != nil {
+			log.Errorf("err reading row values: %v", err)
+			return err
+		}
+
+		f := geojson.NewFeature(nil)
+		for i := range cols {
+			if vals[i] == nil {
+				continue
+			}
+			switch cols[i] {
+			case "fid":
+				f.ID = vals[i]
+			case "geom":
+				// log.Debug("extracting geopackage geometry header.", vals[i])
+				bytes, ok := vals[i].([]byte)
+				if !ok {
+					log.Errorf("unexpected column type for geom field. got %t", vals[i])
+					return fmt.Errorf("unexpected column type for geom field. expected blob")
 				}
-				switch cols[i] {
-				case "fid":
-					f.ID = vals[i]
-				case "geom":
-					// log.Debug("extracting geopackage geometry header.", vals[i])
-					bytes, ok := vals[i].([]byte)
-					if !ok {
-						log.Errorf("unexpected column type for geom field. got %t", vals[i])
-						return nil, fmt.Errorf("unexpected column type for geom field. expected blob")
-					}
-					geom, err := wkb.Unmarshal(bytes[40:])
-					if err != nil {
-						return nil, err
+				geom, err := wkb.Unmarshal(bytes[40:])
+				if err != nil {
+					return err
+				}
+				f.Geometry = geom
+			case "minx", "miny", "maxx", "maxy", "min_zoom", "max_zoom":
+				// Skip these columns used for bounding box and zoom filtering
+				continue
+			default:
+				// Grab any non-nil, non-id, non-bounding box, & non-geometry column as a tag
+				switch v := vals[i].(type) {
+				case []byte:
+					asBytes := make([]byte, len(v))
+					for j := 0; j < len(v); j++ {
+						asBytes[j] = v[j]
 					}
-					f.Geometry = geom
-				case "minx", "miny", "maxx", "maxy", "min_zoom", "max_zoom":
-					// Skip these columns used for bounding box and zoom filtering
-					continue
+					f.Properties[cols[i]] = string(asBytes)
+				case string:
+					f.Properties[cols[i]] = v
+				case int64:
+					f.Properties[cols[i]] = v
+				case float64:
+					f.Properties[cols[i]] = v
 				default:
-					// Grab any non-nil, non-id, non-bounding box, & non-geometry column as a tag
-					switch v := vals[i].(type) {
-					case []byte:
-						asBytes := make([]byte, len(v))
-						for j := 0; j < len(v); j++ {
-							asBytes[j] = v[j]
-						}
-						f.Properties[cols[i]] = string(asBytes)
-					case int64:
-						f.Properties[cols[i]] = v
-					case float64:
-						f.Properties[cols[i]] = v
-					default:
-						// TODO(arolek): return this error?
-						log.Errorf("unexpected type for sqlite column data: %v: %T", cols[i], v)
-					}
+					// TODO(arolek): return this error?
+					log.Errorf("unexpected type for sqlite column data: %v: %T", cols[i], v)
 				}
 			}
-			fc.Append(f)
 		}
-		return fc, nil
-	case Postgres:
-	case Spatialite:
-	default:
+		if err := fn(f); err != nil {
+			return err
+		}
 	}
-	return nil, fmt.Errorf("unsupported dirver")
+	return rows.Err()
+}
+
+//ExportGpkg 导出数据集为独立的GeoPackage文件,仅支持sqlite3数据库
+func (dt *Dataset) ExportGpkg(pathfile string) error {
+	if dbType != Sqlite3 {
+		return fmt.Errorf("export gpkg requires sqlite3 data db")
+	}
+	tbname := strings.ToLower(dt.ID)
+	os.Remove(pathfile)
+	out, err := gorm.Open(string(Sqlite3), pathfile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	err = out.AutoMigrate(&geopkg.Content{}, &geopkg.GeometryColumn{}, &geopkg.SpatialReferenceSystem{}).Error
+	if err != nil {
+		return err
+	}
+	//GPKG application id & version 1.2
+	err = out.Exec("PRAGMA application_id = 1196444487; PRAGMA user_version = 10200;").Error
+	if err != nil {
+		return err
+	}
+	err = out.Exec("ATTACH DATABASE ? AS src", viper.GetString("db.datadb")).Error
+	if err != nil {
+		return err
+	}
+	defer out.Exec("DETACH DATABASE src")
+	var create string
+	err = out.Raw("SELECT sql FROM src.sqlite_master WHERE type = 'table' AND name = ?", tbname).Row().Scan(&create)
+	if err != nil {
+		return fmt.Errorf("dataset table %s not found, details: %s", tbname, err)
+	}
+	stmts := []string{
+		create,
+		fmt.Sprintf(`INSERT INTO main."%s" SELECT * FROM src."%s"`, tbname, tbname),
+		`INSERT OR REPLACE INTO main.gpkg_spatial_ref_sys SELECT * FROM src.gpkg_spatial_ref_sys`,
+		`INSERT INTO main.gpkg_contents SELECT * FROM src.gpkg_contents WHERE table_name = ?`,
+		`INSERT INTO main.gpkg_geometry_columns SELECT * FROM src.gpkg_geometry_columns WHERE table_name = ?`,
+	}
+	for i, st := range stmts {
+		var err error
+		if i < 3 {
+			err = out.Exec(st).Error
+		} else {
+			err = out.Exec(st, tbname).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GeoJSON2MBTiles 缓存服务层
 func (dt *Dataset) GeoJSON2MBTiles(outPathFile string, layerName string, force bool) error {
 	st := time.Now()
-	db, err := CreateMBTileTables(outPathFile, force)
+	if _, err := os.Stat(outPathFile); err == nil && !force {
+		return fmt.Errorf("%s already exists", outPathFile)
+	}
+	src, err := dt.tileSource()
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-
-	fc, err := dt.Dump2GeoJSON()
+	//按要素外包框中心估计最大级别,不加载全部要素
+	var idxs []uint64
+	err = src.Bounds(func(b orb.Bound) error {
+		idxs = append(idxs, PointQuadkey(b.Center()))
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	total := len(fc.Features)
+	total := len(idxs)
 	minzoom := 0
+	maxzoom := guessMaxZoom(idxs)
+	db, err := CreateDedupMBTileTables(outPathFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
 	t := time.Now()
-	maxzoom, scnt := SplitTile(db, fc, layerName, 0, 0, 0)
-	log.Printf("tiler finished,time:%.2f s", time.Since(t).Seconds())
+	tiler := NewTiler(layerName, minzoom, maxzoom)
+	err = tiler.Run(context.Background(), src, db, nil)
+	if err != nil {
+		return err
+	}
+	scnt := tiler.Tiles
+	log.Printf("tiler finished,time:%.2f s, unique: %d, dropped features: %d", time.Since(t).Seconds(), tiler.Unique, tiler.Dropped)
 
-	bound := fc.BBox.Bound()
+	bound := tiler.Extent
 	// log.Printf("bbox: %v ", bound)
 	db.Exec("insert into metadata (name, value) values (?, ?)", "name", layerName)
 	db.Exec("insert into metadata (name, value) values (?, ?)", "bounds", fmt.Sprintf("%f,%f,%f,%f", bound.Left(), bound.Bottom(), bound.Right(), bound.Top()))
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+//PublishOptions 数据集发布参数,Bound为nil时发布全部范围,Fields为空时保留全部属性,
+//Simplify为按级别的简化容差(瓦片像素),未设置的级别使用前面最近级别的容差,默认1,
+//Matrix为切片的瓦片矩阵集,nil为WebMercatorQuad
+type PublishOptions struct {
+	Name     string
+	MinZoom  int
+	MaxZoom  int
+	Bound    *orb.Bound
+	Fields   []string
+	Simplify map[int]float64
+	Matrix   *TileMatrixSet
+}
+
+//parseSimplify 解析按级别的简化容差,格式 级别:容差,如 0:8,10:2,14:1
+func parseSimplify(s string) (map[int]float64, error) {
+	out := make(map[int]float64)
+	if strings.TrimSpace(s) == "" {
+		return out, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(kv), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid simplify %s, zoom:tolerance", kv)
+		}
+		z, err := strconv.Atoi(parts[0])
+		if err != nil || z < 0 || z > 22 {
+			return nil, fmt.Errorf("invalid simplify zoom %s", parts[0])
+		}
+		tol, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || tol < 0 {
+			return nil, fmt.Errorf("invalid simplify tolerance %s", parts[1])
+		}
+		out[z] = tol
+	}
+	return out, nil
+}
+
+//tolerance z级的简化容差
+func (opts *PublishOptions) tolerance(z int) float64 {
+	tol, best := 1.0, -1
+	for k, v := range opts.Simplify {
+		if k <= z && k > best {
+			tol, best = v, k
+		}
+	}
+	return tol
+}
+
+//matrix 发布使用的瓦片矩阵集
+func (opts *PublishOptions) matrix() *TileMatrixSet {
+	if opts.Matrix == nil {
+		return WebMercatorQuad
+	}
+	return opts.Matrix
+}
+
+//Validate 校验级别范围与字段
+func (opts *PublishOptions) Validate(dt *Dataset) error {
+	ms := opts.matrix()
+	if opts.MinZoom < ms.MinZoom || opts.MaxZoom > ms.MaxZoom || opts.MinZoom > opts.MaxZoom {
+		return fmt.Errorf("invalid zoom range %d-%d", opts.MinZoom, opts.MaxZoom)
+	}
+	if len(opts.Fields) == 0 {
+		return nil
+	}
+	fields := make(map[string]bool)
+	for _, f := range dt.fieldList() {
+		fields[f.Name] = true
+	}
+	for _, name := range opts.Fields {
+		if !fields[name] {
+			return fmt.Errorf("field %s not found", name)
+		}
+	}
+	return nil
+}
+
+//fieldList 数据集字段列表
+func (dt *Dataset) fieldList() []Field {
+	var fields []Field
+	json.Unmarshal(dt.Fields, &fields)
+	return fields
+}
+
+//Publish 按发布参数将数据集切片到MBTiles,ctx取消时结束并返回ctx.Err()
+func (dt *Dataset) Publish(ctx context.Context, pathfile string, opts *PublishOptions, task *Task) error {
+	src, err := dt.tileSource()
+	if err != nil {
+		return err
+	}
+	return dt.publishSource(ctx, pathfile, src, opts, task)
+}
+
+//publishSource 按发布参数切片数据源
+func (dt *Dataset) publishSource(ctx context.Context, pathfile string, src tileSource, opts *PublishOptions, task *Task) error {
+	mdb, err := CreateDedupMBTileTables(pathfile)
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+	mdb.SetMaxOpenConns(1)
+
+	name := opts.Name
+	if name == "" {
+		name = dt.Name
+	}
+	tl := NewTiler(name, opts.MinZoom, opts.MaxZoom)
+	tl.Bound = opts.Bound
+	tl.Fields = opts.Fields
+	tl.Tolerance = opts.tolerance
+	tl.Matrix = opts.Matrix
+	err = tl.Run(ctx, src, mdb, task)
+	if err != nil {
+		return err
+	}
+	if tl.Tiles == 0 {
+		return fmt.Errorf("no features to publish")
+	}
+	return dt.writePublishMetadata(mdb, name, tl.Extent, opts)
+}
+
+//writePublishMetadata 写入元数据,vector_layers包含发布的字段
+func (dt *Dataset) writePublishMetadata(mdb *sql.DB, name string, b orb.Bound, opts *PublishOptions) error {
+	keep := make(map[string]bool)
+	for _, f := range opts.Fields {
+		keep[f] = true
+	}
+	fields := make(map[string]string)
+	for _, f := range dt.fieldList() {
+		if len(keep) > 0 && !keep[f.Name] {
+			continue
+		}
+		switch f.Type {
+		case Int, Float:
+			fields[f.Name] = "Number"
+		case Bool:
+			fields[f.Name] = "Boolean"
+		default:
+			fields[f.Name] = "String"
+		}
+	}
+	vl, err := json.Marshal(map[string]interface{}{
+		"vector_layers": []map[string]interface{}{{
+			"id":      name,
+			"fields":  fields,
+			"minzoom": opts.MinZoom,
+			"maxzoom": opts.MaxZoom,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	center := b.Center()
+	meta := [][2]string{
+		{"name", name},
+		{"format", "pbf"},
+		{"type", "overlay"},
+		{"bounds", fmt.Sprintf("%f,%f,%f,%f", b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y())},
+		{"center", fmt.Sprintf("%f,%f,%d", center.X(), center.Y(), opts.MinZoom)},
+		{"minzoom", strconv.Itoa(opts.MinZoom)},
+		{"maxzoom", strconv.Itoa(opts.MaxZoom)},
+		{"json", string(vl)},
+		{"tilematrixset", opts.matrix().ID},
+		{"crs", opts.matrix().CRS},
+	}
+	for _, kv := range meta {
+		_, err := mdb.Exec("insert or replace into metadata (name, value) values (?, ?)", kv[0], kv[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//swapTileset 用新生成的MBTiles替换服务集文件并重新注册,
+//原服务集延迟关闭,等待正在读取的请求结束
+func swapTileset(ds *DataSource, tmpfile string) error {
+	old := userSet.tileset(ds.Owner, ds.ID)
+	err := os.Rename(tmpfile, ds.Path)
+	if err != nil {
+		return err
+	}
+	err = registerMBTiles(ds)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.db != nil {
+		time.AfterFunc(time.Minute, func() {
+			old.Close()
+		})
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestPublishOptions(t *testing.T) {
+	simp, err := parseSimplify("0:8, 10:2,14:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &PublishOptions{MinZoom: 0, MaxZoom: 16, Simplify: simp}
+	for z, want := range map[int]float64{0: 8, 9: 8, 10: 2, 13: 2, 16: 0} {
+		if got := opts.tolerance(z); got != want {
+			t.Errorf("tolerance at zoom %d should be %v, got %v", z, want, got)
+		}
+	}
+	if (&PublishOptions{}).tolerance(5) != 1 {
+		t.Errorf("default tolerance should be 1")
+	}
+	for _, s := range []string{"a:1", "3", "30:1", "3:-1"} {
+		if _, err := parseSimplify(s); err == nil {
+			t.Errorf("simplify %q should be rejected", s)
+		}
+	}
+
+	dt := &Dataset{Name: "pois", Fields: []byte(`[{"name":"name","type":"string"},{"name":"rank","type":"int"}]`)}
+	if err := (&PublishOptions{MinZoom: 5, MaxZoom: 3}).Validate(dt); err == nil {
+		t.Errorf("reversed zoom range should be rejected")
+	}
+	if err := (&PublishOptions{MaxZoom: 3, Fields: []string{"missing"}}).Validate(dt); err == nil {
+		t.Errorf("unknown field should be rejected")
+	}
+}
+
+func TestPublishFeatures(t *testing.T) {
+	dt := &Dataset{Name: "pois", Fields: []byte(`[{"name":"name","type":"string"},{"name":"rank","type":"int"}]`)}
+	newFC := func() *geojson.FeatureCollection {
+		fc := geojson.NewFeatureCollection()
+		for i, p := range []orb.Point{{120.6, 31.3}, {120.7, 31.4}, {-70, -30}} {
+			f := geojson.NewFeature(p)
+			f.ID = i
+			f.Properties["name"] = "poi"
+			f.Properties["rank"] = int64(i)
+			fc.Append(f)
+		}
+		fc.Append(geojson.NewFeature(orb.Polygon{{{120, 31}, {121, 31}, {121, 32}, {120, 32}, {120, 31}}}))
+		return fc
+	}
+	bound := orb.Bound{Min: orb.Point{110, 20}, Max: orb.Point{130, 40}}
+	opts := &PublishOptions{MinZoom: 2, MaxZoom: 6, Bound: &bound, Fields: []string{"name"}}
+	path := filepath.Join(t.TempDir(), "pois.mbtiles")
+	task := &Task{}
+	err := dt.publishSource(context.Background(), path, newMemorySource(newFC()), opts, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Progress != 99 || task.Count == 0 {
+		t.Errorf("unexpected task progress %d, count %d", task.Progress, task.Count)
+	}
+
+	mdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+	var minz, maxz, cnt int
+	err = mdb.QueryRow("select min(zoom_level), max(zoom_level), count(*) from tiles").Scan(&minz, &maxz, &cnt)
+	if err != nil || minz != 2 || maxz != 6 || cnt != task.Count {
+		t.Errorf("unexpected tiles zoom %d-%d count %d, %v", minz, maxz, cnt, err)
+	}
+	rows, err := mdb.Query("select zoom_level, tile_column, tile_row, tile_data from tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var z, x, row uint32
+		var data []byte
+		rows.Scan(&z, &x, &row, &data)
+		minx, miny, maxx, maxy := tileRange(bound, int(z))
+		y := (uint32(1) << z) - 1 - row
+		if x < minx || x > maxx || y < miny || y > maxy {
+			t.Errorf("tile %d/%d/%d outside of bbox", z, x, y)
+		}
+		layers, err := mvt.UnmarshalGzipped(data)
+		if err != nil || len(layers) != 1 || layers[0].Name != "pois" {
+			t.Fatalf("unexpected tile %d/%d/%d, %v", z, x, y, err)
+		}
+		for _, f := range layers[0].Features {
+			if _, ok := f.Properties["rank"]; ok {
+				t.Errorf("unselected field should be dropped, got %v", f.Properties)
+			}
+		}
+	}
+	var meta string
+	mdb.QueryRow("select value from metadata where name = 'json'").Scan(&meta)
+	if !strings.Contains(meta, `"fields":{"name":"String"}`) {
+		t.Errorf("vector_layers should list selected fields, got %s", meta)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = dt.publishSource(ctx, filepath.Join(t.TempDir(), "canceled.mbtiles"), newMemorySource(newFC()), opts, nil)
+	if err != context.Canceled {
+		t.Errorf("canceled publish should return context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	orbmvt "github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/planar"
+	"github.com/paulmach/orb/simplify"
+)
+
+//ZoomRule 图层在MinZoom-MaxZoom级别(含)的综合规则,长度单位为瓦片坐标(4096)
+//Fields为nil时保留全部属性,为空数组时不保留属性;Precision为数值属性保留的小数位数,nil不处理
+type ZoomRule struct {
+	MinZoom   uint     `json:"min_zoom"`
+	MaxZoom   uint     `json:"max_zoom"`
+	Fields    []string `json:"fields"`
+	MinArea   float64  `json:"min_area"`
+	MinLength float64  `json:"min_length"`
+	Tolerance float64  `json:"tolerance"`
+	Precision *int     `json:"precision"`
+}
+
+//ZoomRules 图层综合规则,按级别取第一个匹配的规则
+type ZoomRules []ZoomRule
+
+//Validate 校验综合规则
+func (rules ZoomRules) Validate() error {
+	for i, r := range rules {
+		if r.MinZoom > r.MaxZoom || r.MaxZoom > 22 {
+			return fmt.Errorf("rule %d has invalid zoom range %d-%d", i, r.MinZoom, r.MaxZoom)
+		}
+		if r.MinArea < 0 || r.MinLength < 0 || r.Tolerance < 0 {
+			return fmt.Errorf("rule %d should not have negative thresholds", i)
+		}
+		if r.Precision != nil && (*r.Precision < 0 || *r.Precision > 15) {
+			return fmt.Errorf("rule %d has invalid precision %d", i, *r.Precision)
+		}
+	}
+	return nil
+}
+
+//Match z级使用的规则,没有时返回nil
+func (rules ZoomRules) Match(z uint) *ZoomRule {
+	for i := range rules {
+		if rules[i].MinZoom <= z && z <= rules[i].MaxZoom {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+//Apply 对瓦片图层应用规则,几何为瓦片坐标,返回保留的要素数
+func (r *ZoomRule) Apply(layer *orbmvt.Layer) int {
+	var keep map[string]bool
+	if r.Fields != nil {
+		keep = make(map[string]bool)
+		for _, name := range r.Fields {
+			keep[name] = true
+		}
+	}
+	var scale float64
+	if r.Precision != nil {
+		scale = math.Pow(10, float64(*r.Precision))
+	}
+	features := layer.Features[:0]
+	for _, f := range layer.Features {
+		if f.Geometry == nil {
+			continue
+		}
+		if r.Tolerance > 0 && f.Geometry.Dimensions() > 0 {
+			f.Geometry = simplify.DouglasPeucker(r.Tolerance).Simplify(f.Geometry)
+			if f.Geometry == nil {
+				continue
+			}
+		}
+		switch f.Geometry.Dimensions() {
+		case 1:
+			if r.MinLength > 0 && planar.Length(f.Geometry) < r.MinLength {
+				continue
+			}
+		case 2:
+			if r.MinArea > 0 && math.Abs(planar.Area(f.Geometry)) < r.MinArea {
+				continue
+			}
+		}
+		for k, v := range f.Properties {
+			if keep != nil && !keep[k] {
+				delete(f.Properties, k)
+				continue
+			}
+			if scale > 0 {
+				switch n := v.(type) {
+				case float64:
+					f.Properties[k] = math.Round(n*scale) / scale
+				case float32:
+					f.Properties[k] = math.Round(float64(n)*scale) / scale
+				}
+			}
+		}
+		features = append(features, f)
+	}
+	layer.Features = features
+	return len(features)
+}
+
+//rules 解析图层的综合规则
+func (tl *TileLayer) rules() ZoomRules {
+	var rules ZoomRules
+	if len(tl.Rules) > 0 {
+		json.Unmarshal(tl.Rules, &rules)
+	}
+	return rules
+}
+
+//generalize 对未压缩的瓦片应用z级规则并压缩,同时记录瓦片大小统计
+func (tl *TileLayer) generalize(z uint, raw []byte) ([]byte, error) {
+	rule := tl.rules().Match(z)
+	if rule == nil {
+		recordTileSize(tl.ID, z, len(raw), len(raw), 0, 0)
+		return gzipTile(raw)
+	}
+	layers, err := orbmvt.Unmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	before, after := 0, 0
+	for _, l := range layers {
+		before += len(l.Features)
+		after += rule.Apply(l)
+	}
+	out, err := orbmvt.Marshal(layers)
+	if err != nil {
+		return nil, err
+	}
+	recordTileSize(tl.ID, z, len(raw), len(out), before, after)
+	return gzipTile(out)
+}
+
+//TileSizeStats 单个级别的瓦片大小统计,大小为未压缩字节数,要素数只在应用规则时统计
+type TileSizeStats struct {
+	Zoom           uint    `json:"zoom"`
+	Tiles          int64   `json:"tiles"`
+	RawBytes       int64   `json:"raw_bytes"`
+	Bytes          int64   `json:"bytes"`
+	MaxBytes       int64   `json:"max_bytes"`
+	AvgBytes       int64   `json:"avg_bytes"`
+	Features       int64   `json:"features"`
+	KeptFeatures   int64   `json:"kept_features"`
+	ReductionRatio float64 `json:"reduction_ratio"`
+}
+
+//tileSizeStats 各图层各级别的瓦片大小统计,键为图层ID,值为map[uint]*TileSizeStats
+var tileSizeStats sync.Map
+var tileSizeLock sync.Mutex
+
+//recordTileSize 记录一次瓦片编码的大小
+func recordTileSize(id string, z uint, raw, size, features, kept int) {
+	v, _ := tileSizeStats.LoadOrStore(id, &sync.Map{})
+	zooms := v.(*sync.Map)
+	sv, ok := zooms.Load(z)
+	if !ok {
+		sv, _ = zooms.LoadOrStore(z, &TileSizeStats{Zoom: z})
+	}
+	s := sv.(*TileSizeStats)
+	atomic.AddInt64(&s.Tiles, 1)
+	atomic.AddInt64(&s.RawBytes, int64(raw))
+	atomic.AddInt64(&s.Bytes, int64(size))
+	atomic.AddInt64(&s.Features, int64(features))
+	atomic.AddInt64(&s.KeptFeatures, int64(kept))
+	tileSizeLock.Lock()
+	if int64(size) > s.MaxBytes {
+		s.MaxBytes = int64(size)
+	}
+	tileSizeLock.Unlock()
+}
+
+//layerTileSizes 图层各级别的瓦片大小统计
+func layerTileSizes(id string) []TileSizeStats {
+	out := []TileSizeStats{}
+	v, ok := tileSizeStats.Load(id)
+	if !ok {
+		return out
+	}
+	v.(*sync.Map).Range(func(k, sv interface{}) bool {
+		s := sv.(*TileSizeStats)
+		tileSizeLock.Lock()
+		st := TileSizeStats{
+			Zoom:         s.Zoom,
+			Tiles:        atomic.LoadInt64(&s.Tiles),
+			RawBytes:     atomic.LoadInt64(&s.RawBytes),
+			Bytes:        atomic.LoadInt64(&s.Bytes),
+			MaxBytes:     s.MaxBytes,
+			Features:     atomic.LoadInt64(&s.Features),
+			KeptFeatures: atomic.LoadInt64(&s.KeptFeatures),
+		}
+		tileSizeLock.Unlock()
+		if st.Tiles > 0 {
+			st.AvgBytes = st.Bytes / st.Tiles
+		}
+		if st.RawBytes > 0 {
+			st.ReductionRatio = 1 - float64(st.Bytes)/float64(st.RawBytes)
+		}
+		out = append(out, st)
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Zoom < out[j].Zoom })
+	return out
+}
+
+//resetTileSizes 清除图层瓦片大小统计,规则修改时调用
+func resetTileSizes(id string) {
+	tileSizeStats.Delete(id)
+}
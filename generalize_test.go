@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	orbmvt "github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestZoomRules(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	add := func(g orb.Geometry, name string) {
+		f := geojson.NewFeature(g)
+		f.Properties["name"] = name
+		f.Properties["height"] = 12.3456
+		f.Properties["remark"] = "a long description that is not needed at low zooms"
+		fc.Append(f)
+	}
+	add(orb.Polygon{{{0, 0}, {5, 0}, {5, 5}, {0, 5}, {0, 0}}}, "small")
+	add(orb.Polygon{{{0, 0}, {500, 0}, {500, 500}, {0, 500}, {0, 0}}}, "large")
+	add(orb.LineString{{0, 0}, {10, 0}}, "short")
+	add(orb.LineString{{0, 0}, {100, 1}, {200, 0}, {300, 0}}, "long")
+	add(orb.Point{10, 10}, "point")
+	raw, err := orbmvt.Marshal(orbmvt.Layers{orbmvt.NewLayer("test", fc)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	precision := 1
+	rules := ZoomRules{
+		{MinZoom: 0, MaxZoom: 8, Fields: []string{"name", "height"}, MinArea: 100, MinLength: 50, Tolerance: 2, Precision: &precision},
+		{MinZoom: 9, MaxZoom: 22},
+	}
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rules.Match(5) != &rules[0] || rules.Match(12) != &rules[1] {
+		t.Errorf("unexpected rule match")
+	}
+	if (ZoomRules{{MinZoom: 6, MaxZoom: 3}}).Validate() == nil {
+		t.Errorf("reversed zoom range should be rejected")
+	}
+
+	tl := &TileLayer{ID: "generalize_test"}
+	tl.Rules = []byte(`[{"min_zoom":0,"max_zoom":8,"fields":["name","height"],"min_area":100,"min_length":50,"tolerance":2,"precision":1}]`)
+	defer resetTileSizes(tl.ID)
+	data, err := tl.generalize(5, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := orbmvt.UnmarshalGzipped(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, f := range layers[0].Features {
+		names[f.Properties["name"].(string)] = true
+		if _, ok := f.Properties["remark"]; ok {
+			t.Errorf("unselected field should be dropped")
+		}
+		if f.Properties["height"] != 12.3 {
+			t.Errorf("height should be rounded, got %v", f.Properties["height"])
+		}
+		if ls, ok := f.Geometry.(orb.LineString); ok && len(ls) != 2 {
+			t.Errorf("line should be simplified, got %v", ls)
+		}
+	}
+	if len(names) != 3 || !names["large"] || !names["long"] || !names["point"] {
+		t.Errorf("small features should be dropped, kept %v", names)
+	}
+
+	//无规则的级别原样输出
+	if _, err := tl.generalize(12, raw); err != nil {
+		t.Fatal(err)
+	}
+	stats := layerTileSizes(tl.ID)
+	if len(stats) != 2 || stats[0].Zoom != 5 || stats[0].Features != 5 || stats[0].KeptFeatures != 3 {
+		t.Fatalf("unexpected tile size stats %+v", stats)
+	}
+	if stats[0].Bytes >= stats[0].RawBytes || stats[0].ReductionRatio <= 0 || stats[1].ReductionRatio != 0 {
+		t.Errorf("rules should reduce tile size, got %+v", stats)
+	}
+}
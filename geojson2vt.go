@@ -196,14 +196,19 @@ func GetGeomIDXs(geom orb.Geometry) []uint64 {
 
 //GuessMaxZoom ..
 func GuessMaxZoom(fc *geojson.FeatureCollection) (maxzoom int) {
-	var sum float64
-	var count int64
-	fullDetail := 12
 	idxs := []uint64{}
 	for _, f := range fc.Features {
 		gidxs := GetGeomIDXs(f.Geometry)
 		idxs = append(idxs, gidxs...)
 	}
+	return guessMaxZoom(idxs)
+}
+
+//guessMaxZoom 按四叉树编码的平均间距估计最大级别
+func guessMaxZoom(idxs []uint64) (maxzoom int) {
+	var sum float64
+	var count int64
+	fullDetail := 12
 	sidxs := idxs[:]
 	sort.Slice(sidxs, func(i, j int) bool { return sidxs[i] < sidxs[j] })
 
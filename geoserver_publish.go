@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gs "github.com/hishamkaram/geoserver"
+	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
+	"github.com/spf13/viper"
+)
+
+//GsPublish 数据集发布到Geoserver的映射,重复发布时更新
+type GsPublish struct {
+	ID          string    `json:"id" gorm:"primary_key"`
+	GeoserverID string    `json:"geoserver_id" gorm:"index"`
+	DatasetID   string    `json:"dataset_id" gorm:"index"`
+	Owner       string    `json:"owner" gorm:"index"`
+	Workspace   string    `json:"workspace"`
+	Store       string    `json:"store"`
+	StoreType   string    `json:"store_type"`
+	Layer       string    `json:"layer"`
+	Style       string    `json:"style"`
+	TaskID      string    `json:"task_id"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error"`
+	PublishedAt time.Time `json:"published_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+//GsPublishOptions 发布参数
+type GsPublishOptions struct {
+	Workspace string `form:"workspace" json:"workspace"`
+	Store     string `form:"store" json:"store"`
+	Layer     string `form:"layer" json:"layer"`
+	Title     string `form:"title" json:"title"`
+	SLD       string `form:"sld" json:"sld"`
+	Seed      bool   `form:"seed" json:"seed"`
+	MinZoom   int    `form:"minzoom" json:"minzoom"`
+	MaxZoom   int    `form:"maxzoom" json:"maxzoom"`
+	Format    string `form:"format" json:"format"`
+	GridSet   int    `form:"gridset" json:"gridset"`
+}
+
+//LoadGsPublish 获取用户数据集在Geoserver上的发布映射
+func LoadGsPublish(gsid, did, owner string) (*GsPublish, error) {
+	pub := &GsPublish{}
+	err := db.Where("geoserver_id = ? and dataset_id = ? and owner = ?", gsid, did, owner).First(pub).Error
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+//Save 保存发布映射
+func (pub *GsPublish) Save() error {
+	tmp := &GsPublish{}
+	err := db.Where("id = ?", pub.ID).First(tmp).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return db.Create(pub).Error
+	}
+	if err != nil {
+		return err
+	}
+	return db.Save(pub).Error
+}
+
+//gsPublisher Geoserver REST发布
+type gsPublisher struct {
+	g    *gs.GeoServer
+	task *Task
+}
+
+func (p *gsPublisher) progress(v int) {
+	if p.task != nil {
+		p.task.Progress = v
+	}
+}
+
+//request 执行REST请求,返回状态码
+func (p *gsPublisher) request(method, url, contentType string, body io.Reader) ([]byte, int) {
+	req := gs.HTTPRequest{
+		Method:   method,
+		Accept:   "application/json",
+		URL:      url,
+		Data:     body,
+		DataType: contentType,
+	}
+	return p.g.DoRequest(req)
+}
+
+func (p *gsPublisher) exists(parts ...string) (bool, error) {
+	resp, code := p.request("GET", p.g.ParseURL(parts...), "", nil)
+	switch code {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, p.g.GetError(code, resp)
+}
+
+func (p *gsPublisher) send(method, url, contentType string, body []byte) error {
+	resp, code := p.request(method, url, contentType, bytes.NewReader(body))
+	if code < 200 || code >= 300 {
+		return fmt.Errorf("%s %s failed, %s", method, url, p.g.GetError(code, resp))
+	}
+	return nil
+}
+
+func (p *gsPublisher) sendJSON(method, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.send(method, url, "application/json", body)
+}
+
+//ensureWorkspace 工作空间不存在时创建
+func (p *gsPublisher) ensureWorkspace(ws string) error {
+	ok, err := p.exists("rest", "workspaces", ws)
+	if err != nil || ok {
+		return err
+	}
+	return p.sendJSON("POST", p.g.ParseURL("rest", "workspaces"), map[string]interface{}{
+		"workspace": map[string]string{"name": ws},
+	})
+}
+
+//gsStoreUser Geoserver连接数据库的只读用户,未配置时上传GeoPackage,不使用Atlas数据库账号
+func gsStoreUser() (user, password string) {
+	return viper.GetString("geoserver.dbuser"), viper.GetString("geoserver.dbpassword")
+}
+
+//ensurePostGISStore 创建或更新PostGIS数据存储,使用只读用户连接到数据库
+func (p *gsPublisher) ensurePostGISStore(ws, store string) error {
+	user, password := gsStoreUser()
+	if user == "" {
+		return fmt.Errorf("geoserver.dbuser is not configured")
+	}
+	host := viper.GetString("geoserver.dbhost")
+	if host == "" {
+		host = viper.GetString("db.host")
+	}
+	params := map[string]interface{}{
+		"dataStore": map[string]interface{}{
+			"name": store,
+			"connectionParameters": map[string]interface{}{
+				"entry": []map[string]string{
+					{"@key": "dbtype", "$": "postgis"},
+					{"@key": "host", "$": host},
+					{"@key": "port", "$": viper.GetString("db.port")},
+					{"@key": "database", "$": viper.GetString("db.datadb")},
+					{"@key": "schema", "$": "public"},
+					{"@key": "user", "$": user},
+					{"@key": "passwd", "$": password},
+					{"@key": "Expose primary keys", "$": "true"},
+				},
+			},
+		},
+	}
+	ok, err := p.exists("rest", "workspaces", ws, "datastores", store)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return p.sendJSON("PUT", p.g.ParseURL("rest", "workspaces", ws, "datastores", store), params)
+	}
+	return p.sendJSON("POST", p.g.ParseURL("rest", "workspaces", ws, "datastores"), params)
+}
+
+//uploadGpkgStore 上传GeoPackage文件,已存在时覆盖
+func (p *gsPublisher) uploadGpkgStore(ws, store, pathfile string) error {
+	buf, err := ioutil.ReadFile(pathfile)
+	if err != nil {
+		return err
+	}
+	url := p.g.ParseURL("rest", "workspaces", ws, "datastores", store, "file.gpkg") + "?configure=none&update=overwrite"
+	return p.send("PUT", url, "application/x-sqlite3", buf)
+}
+
+//publishFeatureType 发布或更新要素类型
+func (p *gsPublisher) publishFeatureType(ws, store, layer, native, title string, bbox [4]float64) error {
+	box := map[string]interface{}{
+		"minx": bbox[0], "miny": bbox[1], "maxx": bbox[2], "maxy": bbox[3], "crs": "EPSG:4326",
+	}
+	ft := map[string]interface{}{
+		"featureType": map[string]interface{}{
+			"name":              layer,
+			"nativeName":        native,
+			"title":             title,
+			"srs":               "EPSG:4326",
+			"nativeCRS":         "EPSG:4326",
+			"projectionPolicy":  "FORCE_DECLARED",
+			"nativeBoundingBox": box,
+			"latLonBoundingBox": box,
+			"enabled":           true,
+		},
+	}
+	ok, err := p.exists("rest", "workspaces", ws, "datastores", store, "featuretypes", layer)
+	if err != nil {
+		return err
+	}
+	if ok {
+		url := p.g.ParseURL("rest", "workspaces", ws, "datastores", store, "featuretypes", layer) + "?recalculate=nativebbox,latlonbbox"
+		return p.sendJSON("PUT", url, ft)
+	}
+	return p.sendJSON("POST", p.g.ParseURL("rest", "workspaces", ws, "datastores", store, "featuretypes"), ft)
+}
+
+//uploadStyle 上传SLD并设为图层默认样式
+func (p *gsPublisher) uploadStyle(ws, layer, name, sld string) error {
+	ok, err := p.exists("rest", "workspaces", ws, "styles", name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = p.send("PUT", p.g.ParseURL("rest", "workspaces", ws, "styles", name), "application/vnd.ogc.sld+xml", []byte(sld))
+	} else {
+		err = p.send("POST", p.g.ParseURL("rest", "workspaces", ws, "styles")+"?name="+name, "application/vnd.ogc.sld+xml", []byte(sld))
+	}
+	if err != nil {
+		return err
+	}
+	return p.sendJSON("PUT", p.g.ParseURL("rest", "layers", ws+":"+layer), map[string]interface{}{
+		"layer": map[string]interface{}{
+			"defaultStyle": map[string]string{"name": name, "workspace": ws},
+		},
+	})
+}
+
+//seed GWC预切片,重复发布时重新切片
+func (p *gsPublisher) seed(ws, layer string, opts *GsPublishOptions, reseed bool) error {
+	typ := "seed"
+	if reseed {
+		typ = "reseed"
+	}
+	gridset := opts.GridSet
+	if gridset == 0 {
+		gridset = 900913
+	}
+	format := opts.Format
+	if format == "" {
+		format = "image/png"
+	}
+	name := ws + ":" + layer
+	return p.sendJSON("POST", p.g.ParseURL("gwc", "rest", "seed", name+".json"), map[string]interface{}{
+		"seedRequest": map[string]interface{}{
+			"name":        name,
+			"srs":         map[string]int{"number": gridset},
+			"zoomStart":   opts.MinZoom,
+			"zoomStop":    opts.MaxZoom,
+			"format":      format,
+			"type":        typ,
+			"threadCount": 2,
+		},
+	})
+}
+
+//PublishDataset 发布数据集到Geoserver,pub为已有映射时更新发布
+func (p *gsPublisher) PublishDataset(dt *Dataset, pub *GsPublish, opts *GsPublishOptions) error {
+	republish := !pub.PublishedAt.IsZero()
+	if opts.Workspace != "" {
+		pub.Workspace = opts.Workspace
+	}
+	if pub.Workspace == "" {
+		pub.Workspace = ATLAS
+	}
+	if opts.Store != "" {
+		pub.Store = opts.Store
+	}
+	if opts.Layer != "" {
+		pub.Layer = opts.Layer
+	}
+	if pub.Layer == "" {
+		pub.Layer = strings.ToLower(dt.ID)
+	}
+	title := opts.Title
+	if title == "" {
+		title = dt.Name
+	}
+	err := p.ensureWorkspace(pub.Workspace)
+	if err != nil {
+		return err
+	}
+	p.progress(10)
+	user, _ := gsStoreUser()
+	switch {
+	case dbType == Postgres && user != "":
+		pub.StoreType = "postgis"
+		if pub.Store == "" {
+			pub.Store = ATLAS
+		}
+		err = p.ensurePostGISStore(pub.Workspace, pub.Store)
+	default:
+		pub.StoreType = "geopackage"
+		if pub.Store == "" {
+			pub.Store = pub.Layer
+		}
+		pathfile := filepath.Join(viper.GetString("paths.uploads"), fmt.Sprintf("%s_%s.gpkg", dt.ID, ShortID()))
+		err = dt.ExportGpkg(pathfile)
+		if err == nil {
+			p.progress(30)
+			err = p.uploadGpkgStore(pub.Workspace, pub.Store, pathfile)
+		}
+		os.Remove(pathfile)
+	}
+	if err != nil {
+		return err
+	}
+	p.progress(50)
+	bbox := dt.BBox
+	if bbox == (orb.Bound{}) {
+		bbox, _ = dt.Bound()
+	}
+	err = p.publishFeatureType(pub.Workspace, pub.Store, pub.Layer, strings.ToLower(dt.ID), title,
+		[4]float64{bbox.Min.X(), bbox.Min.Y(), bbox.Max.X(), bbox.Max.Y()})
+	if err != nil {
+		return err
+	}
+	p.progress(70)
+	if opts.SLD != "" {
+		pub.Style = pub.Layer
+		err = p.uploadStyle(pub.Workspace, pub.Layer, pub.Style, opts.SLD)
+		if err != nil {
+			return err
+		}
+	}
+	p.progress(85)
+	if opts.Seed {
+		err = p.seed(pub.Workspace, pub.Layer, opts, republish)
+		if err != nil {
+			return err
+		}
+	}
+	p.progress(100)
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
+	"github.com/spf13/viper"
+)
+
+//GwcHarvest GWC图层采集到本地MBTiles,未完成时重新采集将续传
+type GwcHarvest struct {
+	ID          string    `form:"-" json:"id" gorm:"primary_key"`
+	GeoserverID string    `form:"-" json:"geoserver_id" gorm:"index"`
+	Owner       string    `form:"-" json:"owner" gorm:"index"`
+	Layer       string    `form:"-" json:"layer"`
+	Name        string    `form:"name" json:"name"`
+	Service     string    `form:"service" json:"service"` //tms,wmts
+	GridSet     string    `form:"gridset" json:"gridset"`
+	Format      string    `form:"format" json:"format"` //png,jpeg,pbf
+	BBox        string    `form:"bbox" json:"bbox"`     //minx,miny,maxx,maxy
+	MinZoom     int       `form:"minzoom" json:"minzoom"`
+	MaxZoom     int       `form:"maxzoom" json:"maxzoom"`
+	Concurrency int       `form:"concurrency" json:"concurrency" gorm:"-"`
+	Retry       int       `form:"retry" json:"retry" gorm:"-"`
+	Path        string    `form:"-" json:"-"`
+	TaskID      string    `form:"-" json:"task_id"`
+	Status      string    `form:"-" json:"status"`
+	Total       int       `form:"-" json:"total"`
+	Count       int       `form:"-" json:"count"`
+	Failed      int       `form:"-" json:"failed"`
+	Error       string    `form:"-" json:"error"`
+	CreatedAt   time.Time `form:"-" json:"created_at"`
+	UpdatedAt   time.Time `form:"-" json:"updated_at"`
+}
+
+//webMercatorGridSets GWC中与xyz瓦片一致的格网
+var webMercatorGridSets = map[string]bool{
+	"EPSG:900913":          true,
+	"EPSG:3857":            true,
+	"GoogleMapsCompatible": true,
+}
+
+//LoadGwcHarvest 获取未完成的采集,用于续传
+func LoadGwcHarvest(gsid, layer, owner string) (*GwcHarvest, error) {
+	h := &GwcHarvest{}
+	err := db.Where("geoserver_id = ? and layer = ? and owner = ? and status <> ?", gsid, layer, owner, "done").Order("created_at desc").First(h).Error
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+//Save 保存采集记录
+func (h *GwcHarvest) Save() error {
+	tmp := &GwcHarvest{}
+	err := db.Where("id = ?", h.ID).First(tmp).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return db.Create(h).Error
+	}
+	if err != nil {
+		return err
+	}
+	return db.Save(h).Error
+}
+
+//normalize 校验参数并补全默认值
+func (h *GwcHarvest) normalize() error {
+	if h.Service == "" {
+		h.Service = "tms"
+	}
+	if h.Service != "tms" && h.Service != "wmts" {
+		return fmt.Errorf("unsupported service %s, only tms or wmts", h.Service)
+	}
+	if h.GridSet == "" {
+		h.GridSet = "EPSG:900913"
+	}
+	if !webMercatorGridSets[h.GridSet] {
+		return fmt.Errorf("unsupported gridset %s, only web mercator gridsets", h.GridSet)
+	}
+	switch h.Format {
+	case "":
+		h.Format = "png"
+	case "jpg":
+		h.Format = "jpeg"
+	case "png", "jpeg", "pbf":
+	default:
+		return fmt.Errorf("unsupported format %s", h.Format)
+	}
+	if h.BBox == "" {
+		h.BBox = "-180,-85.051129,180,85.051129"
+	}
+	if _, err := h.bound(); err != nil {
+		return err
+	}
+	if h.MinZoom < 0 || h.MaxZoom > 22 || h.MinZoom > h.MaxZoom {
+		return fmt.Errorf("invalid zoom range %d-%d", h.MinZoom, h.MaxZoom)
+	}
+	if h.Concurrency <= 0 {
+		h.Concurrency = viper.GetInt("geoserver.harvest.concurrency")
+	}
+	if h.Concurrency <= 0 {
+		h.Concurrency = 4
+	}
+	if h.Retry <= 0 {
+		h.Retry = viper.GetInt("geoserver.harvest.retry")
+	}
+	b, _ := h.bound()
+	total := tileCount(b, h.MinZoom, h.MaxZoom)
+	if max := viper.GetInt("geoserver.harvest.maxtiles"); max > 0 && total > max {
+		return fmt.Errorf("too many tiles %d, max %d", total, max)
+	}
+	h.Total = total
+	return nil
+}
+
+func (h *GwcHarvest) bound() (orb.Bound, error) {
+	v, err := stringToFloats(h.BBox)
+	if err != nil {
+		return orb.Bound{}, err
+	}
+	if len(v) != 4 || v[0] >= v[2] || v[1] >= v[3] {
+		return orb.Bound{}, fmt.Errorf("invalid bbox %s", h.BBox)
+	}
+	lat := 85.051129
+	return orb.Bound{
+		Min: orb.Point{math.Max(v[0], -180), math.Max(v[1], -lat)},
+		Max: orb.Point{math.Min(v[2], 180), math.Min(v[3], lat)},
+	}, nil
+}
+
+func (h *GwcHarvest) mime() string {
+	switch h.Format {
+	case "pbf":
+		return "application/vnd.mapbox-vector-tile"
+	case "jpeg":
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+//tileURL 瓦片地址,tms服务y轴自下而上,wmts自上而下
+func (h *GwcHarvest) tileURL(base string, t harvestTile) string {
+	base = strings.TrimSuffix(base, "/")
+	if h.Service == "wmts" {
+		q := url.Values{}
+		q.Set("SERVICE", "WMTS")
+		q.Set("REQUEST", "GetTile")
+		q.Set("VERSION", "1.0.0")
+		q.Set("LAYER", h.Layer)
+		q.Set("STYLE", "")
+		q.Set("TILEMATRIXSET", h.GridSet)
+		q.Set("TILEMATRIX", fmt.Sprintf("%s:%d", h.GridSet, t.z))
+		q.Set("TILEROW", strconv.Itoa(int(t.y)))
+		q.Set("TILECOL", strconv.Itoa(int(t.x)))
+		q.Set("FORMAT", h.mime())
+		return base + "/gwc/service/wmts?" + q.Encode()
+	}
+	y := (uint32(1) << t.z) - 1 - t.y
+	return fmt.Sprintf("%s/gwc/service/tms/1.0.0/%s@%s@%s/%d/%d/%d.%s", base, url.PathEscape(h.Layer), h.GridSet, h.Format, t.z, t.x, y, h.Format)
+}
+
+//fetch 获取瓦片,空瓦片返回nil,服务端错误重试
+func (h *GwcHarvest) fetch(client *http.Client, g *Geoserver, t harvestTile) ([]byte, error) {
+	turl := h.tileURL(g.ServiceURL, t)
+	var err error
+	for i := 0; i <= h.Retry; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1<<uint(i-1)) * 200 * time.Millisecond)
+		}
+		var req *http.Request
+		req, err = http.NewRequest("GET", turl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(g.UserName, string(g.Password))
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			continue
+		}
+		body, rerr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent:
+			return nil, nil
+		case resp.StatusCode == http.StatusOK:
+			if rerr != nil {
+				err = rerr
+				continue
+			}
+			return body, nil
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			err = fmt.Errorf("fetch %s error, status %d", turl, resp.StatusCode)
+		default:
+			return nil, fmt.Errorf("fetch %s error, status %d", turl, resp.StatusCode)
+		}
+	}
+	return nil, err
+}
+
+//Run 并发采集瓦片写入MBTiles,已存在的瓦片跳过
+func (h *GwcHarvest) Run(g *Geoserver, task *Task) error {
+	b, err := h.bound()
+	if err != nil {
+		return err
+	}
+	format := h.Format
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	th := &tileHarvester{
+		Path:        h.Path,
+		Name:        h.Name,
+		Description: fmt.Sprintf("harvested from geoserver gwc layer %s", h.Layer),
+		Bound:       b,
+		MinZoom:     h.MinZoom,
+		MaxZoom:     h.MaxZoom,
+		Format:      format,
+		Concurrency: h.Concurrency,
+		Fetch: func(t harvestTile) ([]byte, error) {
+			return h.fetch(client, g, t)
+		},
+	}
+	if th.Name == "" {
+		th.Name = h.Layer
+	}
+	err = th.Run(task)
+	h.Count = th.Count
+	h.Failed = th.Failed
+	return err
+}
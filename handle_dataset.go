@@ -20,8 +20,6 @@ import (
 
 	geom "github.com/go-spatial/geom"
 	"github.com/go-spatial/geom/encoding/mvt"
-	slippy "github.com/go-spatial/geom/slippy"
-	"github.com/go-spatial/tegola/atlas"
 	"github.com/go-spatial/tegola/mapbox/tilejson"
 	"github.com/go-spatial/tegola/server"
 
@@ -237,6 +235,12 @@ func oneClickImport(c *gin.Context) {
 				}
 				err = dt.Service()
 				if err == nil {
+					//重新导入时原范围与新范围的缓存瓦片都需失效
+					bounds := []orb.Bound{dt.BBox}
+					if old := userSet.dataset(uid, dt.ID); old != nil {
+						bounds = append(bounds, old.BBox)
+					}
+					invalidateLayerCache(dsCacheID(dt.ID), bounds...)
 					set.D.Store(dt.ID, dt)
 					casEnf.AddPolicy(USER, dt.ID, "GET")
 				}
@@ -392,6 +396,12 @@ func importFile(c *gin.Context) {
 			}
 			err = dt.Service()
 			if err == nil {
+				//重新导入时原范围与新范围的缓存瓦片都需失效
+				bounds := []orb.Bound{dt.BBox}
+				if old := userSet.dataset(uid, dt.ID); old != nil {
+					bounds = append(bounds, old.BBox)
+				}
+				invalidateLayerCache(dsCacheID(dt.ID), bounds...)
 				set.D.Store(dt.ID, dt)
 				casEnf.AddPolicy(USER, dt.ID, "GET")
 			}
@@ -1113,7 +1123,9 @@ func upInsertDataset(c *gin.Context) {
 
 	bank.Search = []string{bank.No, bank.Name, bank.Region, bank.Type, bank.Manager}
 
-	if db.Table(did).Where("id = ?", bank.ID).First(&Bank{}).RecordNotFound() {
+	old := &Bank{}
+	exists := !db.Table(did).Where("id = ?", bank.ID).First(old).RecordNotFound()
+	if !exists {
 		db.Omit("geom").Create(bank)
 	} else {
 		err := db.Table(did).Where("id = ?", bank.ID).Update(bank).Error
@@ -1136,6 +1148,12 @@ func upInsertDataset(c *gin.Context) {
 		res.Fail(c, 5001)
 		return
 	}
+	//新旧位置的缓存瓦片都需失效
+	bounds := []orb.Bound{orb.Point{float64(bank.X), float64(bank.Y)}.Bound()}
+	if exists {
+		bounds = append(bounds, orb.Point{float64(old.X), float64(old.Y)}.Bound())
+	}
+	invalidateLayerCache(dsCacheID(did), bounds...)
 
 	res.DoneData(c, gin.H{
 		"id": bank.ID,
@@ -1171,6 +1189,7 @@ func deleteDatasets(c *gin.Context) {
 			res.Fail(c, 5001)
 			return
 		}
+		removeLayerCache(dsCacheID(did))
 	}
 	res.Done(c, "")
 }
@@ -1192,12 +1211,17 @@ func deleteFeatures(c *gin.Context) {
 		res.Fail(c, 4001)
 		return
 	}
+	old := &Bank{}
+	exists := !db.Table(did).Where("id = ?", body.ID).First(old).RecordNotFound()
 	err = db.Where("id = ?", body.ID).Delete(&Bank{}).Error
 	if err != nil {
 		log.Errorf("delete data : %s; dataid: %s", err, body.ID)
 		res.Fail(c, 5001)
 		return
 	}
+	if exists {
+		invalidateLayerCache(dsCacheID(did), orb.Point{float64(old.X), float64(old.Y)}.Bound())
+	}
 	res.Done(c, "")
 }
 
@@ -1214,15 +1238,101 @@ func createTileLayer(c *gin.Context) {
 		res.Fail(c, 4046)
 		return
 	}
+	opts := ClusterOptions{}
+	err := c.ShouldBind(&opts)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	err = opts.Validate()
+	if err != nil {
+		res.FailMsg(c, err.Error())
+		return
+	}
 	tl, err := dts.NewTileLayer()
 	if err != nil {
 		res.FailErr(c, err)
 		return
 	}
-	log.Info(tl)
-	tl.UpInsert()
+	tl.Cluster = opts
+	err = tl.UpInsert()
+	if err != nil {
+		log.Error(err)
+		res.Fail(c, 5001)
+		return
+	}
+	purgeLayerCache(dsCacheID(did), -1, nil)
+	res.Done(c, "")
+}
+
+//setTileLayerRules 设置数据集服务层按级别的综合规则
+func setTileLayerRules(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	did := c.Param("id")
+	dts := userSet.dataset(uid, did)
+	if dts == nil {
+		log.Warnf(`setTileLayerRules, %s's dataset (%s) not found ^^`, uid, did)
+		res.Fail(c, 4046)
+		return
+	}
+	var rules ZoomRules
+	err := c.ShouldBindJSON(&rules)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	err = rules.Validate()
+	if err != nil {
+		res.FailMsg(c, err.Error())
+		return
+	}
+	tl := dts.tlayer
+	if tl == nil {
+		tl, err = dts.NewTileLayer()
+		if err != nil {
+			res.FailErr(c, err)
+			return
+		}
+	}
+	buf, _ := json.Marshal(rules)
+	tl.Rules = buf
+	err = tl.UpInsert()
+	if err != nil {
+		log.Error(err)
+		res.Fail(c, 5001)
+		return
+	}
+	purgeLayerCache(dsCacheID(did), -1, nil)
+	resetTileSizes(tl.ID)
 	res.Done(c, "")
-	return
+}
+
+//getTileLayerStats 获取数据集服务层各级别的瓦片大小统计
+func getTileLayerStats(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	did := c.Param("id")
+	dts := userSet.dataset(uid, did)
+	if dts == nil {
+		log.Warnf(`getTileLayerStats, %s's dataset (%s) not found ^^`, uid, did)
+		res.Fail(c, 4046)
+		return
+	}
+	var rules ZoomRules
+	if dts.tlayer != nil {
+		rules = dts.tlayer.rules()
+	}
+	res.DoneData(c, gin.H{
+		"rules": rules,
+		"zooms": layerTileSizes(did),
+	})
 }
 
 func getLayerTiles(c *gin.Context) {
@@ -1266,14 +1376,7 @@ func getLayerTiles(c *gin.Context) {
 		return
 	}
 
-	tile := slippy.NewTile(z, x, y)
-	var pbyte []byte
-	var err error
-	if dts.tlayer.Provider.Std != nil {
-		pbyte, err = dts.tlayer.Encode(c.Request.Context(), tile)
-	} else {
-		pbyte, err = dts.tlayer.MVTEncode(c.Request.Context(), tile)
-	}
+	pbyte, status, err := dts.Tile(c.Request.Context(), z, x, y)
 
 	if err != nil {
 		switch err {
@@ -1288,6 +1391,13 @@ func getLayerTiles(c *gin.Context) {
 		}
 	}
 
+	etag := tileETag(pbyte)
+	c.Header("ETag", etag)
+	c.Header("X-Cache", status)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
 	// mimetype for mapbox vector tiles
 	// https://www.iana.org/assignments/media-types/application/vnd.mapbox-vector-tile
 	c.Header("Content-Type", mvt.MimeType)
@@ -1404,98 +1514,6 @@ func getTileLayerJSON(c *gin.Context) {
 	}
 }
 
-func createTileMap(c *gin.Context) {
-}
-
-func getTileMap(c *gin.Context) {
-	res := NewRes()
-	uid := c.GetString(userKey)
-	if uid == "" {
-		uid = c.GetString(identityKey)
-	}
-	log.Info(uid)
-	did := c.Param("id")
-	// ds := userSet.dataset(uid, did)
-	// if ds == nil {
-	// 	res.Fail(c, 4046)
-	// 	return
-	// }
-	// lookup our Map
-	placeholder, _ := strconv.ParseUint(c.Param("z"), 10, 32)
-	z := uint(placeholder)
-	placeholder, _ = strconv.ParseUint(c.Param("x"), 10, 32)
-	x := uint(placeholder)
-	ypbf := c.Param("y")
-	ys := strings.Split(ypbf, ".")
-	if len(ys) != 2 {
-		res.Fail(c, 404)
-		return
-	}
-	placeholder, _ = strconv.ParseUint(ys[0], 10, 32)
-	y := uint(placeholder)
-	type A struct {
-		*atlas.Atlas
-	}
-	a := A{}
-	m, err := a.Map(did)
-	if err != nil {
-		errMsg := fmt.Sprintf("map (%v) not configured. check your config file", did)
-		log.Errorf(errMsg)
-		http.Error(c.Writer, errMsg, http.StatusNotFound)
-		return
-	}
-
-	// filter down the layers we need for this zoom
-	m = m.FilterLayersByZoom(z)
-	if len(m.Layers) == 0 {
-		log.Errorf("map (%v) has no layers, at zoom %v", did, z)
-		return
-	}
-	ids := c.Query("layers")
-	if ids != "" {
-		m = m.FilterLayersByID(ids)
-		if len(m.Layers) == 0 {
-			log.Errorf("map (%v) has no layers, for LayerName %v at zoom %v", did, ids, z)
-			return
-		}
-	}
-
-	tile := slippy.NewTile(z, x, y)
-
-	// check for the debug query string
-	if true {
-		m = m.AddDebugLayers()
-	}
-
-	pbyte, err := m.Encode(c.Request.Context(), tile)
-	if err != nil {
-		switch err {
-		case context.Canceled:
-			// TODO: add debug logs
-			return
-		default:
-			errMsg := fmt.Sprintf("error marshalling tile: %v", err)
-			log.Error(errMsg)
-			http.Error(c.Writer, errMsg, http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// mimetype for mapbox vector tiles
-	// https://www.iana.org/assignments/media-types/application/vnd.mapbox-vector-tile
-	c.Header("Content-Type", mvt.MimeType)
-	c.Header("Content-Encoding", "gzip")
-	// c.Header("Content-Type", "application/x-protobuf")
-	c.Header("Content-Length", fmt.Sprintf("%d", len(pbyte)))
-	c.Writer.WriteHeader(http.StatusOK)
-	c.Writer.Write(pbyte)
-	log.Info(len(pbyte))
-	// check for tile size warnings
-	if len(pbyte) > server.MaxTileSize {
-		log.Infof("tile z:%v, x:%v, y:%v is rather large - %vKb", z, x, y, len(pbyte)/1024)
-	}
-}
-
 func viewDataset(c *gin.Context) {
 	res := NewRes()
 	uid := c.GetString(userKey)
@@ -1604,6 +1622,7 @@ func getLayerMBTiles(c *gin.Context) {
 	}
 }
 
+//publishToMBTiles 发布数据集为服务集,后台任务按级别,范围,字段与简化容差切片,完成后替换原服务集
 func publishToMBTiles(c *gin.Context) {
 	res := NewRes()
 	uid := c.GetString(userKey)
@@ -1617,17 +1636,129 @@ func publishToMBTiles(c *gin.Context) {
 		res.Fail(c, 4046)
 		return
 	}
-	//dump geojson
-	pathFile := dts.Name + ".mbtiles"
-	err := dts.GeoJSON2MBTiles(pathFile, dts.Name, true)
+	var body struct {
+		Name     string `form:"name" json:"name"`
+		MinZoom  int    `form:"minzoom" json:"minzoom"`
+		MaxZoom  int    `form:"maxzoom" json:"maxzoom"`
+		BBox     string `form:"bbox" json:"bbox"`
+		Fields   string `form:"fields" json:"fields"`
+		Simplify string `form:"simplify" json:"simplify"`
+		Matrix   string `form:"tilematrixset" json:"tilematrixset"`
+	}
+	body.MaxZoom = viper.GetInt("tilesets.publish.maxzoom")
+	err := c.ShouldBind(&body)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	//兼容原有 /publish/:id/:min/:max/ 接口
+	if c.Param("min") != "" {
+		body.MinZoom, err = strconv.Atoi(c.Param("min"))
+		if err == nil {
+			body.MaxZoom, err = strconv.Atoi(c.Param("max"))
+		}
+		if err != nil {
+			res.FailMsg(c, "invalid zoom range")
+			return
+		}
+	}
+	ms := getTileMatrixSet(body.Matrix)
+	if ms == nil {
+		res.FailMsg(c, "unsupported tilematrixset")
+		return
+	}
+	//天地图c矩阵等首级不为0的矩阵集
+	if body.MinZoom < ms.MinZoom {
+		body.MinZoom = ms.MinZoom
+	}
+	opts := &PublishOptions{
+		Name:    body.Name,
+		MinZoom: body.MinZoom,
+		MaxZoom: body.MaxZoom,
+		Matrix:  ms,
+	}
+	if body.Fields != "" {
+		opts.Fields = strings.Split(body.Fields, ",")
+	}
+	if body.BBox != "" {
+		v, err := stringToFloats(body.BBox)
+		if err != nil || len(v) != 4 || v[0] >= v[2] || v[1] >= v[3] {
+			res.FailMsg(c, "invalid bbox, minx,miny,maxx,maxy")
+			return
+		}
+		opts.Bound = &orb.Bound{Min: orb.Point{v[0], v[1]}, Max: orb.Point{v[2], v[3]}}
+	}
+	opts.Simplify, err = parseSimplify(body.Simplify)
+	if err == nil {
+		err = opts.Validate(dts)
+	}
+	if err != nil {
+		res.FailMsg(c, err.Error())
+		return
+	}
+	if opts.Name == "" {
+		opts.Name = dts.Name
+	}
+
+	outfile := filepath.Join(viper.GetString("paths.tilesets"), uid, dts.ID+MBTILESEXT)
+	err = os.MkdirAll(filepath.Dir(outfile), os.ModePerm)
 	if err != nil {
 		log.Error(err)
-		res.Fail(c, 5001)
+		res.Fail(c, 5003)
 		return
 	}
-	res.DoneData(c, gin.H{
-		"file": pathFile,
-	})
+	task := &Task{
+		ID:    ShortID(),
+		Base:  dts.ID,
+		Name:  opts.Name,
+		Owner: uid,
+		Type:  DS2TS,
+		Pipe:  make(chan struct{}),
+	}
+	ctx := task.cancelable()
+	//任务队列
+	taskQueue <- task
+	taskSet.Store(task.ID, task)
+
+	go func(task *Task) {
+		defer func() {
+			task.Pipe <- struct{}{}
+		}()
+		defer task.release()
+		task.Status = "processing"
+		st := time.Now()
+		//先写临时文件,完成后替换,切片过程中原服务集不受影响
+		tmpfile := outfile + "." + task.ID
+		err := dts.Publish(ctx, tmpfile, opts, task)
+		if err == nil {
+			err = swapTileset(&DataSource{ID: dts.ID, Name: opts.Name, Owner: task.Owner, Path: outfile}, tmpfile)
+		}
+		if err != nil {
+			os.Remove(tmpfile)
+			if ctx.Err() != nil {
+				task.Status = "canceled"
+				task.Error = "task canceled"
+				return
+			}
+			log.Errorf("publish dataset (%s) error, details: %s", dts.ID, err)
+			task.Status = "failed"
+			task.Error = err.Error()
+			return
+		}
+		log.Infof("publish dataset (%s) to %s, takes: %v", dts.ID, outfile, time.Since(st))
+		task.Progress = 100
+		task.Status = "finished"
+	}(task)
+
+	//退出队列,通知完成消息
+	go func(task *Task) {
+		<-task.Pipe
+		<-taskQueue
+		task.save()
+		taskSet.Delete(task.ID)
+	}(task)
+
+	res.DoneData(c, task)
 }
 
 func dts2tsLite(task *Task, dts *Dataset) (*Tileset, error) {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -9,17 +11,18 @@ import (
 	gs "github.com/hishamkaram/geoserver"
 	"github.com/jinzhu/gorm"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 //Geoserver Geoserver实例管理
 type Geoserver struct {
-	ID         string    `form:"id" json:"id" gorm:"primary_key"`
-	Name       string    `form:"name" json:"name" binding:"required"`
-	ServiceURL string    `form:"url" json:"url" binding:"required"`
-	UserName   string    `form:"username" json:"username" binding:"required"`
-	Password   string    `form:"password" json:"password" binding:"required"`
-	Thumbnail  string    `form:"thumbnail" json:"thumbnail"`
-	CreatedAt  time.Time `form:"-" json:"-"`
+	ID         string     `form:"id" json:"id" gorm:"primary_key"`
+	Name       string     `form:"name" json:"name" binding:"required"`
+	ServiceURL string     `form:"url" json:"url" binding:"required"`
+	UserName   string     `form:"username" json:"username" binding:"required"`
+	Password   Credential `form:"password" json:"password"`
+	Thumbnail  string     `form:"thumbnail" json:"thumbnail"`
+	CreatedAt  time.Time  `form:"-" json:"-"`
 }
 
 // NodeType 节点类型
@@ -170,8 +173,10 @@ func updateGeoserverService(c *gin.Context) {
 		resp.Fail(c, 4001)
 		return
 	}
+	//空密码不更新
+	geoserver.Password.Unmask("")
 	// 更新insertUser
-	dbres := db.Model(Olmap{}).Where("id = ?", id).Update(geoserver)
+	dbres := db.Model(Geoserver{}).Where("id = ?", id).Update(geoserver)
 
 	if dbres.Error != nil {
 		log.Error(err)
@@ -230,7 +235,7 @@ func getGeoserverLayers(c *gin.Context) {
 		return
 	}
 
-	gsCatalog := gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, geoserver.Password)
+	gsCatalog := gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, string(geoserver.Password))
 	ls, err := gsCatalog.GetLayers("")
 	if err != nil {
 		resp.Fail(c, 4049)
@@ -260,7 +265,7 @@ func getGWCLayers(c *gin.Context) {
 		resp.Fail(c, 4049)
 		return
 	}
-	gsCatalog := gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, geoserver.Password)
+	gsCatalog := gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, string(geoserver.Password))
 	targetURL := gsCatalog.ParseURL("gwc", "rest", "layers")
 	httpRequest := gs.HTTPRequest{
 		Method: "GET",
@@ -305,7 +310,7 @@ func getGWCLayer(c *gin.Context) {
 		return
 	}
 	layerName := c.Param("name")
-	gsCatalog := gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, geoserver.Password)
+	gsCatalog := gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, string(geoserver.Password))
 	targetURL := gsCatalog.ParseURL("rest", "layergroups", layerName+".json")
 	httpRequest := gs.HTTPRequest{
 		Method: "GET",
@@ -498,3 +503,324 @@ func GetGsSourceLayerInfo(g *gs.GeoServer, layerName string) (layer *LayerNode,
 	}
 	return &lyrNode, nil
 }
+
+//listGeoserverStyles 获取Geoserver样式列表
+func listGeoserverStyles(c *gin.Context) {
+	resp := NewResp()
+	sid := c.Param("id")
+	geoserver := &Geoserver{}
+	if err := db.Where("id = ?", sid).First(&geoserver).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	gsCatalog := gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, string(geoserver.Password))
+	styles, err := gsCatalog.GetStyles(c.Query("workspace"))
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	resp.DoneData(c, styles)
+}
+
+//gsStylePath Geoserver样式资源路径,workspace为空时为全局样式
+func gsStylePath(workspace string, parts ...string) []string {
+	out := []string{"rest"}
+	if workspace != "" {
+		out = append(out, "workspaces", workspace)
+	}
+	return append(out, parts...)
+}
+
+//GetGsStyleSLD 获取Geoserver样式的SLD内容
+func GetGsStyleSLD(g *gs.GeoServer, workspace, name string) ([]byte, error) {
+	targetURL := g.ParseURL(gsStylePath(workspace, "styles", name+".sld")...)
+	httpRequest := gs.HTTPRequest{
+		Method: "GET",
+		Accept: "application/vnd.ogc.sld+xml",
+		URL:    targetURL,
+		Query:  nil,
+	}
+	response, responseCode := g.DoRequest(httpRequest)
+	if responseCode != 200 {
+		log.Error(string(response))
+		return nil, g.GetError(responseCode, response)
+	}
+	return response, nil
+}
+
+//GetGsStyleResource 获取Geoserver样式目录下的资源文件,如SLD引用的图标
+func GetGsStyleResource(g *gs.GeoServer, workspace, file string) ([]byte, error) {
+	parts := append([]string{"resource"}, gsStylePath(workspace, "styles", file)[1:]...)
+	targetURL := g.ParseURL(append([]string{"rest"}, parts...)...)
+	httpRequest := gs.HTTPRequest{
+		Method: "GET",
+		URL:    targetURL,
+		Query:  nil,
+	}
+	response, responseCode := g.DoRequest(httpRequest)
+	if responseCode != 200 {
+		return nil, g.GetError(responseCode, response)
+	}
+	return response, nil
+}
+
+//listGeoserverPublishes 获取发布到Geoserver的数据集列表
+func listGeoserverPublishes(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	var pubs []GsPublish
+	err := db.Where("geoserver_id = ? and owner = ?", c.Param("id"), uid).Order("updated_at desc").Find(&pubs).Error
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	resp.DoneData(c, pubs)
+}
+
+//publishToGeoserver 发布数据集到Geoserver,后台任务执行,重复发布时更新
+func publishToGeoserver(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+
+	sid := c.Param("id")
+	geoserver := &Geoserver{}
+	if err := db.Where("id = ?", sid).First(&geoserver).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	did := c.Param("did")
+	dt := userSet.dataset(uid, did)
+	if dt == nil {
+		log.Warnf(`publishToGeoserver, %s's dataset (%s) not found ^^`, uid, did)
+		resp.Fail(c, 4046)
+		return
+	}
+	opts := &GsPublishOptions{}
+	err := c.ShouldBind(opts)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 4001)
+		return
+	}
+	if file, err := c.FormFile("sldfile"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			resp.Fail(c, 5002)
+			return
+		}
+		buf, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			resp.Fail(c, 5002)
+			return
+		}
+		opts.SLD = string(buf)
+	}
+	pub, err := LoadGsPublish(geoserver.ID, dt.ID, uid)
+	if err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		pub = &GsPublish{
+			ID:          ShortID(),
+			GeoserverID: geoserver.ID,
+			DatasetID:   dt.ID,
+			Owner:       uid,
+		}
+	}
+
+	task := &Task{
+		ID:    ShortID(),
+		Base:  dt.ID,
+		Name:  dt.Name,
+		Owner: uid,
+		Type:  DS2GS,
+		Pipe:  make(chan struct{}),
+	}
+	//任务队列
+	taskQueue <- task
+	taskSet.Store(task.ID, task)
+	go func(task *Task, pub *GsPublish) {
+		defer func() {
+			task.Pipe <- struct{}{}
+		}()
+		task.Status = "processing"
+		p := &gsPublisher{
+			g:    gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, string(geoserver.Password)),
+			task: task,
+		}
+		err := p.PublishDataset(dt, pub, opts)
+		pub.TaskID = task.ID
+		if err != nil {
+			log.Errorf(`publishToGeoserver, publish dataset (%s) error, details: %s`, dt.ID, err)
+			task.Status = "failed"
+			task.Error = err.Error()
+			pub.Status = "failed"
+			pub.Error = err.Error()
+		} else {
+			task.Progress = 100
+			task.Status = "finished"
+			pub.Status = "published"
+			pub.Error = ""
+			pub.PublishedAt = time.Now()
+		}
+		err = pub.Save()
+		if err != nil {
+			log.Errorf(`publishToGeoserver, save publish (%s) error, details: %s`, pub.ID, err)
+		}
+	}(task, pub)
+
+	//退出队列,通知完成消息
+	go func(task *Task) {
+		<-task.Pipe
+		<-taskQueue
+		task.save()
+		taskSet.Delete(task.ID)
+	}(task)
+
+	resp.DoneData(c, task)
+}
+
+//listGwcHarvests 获取GWC图层采集记录
+func listGwcHarvests(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	var hs []GwcHarvest
+	err := db.Where("geoserver_id = ? and owner = ?", c.Param("id"), uid).Order("updated_at desc").Find(&hs).Error
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	resp.DoneData(c, hs)
+}
+
+//harvestGWCLayer 采集GWC图层瓦片到本地服务集,后台任务执行,未完成的采集续传
+func harvestGWCLayer(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+
+	sid := c.Param("id")
+	geoserver := &Geoserver{}
+	if err := db.Where("id = ?", sid).First(&geoserver).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	layer := c.Param("name")
+	h, err := LoadGwcHarvest(geoserver.ID, layer, uid)
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	if h == nil || c.Query("restart") == "true" {
+		id := ShortID()
+		h = &GwcHarvest{
+			ID:          id,
+			GeoserverID: geoserver.ID,
+			Owner:       uid,
+			Layer:       layer,
+			Path:        filepath.Join(viper.GetString("paths.tilesets"), uid, id+MBTILESEXT),
+		}
+	}
+	err = c.ShouldBind(h)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 4001)
+		return
+	}
+	err = h.normalize()
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	if h.Name == "" {
+		h.Name = layer
+	}
+
+	task := &Task{
+		ID:    ShortID(),
+		Base:  h.ID,
+		Name:  h.Name,
+		Owner: uid,
+		Type:  GS2TS,
+		Pipe:  make(chan struct{}),
+	}
+	h.TaskID = task.ID
+	h.Status = "harvesting"
+	err = h.Save()
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	//任务队列
+	taskQueue <- task
+	taskSet.Store(task.ID, task)
+	go func(task *Task, h *GwcHarvest) {
+		defer func() {
+			task.Pipe <- struct{}{}
+		}()
+		task.Status = "processing"
+		err := h.Run(geoserver, task)
+		if err == nil {
+			err = registerMBTiles(&DataSource{ID: h.ID, Name: h.Name, Owner: h.Owner, Path: h.Path})
+		}
+		if err != nil {
+			log.Errorf(`harvestGWCLayer, harvest layer (%s) error, details: %s`, h.Layer, err)
+			task.Status = "failed"
+			task.Error = err.Error()
+			h.Status = "failed"
+			h.Error = err.Error()
+		} else {
+			task.Progress = 100
+			task.Status = "finished"
+			h.Status = "done"
+			h.Error = ""
+		}
+		err = h.Save()
+		if err != nil {
+			log.Errorf(`harvestGWCLayer, save harvest (%s) error, details: %s`, h.ID, err)
+		}
+	}(task, h)
+
+	//退出队列,通知完成消息
+	go func(task *Task) {
+		<-task.Pipe
+		<-taskQueue
+		task.save()
+		taskSet.Delete(task.ID)
+	}(task)
+
+	resp.DoneData(c, task)
+}
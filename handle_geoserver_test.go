@@ -1,10 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gs "github.com/hishamkaram/geoserver"
+	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
+	"github.com/spf13/viper"
 )
 
 func TestBaiduRespConvertx(t *testing.T) {
@@ -55,3 +69,274 @@ func TestBaiduRespConvertx(t *testing.T) {
 		t.Errorf("baiduRespConvert() output:\ngot  %v\nwant %v", res, out)
 	}
 }
+
+//gsStub Geoserver REST接口桩,记录请求并模拟资源的创建与更新
+type gsStub struct {
+	mu        sync.Mutex
+	resources map[string]bool
+	calls     []string
+	bodies    map[string]string
+}
+
+func (s *gsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "geoserver" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/geoserver/")
+	call := r.Method + " " + p
+	s.calls = append(s.calls, call)
+	body, _ := ioutil.ReadAll(r.Body)
+	s.bodies[call] = string(body)
+	switch r.Method {
+	case "GET":
+		if !s.resources[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("{}"))
+	case "POST":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			var v map[string]map[string]interface{}
+			json.Unmarshal(body, &v)
+			for _, obj := range v {
+				name, _ = obj["name"].(string)
+			}
+		}
+		if name != "" {
+			s.resources[p+"/"+name] = true
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "PUT":
+		s.resources[strings.TrimSuffix(p, "/file.gpkg")] = true
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *gsStub) count(call string) int {
+	n := 0
+	for _, c := range s.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGsPublishDataset(t *testing.T) {
+	stub := &gsStub{resources: make(map[string]bool), bodies: make(map[string]string)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	oldType := dbType
+	dbType = Postgres
+	defer func() { dbType = oldType }()
+	oldPass := viper.GetString("db.password")
+	viper.Set("db.password", "superpass")
+	viper.Set("geoserver.dbuser", "gs_reader")
+	viper.Set("geoserver.dbpassword", "readonly")
+	defer func() { viper.Set("db.password", oldPass); viper.Set("geoserver.dbuser", "") }()
+
+	dt := &Dataset{
+		ID:   "Roads01",
+		Name: "道路",
+		BBox: orb.Bound{Min: orb.Point{120, 30}, Max: orb.Point{121, 31}},
+	}
+	pub := &GsPublish{ID: "p1", GeoserverID: "g1", DatasetID: dt.ID}
+	opts := &GsPublishOptions{SLD: testSLD10, Seed: true, MaxZoom: 10}
+	task := &Task{}
+	p := &gsPublisher{g: gs.GetCatalog(server.URL+"/geoserver/", "admin", "geoserver"), task: task}
+
+	err := p.PublishDataset(dt, pub, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Workspace != ATLAS || pub.Store != ATLAS || pub.Layer != "roads01" || pub.StoreType != "postgis" || task.Progress != 100 {
+		t.Errorf("unexpected publish mapping %+v, progress %d", pub, task.Progress)
+	}
+	for _, c := range []string{
+		"POST rest/workspaces",
+		"POST rest/workspaces/atlas/datastores",
+		"POST rest/workspaces/atlas/datastores/atlas/featuretypes",
+		"POST rest/workspaces/atlas/styles",
+		"PUT rest/layers/atlas:roads01",
+		"POST gwc/rest/seed/atlas:roads01.json",
+	} {
+		if stub.count(c) != 1 {
+			t.Errorf("expected one %q call, calls: %v", c, stub.calls)
+		}
+	}
+	//数据存储使用只读用户,不使用Atlas数据库账号
+	if ds := stub.bodies["POST rest/workspaces/atlas/datastores"]; !strings.Contains(ds, `"$":"gs_reader"`) || strings.Contains(ds, "superpass") {
+		t.Errorf("unexpected datastore body %s", ds)
+	}
+	ft := stub.bodies["POST rest/workspaces/atlas/datastores/atlas/featuretypes"]
+	if !strings.Contains(ft, `"srs":"EPSG:4326"`) || !strings.Contains(ft, `"maxx":121`) || !strings.Contains(ft, `"nativeName":"roads01"`) {
+		t.Errorf("unexpected featuretype body %s", ft)
+	}
+
+	//再次发布,更新而不是重复创建
+	pub.PublishedAt = time.Now()
+	stub.calls = nil
+	err = p.PublishDataset(dt, pub, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range stub.calls {
+		if strings.HasPrefix(c, "POST rest/") {
+			t.Errorf("republish should not create resources, calls: %v", stub.calls)
+			break
+		}
+	}
+	for _, c := range []string{
+		"PUT rest/workspaces/atlas/datastores/atlas",
+		"PUT rest/workspaces/atlas/datastores/atlas/featuretypes/roads01",
+		"PUT rest/workspaces/atlas/styles/roads01",
+	} {
+		if stub.count(c) != 1 {
+			t.Errorf("expected one %q call, calls: %v", c, stub.calls)
+		}
+	}
+	if seed := stub.bodies["POST gwc/rest/seed/atlas:roads01.json"]; !strings.Contains(seed, `"type":"reseed"`) {
+		t.Errorf("expected reseed, got %s", seed)
+	}
+}
+
+func TestGwcHarvest(t *testing.T) {
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	down := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		prefix := "/geoserver/gwc/service/tms/1.0.0/ws:roads@EPSG:900913@png/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		zxy := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), ".png")
+		fetched[zxy]++
+		switch {
+		case zxy == "1/0/1" && fetched[zxy] == 1:
+			//首次失败,重试成功
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case zxy == "2/3/0" && down:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case zxy == "2/0/0":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(append([]byte("\x89\x50\x4E\x47\x0D\x0A\x1A\x0A"), zxy...))
+	}))
+	defer server.Close()
+
+	g := &Geoserver{ServiceURL: server.URL + "/geoserver/", UserName: "admin", Password: "geoserver"}
+	path := filepath.Join(t.TempDir(), "roads.mbtiles")
+	newHarvest := func() *GwcHarvest {
+		h := &GwcHarvest{Layer: "ws:roads", MinZoom: 0, MaxZoom: 2, Retry: 1, Concurrency: 3, Path: path}
+		if err := h.normalize(); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	h := newHarvest()
+	if h.Total != 21 {
+		t.Fatalf("expected 21 tiles, got %d", h.Total)
+	}
+	task := &Task{}
+	err := h.Run(g, task)
+	if err == nil || h.Failed != 1 {
+		t.Fatalf("expected one failed tile, got %d, err %v", h.Failed, err)
+	}
+	if task.Count != 21 {
+		t.Errorf("expected progress over 21 tiles, got %d", task.Count)
+	}
+	if fetched["1/0/1"] != 2 {
+		t.Errorf("expected retry of 1/0/1, fetched %d times", fetched["1/0/1"])
+	}
+
+	//续传只获取缺失的瓦片
+	down = false
+	for k := range fetched {
+		delete(fetched, k)
+	}
+	h = newHarvest()
+	err = h.Run(g, &Task{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 2 || fetched["2/3/0"] != 1 || fetched["2/0/0"] != 1 {
+		t.Errorf("resume should only fetch missing tiles, fetched %v", fetched)
+	}
+
+	mdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+	var n int
+	mdb.QueryRow("select count(*) from tiles").Scan(&n)
+	if n != 20 {
+		t.Errorf("expected 20 stored tiles, got %d", n)
+	}
+	//MBTiles为tms行序,xyz的(1,0,0)对应tms行1
+	var data []byte
+	err = mdb.QueryRow("select tile_data from tiles where zoom_level = 1 and tile_column = 0 and tile_row = 1").Scan(&data)
+	if err != nil || !bytes.HasSuffix(data, []byte("1/0/1")) {
+		t.Errorf("unexpected tile row order, data %q, err %v", data, err)
+	}
+	var format string
+	mdb.QueryRow("select value from metadata where name = 'format'").Scan(&format)
+	if format != "png" {
+		t.Errorf("expected png format, got %s", format)
+	}
+
+	wmts := &GwcHarvest{Layer: "ws:roads", Service: "wmts", GridSet: "EPSG:900913", Format: "png"}
+	u := wmts.tileURL("http://gs/geoserver", harvestTile{z: 1, x: 0, y: 0})
+	if !strings.Contains(u, "TILEROW=0") || !strings.Contains(u, "TILEMATRIX=EPSG%3A900913%3A1") {
+		t.Errorf("unexpected wmts url %s", u)
+	}
+}
+
+func TestListGwcHarvestsOwner(t *testing.T) {
+	tdb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&GwcHarvest{}, &GsPublish{})
+	oldDB := db
+	db = tdb
+	defer func() { db = oldDB }()
+	tdb.Create(&GwcHarvest{ID: "h1", GeoserverID: "g1", Owner: "u1", Layer: "ws:a"})
+	tdb.Create(&GwcHarvest{ID: "h2", GeoserverID: "g1", Owner: "u2", Layer: "ws:b"})
+	tdb.Create(&GsPublish{ID: "p1", GeoserverID: "g1", Owner: "u2", DatasetID: "d1"})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(identityKey, "u1") })
+	r.GET("/gs/gwc/harvest/:id/", listGwcHarvests)
+	r.GET("/gs/publish/:id/", listGeoserverPublishes)
+	var out struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/gs/gwc/harvest/g1/", nil))
+	json.Unmarshal(w.Body.Bytes(), &out)
+	if len(out.Results) != 1 || out.Results[0]["id"] != "h1" {
+		t.Errorf("harvests should be filtered by owner, got %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/gs/publish/g1/", nil))
+	out.Results = nil
+	json.Unmarshal(w.Body.Bytes(), &out)
+	if len(out.Results) != 0 {
+		t.Errorf("publishes should be filtered by owner, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+//listIconLibs 获取图标库列表,public=true时包含公开图标库
+func listIconLibs(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	var libs []*IconLib
+	tdb := db
+	pub, y := c.GetQuery("public")
+	if y && strings.ToLower(pub) == "true" {
+		tdb = tdb.Where("owner = ? or public = ?", uid, true)
+	} else {
+		tdb = tdb.Where("owner = ?", uid)
+	}
+	kw, y := c.GetQuery("keyword")
+	if y {
+		tdb = tdb.Where("name LIKE ?", "%"+kw+"%")
+	}
+	err := tdb.Order("name").Find(&libs).Error
+	if err != nil {
+		log.Errorf(`listIconLibs, query %s's icon libraries error, details: %s`, uid, err)
+		res.Fail(c, 5001)
+		return
+	}
+	res.DoneData(c, libs)
+}
+
+//createIconLib 创建图标库
+func createIconLib(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	lib := &IconLib{}
+	err := c.Bind(lib)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	lib.ID = ShortID()
+	lib.Owner = uid
+	lib.Path = iconLibPath(uid, lib.ID)
+	err = os.MkdirAll(lib.Path, os.ModePerm)
+	if err != nil {
+		log.Errorf(`createIconLib, make %s's icon library dir error, details: %s`, uid, err)
+		res.Fail(c, 5002)
+		return
+	}
+	err = db.Create(lib).Error
+	if err != nil {
+		log.Errorf(`createIconLib, create %s's icon library error, details: %s`, uid, err)
+		res.Fail(c, 5001)
+		return
+	}
+	res.DoneData(c, lib)
+}
+
+//getIconLib 获取图标库信息及图标列表
+func getIconLib(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	lib, err := LoadIconLib(id)
+	if err != nil || !lib.Readable(uid) {
+		log.Warnf(`getIconLib, %s's icon library (%s) not found ^^`, uid, id)
+		res.Fail(c, 4049)
+		return
+	}
+	icons, err := lib.Icons()
+	if err != nil {
+		log.Errorf(`getIconLib, query icon library (%s) icons error, details: %s`, id, err)
+		res.Fail(c, 5001)
+		return
+	}
+	res.DoneData(c, gin.H{
+		"library": lib,
+		"icons":   icons,
+	})
+}
+
+//updateIconLib 更新图标库信息
+func updateIconLib(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	lib, err := LoadIconLib(id)
+	if err != nil || !lib.Writable(uid) {
+		log.Warnf(`updateIconLib, %s's icon library (%s) not found ^^`, uid, id)
+		res.Fail(c, 4049)
+		return
+	}
+	var body struct {
+		Name       string   `json:"name" form:"name"`
+		Summary    string   `json:"summary" form:"summary"`
+		Public     *bool    `json:"public" form:"public"`
+		Categories []string `json:"categories" form:"categories"`
+		Tags       []string `json:"tags" form:"tags"`
+		Thumbnail  string   `json:"thumbnail" form:"thumbnail"`
+	}
+	err = c.Bind(&body)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	updates := make(map[string]interface{})
+	if body.Name != "" {
+		updates["name"] = body.Name
+	}
+	if body.Summary != "" {
+		updates["summary"] = body.Summary
+	}
+	if body.Public != nil {
+		updates["public"] = *body.Public
+	}
+	if body.Categories != nil {
+		updates["categories"] = pq.StringArray(body.Categories)
+	}
+	if body.Tags != nil {
+		updates["tags"] = pq.StringArray(body.Tags)
+	}
+	if body.Thumbnail != "" {
+		updates["thumbnail"] = body.Thumbnail
+	}
+	err = db.Model(lib).Updates(updates).Error
+	if err != nil {
+		log.Errorf(`updateIconLib, update %s's icon library (%s) error, details: %s`, uid, id, err)
+		res.Fail(c, 5001)
+		return
+	}
+	res.DoneData(c, lib)
+}
+
+//deleteIconLibs 删除图标库
+func deleteIconLibs(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	ids := strings.Split(c.Param("ids"), ",")
+	for _, id := range ids {
+		lib, err := LoadIconLib(id)
+		if err != nil || !lib.Writable(uid) {
+			log.Warnf(`deleteIconLibs, %s's icon library (%s) not found ^^`, uid, id)
+			res.Fail(c, 4049)
+			return
+		}
+		err = lib.Remove()
+		if err != nil {
+			log.Errorf(`deleteIconLibs, remove %s's icon library (%s) error, details: %s`, uid, id, err)
+			res.Fail(c, 5001)
+			return
+		}
+		lib.Refresh()
+	}
+	res.Done(c, "")
+}
+
+//uploadLibIcons 上传图标到图标库,可指定分类、标签及是否sdf
+func uploadLibIcons(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	lib, err := LoadIconLib(id)
+	if err != nil || !lib.Writable(uid) {
+		log.Warnf(`uploadLibIcons, %s's icon library (%s) not found ^^`, uid, id)
+		res.Fail(c, 4049)
+		return
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		log.Warnf(`uploadLibIcons, read %s's upload icons error, details: %s`, uid, err)
+		res.Fail(c, 4008)
+		return
+	}
+	files := form.File["files"]
+	if len(files) == 0 {
+		log.Warnf(`uploadLibIcons, can not find any file`)
+		res.Fail(c, 4008)
+		return
+	}
+	category := c.PostForm("category")
+	var tags pq.StringArray
+	if t := c.PostForm("tags"); t != "" {
+		tags = strings.Split(t, ",")
+	}
+	sdf, _ := strconv.ParseBool(c.PostForm("sdf"))
+	err = os.MkdirAll(lib.Path, os.ModePerm)
+	if err != nil {
+		log.Errorf(`uploadLibIcons, make icon library (%s) dir error, details: %s`, id, err)
+		res.Fail(c, 5002)
+		return
+	}
+	var icons []*Icon
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Filename))
+		switch ext {
+		case ".svg", ".png", ".jpg", ".jpeg", ".bmp", ".gif":
+		default:
+			log.Warnf(`uploadLibIcons, unkown icon format: %s`, file.Filename)
+			continue
+		}
+		name := strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename))
+		icon, err := lib.Icon(name)
+		if err != nil {
+			icon = &Icon{ID: ShortID(), LibID: lib.ID, Name: name}
+		} else if icon.File != name+ext {
+			os.Remove(filepath.Join(lib.Path, icon.File))
+		}
+		dst := filepath.Join(lib.Path, name+ext)
+		if err := c.SaveUploadedFile(file, dst); err != nil {
+			log.Errorf(`uploadLibIcons, save %s's upload file error, details: %s`, uid, err)
+			res.Fail(c, 5002)
+			return
+		}
+		icon.File = name + ext
+		icon.Category = category
+		icon.Tags = tags
+		icon.SDF = sdf
+		if ext != ".svg" {
+			if f, err := os.Open(dst); err == nil {
+				if cfg, _, err := image.DecodeConfig(f); err == nil {
+					icon.Width = cfg.Width
+					icon.Height = cfg.Height
+				}
+				f.Close()
+			}
+		}
+		err = db.Save(icon).Error
+		if err != nil {
+			log.Errorf(`uploadLibIcons, save icon (%s) info error, details: %s`, name, err)
+			res.Fail(c, 5001)
+			return
+		}
+		icons = append(icons, icon)
+	}
+	if category != "" && !contains(lib.Categories, category) {
+		lib.Categories = append(lib.Categories, category)
+		db.Model(lib).Update("categories", lib.Categories)
+	}
+	lib.Refresh()
+	res.DoneData(c, icons)
+}
+
+//updateLibIcon 更新图标分类、标签、sdf
+func updateLibIcon(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	lib, err := LoadIconLib(id)
+	if err != nil || !lib.Writable(uid) {
+		log.Warnf(`updateLibIcon, %s's icon library (%s) not found ^^`, uid, id)
+		res.Fail(c, 4049)
+		return
+	}
+	icon, err := lib.Icon(c.Param("name"))
+	if err != nil {
+		res.FailMsg(c, "icon not found")
+		return
+	}
+	var body struct {
+		Category *string  `json:"category" form:"category"`
+		Tags     []string `json:"tags" form:"tags"`
+		SDF      *bool    `json:"sdf" form:"sdf"`
+	}
+	err = c.Bind(&body)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	if body.Category != nil {
+		icon.Category = *body.Category
+	}
+	if body.Tags != nil {
+		icon.Tags = body.Tags
+	}
+	if body.SDF != nil {
+		icon.SDF = *body.SDF
+	}
+	err = db.Save(icon).Error
+	if err != nil {
+		log.Errorf(`updateLibIcon, save icon (%s) info error, details: %s`, icon.Name, err)
+		res.Fail(c, 5001)
+		return
+	}
+	if body.SDF != nil {
+		lib.Refresh()
+	}
+	res.DoneData(c, icon)
+}
+
+//deleteLibIcons 删除图标库中的图标
+func deleteLibIcons(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	lib, err := LoadIconLib(id)
+	if err != nil || !lib.Writable(uid) {
+		log.Warnf(`deleteLibIcons, %s's icon library (%s) not found ^^`, uid, id)
+		res.Fail(c, 4049)
+		return
+	}
+	var body struct {
+		Names []string `json:"names" form:"names" binding:"required"`
+	}
+	err = c.Bind(&body)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	var sucs []string
+	for _, name := range body.Names {
+		icon, err := lib.Icon(name)
+		if err != nil {
+			continue
+		}
+		err = db.Where("id = ?", icon.ID).Delete(Icon{}).Error
+		if err != nil {
+			log.Errorf(`deleteLibIcons, delete icon (%s) error, details: %s`, name, err)
+			continue
+		}
+		os.Remove(filepath.Join(lib.Path, icon.File))
+		sucs = append(sucs, name)
+	}
+	if len(sucs) > 0 {
+		lib.Refresh()
+	}
+	res.DoneData(c, sucs)
+}
+
+//getLibIcon 获取图标库中的单个图标
+func getLibIcon(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	lib, err := LoadIconLib(id)
+	if err != nil || !lib.Readable(uid) {
+		log.Warnf(`getLibIcon, %s's icon library (%s) not found ^^`, uid, id)
+		res.Fail(c, 4049)
+		return
+	}
+	icon, err := lib.Icon(c.Param("name"))
+	if err != nil {
+		res.FailMsg(c, "icon not found")
+		return
+	}
+	file, err := ioutil.ReadFile(filepath.Join(lib.Path, icon.File))
+	if err != nil {
+		log.Errorf(`getLibIcon, read icon file error, details: %s`, err)
+		res.Fail(c, 5002)
+		return
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(icon.File)), ".")
+	if ext == "svg" {
+		ext = "svg+xml"
+	}
+	c.Header("Content-Type", "image/"+ext)
+	c.Writer.Write(file)
+}
+
+//searchIcons 在可访问的图标库中搜索图标,支持keyword/category/tag/libs过滤
+func searchIcons(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	var libs []*IconLib
+	tdb := db.Where("owner = ? or public = ?", uid, true)
+	if ids := c.Query("libs"); ids != "" {
+		tdb = tdb.Where("id in (?)", strings.Split(ids, ","))
+	}
+	err := tdb.Find(&libs).Error
+	if err != nil {
+		log.Errorf(`searchIcons, query %s's icon libraries error, details: %s`, uid, err)
+		res.Fail(c, 5001)
+		return
+	}
+	if len(libs) == 0 {
+		res.DoneData(c, []*Icon{})
+		return
+	}
+	var lids []string
+	for _, lib := range libs {
+		lids = append(lids, lib.ID)
+	}
+	var icons []*Icon
+	err = db.Where("lib_id in (?)", lids).Order("name").Find(&icons).Error
+	if err != nil {
+		log.Errorf(`searchIcons, query icons error, details: %s`, err)
+		res.Fail(c, 5001)
+		return
+	}
+	keyword, category, tag := c.Query("keyword"), c.Query("category"), c.Query("tag")
+	out := []*Icon{}
+	for _, icon := range icons {
+		if matchIcon(icon, keyword, category, tag) {
+			out = append(out, icon)
+		}
+	}
+	res.DoneData(c, out)
+}
+
+//bindStyleIconLibs 设置样式引用的图标库
+func bindStyleIconLibs(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	sid := c.Param("id")
+	style := userSet.style(uid, sid)
+	if style == nil || style.Owner != uid {
+		log.Warnf(`bindStyleIconLibs, %s's style (%s) not found ^^`, uid, sid)
+		res.Fail(c, 4044)
+		return
+	}
+	var body struct {
+		Libs []string `json:"libs" form:"libs"`
+	}
+	err := c.Bind(&body)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	for _, id := range body.Libs {
+		lib, err := LoadIconLib(id)
+		if err != nil || !lib.Readable(uid) {
+			log.Warnf(`bindStyleIconLibs, %s's icon library (%s) not found ^^`, uid, id)
+			res.Fail(c, 4049)
+			return
+		}
+	}
+	style.IconLibs = body.Libs
+	err = db.Model(style).Update("icon_libs", style.IconLibs).Error
+	if err != nil {
+		log.Errorf(`bindStyleIconLibs, update %s's style (%s) error, details: %s`, uid, sid, err)
+		res.Fail(c, 5001)
+		return
+	}
+	err = style.cleanSprites()
+	if err != nil {
+		log.Warnf("clean old sprites error, details: %s", err)
+	}
+	res.DoneData(c, style.IconLibs)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//listUpstreams 获取代理上游列表,公开的与自己的
+func listUpstreams(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+
+	var ups []Upstream
+	tx := db
+	if uid != ATLAS {
+		tx = tx.Where("public = ? or owner = ?", true, uid)
+	}
+	err := tx.Order("created_at desc").Find(&ups).Error
+	if err != nil {
+		resp.Fail(c, 5001)
+		return
+	}
+	for i := range ups {
+		ups[i].Redact()
+	}
+	resp.DoneData(c, ups)
+}
+
+//getUpstream 获取代理上游信息,仅公开的与自己的
+func getUpstream(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	up, err := LoadUpstream(c.Param("id"))
+	if err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	if !up.Public && up.Owner != uid && uid != ATLAS {
+		resp.Fail(c, 4049)
+		return
+	}
+	up.Redact()
+	resp.DoneData(c, up)
+}
+
+//createUpstream 注册代理上游
+func createUpstream(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+
+	up := &Upstream{}
+	err := c.Bind(up)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 4001)
+		return
+	}
+	err = up.Validate()
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	//丢掉原来的id使用新的id
+	up.ID = ShortID()
+	up.Owner = uid
+	err = db.Create(up).Error
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	casEnf.AddPolicy(uid, up.ID, "(GET)|(POST)")
+	resp.DoneData(c, gin.H{
+		"id": up.ID,
+	})
+}
+
+//updateUpstream 更新代理上游,未提交的字段保持不变
+func updateUpstream(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+
+	up, err := LoadUpstream(c.Param("id"))
+	if err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	if up.Owner != uid && uid != ATLAS {
+		resp.Fail(c, 403)
+		return
+	}
+	id, owner, secret := up.ID, up.Owner, up.Secret
+	err = c.ShouldBind(up)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 4001)
+		return
+	}
+	up.ID, up.Owner = id, owner
+	up.Secret.Unmask(secret)
+	err = up.Validate()
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	err = db.Save(up).Error
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	clearProxyCache(up.ID)
+	resp.Done(c, "")
+}
+
+//deleteUpstream 删除代理上游
+func deleteUpstream(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	ids := strings.Split(c.Param("ids"), ",")
+	tx := db.Where("id in (?)", ids)
+	if uid != ATLAS {
+		tx = tx.Where("owner = ?", uid)
+	}
+	var ups []Upstream
+	err := tx.Find(&ups).Error
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	for _, up := range ups {
+		err = db.Where("id = ?", up.ID).Delete(Upstream{}).Error
+		if err != nil {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		casEnf.RemoveFilteredPolicy(1, up.ID)
+		clearProxyCache(up.ID)
+	}
+	resp.DoneData(c, gin.H{
+		"affected": len(ups),
+	})
+}
+
+//proxyUpstream 代理请求到上游服务
+func proxyUpstream(c *gin.Context) {
+	serveUpstream(c, c.Param("id"), c.Param("uri"))
+}
+
+//tilesProxy 原有三维瓦片代理,使用配置生成的上游dh3dts
+func tilesProxy(c *gin.Context) {
+	serveUpstream(c, "dh3dts", c.Param("uri"))
+}
+
+//serveUpstream 鉴权后转发请求,GET成功响应按上游配置缓存
+func serveUpstream(c *gin.Context, id, uri string) {
+	resp := NewResp()
+	up, err := LoadUpstream(id)
+	if err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	if !up.Public {
+		uid := c.GetString(userKey)
+		if uid == "" {
+			uid = c.GetString(identityKey)
+		}
+		if uid == "" || (up.Owner != uid && !casEnf.Enforce(uid, up.ID, c.Request.Method)) {
+			resp.Fail(c, 403)
+			return
+		}
+	}
+	query := c.Request.URL.Query()
+	cacheable := c.Request.Method == "GET" && up.CacheTTL > 0
+	if cacheable {
+		if data, ct, ok := up.CachedResponse(uri, query); ok {
+			c.Header("X-Cache", "HIT")
+			c.Data(http.StatusOK, ct, data)
+			return
+		}
+	}
+	req, err := up.NewRequest(c.Request.Method, uri, query, c.Request.Header, c.Request.Body, time.Now())
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	client := &http.Client{Timeout: viper.GetDuration("proxy.timeout"), Transport: upstreamTransport}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Warnf("proxy upstream (%s) error, details: %s", up.ID, err)
+		resp.Fail(c, 503)
+		return
+	}
+	defer res.Body.Close()
+	headers := make(map[string]string)
+	for _, k := range proxyRespHeaders {
+		if v := res.Header.Get(k); v != "" && k != "Content-Type" {
+			headers[k] = v
+		}
+	}
+	contentType := res.Header.Get("Content-Type")
+	if cacheable && res.StatusCode == http.StatusOK {
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			resp.Fail(c, 5003)
+			return
+		}
+		err = up.CacheResponse(uri, query, data, contentType)
+		if err != nil {
+			log.Warnf("cache upstream (%s) response error, details: %s", up.ID, err)
+		}
+		for k, v := range headers {
+			c.Header(k, v)
+		}
+		c.Header("X-Cache", "MISS")
+		c.Data(http.StatusOK, contentType, data)
+		return
+	}
+	c.DataFromReader(res.StatusCode, res.ContentLength, contentType, res.Body, headers)
+}
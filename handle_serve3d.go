@@ -1,20 +1,20 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -167,6 +167,7 @@ type Olmap struct {
 	URL       string    `form:"url" json:"url"`
 	Coord     string    `form:"coordType" json:"coordType"`
 	Require   string    `form:"requireField" json:"requireField"`
+	Key       string    `form:"key" json:"key,omitempty"`
 	Thumbnail string    `form:"thumbnail" json:"thumbnail"`
 	CreatedAt time.Time `form:"-" json:"-"`
 }
@@ -254,6 +255,10 @@ func listOnlineMaps(c *gin.Context) {
 		resp.Fail(c, 5001)
 		return
 	}
+	//密钥仅在服务端使用
+	for i := range olmaps {
+		olmaps[i].Key = ""
+	}
 
 	resp.DoneData(c, olmaps)
 }
@@ -280,6 +285,7 @@ func getOnlineMap(c *gin.Context) {
 		return
 	}
 
+	olmap.Key = ""
 	resp.DoneData(c, olmap)
 }
 
@@ -370,11 +376,175 @@ func deleteOnlineMap(c *gin.Context) {
 		resp.Fail(c, 5001)
 		return
 	}
+	for _, id := range sids {
+		closeOlmapCache(id)
+	}
 	resp.DoneData(c, gin.H{
 		"affected": dbres.RowsAffected,
 	})
 }
 
+//getOnlineMapTile 在线底图瓦片代理,带缓存,离线时只使用缓存
+func getOnlineMapTile(c *gin.Context) {
+	resp := NewResp()
+	sid := c.Param("id")
+	olmap := &Olmap{}
+	if err := db.Where("id = ?", sid).First(&olmap).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	z, err := strconv.ParseUint(c.Param("z"), 10, 32)
+	if err != nil || z > 22 {
+		resp.Fail(c, 4003)
+		return
+	}
+	x, err := strconv.ParseUint(c.Param("x"), 10, 32)
+	if err != nil || x >= (1<<z) {
+		resp.Fail(c, 4003)
+		return
+	}
+	ys := strings.Split(c.Param("y"), ".")
+	y, err := strconv.ParseUint(ys[0], 10, 32)
+	if err != nil || y >= (1<<z) {
+		resp.Fail(c, 4003)
+		return
+	}
+	data, status, err := olmap.Tile(uint32(z), uint32(x), uint32(y))
+	c.Header("X-Cache", status)
+	if err != nil {
+		log.Warn(err)
+		c.Status(http.StatusBadGateway)
+		return
+	}
+	if data == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "max-age=86400")
+	c.Data(http.StatusOK, http.DetectContentType(data), data)
+}
+
+//seedOnlineMap 在线底图按范围与级别预取到服务集,同时写入缓存,后台任务执行
+func seedOnlineMap(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	if uid == "" {
+		uid = ATLAS
+	}
+
+	sid := c.Param("id")
+	olmap := &Olmap{}
+	if err := db.Where("id = ?", sid).First(&olmap).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Error(err)
+			resp.Fail(c, 5001)
+			return
+		}
+		resp.Fail(c, 4049)
+		return
+	}
+	var body struct {
+		Name        string `form:"name" json:"name"`
+		BBox        string `form:"bbox" json:"bbox" binding:"required"`
+		MinZoom     int    `form:"minzoom" json:"minzoom"`
+		MaxZoom     *int   `form:"maxzoom" json:"maxzoom" binding:"required"`
+		Concurrency int    `form:"concurrency" json:"concurrency"`
+	}
+	err := c.ShouldBind(&body)
+	if err != nil {
+		resp.Fail(c, 4001)
+		return
+	}
+	v, err := stringToFloats(body.BBox)
+	if err != nil || len(v) != 4 || v[0] >= v[2] || v[1] >= v[3] {
+		resp.FailMsg(c, "invalid bbox, minx,miny,maxx,maxy")
+		return
+	}
+	maxzoom := *body.MaxZoom
+	if body.MinZoom < 0 || maxzoom > 22 || body.MinZoom > maxzoom {
+		resp.FailMsg(c, "invalid zoom range")
+		return
+	}
+	lat := 85.051129
+	bound := orb.Bound{
+		Min: orb.Point{math.Max(v[0], -180), math.Max(v[1], -lat)},
+		Max: orb.Point{math.Min(v[2], 180), math.Min(v[3], lat)},
+	}
+	total := tileCount(bound, body.MinZoom, maxzoom)
+	if max := viper.GetInt("olmaps.seed.maxtiles"); max > 0 && total > max {
+		resp.FailMsg(c, fmt.Sprintf("too many tiles %d, max %d", total, max))
+		return
+	}
+	if body.Name == "" {
+		body.Name = olmap.Name
+	}
+	if body.Concurrency <= 0 {
+		body.Concurrency = viper.GetInt("olmaps.seed.concurrency")
+	}
+
+	id := ShortID()
+	th := &tileHarvester{
+		Path:        filepath.Join(viper.GetString("paths.tilesets"), uid, id+MBTILESEXT),
+		Name:        body.Name,
+		Description: fmt.Sprintf("seeded from online map %s", olmap.Name),
+		Bound:       bound,
+		MinZoom:     body.MinZoom,
+		MaxZoom:     maxzoom,
+		Concurrency: body.Concurrency,
+		Fetch: func(t harvestTile) ([]byte, error) {
+			data, _, err := olmap.Tile(t.z, t.x, t.y)
+			return data, err
+		},
+	}
+	task := &Task{
+		ID:    id,
+		Base:  olmap.ID,
+		Name:  body.Name,
+		Owner: uid,
+		Type:  OL2TS,
+		Pipe:  make(chan struct{}),
+	}
+	//任务队列
+	taskQueue <- task
+	taskSet.Store(task.ID, task)
+	go func(task *Task) {
+		defer func() {
+			task.Pipe <- struct{}{}
+		}()
+		task.Status = "processing"
+		err := th.Run(task)
+		if err == nil {
+			err = registerMBTiles(&DataSource{ID: task.ID, Name: task.Name, Owner: task.Owner, Path: th.Path})
+		}
+		if err != nil {
+			log.Errorf(`seedOnlineMap, seed olmap (%s) error, details: %s`, olmap.ID, err)
+			task.Status = "failed"
+			task.Error = err.Error()
+			return
+		}
+		task.Progress = 100
+		task.Status = "finished"
+	}(task)
+
+	//退出队列,通知完成消息
+	go func(task *Task) {
+		<-task.Pipe
+		<-taskQueue
+		task.save()
+		taskSet.Delete(task.ID)
+	}(task)
+
+	resp.DoneData(c, task)
+}
+
 //**********************************************
 //listTilesets3d 获取三维服务列表
 func listTilesets3d(c *gin.Context) {
@@ -1313,48 +1483,6 @@ func getShortID(c *gin.Context) {
 	})
 }
 
-func tilesProxy(c *gin.Context) {
-	resp := NewResp()
-	uri := c.Param("uri")
-	host := viper.GetString("proxy.host")
-	appid := viper.GetString("proxy.appid")
-	key := viper.GetString("proxy.key")
-	timestamp := "1603949582000" //strconv.FormatInt(time.Now().Unix(), 10)
-	hash := md5.New()
-	hash.Write([]byte(appid + key + uri + timestamp))
-	token := strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
-	claims := fmt.Sprintf(`{"appId":"%s","ms":%s,"token":"%s"}`, appid, timestamp, token)
-	body := bytes.NewBuffer([]byte(claims))
-	url := host + uri
-	client := &http.Client{}
-	req, err := http.NewRequest("PUT", url, body)
-	if err != nil {
-		resp.FailMsg(c, err.Error())
-		return
-	}
-
-	// req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("Content-Type", "application/json;charset=utf-8")
-	//     return JSON.stringify(claims);
-	res, err := client.Do(req)
-	if err != nil {
-		resp.FailMsg(c, err.Error())
-		return
-	}
-	defer res.Body.Close()
-
-	contentType := res.Header.Get("Content-Type")
-	contentLength := res.ContentLength
-	// c.Header("Content-Type", contentType)
-	// rbody, err := ioutil.ReadAll(res.Body)
-	// if err != nil {
-	// resp.FailMsg(c, err.Error())
-	// return
-	// }
-	// c.Writer.Write(rbody)
-	c.DataFromReader(http.StatusOK, contentLength, contentType, res.Body, map[string]string{})
-}
-
 //geoQuery3d 三维查询接口
 func geoQuery3d(c *gin.Context) {
 	resp := NewResp()
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/spf13/viper"
 )
 
 func TestBaiduRespConvert(t *testing.T) {
@@ -55,3 +64,130 @@ func TestBaiduRespConvert(t *testing.T) {
 		t.Errorf("baiduRespConvert() output:\ngot  %v\nwant %v", res, out)
 	}
 }
+
+func TestOlmapTileURL(t *testing.T) {
+	viper.Set("olmaps.keys.tk", "s/k")
+	defer viper.Set("olmaps.keys.tk", nil)
+	for tpl, want := range map[string]string{
+		"https://t0.example.com/{z}/{x}/{-y}.png?sig=a%2Bb&b=2&a=1":  "https://t0.example.com/3/6/5.png?sig=a%2Bb&b=2&a=1&tk=s%2Fk",
+		"https://t0.example.com/DataServer?l={z}&tk=old&x={x}&y={y}": "https://t0.example.com/DataServer?l=3&tk=s%2Fk&x=6&y=2",
+		"https://t0.example.com/{z}/{x}/{y}":                         "https://t0.example.com/3/6/2?tk=s%2Fk",
+	} {
+		o := &Olmap{URL: tpl, Require: "tk"}
+		if got, err := o.TileURL(3, 6, 2); err != nil || got != want {
+			t.Errorf("TileURL(%s) = %s, want %s", tpl, got, want)
+		}
+	}
+	o := &Olmap{URL: "https://t0.example.com/{z}/{x}/{y}?b=2&a={x}"}
+	if got, _ := o.TileURL(3, 6, 2); got != "https://t0.example.com/3/6/2?b=2&a=6" {
+		t.Errorf("query order should be kept, got %s", got)
+	}
+}
+
+func TestOlmapTile(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	fetched := 0
+	up := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched++
+		keys = append(keys, r.URL.Query().Get("tk"))
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		q := r.URL.Query()
+		w.Write(append([]byte("\x89\x50\x4E\x47\x0D\x0A\x1A\x0A"), q.Get("l")+"/"+q.Get("x")+"/"+q.Get("y")...))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	viper.Set("olmaps.cache.path", dir)
+	viper.Set("olmaps.keys.tk", "secret")
+	defer func() {
+		viper.Set("olmaps.cache.path", nil)
+		viper.Set("olmaps.keys.tk", nil)
+		viper.Set("olmaps.cache.ttl", nil)
+		viper.Set("olmaps.offline", nil)
+	}()
+
+	for _, backend := range []string{"file", "mbtiles"} {
+		viper.Set("olmaps.cache.backend", backend)
+		viper.Set("olmaps.cache.ttl", "1h")
+		viper.Set("olmaps.offline", false)
+		fetched, keys, up = 0, nil, true
+		o := &Olmap{ID: "tdt_" + backend, URL: server.URL + "/DataServer?T=vec_w&x={x}&y={y}&l={z}", Require: "tk"}
+
+		data, status, err := o.Tile(3, 6, 2)
+		if err != nil || status != "MISS" || !bytes.HasSuffix(data, []byte("3/6/2")) {
+			t.Fatalf("%s: unexpected first fetch %q %s %v", backend, data, status, err)
+		}
+		if len(keys) != 1 || keys[0] != "secret" {
+			t.Errorf("%s: key should be injected server side, got %v", backend, keys)
+		}
+		_, status, _ = o.Tile(3, 6, 2)
+		if status != "HIT" || fetched != 1 {
+			t.Errorf("%s: expected cache hit, got %s after %d fetches", backend, status, fetched)
+		}
+
+		//过期且回源失败时使用过期缓存
+		viper.Set("olmaps.cache.ttl", "1ns")
+		up = false
+		data, status, err = o.Tile(3, 6, 2)
+		if err != nil || status != "STALE" || !bytes.HasSuffix(data, []byte("3/6/2")) {
+			t.Errorf("%s: expected stale tile, got %q %s %v", backend, data, status, err)
+		}
+
+		//离线只使用缓存
+		viper.Set("olmaps.offline", true)
+		fetched = 0
+		_, status, _ = o.Tile(3, 6, 2)
+		data, miss, err := o.Tile(3, 0, 0)
+		if status != "HIT" || miss != "MISS" || data != nil || err != nil || fetched != 0 {
+			t.Errorf("%s: offline should serve from cache only, got %s %s %d fetches", backend, status, miss, fetched)
+		}
+		closeOlmapCache(o.ID)
+	}
+
+	//预取到MBTiles,同时写入缓存
+	viper.Set("olmaps.cache.backend", "file")
+	viper.Set("olmaps.cache.ttl", "1h")
+	viper.Set("olmaps.offline", false)
+	fetched, up = 0, true
+	o := &Olmap{ID: "tdt_seed", URL: server.URL + "/DataServer?x={x}&y={y}&l={z}"}
+	th := &tileHarvester{
+		Path:        filepath.Join(dir, "seed.mbtiles"),
+		Name:        "seed",
+		Bound:       orb.Bound{Min: orb.Point{100, 20}, Max: orb.Point{120, 40}},
+		MinZoom:     0,
+		MaxZoom:     3,
+		Concurrency: 2,
+		Fetch: func(t harvestTile) ([]byte, error) {
+			data, _, err := o.Tile(t.z, t.x, t.y)
+			return data, err
+		},
+	}
+	if err := th.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if th.Count != fetched || fetched != tileCount(th.Bound, 0, 3) {
+		t.Errorf("expected %d seeded tiles, got %d after %d fetches", tileCount(th.Bound, 0, 3), th.Count, fetched)
+	}
+	viper.Set("olmaps.offline", true)
+	if _, status, _ := o.Tile(3, 6, 3); status != "HIT" {
+		t.Errorf("seeded tile should be cached, got %s", status)
+	}
+	closeOlmapCache(o.ID)
+	mdb, err := sql.Open("sqlite3", th.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+	var format string
+	mdb.QueryRow("select value from metadata where name = 'format'").Scan(&format)
+	if format != "png" {
+		t.Errorf("expected detected png format, got %q", format)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 
@@ -22,6 +24,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gin-gonic/gin"
+	gs "github.com/hishamkaram/geoserver"
 )
 
 //REGEN 反向生成符号
@@ -261,6 +264,10 @@ func createStyle(c *gin.Context) {
 		res.FailErr(c, err)
 		return
 	}
+	_, err = style.Commit(uid, "create")
+	if err != nil {
+		log.Warnf(`createStyle, commit %s's style (%s) revision error, details: %s`, uid, id, err)
+	}
 	set.S.Store(style.ID, style)
 	res.DoneData(c, style)
 }
@@ -421,6 +428,10 @@ func replaceStyle(c *gin.Context) {
 	style.Service()
 	set := userSet.service(uid)
 	set.S.Store(style.ID, style)
+	_, err = style.Commit(uid, c.DefaultQuery("message", "replace"))
+	if err != nil {
+		log.Warnf(`replaceStyle, commit %s's style (%s) revision error, details: %s`, uid, sid, err)
+	}
 	go func(s *Style) {
 		err := os.RemoveAll(s.Path)
 		if err != nil && !os.IsNotExist(err) {
@@ -491,6 +502,10 @@ func deleteStyle(c *gin.Context) {
 			res.Fail(c, 5001)
 			return
 		}
+		err = style.removeRevisions()
+		if err != nil {
+			log.Warnf(`deleteStyle, remove %s's style (%s) revisions error, details:%s ^^`, uid, sid, err)
+		}
 		err = os.RemoveAll(style.Path)
 		if err != nil && !os.IsNotExist(err) {
 			log.Warnf(`deleteStyle, remove %s's style dir (%s) error, details:%s ^^`, uid, sid, err)
@@ -529,6 +544,18 @@ func updateStyle(c *gin.Context) {
 		res.FailMsg(c, "decode style error")
 		return
 	}
+	unlock := lockStyle(style.ID)
+	defer unlock()
+	m := styleIfMatch(c)
+	if m == "" {
+		stylePreconditionRequired(c, style)
+		return
+	}
+	if !matchETag(m, style.Hash()) {
+		log.Warnf(`updateStyle, %s's style (%s) version conflict ^^`, uid, sid)
+		styleConflict(c, style, nil)
+		return
+	}
 	style.Data = data
 	save2db := true
 	if save2db {
@@ -538,7 +565,12 @@ func updateStyle(c *gin.Context) {
 			res.FailMsg(c, "save style to db/file error")
 			return
 		}
+		_, err = style.Commit(uid, c.Query("message"))
+		if err != nil {
+			log.Warnf(`updateStyle, commit %s's style (%s) revision error, details: %s`, uid, sid, err)
+		}
 	}
+	c.Header("ETag", `"`+style.Hash()+`"`)
 	res.Done(c, "")
 }
 
@@ -556,15 +588,142 @@ func saveStyle(c *gin.Context) {
 		res.Fail(c, 4044)
 		return
 	}
+	unlock := lockStyle(style.ID)
+	defer unlock()
+	m := styleIfMatch(c)
+	if m == "" {
+		stylePreconditionRequired(c, style)
+		return
+	}
+	if !matchETag(m, style.Hash()) {
+		log.Warnf(`saveStyle, %s's style (%s) version conflict ^^`, uid, sid)
+		styleConflict(c, style, nil)
+		return
+	}
 	err := style.UpInsert()
 	if err != nil {
 		log.Errorf(`saveStyle, saved %s's style (%s) to db/file error, details: %s`, uid, sid, err)
 		res.FailMsg(c, "save style to db/file error")
 		return
 	}
+	_, err = style.Commit(uid, c.Query("message"))
+	if err != nil {
+		log.Warnf(`saveStyle, commit %s's style (%s) revision error, details: %s`, uid, sid, err)
+	}
+	c.Header("ETag", `"`+style.Hash()+`"`)
 	res.Done(c, "")
 }
 
+//patchStyle 按图层应用JSON Patch,基于旧版本的修改与服务端修改不冲突时自动合并
+func patchStyle(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	sid := c.Param("id")
+	style := userSet.style(uid, sid)
+	if style == nil {
+		log.Warnf(`patchStyle, %s's style (%s) not found ^^`, uid, sid)
+		res.Fail(c, 4044)
+		return
+	}
+	var ops []PatchOp
+	err := c.ShouldBindJSON(&ops)
+	if err != nil {
+		log.Warnf(`patchStyle, decode %s's style (%s) patch error, details: %s`, uid, sid, err)
+		res.Fail(c, 4001)
+		return
+	}
+	unlock := lockStyle(style.ID)
+	defer unlock()
+	merged := false
+	m := styleIfMatch(c)
+	if m == "" {
+		stylePreconditionRequired(c, style)
+		return
+	}
+	if !matchETag(m, style.Hash()) {
+		//基础版本已过期,与服务端修改比较
+		base, err := style.RevisionByHash(strings.Trim(strings.TrimPrefix(strings.TrimSpace(m), "W/"), `"`))
+		if err != nil {
+			log.Warnf(`patchStyle, %s's style (%s) base revision not found ^^`, uid, sid)
+			styleConflict(c, style, nil)
+			return
+		}
+		diff, err := DiffStyle(base.Data, style.Data)
+		if err != nil {
+			res.FailErr(c, err)
+			return
+		}
+		if conflicts := PatchConflicts(diff, ops); len(conflicts) > 0 {
+			log.Warnf(`patchStyle, %s's style (%s) patch conflicts: %v ^^`, uid, sid, conflicts)
+			styleConflict(c, style, conflicts)
+			return
+		}
+		merged = true
+	}
+	data, err := ApplyStylePatch(style.Data, ops)
+	if err != nil {
+		log.Warnf(`patchStyle, apply %s's style (%s) patch error, details: %s`, uid, sid, err)
+		res.FailErr(c, err)
+		return
+	}
+	var root Root
+	err = json.Unmarshal(data, &root)
+	if err != nil {
+		res.FailMsg(c, "patched style is invalid")
+		return
+	}
+	style.Data = data
+	err = style.UpInsert()
+	if err != nil {
+		log.Errorf(`patchStyle, saved %s's style (%s) to db/file error, details: %s`, uid, sid, err)
+		res.FailMsg(c, "save style to db/file error")
+		return
+	}
+	_, err = style.Commit(uid, c.Query("message"))
+	if err != nil {
+		log.Warnf(`patchStyle, commit %s's style (%s) revision error, details: %s`, uid, sid, err)
+	}
+	etag := style.Hash()
+	c.Header("ETag", `"`+etag+`"`)
+	res.DoneData(c, gin.H{"etag": etag, "merged": merged})
+}
+
+//styleIfMatch 修改所基于的样式版本,If-Match头或etag参数
+func styleIfMatch(c *gin.Context) string {
+	if m := c.GetHeader("If-Match"); m != "" {
+		return m
+	}
+	if etag := c.Query("etag"); etag != "" {
+		return `"` + strings.Trim(etag, `"`) + `"`
+	}
+	return ""
+}
+
+//stylePreconditionRequired 未提供基础版本,返回服务端当前版本,避免覆盖他人的修改
+func stylePreconditionRequired(c *gin.Context, s *Style) {
+	etag := s.Hash()
+	c.Header("ETag", `"`+etag+`"`)
+	res := NewRes()
+	res.Code = 4281
+	res.Msg = codes[4281]
+	res.Data = gin.H{"etag": etag}
+	c.JSON(http.StatusPreconditionRequired, res)
+}
+
+//styleConflict 版本冲突,返回服务端当前版本
+func styleConflict(c *gin.Context, s *Style, conflicts []string) {
+	etag := s.Hash()
+	c.Header("ETag", `"`+etag+`"`)
+	res := NewRes()
+	res.Code = 4091
+	res.Msg = codes[4091]
+	res.Data = gin.H{"etag": etag, "conflicts": conflicts, "style": s.Data}
+	c.JSON(http.StatusConflict, res)
+}
+
 //uploadStyle 多个icons图标上传
 func uploadIcons(c *gin.Context) {
 	res := NewRes()
@@ -607,6 +766,7 @@ func uploadIcons(c *gin.Context) {
 			return
 		}
 	}
+	var names []string
 	for _, file := range files {
 		dst := filepath.Join(dir, file.Filename)
 		if err := c.SaveUploadedFile(file, dst); err != nil {
@@ -614,23 +774,19 @@ func uploadIcons(c *gin.Context) {
 			res.Fail(c, 5002)
 			return
 		}
+		names = append(names, strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename)))
 	}
-	if len(files) > 0 {
-		items, err := ioutil.ReadDir(style.Path)
-		if err == nil {
-			for _, item := range items {
-				if item.IsDir() {
-					continue
-				}
-				if strings.HasPrefix(item.Name(), "sprite") {
-					err = os.Remove(filepath.Join(style.Path, item.Name()))
-				}
-			}
-		}
+	//sdf=true 时本次上传的图标均生成sdf图标
+	if sdf, _ := strconv.ParseBool(c.PostForm("sdf")); sdf {
+		err := style.markSDF(names, true)
 		if err != nil {
-			log.Warnf("clean old sprites error, details: %s", err)
+			log.Errorf(`uploadIcons, mark %s's sdf icons error, details: %s`, uid, err)
+			res.Fail(c, 5002)
+			return
 		}
 	}
+	//增量更新已生成的sprites
+	style.PatchSprites(names, nil)
 	res.Done(c, "")
 }
 
@@ -678,22 +834,81 @@ func deleteIcons(c *gin.Context) {
 		}
 	}
 	if len(sucs) > 0 {
-		items, err := ioutil.ReadDir(style.Path)
-		if err == nil {
-			for _, item := range items {
-				if item.IsDir() {
-					continue
-				}
-				if strings.HasPrefix(item.Name(), "sprite") {
-					err = os.Remove(filepath.Join(style.Path, item.Name()))
-				}
+		style.PatchSprites(nil, sucs)
+	}
+	res.DoneData(c, sucs)
+}
+
+//convertSDFIcons 将已有的单色图标转换为sdf图标(或取消sdf),并刷新sprite
+func convertSDFIcons(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	sid := c.Param("id")
+	style := userSet.style(uid, sid)
+	if style == nil {
+		log.Warnf(`convertSDFIcons, %s's style (%s) not found ^^`, uid, sid)
+		res.Fail(c, 4044)
+		return
+	}
+	var body struct {
+		Names []string `json:"names" form:"names" binding:"required"`
+		SDF   *bool    `json:"sdf" form:"sdf"`
+		Force bool     `json:"force" form:"force"`
+	}
+	err := c.Bind(&body)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	sdf := body.SDF == nil || *body.SDF
+	dir := filepath.Join(style.Path, "icons")
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if REGEN {
+			err := GenIconsFromSprite(style.Path)
+			if err != nil {
+				log.Errorf("GenIconsFromSprite, gen icons error, details: %s", err)
 			}
+		} else {
+			res.FailMsg(c, "regenerate icons error")
+			return
+		}
+	}
+	//仅单色图标可着色,彩色图标需force强制转换
+	mono := make(map[string]bool)
+	if sdf && !body.Force {
+		for _, sym := range ReadIcons(dir, 1) {
+			mono[sym.Name] = IsMonochrome(sym.Image, 16)
 		}
+	}
+	var sucs, fails []string
+	for _, name := range body.Names {
+		pathfile := autoAppendExt(filepath.Join(dir, name))
+		if pathfile == "" {
+			fails = append(fails, name)
+			continue
+		}
+		if sdf && !body.Force && !mono[name] {
+			fails = append(fails, name)
+			continue
+		}
+		sucs = append(sucs, name)
+	}
+	if len(sucs) > 0 {
+		err = style.markSDF(sucs, sdf)
 		if err != nil {
-			log.Warnf("clean old sprites error, details: %s", err)
+			log.Errorf(`convertSDFIcons, mark %s's sdf icons error, details: %s`, uid, err)
+			res.Fail(c, 5002)
+			return
 		}
+		style.PatchSprites(sucs, nil)
 	}
-	res.DoneData(c, sucs)
+	res.DoneData(c, gin.H{
+		"success": sucs,
+		"failed":  fails,
+	})
 }
 
 //getIcon 获取单个icon符号
@@ -848,6 +1063,8 @@ func updateIcon(c *gin.Context) {
 				log.Warnf("uploadIcons, generate sprite@2x error")
 			}
 		}
+	} else {
+		style.PatchSprites([]string{strings.TrimSuffix(filepath.Base(pathfile), ext)}, nil)
 	}
 	res.Done(c, "")
 }
@@ -912,6 +1129,10 @@ func uploadSprite(c *gin.Context) {
 			return
 		}
 		sucs = append(sucs, file.Filename)
+		//上传的sprite与打包状态不再一致,删除打包状态,后续更新时全量生成
+		if strings.HasPrefix(file.Filename, "sprite") && strings.HasSuffix(file.Filename, ".png") {
+			os.Remove(strings.TrimSuffix(dst, ".png") + ".pack.json")
+		}
 	}
 	//todo update to cache
 	res.DoneData(c, sucs)
@@ -931,6 +1152,13 @@ func getStyle(c *gin.Context) {
 		res.Fail(c, 4044)
 		return
 	}
+	etag := s.Hash()
+	c.Header("ETag", `"`+etag+`"`)
+	c.Header("Cache-Control", "no-cache")
+	if m := c.GetHeader("If-None-Match"); m != "" && matchETag(m, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
 	c.JSON(http.StatusOK, s.Data)
 }
 
@@ -976,15 +1204,30 @@ func getSprite(c *gin.Context) {
 		// return
 	}
 
+	//ETag缓存校验,sprite内容变化后ETag随之变化,base64输出使用不同ETag
+	isPng := strings.HasSuffix(strings.ToLower(sprite), ".png")
+	p, y := c.GetQuery("base64")
+	b64 := isPng && y && p != ""
+	if buf != nil {
+		etag := fmt.Sprintf(`"%x"`, md5.Sum(buf))
+		if b64 {
+			etag = fmt.Sprintf(`"%x-b64"`, md5.Sum(buf))
+		}
+		c.Header("ETag", etag)
+		c.Header("Cache-Control", "no-cache")
+		if match := c.GetHeader("If-None-Match"); match == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
 	if strings.HasSuffix(strings.ToLower(sprite), ".json") {
 		c.Writer.Header().Set("Content-Type", "application/json")
 		if buf == nil {
 			buf = []byte("{}")
 		}
 	}
-	if strings.HasSuffix(strings.ToLower(sprite), ".png") {
-		p, y := c.GetQuery("base64")
-		if y && p != "" {
+	if isPng {
+		if b64 {
 			b64src := base64.StdEncoding.EncodeToString(buf)
 			c.Writer.WriteString("data:image/png;base64," + b64src)
 			return
@@ -1062,3 +1305,398 @@ func getViewStyle(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, &style)
 }
+
+//listStyleRevisions 获取样式历史版本列表
+func listStyleRevisions(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	sid := c.Param("id")
+	s := userSet.style(uid, sid)
+	if s == nil {
+		log.Warnf(`listStyleRevisions, %s's style (%s) not found ^^`, uid, sid)
+		res.Fail(c, 4044)
+		return
+	}
+	revs, err := s.Revisions()
+	if err != nil {
+		log.Errorf(`listStyleRevisions, query %s's style (%s) revisions error, details: %s`, uid, sid, err)
+		res.Fail(c, 5001)
+		return
+	}
+	res.DoneData(c, revs)
+}
+
+//getStyleRevision 获取样式指定历史版本
+func getStyleRevision(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	sid := c.Param("id")
+	s := userSet.style(uid, sid)
+	if s == nil {
+		log.Warnf(`getStyleRevision, %s's style (%s) not found ^^`, uid, sid)
+		res.Fail(c, 4044)
+		return
+	}
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	r, err := s.Revision(rev)
+	if err != nil {
+		log.Warnf(`getStyleRevision, %s's style (%s) revision (%d) not found ^^`, uid, sid, rev)
+		res.FailMsg(c, "revision not found")
+		return
+	}
+	res.DoneData(c, r)
+}
+
+//diffStyleRevisions 比较样式两个版本,to缺省为当前样式,from缺省为最新版本
+func diffStyleRevisions(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	sid := c.Param("id")
+	s := userSet.style(uid, sid)
+	if s == nil {
+		log.Warnf(`diffStyleRevisions, %s's style (%s) not found ^^`, uid, sid)
+		res.Fail(c, 4044)
+		return
+	}
+	load := func(param string) (int, []byte, error) {
+		v := c.Query(param)
+		if v == "" {
+			if param == "to" {
+				return 0, s.Data, nil
+			}
+			r, err := s.LatestRevision()
+			if err != nil {
+				return 0, nil, err
+			}
+			return r.Rev, r.Data, nil
+		}
+		rev, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid revision %s", v)
+		}
+		r, err := s.Revision(rev)
+		if err != nil {
+			return 0, nil, fmt.Errorf("revision %d not found", rev)
+		}
+		return r.Rev, r.Data, nil
+	}
+	from, a, err := load("from")
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	to, b, err := load("to")
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	diff, err := DiffStyle(a, b)
+	if err != nil {
+		log.Errorf(`diffStyleRevisions, diff %s's style (%s) error, details: %s`, uid, sid, err)
+		res.FailErr(c, err)
+		return
+	}
+	diff.From = from
+	diff.To = to
+	res.DoneData(c, diff)
+}
+
+//rollbackStyle 回滚样式到指定历史版本,回滚本身记录为新版本
+func rollbackStyle(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	sid := c.Param("id")
+	s := userSet.style(uid, sid)
+	if s == nil {
+		log.Warnf(`rollbackStyle, %s's style (%s) not found ^^`, uid, sid)
+		res.Fail(c, 4044)
+		return
+	}
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	r, err := s.Revision(rev)
+	if err != nil {
+		log.Warnf(`rollbackStyle, %s's style (%s) revision (%d) not found ^^`, uid, sid, rev)
+		res.FailMsg(c, "revision not found")
+		return
+	}
+	unlock := lockStyle(s.ID)
+	defer unlock()
+	s.Data = r.Data
+	err = s.UpInsert()
+	if err != nil {
+		log.Errorf(`rollbackStyle, saved %s's style (%s) to db/file error, details: %s`, uid, sid, err)
+		res.FailMsg(c, "save style to db/file error")
+		return
+	}
+	nr, err := s.Commit(uid, c.DefaultQuery("message", fmt.Sprintf("rollback to #%d", rev)))
+	if err != nil {
+		log.Errorf(`rollbackStyle, commit %s's style (%s) revision error, details: %s`, uid, sid, err)
+		res.Fail(c, 5001)
+		return
+	}
+	nr.Data = nil
+	res.DoneData(c, nr)
+}
+
+//importSLD 导入SLD/SE样式,转换为绑定数据集或瓦片集的地图样式
+func importSLD(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	set := userSet.service(uid)
+	if set == nil {
+		log.Warnf("importSLD, %s's service not found ^^", uid)
+		res.Fail(c, 4043)
+		return
+	}
+	body := struct {
+		Name      string `form:"name" json:"name"`
+		Dataset   string `form:"dataset" json:"dataset"`
+		Tileset   string `form:"tileset" json:"tileset"`
+		Layer     string `form:"layer" json:"layer"`
+		Geoserver string `form:"geoserver" json:"geoserver"`
+		Workspace string `form:"workspace" json:"workspace"`
+		Style     string `form:"style" json:"style"`
+	}{}
+	err := c.ShouldBind(&body)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	//数据源
+	opts := SLDOptions{SourceLayer: body.Layer}
+	source := &Source{Type: "vector"}
+	switch {
+	case body.Dataset != "":
+		ds := userSet.dataset(uid, body.Dataset)
+		if ds == nil {
+			log.Warnf(`importSLD, %s's dataset (%s) not found ^^`, uid, body.Dataset)
+			res.Fail(c, 4046)
+			return
+		}
+		opts.Source = ds.ID
+		opts.SourceLayer = ds.ID
+		source.URL = fmt.Sprintf("atlasdata://datasets/x/%s/", ds.ID)
+	case body.Tileset != "":
+		ts := userSet.tileset(uid, body.Tileset)
+		if ts == nil {
+			log.Warnf(`importSLD, %s's tileset (%s) not found ^^`, uid, body.Tileset)
+			res.Fail(c, 4045)
+			return
+		}
+		opts.Source = ts.ID
+		source.URL = fmt.Sprintf("atlasdata://ts/x/%s/", ts.ID)
+		if ts.Format != PBF {
+			opts.Raster = true
+			source.Type = "raster"
+			source.TileSize = 256
+		}
+	default:
+		res.FailMsg(c, "dataset or tileset required")
+		return
+	}
+	//SLD内容,上传文件或从Geoserver获取
+	var data []byte
+	var catalog *gs.GeoServer
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			res.Fail(c, 5002)
+			return
+		}
+		data, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			res.Fail(c, 5002)
+			return
+		}
+		if body.Name == "" {
+			body.Name = strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename))
+		}
+	} else if body.Geoserver != "" && body.Style != "" {
+		geoserver := &Geoserver{}
+		err := db.Where("id = ?", body.Geoserver).First(geoserver).Error
+		if err != nil {
+			log.Warnf(`importSLD, geoserver (%s) not found ^^`, body.Geoserver)
+			res.Fail(c, 4049)
+			return
+		}
+		catalog = gs.GetCatalog(geoserver.ServiceURL, geoserver.UserName, string(geoserver.Password))
+		data, err = GetGsStyleSLD(catalog, body.Workspace, body.Style)
+		if err != nil {
+			log.Warnf(`importSLD, get geoserver style (%s) error, details: %s`, body.Style, err)
+			res.FailErr(c, err)
+			return
+		}
+		if body.Name == "" {
+			body.Name = body.Style
+		}
+	} else {
+		res.FailMsg(c, "sld file or geoserver style required")
+		return
+	}
+	result, err := ConvertSLD(data, opts)
+	if err != nil {
+		log.Warnf(`importSLD, convert %s's sld error, details: %s`, uid, err)
+		res.FailErr(c, err)
+		return
+	}
+	id := ShortID()
+	path := filepath.Join(viper.GetString("paths.styles"), uid, id)
+	err = os.MkdirAll(filepath.Join(path, "icons"), os.ModePerm)
+	if err != nil {
+		log.Errorf("importSLD, make %s' new style path dir error, details:%s", uid, err)
+		res.Fail(c, 5002)
+		return
+	}
+	//外部图形导入为样式图标
+	heights := make(map[string]int)
+	for _, icon := range result.Icons {
+		h, err := importSLDIcon(icon, filepath.Join(path, "icons"), catalog, body.Workspace)
+		if err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("icon %s not imported, %s", icon.Href, err))
+			continue
+		}
+		heights[icon.Name] = h
+	}
+	result.ScaleIcons(heights)
+
+	if body.Name == "" {
+		body.Name = "地图"
+	}
+	root := Root{
+		Version: 8,
+		Name:    body.Name,
+		Sources: map[string]*Source{opts.Source: source},
+		Glyphs:  "atlasdata://fonts/{fontstack}/{range}.pbf",
+	}
+	if len(heights) > 0 {
+		root.Sprite = fmt.Sprintf("atlasdata://maps/x/%s/sprite", id)
+	}
+	for _, l := range result.Layers {
+		root.Layers = append(root.Layers, l)
+	}
+	buf, err := json.Marshal(root)
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	style := &Style{
+		ID:    id,
+		Name:  body.Name,
+		Owner: uid,
+		Path:  path,
+		Data:  buf,
+	}
+	err = style.UpInsert()
+	if err != nil {
+		log.Errorf("importSLD, upinsert %s's new style error ^^", uid)
+		res.FailErr(c, err)
+		return
+	}
+	_, err = style.Commit(uid, "import sld")
+	if err != nil {
+		log.Warnf(`importSLD, commit %s's style (%s) revision error, details: %s`, uid, id, err)
+	}
+	set.S.Store(style.ID, style)
+	res.DoneData(c, gin.H{
+		"style":    style,
+		"layers":   len(result.Layers),
+		"icons":    result.Icons,
+		"warnings": result.Warnings,
+	})
+}
+
+//sldIconMaxSize SLD外部图形大小上限
+const sldIconMaxSize = 2 << 20
+
+//sldIconClient 下载SLD外部图形,仅允许http/https并拒绝连接内网与回环地址(含重定向)
+var sldIconClient = &http.Client{
+	Timeout:   15 * time.Second,
+	Transport: publicTransport(nil),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("unsupported redirect scheme %s", req.URL.Scheme)
+		}
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		return nil
+	},
+}
+
+//importSLDIcon 下载SLD外部图形到样式图标目录,返回图标高度
+func importSLDIcon(icon *SLDIcon, dir string, catalog *gs.GeoServer, workspace string) (int, error) {
+	var data []byte
+	var err error
+	href := icon.Href
+	switch {
+	case strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://"):
+		resp, err := sldIconClient.Get(href)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("http status %d", resp.StatusCode)
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(resp.Body, sldIconMaxSize+1))
+		if err != nil {
+			return 0, err
+		}
+		if len(data) > sldIconMaxSize {
+			return 0, fmt.Errorf("graphic exceeds %d bytes", sldIconMaxSize)
+		}
+	case catalog != nil && !strings.Contains(href, "://"):
+		data, err = GetGsStyleResource(catalog, workspace, strings.TrimPrefix(href, "./"))
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unsupported graphic location")
+	}
+	ext := strings.ToLower(filepath.Ext(strings.SplitN(href, "?", 2)[0]))
+	switch icon.Format {
+	case "image/png":
+		ext = ".png"
+	case "image/jpeg", "image/jpg":
+		ext = ".jpg"
+	case "image/gif":
+		ext = ".gif"
+	case "image/svg+xml", "image/svg":
+		ext = ".svg"
+	}
+	pathfile := filepath.Join(dir, icon.Name+ext)
+	err = ioutil.WriteFile(pathfile, data, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	sym, err := ReadIcon(pathfile, 1)
+	if err != nil {
+		os.Remove(pathfile)
+		return 0, err
+	}
+	return sym.Height, nil
+}
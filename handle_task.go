@@ -115,3 +115,28 @@ func taskStreamQuery(c *gin.Context) {
 		})
 	}
 }
+
+//taskCancel 取消进行中的任务
+func taskCancel(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(identityKey)
+	if uid == "" {
+		uid = c.GetString(userKey)
+	}
+	id := c.Param("id")
+	v, ok := taskSet.Load(id)
+	if !ok {
+		res.FailMsg(c, "task not found or finished")
+		return
+	}
+	task, ok := v.(*Task)
+	if !ok || (task.Owner != uid && uid != ATLAS) {
+		res.Fail(c, 403)
+		return
+	}
+	if !cancelTask(id) {
+		res.FailMsg(c, "task can not be canceled")
+		return
+	}
+	res.Done(c, "")
+}
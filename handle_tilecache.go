@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/orb"
+	log "github.com/sirupsen/logrus"
+)
+
+//listLayerCaches 获取图层缓存统计列表
+func listLayerCaches(c *gin.Context) {
+	resp := NewResp()
+	ids, err := listLayerCacheIDs()
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5003)
+		return
+	}
+	list := []*LayerCacheStats{}
+	for _, id := range ids {
+		stats, err := layerCacheStats(id)
+		if err != nil {
+			log.Warnf("stat layer cache (%s) error, details: %s", id, err)
+			continue
+		}
+		list = append(list, stats)
+	}
+	resp.DoneData(c, list)
+}
+
+//getLayerCache 获取图层缓存统计
+func getLayerCache(c *gin.Context) {
+	resp := NewResp()
+	id := c.Param("id")
+	if !layerCacheIDReg.MatchString(id) {
+		resp.Fail(c, 4001)
+		return
+	}
+	stats, err := layerCacheStats(id)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5003)
+		return
+	}
+	resp.DoneData(c, stats)
+}
+
+//purgeLayerCacheTiles 删除图层缓存,可按级别zoom与范围bbox(minx,miny,maxx,maxy)删除,都不传时清空
+func purgeLayerCacheTiles(c *gin.Context) {
+	resp := NewResp()
+	id := c.Param("id")
+	if !layerCacheIDReg.MatchString(id) {
+		resp.Fail(c, 4001)
+		return
+	}
+	var body struct {
+		Zoom string `form:"zoom" json:"zoom"`
+		BBox string `form:"bbox" json:"bbox"`
+	}
+	err := c.ShouldBind(&body)
+	if err != nil {
+		resp.Fail(c, 4001)
+		return
+	}
+	zoom := -1
+	if body.Zoom != "" {
+		zoom, err = strconv.Atoi(body.Zoom)
+		if err != nil || zoom < 0 || zoom > 24 {
+			resp.FailMsg(c, "zoom should be between 0 and 24")
+			return
+		}
+	}
+	var bound *orb.Bound
+	if body.BBox != "" {
+		v, err := stringToFloats(body.BBox)
+		if err != nil || len(v) != 4 || v[0] > v[2] || v[1] > v[3] {
+			resp.FailMsg(c, "invalid bbox, minx,miny,maxx,maxy")
+			return
+		}
+		lat := 85.051129
+		bound = &orb.Bound{
+			Min: orb.Point{math.Max(v[0], -180), math.Max(v[1], -lat)},
+			Max: orb.Point{math.Min(v[2], 180), math.Min(v[3], lat)},
+		}
+	}
+	cnt, err := purgeLayerCache(id, zoom, bound)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5003)
+		return
+	}
+	resp.DoneData(c, gin.H{
+		"affected": cnt,
+	})
+}
+
+//setLayerCachePolicy 设置图层缓存有效期ttl,单位秒,0使用默认配置,负数不缓存
+func setLayerCachePolicy(c *gin.Context) {
+	resp := NewResp()
+	id := c.Param("id")
+	if !layerCacheIDReg.MatchString(id) {
+		resp.Fail(c, 4001)
+		return
+	}
+	policy := &TileCachePolicy{}
+	err := c.ShouldBind(policy)
+	if err != nil {
+		resp.Fail(c, 4001)
+		return
+	}
+	err = setLayerCacheTTL(id, policy.TTL)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	resp.Done(c, "")
+}
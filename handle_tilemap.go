@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-spatial/geom"
+	"github.com/go-spatial/geom/encoding/mvt"
+	"github.com/go-spatial/tegola"
+	"github.com/go-spatial/tegola/mapbox/tilejson"
+	"github.com/go-spatial/tegola/server"
+	log "github.com/sirupsen/logrus"
+)
+
+//userTileMap 获取用户的瓦片数据集
+func userTileMap(uid, id string) (*TileMap, error) {
+	tm, err := LoadTileMap(id)
+	if err != nil {
+		return nil, err
+	}
+	if tm.Owner != uid && uid != ATLAS {
+		return nil, fmt.Errorf("tilemap %s not found", id)
+	}
+	return tm, nil
+}
+
+//listTileMaps 获取瓦片数据集列表
+func listTileMaps(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	var tms []TileMap
+	err := db.Where("owner = ?", uid).Order("updated_at desc").Find(&tms).Error
+	if err != nil {
+		log.Error(err)
+		res.Fail(c, 5001)
+		return
+	}
+	for i := range tms {
+		json.Unmarshal(tms[i].Config, &tms[i].Layers)
+	}
+	res.DoneData(c, tms)
+}
+
+//createTileMap 创建瓦片数据集,组合多个数据集与驱动图层
+func createTileMap(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	tm := &TileMap{}
+	err := c.ShouldBindJSON(tm)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	tm.ID = ShortID()
+	tm.Owner = uid
+	err = tm.Prepare()
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	err = tm.Save()
+	if err != nil {
+		log.Error(err)
+		res.Fail(c, 5001)
+		return
+	}
+	tileMaps.Store(tm.ID, tm)
+	res.DoneData(c, tm)
+}
+
+//getTileMapInfo 获取瓦片数据集信息
+func getTileMapInfo(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	tm, err := userTileMap(uid, c.Param("id"))
+	if err != nil {
+		log.Warnf(`getTileMapInfo, %s's tilemap (%s) not found ^^, %s`, uid, c.Param("id"), err)
+		res.Fail(c, 4049)
+		return
+	}
+	res.DoneData(c, tm)
+}
+
+//updateTileMap 更新瓦片数据集,无需重启立即生效
+func updateTileMap(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	old, err := userTileMap(uid, id)
+	if err != nil {
+		res.Fail(c, 4049)
+		return
+	}
+	tm := &TileMap{}
+	err = c.ShouldBindJSON(tm)
+	if err != nil {
+		res.Fail(c, 4001)
+		return
+	}
+	tm.ID = old.ID
+	tm.Owner = old.Owner
+	tm.CreatedAt = old.CreatedAt
+	err = tm.Prepare()
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	err = tm.Save()
+	if err != nil {
+		log.Error(err)
+		res.Fail(c, 5001)
+		return
+	}
+	tileMaps.Store(tm.ID, tm)
+	res.DoneData(c, tm)
+}
+
+//deleteTileMaps 删除瓦片数据集
+func deleteTileMaps(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	ids := strings.Split(c.Param("ids"), ",")
+	tdb := db.Where("id in (?)", ids)
+	if uid != ATLAS {
+		tdb = tdb.Where("owner = ?", uid)
+	}
+	dbres := tdb.Delete(TileMap{})
+	if dbres.Error != nil {
+		log.Error(dbres.Error)
+		res.Fail(c, 5001)
+		return
+	}
+	for _, id := range ids {
+		tileMaps.Delete(id)
+	}
+	res.DoneData(c, gin.H{
+		"affected": dbres.RowsAffected,
+	})
+}
+
+//getTileMapJSON 获取瓦片数据集tilejson,vector_layers包含全部图层
+func getTileMapJSON(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	tm, err := userTileMap(uid, id)
+	if err != nil {
+		log.Warnf(`getTileMapJSON, %s's tilemap (%s) not found ^^, %s`, uid, id, err)
+		res.Fail(c, 4049)
+		return
+	}
+	q := ""
+	if c.Query("debug") == "true" {
+		m := tm.AddDebugLayers()
+		tm = &m
+		q = "?debug=true"
+	}
+	tileurl := fmt.Sprintf(`%s/tilemaps/x/%s/{z}/{x}/{y}.pbf%s`, rootURL(c.Request), id, q)
+	tileJSON := tilejson.TileJSON{
+		Attribution: &tm.Attribution,
+		Center:      tm.Center,
+		Format:      "pbf",
+		Name:        &tm.Name,
+		Scheme:      tilejson.SchemeXYZ,
+		TileJSON:    tilejson.Version,
+		Version:     "2",
+		Grids:       make([]string, 0),
+		Data:        make([]string, 0),
+		Tiles:       []string{tileurl},
+	}
+	if tm.Bounds != nil {
+		tileJSON.Bounds = tm.Bounds.Extent()
+	}
+	for i, l := range tm.Layers {
+		minzoom, maxzoom := l.MinZoom, l.MaxZoom
+		if maxzoom == 0 {
+			maxzoom = tegola.MaxZ
+		}
+		if i == 0 || minzoom < tileJSON.MinZoom {
+			tileJSON.MinZoom = minzoom
+		}
+		if maxzoom > tileJSON.MaxZoom {
+			tileJSON.MaxZoom = maxzoom
+		}
+		layer := tilejson.VectorLayer{
+			Version: 2,
+			Extent:  4096,
+			ID:      l.MVTName(),
+			Name:    l.MVTName(),
+			MinZoom: minzoom,
+			MaxZoom: maxzoom,
+			Tiles:   []string{tileurl},
+		}
+		switch l.GeomType.(type) {
+		case geom.Point, geom.MultiPoint:
+			layer.GeometryType = tilejson.GeomTypePoint
+		case geom.Line, geom.LineString, geom.MultiLineString:
+			layer.GeometryType = tilejson.GeomTypeLine
+		case geom.Polygon, geom.MultiPolygon:
+			layer.GeometryType = tilejson.GeomTypePolygon
+		default:
+			layer.GeometryType = tilejson.GeomTypeUnknown
+		}
+		tileJSON.VectorLayers = append(tileJSON.VectorLayers, layer)
+	}
+
+	c.Header("Content-Type", "application/json")
+	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
+	c.Header("Pragma", "no-cache")
+	c.Header("Expires", "0")
+	if err := json.NewEncoder(c.Writer).Encode(tileJSON); err != nil {
+		log.Printf("error encoding tileJSON for tilemap (%v)", id)
+	}
+}
+
+//getTileMap 获取瓦片数据集瓦片,可用layers参数选择图层,debug=true附加调试图层
+func getTileMap(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	tm, err := userTileMap(uid, id)
+	if err != nil {
+		errMsg := fmt.Sprintf("tilemap (%v) not found", id)
+		log.Error(errMsg)
+		http.Error(c.Writer, errMsg, http.StatusNotFound)
+		return
+	}
+	placeholder, _ := strconv.ParseUint(c.Param("z"), 10, 32)
+	z := uint(placeholder)
+	placeholder, _ = strconv.ParseUint(c.Param("x"), 10, 32)
+	x := uint(placeholder)
+	ys := strings.Split(c.Param("y"), ".")
+	if len(ys) != 2 {
+		res.Fail(c, 4003)
+		return
+	}
+	placeholder, _ = strconv.ParseUint(ys[0], 10, 32)
+	y := uint(placeholder)
+
+	m := *tm
+	if names := c.Query("layers"); names != "" {
+		m = m.FilterLayersByName(strings.Split(names, ",")...)
+	}
+	pbyte, err := m.Tile(c.Request.Context(), uint8(z), x, y, c.Query("debug") == "true")
+	if err != nil {
+		if err != context.Canceled {
+			http.Error(c.Writer, fmt.Sprintf("error marshalling tile: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// mimetype for mapbox vector tiles
+	// https://www.iana.org/assignments/media-types/application/vnd.mapbox-vector-tile
+	c.Header("Content-Type", mvt.MimeType)
+	c.Header("Content-Encoding", "gzip")
+	c.Header("Content-Length", fmt.Sprintf("%d", len(pbyte)))
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Write(pbyte)
+	// check for tile size warnings
+	if len(pbyte) > server.MaxTileSize {
+		log.Infof("tile z:%v, x:%v, y:%v is rather large - %vKb", z, x, y, len(pbyte)/1024)
+	}
+}
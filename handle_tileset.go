@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
@@ -747,14 +748,17 @@ func getTile(c *gin.Context) {
 	}
 	y := uint(placeholder)
 
-	var data []byte
 	// flip y to match the spec
 	y = (1 << z) - 1 - y
+	writeTilesetTile(c, ts, z, x, y)
+}
 
-	data, err = ts.Tile(c.Request.Context(), z, x, y)
+//writeTilesetTile 输出瓦片集瓦片,y为mbtiles(TMS)行号,空瓦片按格式返回空白图片或204
+func writeTilesetTile(c *gin.Context, ts *Tileset, z, x, y uint) {
+	data, err := ts.Tile(c.Request.Context(), z, x, y)
 	if err != nil {
-		log.Errorf("getTile, cannot fetch %s from DB for z=%d, x=%d, y=%d, details: %v", tid, z, x, y, err)
-		res.Fail(c, 5004)
+		log.Errorf("getTile, cannot fetch %s from DB for z=%d, x=%d, y=%d, details: %v", ts.ID, z, x, y, err)
+		NewRes().Fail(c, 5004)
 		return
 	}
 	if data == nil || len(data) <= 1 {
@@ -774,6 +778,7 @@ func getTile(c *gin.Context) {
 			c.Writer.WriteHeader(http.StatusNotFound)
 			fmt.Fprint(c.Writer, `{"message": "Tile does not exist"}`)
 		}
+		return
 	}
 
 	c.Header("Content-Type", ts.Format.ContentType())
@@ -825,3 +830,198 @@ func viewTile(c *gin.Context) {
 		"URL":    tileurl,
 	})
 }
+
+//mergeTilesets 获取待合并的服务集,需同为矢量或同为栅格
+func mergeTilesets(c *gin.Context) ([]string, []*Tileset, bool) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	tids := strings.Split(c.Param("ids"), ",")
+	var tss []*Tileset
+	for _, tid := range tids {
+		ts := userSet.tileset(uid, tid)
+		if ts == nil {
+			log.Warnf("mergeTilesets, %s's tilesets (%s) not found ^^", uid, tid)
+			res.Fail(c, 4045)
+			return nil, nil, false
+		}
+		if len(tss) > 0 && (ts.Format == PBF) != (tss[0].Format == PBF) {
+			res.FailMsg(c, "can not merge vector and raster tilesets")
+			return nil, nil, false
+		}
+		tss = append(tss, ts)
+	}
+	return tids, tss, true
+}
+
+//tilesetLayerIDs 服务集元数据中的矢量图层
+func tilesetLayerIDs(metadata map[string]interface{}) []string {
+	var ids []string
+	layers, _ := metadata["vector_layers"].([]interface{})
+	for _, l := range layers {
+		if layer, ok := l.(map[string]interface{}); ok {
+			if id, ok := layer["id"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+//getMergedTileJSON 获取合并服务集tilejson,范围与级别取并集
+func getMergedTileJSON(c *gin.Context) {
+	res := NewRes()
+	tids, tss, ok := mergeTilesets(c)
+	if !ok {
+		return
+	}
+	ids := strings.Join(tids, ",")
+	tileurl := fmt.Sprintf(`atlasdata://ts/merge/%s/{z}/{x}/{y}`, ids)
+	if c.Query("fixurl") == "yes" {
+		tileurl = fmt.Sprintf(`%s/ts/merge/%s/{z}/{x}/{y}`, rootURL(c.Request), ids)
+	}
+	format := tss[0].Format
+	if format != PBF {
+		format = PNG
+	}
+	out := map[string]interface{}{
+		"tilejson": "2.1.0",
+		"id":       ids,
+		"scheme":   "xyz",
+		"format":   format,
+		"tiles":    []string{fmt.Sprintf("%s.%s", tileurl, format)},
+	}
+	var bounds []float64
+	minzoom, maxzoom := -1, -1
+	var layers [][]string
+	var metas []map[string]interface{}
+	for i, ts := range tss {
+		metadata, err := ts.GetInfo()
+		if err != nil {
+			log.Errorf("getMergedTileJSON, get %s metadata failed: %s ^^", tids[i], err)
+			res.Fail(c, 5004)
+			return
+		}
+		metas = append(metas, metadata)
+		layers = append(layers, tilesetLayerIDs(metadata))
+		if b, ok := metadata["bounds"].([]float64); ok && len(b) == 4 {
+			if bounds == nil {
+				bounds = append([]float64{}, b...)
+			} else {
+				bounds[0], bounds[1] = math.Min(bounds[0], b[0]), math.Min(bounds[1], b[1])
+				bounds[2], bounds[3] = math.Max(bounds[2], b[2]), math.Max(bounds[3], b[3])
+			}
+		}
+		if z, ok := metadata["minzoom"].(int); ok && (minzoom < 0 || z < minzoom) {
+			minzoom = z
+		}
+		if z, ok := metadata["maxzoom"].(int); ok && z > maxzoom {
+			maxzoom = z
+		}
+		if i == 0 {
+			for _, k := range []string{"center", "attribution"} {
+				if v, ok := metadata[k]; ok {
+					out[k] = v
+				}
+			}
+		}
+	}
+	if bounds != nil {
+		out["bounds"] = bounds
+	}
+	if minzoom >= 0 {
+		out["minzoom"] = minzoom
+	}
+	if maxzoom >= 0 {
+		out["maxzoom"] = maxzoom
+	}
+	if format == PBF {
+		names := tilesetsMergeLayerNames(tids, tss, layers)
+		var vlayers []interface{}
+		for i, metadata := range metas {
+			ls, _ := metadata["vector_layers"].([]interface{})
+			for _, l := range ls {
+				layer, ok := l.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if id, ok := layer["id"].(string); ok {
+					layer["id"] = names[i][id]
+				}
+				vlayers = append(vlayers, layer)
+			}
+		}
+		out["vector_layers"] = vlayers
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+//getMergedTile 获取合并瓦片,矢量瓦片合并图层,栅格瓦片按透明度叠加
+func getMergedTile(c *gin.Context) {
+	res := NewRes()
+	tids, tss, ok := mergeTilesets(c)
+	if !ok {
+		return
+	}
+	placeholder, err := strconv.ParseUint(c.Param("z"), 10, 32)
+	if err != nil || placeholder > 22 {
+		res.Fail(c, 4003)
+		return
+	}
+	z := uint(placeholder)
+	placeholder, err = strconv.ParseUint(c.Param("x"), 10, 32)
+	if err != nil || placeholder >= (1<<z) {
+		res.Fail(c, 4003)
+		return
+	}
+	x := uint(placeholder)
+	ys := strings.Split(c.Param("y"), ".")
+	placeholder, err = strconv.ParseUint(ys[0], 10, 32)
+	if err != nil || placeholder >= (1<<z) {
+		res.Fail(c, 4003)
+		return
+	}
+	// flip y to match the spec
+	y := (1 << z) - 1 - uint(placeholder)
+
+	tiles := make([][]byte, len(tss))
+	for i, ts := range tss {
+		tiles[i], err = ts.Tile(c.Request.Context(), z, x, y)
+		if err != nil {
+			log.Errorf("getMergedTile, cannot fetch %s from DB for z=%d, x=%d, y=%d, details: %v", tids[i], z, x, y, err)
+			res.Fail(c, 5004)
+			return
+		}
+	}
+	if tss[0].Format == PBF {
+		data, err := MergeVectorTiles(tids, tiles, tilesetsMergeLayerNames(tids, tss, nil))
+		if err != nil {
+			log.Errorf("getMergedTile, merge %s error, details: %s", c.Param("ids"), err)
+			res.Fail(c, 5004)
+			return
+		}
+		if data == nil {
+			c.Writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		c.Header("Content-Type", tss[0].Format.ContentType())
+		c.Header("Content-Encoding", "gzip")
+		c.Writer.Write(data)
+		return
+	}
+	data, err := BlendRasterTiles(tiles)
+	if err != nil {
+		log.Errorf("getMergedTile, blend %s error, details: %s", c.Param("ids"), err)
+		res.Fail(c, 5004)
+		return
+	}
+	if data == nil {
+		data = BlankPNG()
+	}
+	c.Render(http.StatusOK, render.Data{
+		ContentType: "image/png",
+		Data:        data,
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+)
+
+//harvestTile 待采集瓦片,xyz行序
+type harvestTile struct {
+	z, x, y uint32
+	data    []byte
+}
+
+//tileHarvester 并发采集瓦片写入MBTiles,已存在的瓦片跳过,中断后重新采集即续传
+type tileHarvester struct {
+	Path        string
+	Name        string
+	Description string
+	Bound       orb.Bound
+	MinZoom     int
+	MaxZoom     int
+	Format      string //png,jpg,pbf,为空时按瓦片内容识别
+	Concurrency int
+	Fetch       func(t harvestTile) ([]byte, error)
+	Count       int
+	Failed      int
+}
+
+//tileRange 层级z覆盖范围的瓦片行列号,xyz行序
+func tileRange(b orb.Bound, z int) (minx, miny, maxx, maxy uint32) {
+	zoom := maptile.Zoom(z)
+	tl := maptile.At(orb.Point{b.Min.X(), b.Max.Y()}, zoom)
+	br := maptile.At(orb.Point{b.Max.X(), b.Min.Y()}, zoom)
+	n := uint32(1)<<uint(z) - 1
+	if br.X > n {
+		br.X = n
+	}
+	if br.Y > n {
+		br.Y = n
+	}
+	return tl.X, tl.Y, br.X, br.Y
+}
+
+//tileCount 范围内的瓦片总数
+func tileCount(b orb.Bound, minzoom, maxzoom int) int {
+	total := 0
+	for z := minzoom; z <= maxzoom; z++ {
+		minx, miny, maxx, maxy := tileRange(b, z)
+		total += int(maxx-minx+1) * int(maxy-miny+1)
+	}
+	return total
+}
+
+//existingTiles 已采集的瓦片,续传时跳过
+func existingTiles(db *sql.DB) (map[[3]uint32]bool, error) {
+	done := make(map[[3]uint32]bool)
+	rows, err := db.Query("select zoom_level, tile_column, tile_row from tiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var z, x, row uint32
+		if err := rows.Scan(&z, &x, &row); err != nil {
+			return nil, err
+		}
+		done[[3]uint32{z, x, (uint32(1) << z) - 1 - row}] = true
+	}
+	return done, rows.Err()
+}
+
+//Run 执行采集,task不为空时更新进度
+func (th *tileHarvester) Run(task *Task) error {
+	var mdb *sql.DB
+	var err error
+	if _, serr := os.Stat(th.Path); serr == nil {
+		mdb, err = sql.Open("sqlite3", th.Path)
+	} else {
+		mdb, err = CreateMBTileTables(th.Path, true)
+	}
+	if err != nil {
+		return err
+	}
+	defer mdb.Close()
+	//MBTiles库为独占锁模式,只使用一个连接
+	mdb.SetMaxOpenConns(1)
+	done, err := existingTiles(mdb)
+	if err != nil {
+		return err
+	}
+	concurrency := th.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	total := tileCount(th.Bound, th.MinZoom, th.MaxZoom)
+
+	jobs := make(chan harvestTile, concurrency*4)
+	results := make(chan harvestTile, concurrency*4)
+	var failed int
+	var lastErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				data, err := th.Fetch(t)
+				if err != nil {
+					log.Warnf("harvest %s, tile %d/%d/%d failed, details: %s", th.Name, t.z, t.x, t.y, err)
+					mu.Lock()
+					failed++
+					lastErr = err
+					mu.Unlock()
+				}
+				t.data = data
+				results <- t
+			}
+		}()
+	}
+	go func() {
+		for z := th.MinZoom; z <= th.MaxZoom; z++ {
+			minx, miny, maxx, maxy := tileRange(th.Bound, z)
+			for x := minx; x <= maxx; x++ {
+				for y := miny; y <= maxy; y++ {
+					t := harvestTile{z: uint32(z), x: x, y: y}
+					if done[[3]uint32{t.z, t.x, t.y}] {
+						results <- t
+						continue
+					}
+					jobs <- t
+				}
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	//单线程分批写入,写入出错后继续消费结果以结束采集协程
+	count := 0
+	var werr error
+	var tx *sql.Tx
+	var stmt *sql.Stmt
+	for t := range results {
+		count++
+		if task != nil {
+			task.Count = count
+			task.Total = total
+			if total > 0 {
+				task.Progress = count * 99 / total
+			}
+		}
+		if len(t.data) == 0 || werr != nil {
+			continue
+		}
+		if th.Format == "pbf" {
+			t.data, err = gzipTile(t.data)
+			if err != nil {
+				werr = err
+				continue
+			}
+		}
+		if tx == nil {
+			tx, werr = mdb.Begin()
+			if werr != nil {
+				continue
+			}
+			stmt, werr = tx.Prepare("insert or replace into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?)")
+			if werr != nil {
+				tx.Rollback()
+				continue
+			}
+		}
+		_, werr = stmt.Exec(t.z, t.x, (uint32(1)<<t.z)-1-t.y, t.data)
+		if werr != nil {
+			stmt.Close()
+			tx.Rollback()
+			continue
+		}
+		if count%500 == 0 {
+			stmt.Close()
+			werr = tx.Commit()
+			tx = nil
+		}
+	}
+	if tx != nil && werr == nil {
+		stmt.Close()
+		werr = tx.Commit()
+	}
+	if werr != nil {
+		return werr
+	}
+	th.Count = count - failed
+	th.Failed = failed
+	err = th.writeMetadata(mdb)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d tiles failed, harvest again to resume, last error: %s", failed, lastErr)
+	}
+	return nil
+}
+
+func (th *tileHarvester) writeMetadata(mdb *sql.DB) error {
+	format := th.Format
+	if format == "" {
+		var data []byte
+		mdb.QueryRow("select tile_data from tiles limit 1").Scan(&data)
+		tf, err := detectTileFormat(data)
+		if err == nil {
+			format = string(tf)
+		}
+	}
+	b := th.Bound
+	center := b.Center()
+	meta := [][2]string{
+		{"name", th.Name},
+		{"format", format},
+		{"type", "overlay"},
+		{"bounds", fmt.Sprintf("%f,%f,%f,%f", b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y())},
+		{"center", fmt.Sprintf("%f,%f,%d", center.X(), center.Y(), th.MinZoom)},
+		{"minzoom", strconv.Itoa(th.MinZoom)},
+		{"maxzoom", strconv.Itoa(th.MaxZoom)},
+		{"description", th.Description},
+	}
+	for _, kv := range meta {
+		_, err := mdb.Exec("insert or replace into metadata (name, value) values (?, ?)", kv[0], kv[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//gzipTile 矢量瓦片按MBTiles约定gzip压缩
+func gzipTile(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("\x1f\x8b")) {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//registerMBTiles 采集完成的MBTiles加载为服务集
+func registerMBTiles(ds *DataSource) error {
+	ts, err := LoadTileset(ds)
+	if err != nil {
+		return err
+	}
+	ts.Owner = ds.Owner
+	err = ts.UpInsert()
+	if err != nil {
+		return err
+	}
+	err = ts.Service()
+	if err != nil {
+		return err
+	}
+	set := userSet.service(ds.Owner)
+	if set == nil {
+		return fmt.Errorf("%s's service set not found", ds.Owner)
+	}
+	set.T.Store(ts.ID, ts)
+	casEnf.AddPolicy(USER, ts.ID, "GET")
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//IconLib 共享图标库,可被多个样式引用
+type IconLib struct {
+	ID         string         `json:"id" gorm:"primary_key"`
+	Name       string         `json:"name" form:"name" gorm:"index"`
+	Summary    string         `json:"summary" form:"summary"`
+	Owner      string         `json:"owner" gorm:"index"`
+	Public     bool           `json:"public" form:"public"`
+	Path       string         `json:"-"`
+	Categories pq.StringArray `json:"categories" form:"categories" gorm:"type:varchar[]"`
+	Tags       pq.StringArray `json:"tags" form:"tags" gorm:"type:varchar[]"`
+	Thumbnail  string         `json:"thumbnail" form:"thumbnail"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+//Icon 图标库中的图标
+type Icon struct {
+	ID        string         `json:"id" gorm:"primary_key"`
+	LibID     string         `json:"lib_id" gorm:"index"`
+	Name      string         `json:"name" gorm:"index"`
+	Category  string         `json:"category" gorm:"index"`
+	Tags      pq.StringArray `json:"tags" gorm:"type:varchar[]"`
+	File      string         `json:"-"`
+	SDF       bool           `json:"sdf"`
+	Width     int            `json:"width"`
+	Height    int            `json:"height"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+//LoadIconLib 从数据库加载图标库
+func LoadIconLib(id string) (*IconLib, error) {
+	lib := &IconLib{}
+	err := db.Where("id = ?", id).First(lib).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, fmt.Errorf("icon library (%s) not found", id)
+		}
+		return nil, err
+	}
+	return lib, nil
+}
+
+//Readable 是否可读,自己的或者公开的
+func (lib *IconLib) Readable(uid string) bool {
+	return lib.Owner == uid || lib.Public
+}
+
+//Writable 是否可修改,仅拥有者
+func (lib *IconLib) Writable(uid string) bool {
+	return lib.Owner == uid
+}
+
+//Icons 图标列表
+func (lib *IconLib) Icons() ([]*Icon, error) {
+	var icons []*Icon
+	err := db.Where("lib_id = ?", lib.ID).Order("category, name").Find(&icons).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	return icons, nil
+}
+
+//Icon 按名称获取图标
+func (lib *IconLib) Icon(name string) (*Icon, error) {
+	icon := &Icon{}
+	err := db.Where("lib_id = ? and name = ?", lib.ID, name).First(icon).Error
+	if err != nil {
+		return nil, err
+	}
+	return icon, nil
+}
+
+//sdfIcons 图标库中标记为sdf的图标
+func (lib *IconLib) sdfIcons() map[string]bool {
+	set := make(map[string]bool)
+	var icons []*Icon
+	err := db.Where("lib_id = ? and sdf = ?", lib.ID, true).Find(&icons).Error
+	if err != nil {
+		return set
+	}
+	for _, icon := range icons {
+		set[icon.Name] = true
+	}
+	return set
+}
+
+//Remove 删除图标库及其图标文件
+func (lib *IconLib) Remove() error {
+	err := db.Where("lib_id = ?", lib.ID).Delete(Icon{}).Error
+	if err != nil {
+		return err
+	}
+	err = db.Where("id = ?", lib.ID).Delete(IconLib{}).Error
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(lib.Path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf(`remove icon library (%s) dir error, details: %s`, lib.ID, err)
+	}
+	return nil
+}
+
+//Refresh 图标库变更后,清理引用该库的样式sprite,下次请求时重新生成
+func (lib *IconLib) Refresh() {
+	var styles []*Style
+	err := db.Where("icon_libs IS NOT NULL").Find(&styles).Error
+	if err != nil {
+		log.Errorf(`refresh icon library (%s), query styles error, details: %s`, lib.ID, err)
+		return
+	}
+	for _, s := range styles {
+		if !s.usesIconLib(lib.ID) {
+			continue
+		}
+		err := s.cleanSprites()
+		if err != nil {
+			log.Warnf(`refresh icon library (%s), clean style (%s) sprites error, details: %s`, lib.ID, s.ID, err)
+		}
+	}
+}
+
+//iconLibPath 图标库存储目录
+func iconLibPath(owner, id string) string {
+	return filepath.Join(viper.GetString("paths.icons"), owner, id)
+}
+
+//usesIconLib 样式是否引用了指定图标库
+func (s *Style) usesIconLib(id string) bool {
+	for _, lid := range s.IconLibs {
+		if lid == id {
+			return true
+		}
+	}
+	return false
+}
+
+//libSymbols 读取样式引用的图标库图标,样式自身的同名图标优先
+func (s *Style) libSymbols(scale float64, exists map[string]bool) ([]*Symbol, map[string]bool) {
+	var symbols []*Symbol
+	sdfs := make(map[string]bool)
+	for _, id := range s.IconLibs {
+		lib, err := LoadIconLib(id)
+		if err != nil {
+			log.Warnf(`style (%s) load icon library (%s) error, details: %s`, s.ID, id, err)
+			continue
+		}
+		if !lib.Readable(s.Owner) {
+			log.Warnf(`style (%s) can not access icon library (%s)`, s.ID, id)
+			continue
+		}
+		libsdfs := lib.sdfIcons()
+		for _, sym := range ReadIcons(lib.Path, scale) {
+			if exists[sym.Name] {
+				continue
+			}
+			exists[sym.Name] = true
+			if libsdfs[sym.Name] {
+				sdfs[sym.Name] = true
+			}
+			symbols = append(symbols, sym)
+		}
+	}
+	return symbols, sdfs
+}
+
+//matchIcon 图标关键字/分类/标签匹配
+func matchIcon(icon *Icon, keyword, category, tag string) bool {
+	if keyword != "" {
+		kw := strings.ToLower(keyword)
+		found := strings.Contains(strings.ToLower(icon.Name), kw)
+		for _, t := range icon.Tags {
+			if found {
+				break
+			}
+			found = strings.Contains(strings.ToLower(t), kw)
+		}
+		if !found {
+			return false
+		}
+	}
+	if category != "" && icon.Category != category {
+		return false
+	}
+	if tag != "" {
+		found := false
+		for _, t := range icon.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
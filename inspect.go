@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	orbmvt "github.com/paulmach/orb/encoding/mvt"
+	log "github.com/sirupsen/logrus"
+)
+
+//TileInspection 瓦片检查结果,Size为未压缩字节数
+type TileInspection struct {
+	Z        uint              `json:"z"`
+	X        uint              `json:"x"`
+	Y        uint              `json:"y"`
+	Format   TileFormat        `json:"format"`
+	Size     int               `json:"size"`
+	GzipSize int               `json:"gzip_size"`
+	Layers   []LayerInspection `json:"layers"`
+}
+
+//LayerInspection 瓦片图层检查结果
+type LayerInspection struct {
+	Name          string         `json:"name"`
+	Version       int            `json:"version"`
+	Extent        uint32         `json:"extent"`
+	Features      int            `json:"features"`
+	Bytes         int            `json:"bytes"`
+	GeometryTypes map[string]int `json:"geometry_types"`
+	Keys          []string       `json:"keys"`
+}
+
+//inspectTile 解析MVT瓦片(可为gzip压缩),统计各图层要素、几何类型、属性及大小
+func inspectTile(data []byte) (*TileInspection, error) {
+	ti := &TileInspection{Format: PBF, Layers: []LayerInspection{}}
+	raw := data
+	if bytes.HasPrefix(data, []byte("\x1f\x8b")) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		raw, err = ioutil.ReadAll(gz)
+		if err != nil {
+			return nil, err
+		}
+		ti.GzipSize = len(data)
+	} else {
+		gz, err := gzipTile(data)
+		if err != nil {
+			return nil, err
+		}
+		ti.GzipSize = len(gz)
+	}
+	ti.Size = len(raw)
+	layers, err := orbmvt.Unmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	sizes := layerSizes(raw)
+	for i, l := range layers {
+		li := LayerInspection{
+			Name:          l.Name,
+			Version:       int(l.Version),
+			Extent:        l.Extent,
+			Features:      len(l.Features),
+			GeometryTypes: make(map[string]int),
+			Keys:          []string{},
+		}
+		if i < len(sizes) {
+			li.Bytes = sizes[i]
+		}
+		keys := make(map[string]bool)
+		for _, f := range l.Features {
+			if f.Geometry != nil {
+				li.GeometryTypes[f.Geometry.GeoJSONType()]++
+			}
+			for k := range f.Properties {
+				keys[k] = true
+			}
+		}
+		for k := range keys {
+			li.Keys = append(li.Keys, k)
+		}
+		sort.Strings(li.Keys)
+		ti.Layers = append(ti.Layers, li)
+	}
+	return ti, nil
+}
+
+//layerSizes 按顺序返回瓦片中各图层(字段3)的编码字节数
+func layerSizes(raw []byte) []int {
+	var sizes []int
+	for i := 0; i < len(raw); {
+		key, n := binary.Uvarint(raw[i:])
+		if n <= 0 {
+			break
+		}
+		start := i
+		i += n
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(raw[i:])
+			if n <= 0 {
+				return sizes
+			}
+			i += n
+		case 1:
+			i += 8
+		case 2:
+			l, n := binary.Uvarint(raw[i:])
+			if n <= 0 {
+				return sizes
+			}
+			i += n + int(l)
+		case 5:
+			i += 4
+		default:
+			return sizes
+		}
+		if key>>3 == 3 && i <= len(raw) {
+			sizes = append(sizes, i-start)
+		}
+	}
+	return sizes
+}
+
+//tileParams 解析瓦片请求的z/x/y参数,y可带扩展名
+func tileParams(c *gin.Context) (z, x, y uint, err error) {
+	pz, err := strconv.ParseUint(c.Param("z"), 10, 32)
+	if err != nil || pz > 22 {
+		return 0, 0, 0, fmt.Errorf("invalid zoom %s", c.Param("z"))
+	}
+	px, err := strconv.ParseUint(c.Param("x"), 10, 32)
+	if err != nil || px >= (1<<pz) {
+		return 0, 0, 0, fmt.Errorf("invalid x %s", c.Param("x"))
+	}
+	py, err := strconv.ParseUint(strings.Split(c.Param("y"), ".")[0], 10, 32)
+	if err != nil || py >= (1<<pz) {
+		return 0, 0, 0, fmt.Errorf("invalid y %s", c.Param("y"))
+	}
+	return uint(pz), uint(px), uint(py), nil
+}
+
+//inspectTilesetTile 检查服务集瓦片,非矢量瓦片只返回格式与大小
+func inspectTilesetTile(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	tid := c.Param("id")
+	ts := userSet.tileset(uid, tid)
+	if ts == nil {
+		log.Warnf("inspectTilesetTile, %s's tilesets (%s) not found ^^", uid, tid)
+		res.Fail(c, 4045)
+		return
+	}
+	z, x, y, err := tileParams(c)
+	if err != nil {
+		res.Fail(c, 4003)
+		return
+	}
+	// flip y to match the spec
+	data, err := ts.Tile(c.Request.Context(), z, x, (1<<z)-1-y)
+	if err != nil {
+		log.Errorf("inspectTilesetTile, cannot fetch %s for z=%d, x=%d, y=%d, details: %v", tid, z, x, y, err)
+		res.Fail(c, 5004)
+		return
+	}
+	ti := &TileInspection{Format: ts.Format, Size: len(data), Layers: []LayerInspection{}}
+	if ts.Format == PBF && len(data) > 0 {
+		ti, err = inspectTile(data)
+		if err != nil {
+			res.FailErr(c, err)
+			return
+		}
+	}
+	ti.Z, ti.X, ti.Y = z, x, y
+	res.DoneData(c, ti)
+}
+
+//inspectDatasetTile 检查数据集图层瓦片
+func inspectDatasetTile(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	did := c.Param("id")
+	dts := userSet.dataset(uid, did)
+	if dts == nil {
+		log.Warnf(`inspectDatasetTile, %s's dataset (%s) not found ^^`, uid, did)
+		res.Fail(c, 4046)
+		return
+	}
+	z, x, y, err := tileParams(c)
+	if err != nil {
+		res.Fail(c, 4003)
+		return
+	}
+	if dts.tlayer == nil {
+		if _, err := dts.NewTileLayer(); err != nil {
+			res.FailErr(c, err)
+			return
+		}
+	}
+	data, _, err := dts.Tile(c.Request.Context(), z, x, y)
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	ti, err := inspectTile(data)
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	ti.Z, ti.X, ti.Y = z, x, y
+	res.DoneData(c, ti)
+}
+
+//inspectTileMapTile 检查瓦片数据集瓦片,debug=true包含调试图层
+func inspectTileMapTile(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	tm, err := userTileMap(uid, id)
+	if err != nil {
+		log.Warnf(`inspectTileMapTile, %s's tilemap (%s) not found ^^, %s`, uid, id, err)
+		res.Fail(c, 4049)
+		return
+	}
+	z, x, y, err := tileParams(c)
+	if err != nil {
+		res.Fail(c, 4003)
+		return
+	}
+	m := *tm
+	if names := c.Query("layers"); names != "" {
+		m = m.FilterLayersByName(strings.Split(names, ",")...)
+	}
+	data, err := m.Tile(c.Request.Context(), uint8(z), x, y, c.Query("debug") == "true")
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	ti, err := inspectTile(data)
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	ti.Z, ti.X, ti.Y = z, x, y
+	res.DoneData(c, ti)
+}
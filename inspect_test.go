@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-spatial/tegola/atlas"
+	"github.com/paulmach/orb"
+	orbmvt "github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestInspectTile(t *testing.T) {
+	roads := geojson.NewFeatureCollection()
+	for i := 0; i < 3; i++ {
+		f := geojson.NewFeature(orb.LineString{{0, 0}, {100, float64(i)}})
+		f.Properties["name"] = "road"
+		f.Properties["lanes"] = float64(i)
+		roads.Append(f)
+	}
+	pois := geojson.NewFeatureCollection()
+	pois.Append(geojson.NewFeature(orb.Point{10, 10}))
+	poly := geojson.NewFeature(orb.Polygon{{{0, 0}, {50, 0}, {50, 50}, {0, 50}, {0, 0}}})
+	poly.Properties["kind"] = "park"
+	pois.Append(poly)
+	raw, err := orbmvt.Marshal(orbmvt.Layers{orbmvt.NewLayer("roads", roads), orbmvt.NewLayer("pois", pois)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzipTile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{raw, gz} {
+		ti, err := inspectTile(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti.Size != len(raw) || ti.GzipSize != len(gz) || len(ti.Layers) != 2 {
+			t.Fatalf("unexpected inspection %+v", ti)
+		}
+		r, p := ti.Layers[0], ti.Layers[1]
+		if r.Name != "roads" || r.Features != 3 || r.GeometryTypes["LineString"] != 3 || len(r.Keys) != 2 || r.Keys[0] != "lanes" {
+			t.Errorf("unexpected roads layer %+v", r)
+		}
+		if p.Name != "pois" || p.Features != 2 || p.GeometryTypes["Point"] != 1 || p.GeometryTypes["Polygon"] != 1 || len(p.Keys) != 1 {
+			t.Errorf("unexpected pois layer %+v", p)
+		}
+		if r.Bytes == 0 || p.Bytes == 0 || r.Bytes+p.Bytes != ti.Size {
+			t.Errorf("layer sizes %d+%d should add up to %d", r.Bytes, p.Bytes, ti.Size)
+		}
+	}
+}
+
+func TestTileMapDebugLayers(t *testing.T) {
+	tm := TileMap{ID: "tm", Layers: []TileLayer{{Name: "roads", ProviderLayerID: "roads"}}}
+	m := atlas.NewWebMercatorMap(tm.ID)
+	m.Layers = []atlas.Layer{{Name: "roads", ProviderLayerID: "roads", Provider: pointTiler{}}}
+	tm.Layers[0].amap = &m
+
+	for debug, want := range map[bool]int{false: 1, true: 3} {
+		data, err := tm.Tile(context.Background(), 3, 4, 3, debug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ti, err := inspectTile(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ti.Layers) != want {
+			t.Errorf("debug=%v: expected %d layers, got %+v", debug, want, ti.Layers)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//TileCachePolicy 图层瓦片缓存策略,TTL单位秒,0使用tilecache.ttl(服务图层为tilecache.providerttl)配置,负数不缓存
+type TileCachePolicy struct {
+	ID        string    `form:"-" json:"id" gorm:"primary_key"`
+	TTL       int       `form:"ttl" json:"ttl"`
+	UpdatedAt time.Time `form:"-" json:"updated_at"`
+}
+
+//LayerCacheStats 图层缓存统计,命中数从服务启动开始计
+type LayerCacheStats struct {
+	ID     string `json:"id"`
+	TTL    int    `json:"ttl"`
+	Hits   int64  `json:"hits"`
+	Misses int64  `json:"misses"`
+	TileCacheStats
+}
+
+//layerCache 图层瓦片缓存
+type layerCache struct {
+	id     string
+	cache  TileCache
+	hits   int64
+	misses int64
+}
+
+//layerCaches 动态图层瓦片缓存,按图层缓存ID
+var layerCaches sync.Map
+
+//layerPolicies 图层缓存策略,按图层缓存ID
+var layerPolicies sync.Map
+
+//layerCacheIDReg 图层缓存ID,数据集为ds_数据集ID,服务图层为prd_图层ID
+var layerCacheIDReg = regexp.MustCompile(`^(ds|prd)_[\w-]+$`)
+
+//dsCacheID 数据集图层缓存ID
+func dsCacheID(did string) string {
+	return "ds_" + did
+}
+
+//prdCacheID 服务图层缓存ID
+func prdCacheID(id string) string {
+	return "prd_" + id
+}
+
+//layerCachePath 图层缓存路径,mbtiles后端另加扩展名
+func layerCachePath(id string) string {
+	return filepath.Join(viper.GetString("tilecache.path"), id)
+}
+
+//layerCacheExists 图层缓存是否已创建
+func layerCacheExists(id string) bool {
+	if _, ok := layerCaches.Load(id); ok {
+		return true
+	}
+	path := layerCachePath(id)
+	if viper.GetString("tilecache.backend") == "mbtiles" {
+		path += MBTILESEXT
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+//openLayerCache 图层缓存,首次使用时按tilecache配置创建
+func openLayerCache(id string) (*layerCache, error) {
+	if v, ok := layerCaches.Load(id); ok {
+		return v.(*layerCache), nil
+	}
+	if !layerCacheIDReg.MatchString(id) {
+		return nil, fmt.Errorf("invalid layer cache id %s", id)
+	}
+	cache, err := NewTileCache(viper.GetString("tilecache.backend"), layerCachePath(id))
+	if err != nil {
+		return nil, err
+	}
+	v, loaded := layerCaches.LoadOrStore(id, &layerCache{id: id, cache: cache})
+	if loaded {
+		cache.Close()
+	}
+	return v.(*layerCache), nil
+}
+
+//layerCachePolicy 图层设置的缓存有效期,单位秒
+func layerCachePolicy(id string) int {
+	if v, ok := layerPolicies.Load(id); ok {
+		return v.(int)
+	}
+	policy := &TileCachePolicy{}
+	err := db.Where("id = ?", id).First(policy).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		log.Warnf("load tile cache policy (%s) error, details: %s", id, err)
+	}
+	layerPolicies.Store(id, policy.TTL)
+	return policy.TTL
+}
+
+//layerCacheTTL 图层缓存有效期,0为永不过期,负数为不缓存,
+//服务图层的数据可能在Atlas之外修改,无法按编辑失效,默认使用tilecache.providerttl
+func layerCacheTTL(id string) time.Duration {
+	ttl := layerCachePolicy(id)
+	if ttl == 0 {
+		if strings.HasPrefix(id, "prd_") {
+			return viper.GetDuration("tilecache.providerttl")
+		}
+		return viper.GetDuration("tilecache.ttl")
+	}
+	if ttl < 0 {
+		return -1
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+//setLayerCacheTTL 设置图层缓存有效期,单位秒
+func setLayerCacheTTL(id string, ttl int) error {
+	err := db.Save(&TileCachePolicy{ID: id, TTL: ttl}).Error
+	if err != nil {
+		return err
+	}
+	layerPolicies.Store(id, ttl)
+	return nil
+}
+
+//tileETag 瓦片内容哈希,用作ETag
+func tileETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+//layerTile 获取图层瓦片,缓存未过期时使用缓存,否则调用encode生成并写入缓存,
+//返回缓存状态HIT,MISS,BYPASS
+func layerTile(id string, z, x, y uint32, encode func() ([]byte, error)) ([]byte, string, error) {
+	ttl := layerCacheTTL(id)
+	if !viper.GetBool("tilecache.enable") || ttl < 0 {
+		data, err := encode()
+		return data, "BYPASS", err
+	}
+	lc, err := openLayerCache(id)
+	if err != nil {
+		log.Warnf("open layer cache (%s) error, details: %s", id, err)
+		data, err := encode()
+		return data, "BYPASS", err
+	}
+	data, updated, ok := lc.cache.Get(z, x, y)
+	if ok && (ttl == 0 || time.Since(updated) < ttl) {
+		atomic.AddInt64(&lc.hits, 1)
+		return data, "HIT", nil
+	}
+	atomic.AddInt64(&lc.misses, 1)
+	data, err = encode()
+	if err != nil {
+		return nil, "MISS", err
+	}
+	//空瓦片同样缓存,避免无数据区域反复查询
+	err = lc.cache.Put(z, x, y, data)
+	if err != nil {
+		log.Warnf("cache layer (%s) tile %d/%d/%d error, details: %s", id, z, x, y, err)
+	}
+	return data, "MISS", nil
+}
+
+//purgeLayerCache 删除图层缓存瓦片,zoom小于0为所有级别,b为nil时不限范围,
+//按范围删除时外扩一个瓦片,覆盖瓦片缓冲区内的要素
+func purgeLayerCache(id string, zoom int, b *orb.Bound) (int, error) {
+	if !layerCacheExists(id) {
+		return 0, nil
+	}
+	lc, err := openLayerCache(id)
+	if err != nil {
+		return 0, err
+	}
+	if zoom < 0 && b == nil {
+		dropClusterIndex(id)
+		stats, err := lc.cache.Stats()
+		if err != nil {
+			return 0, err
+		}
+		return stats.Tiles, lc.cache.Clear()
+	}
+	minz, maxz := 0, viper.GetInt("tilecache.maxzoom")
+	if zoom >= 0 {
+		minz, maxz = zoom, zoom
+	}
+	total := 0
+	for z := minz; z <= maxz; z++ {
+		n := uint32(1)<<uint(z) - 1
+		minx, miny, maxx, maxy := uint32(0), uint32(0), n, n
+		if b != nil {
+			minx, miny, maxx, maxy = tileRange(*b, z)
+			if minx > 0 {
+				minx--
+			}
+			if miny > 0 {
+				miny--
+			}
+			if maxx < n {
+				maxx++
+			}
+			if maxy < n {
+				maxy++
+			}
+		}
+		cnt, err := lc.cache.DeleteRange(uint32(z), minx, miny, maxx, maxy)
+		total += cnt
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+//invalidateLayerCache 要素编辑或重新导入后按范围删除缓存,失败只记录日志
+func invalidateLayerCache(id string, bounds ...orb.Bound) {
+	dropClusterIndex(id)
+	for _, b := range bounds {
+		_, err := purgeLayerCache(id, -1, &b)
+		if err != nil {
+			log.Warnf("invalidate layer cache (%s) error, details: %s", id, err)
+		}
+	}
+}
+
+//removeLayerCache 删除图层缓存及策略,图层删除时调用
+func removeLayerCache(id string) {
+	dropClusterIndex(id)
+	if v, ok := layerCaches.Load(id); ok {
+		layerCaches.Delete(id)
+		v.(*layerCache).cache.Close()
+	}
+	path := layerCachePath(id)
+	os.RemoveAll(path)
+	os.Remove(path + MBTILESEXT)
+	os.Remove(path + MBTILESEXT + "-wal")
+	os.Remove(path + MBTILESEXT + "-shm")
+	db.Where("id = ?", id).Delete(TileCachePolicy{})
+	layerPolicies.Delete(id)
+}
+
+//layerCacheStats 图层缓存统计
+func layerCacheStats(id string) (*LayerCacheStats, error) {
+	stats := &LayerCacheStats{ID: id, TTL: layerCachePolicy(id)}
+	stats.Zooms = make(map[uint32]int)
+	if !layerCacheExists(id) {
+		return stats, nil
+	}
+	lc, err := openLayerCache(id)
+	if err != nil {
+		return nil, err
+	}
+	stats.TileCacheStats, err = lc.cache.Stats()
+	if err != nil {
+		return nil, err
+	}
+	stats.Hits = atomic.LoadInt64(&lc.hits)
+	stats.Misses = atomic.LoadInt64(&lc.misses)
+	return stats, nil
+}
+
+//listLayerCacheIDs 已创建的图层缓存
+func listLayerCacheIDs() ([]string, error) {
+	files, err := ioutil.ReadDir(viper.GetString("tilecache.path"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), MBTILESEXT)
+		if layerCacheIDReg.MatchString(id) && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/spf13/viper"
+)
+
+func TestLayerCacheTTL(t *testing.T) {
+	viper.Set("tilecache.ttl", "0s")
+	viper.Set("tilecache.providerttl", "10m")
+	defer func() {
+		viper.Set("tilecache.ttl", nil)
+		viper.Set("tilecache.providerttl", nil)
+	}()
+	for id, ttl := range map[string]time.Duration{dsCacheID("a"): 0, prdCacheID("a"): 10 * time.Minute} {
+		layerPolicies.Store(id, 0)
+		if got := layerCacheTTL(id); got != ttl {
+			t.Errorf("%s: default ttl should be %s, got %s", id, ttl, got)
+		}
+		layerPolicies.Store(id, 60)
+		if got := layerCacheTTL(id); got != time.Minute {
+			t.Errorf("%s: layer ttl should override default, got %s", id, got)
+		}
+		layerPolicies.Delete(id)
+	}
+}
+
+func TestLayerTileCache(t *testing.T) {
+	viper.Set("tilecache.enable", true)
+	viper.Set("tilecache.path", t.TempDir())
+	viper.Set("tilecache.ttl", "0s")
+	viper.Set("tilecache.maxzoom", 10)
+	defer func() {
+		viper.Set("tilecache.enable", nil)
+		viper.Set("tilecache.path", nil)
+		viper.Set("tilecache.ttl", nil)
+		viper.Set("tilecache.maxzoom", nil)
+		viper.Set("tilecache.backend", nil)
+	}()
+
+	//苏州附近的点与远处的瓦片
+	pt := orb.Point{120.62, 31.32}
+	near := maptile.At(pt, 10)
+	far := maptile.At(orb.Point{-70, -30}, 10)
+
+	for _, backend := range []string{"file", "mbtiles"} {
+		viper.Set("tilecache.backend", backend)
+		id := dsCacheID("test_" + backend)
+		layerPolicies.Store(id, 0)
+		encoded := 0
+		encode := func() ([]byte, error) {
+			encoded++
+			return []byte{byte(encoded)}, nil
+		}
+
+		for _, tile := range []maptile.Tile{near, far} {
+			if _, status, _ := layerTile(id, uint32(tile.Z), tile.X, tile.Y, encode); status != "MISS" {
+				t.Fatalf("%s: first request should miss, got %s", backend, status)
+			}
+		}
+		data, status, _ := layerTile(id, uint32(near.Z), near.X, near.Y, encode)
+		if status != "HIT" || encoded != 2 || data[0] != 1 {
+			t.Fatalf("%s: expected cached tile, got %v %s after %d encodes", backend, data, status, encoded)
+		}
+		if tileETag(data) == tileETag([]byte{2}) {
+			t.Errorf("%s: etag should follow tile content", backend)
+		}
+
+		stats, err := layerCacheStats(id)
+		if err != nil || stats.Tiles != 2 || stats.Hits != 1 || stats.Misses != 2 || stats.Zooms[10] != 2 {
+			t.Errorf("%s: unexpected stats %+v %v", backend, stats, err)
+		}
+
+		//编辑要素后只失效所在范围
+		invalidateLayerCache(id, pt.Bound())
+		if _, status, _ := layerTile(id, uint32(near.Z), near.X, near.Y, encode); status != "MISS" {
+			t.Errorf("%s: edited tile should be invalidated, got %s", backend, status)
+		}
+		if _, status, _ := layerTile(id, uint32(far.Z), far.X, far.Y, encode); status != "HIT" {
+			t.Errorf("%s: tile outside edit bbox should stay cached, got %s", backend, status)
+		}
+
+		n, err := purgeLayerCache(id, 9, nil)
+		if err != nil || n != 0 {
+			t.Errorf("%s: purge of empty zoom removed %d tiles, %v", backend, n, err)
+		}
+		n, err = purgeLayerCache(id, 10, nil)
+		if err != nil || n != 2 {
+			t.Errorf("%s: expected zoom purge to remove 2 tiles, got %d %v", backend, n, err)
+		}
+
+		//负数有效期不缓存
+		layerPolicies.Store(id, -1)
+		if _, status, _ := layerTile(id, uint32(near.Z), near.X, near.Y, encode); status != "BYPASS" {
+			t.Errorf("%s: disabled layer should bypass cache, got %s", backend, status)
+		}
+		layerPolicies.Delete(id)
+		if v, ok := layerCaches.Load(id); ok {
+			layerCaches.Delete(id)
+			v.(*layerCache).cache.Close()
+		}
+	}
+
+	ids, err := listLayerCacheIDs()
+	if err != nil || len(ids) != 2 {
+		t.Errorf("expected both layer caches listed, got %v %v", ids, err)
+	}
+}
@@ -163,6 +163,34 @@ func initConf(cfgFile string) {
 	viper.SetDefault("paths.tilesets", "tilesets")
 	viper.SetDefault("paths.datasets", "datasets")
 	viper.SetDefault("paths.uploads", "tmp")
+	viper.SetDefault("paths.icons", "icons")
+	viper.SetDefault("paths.providers", "providers")
+	viper.SetDefault("secrets.keyfile", "secrets/master.key")
+	viper.SetDefault("styles.revisions.max", 50)
+	viper.SetDefault("styles.revisions.maxage", "2160h")
+	viper.SetDefault("geoserver.harvest.concurrency", 4)
+	viper.SetDefault("geoserver.harvest.retry", 3)
+	viper.SetDefault("geoserver.harvest.maxtiles", 1000000)
+	viper.SetDefault("proxy.cache", "cache/proxy")
+	viper.SetDefault("proxy.timeout", "30s")
+	viper.SetDefault("proxy.allowprivate", false)
+	viper.SetDefault("olmaps.offline", false)
+	viper.SetDefault("olmaps.useragent", "Mozilla/5.0 (compatible; atlas)")
+	viper.SetDefault("olmaps.cache.backend", "file")
+	viper.SetDefault("olmaps.cache.path", "cache/olmaps")
+	viper.SetDefault("olmaps.cache.ttl", "720h")
+	viper.SetDefault("olmaps.seed.concurrency", 4)
+	viper.SetDefault("olmaps.seed.maxtiles", 1000000)
+	viper.SetDefault("tilecache.enable", true)
+	viper.SetDefault("tilecache.backend", "file")
+	viper.SetDefault("tilecache.path", "cache/tiles")
+	viper.SetDefault("tilecache.ttl", "0s")
+	viper.SetDefault("tilecache.providerttl", "10m")
+	viper.SetDefault("tilecache.maxzoom", 22)
+	viper.SetDefault("tilesets.publish.maxzoom", 14)
+	viper.SetDefault("tiler.concurrency", 0)
+	viper.SetDefault("tiler.maxtilebytes", 500*1024)
+	viper.SetDefault("tiler.maxtilefeatures", 200000)
 }
 
 //initSysDb 初始化数据库
@@ -203,8 +231,13 @@ func initSysDb() (*gorm.DB, error) {
 	//gorm自动构建管理
 	db.AutoMigrate(&Map{}, &Style{}, &Font{}, &Tileset{}, &Dataset{}, &DataSource{}, &Task{})
 	db.AutoMigrate(&Scene{}, &Olmap{}, &Tileset3d{}, &Terrain3d{}, &Style3d{}, &Symbol3d{}, &Symbol3dGroup{})
-	db.AutoMigrate(&Geoserver{})
-	db.AutoMigrate(&Provider{}, &ProviderLayer{})
+	db.AutoMigrate(&Geoserver{}, &GsPublish{}, &GwcHarvest{})
+	db.AutoMigrate(&Provider{}, &ProviderLayer{}, &TileLayer{}, &TileMap{})
+	db.AutoMigrate(&IconLib{}, &Icon{})
+	db.AutoMigrate(&StyleRevision{})
+	db.AutoMigrate(&Upstream{})
+	db.AutoMigrate(&TileCachePolicy{})
+	db.AutoMigrate(&Secret{})
 	return db, nil
 }
 
@@ -539,6 +572,8 @@ func setupRouter() *gin.Engine {
 		olmaps.GET("/info/:id/", getOnlineMap)
 		olmaps.POST("/info/:id/", updateOnlineMap)
 		olmaps.DELETE("/delete/:ids/", deleteOnlineMap)
+		olmaps.GET("/x/:id/:z/:x/:y", getOnlineMapTile)
+		olmaps.POST("/seed/:id/", seedOnlineMap)
 	}
 
 	ts3d := r.Group("/ts3d")
@@ -613,6 +648,17 @@ func setupRouter() *gin.Engine {
 		gs.GET("/layers/:id/", getGeoserverLayers)
 		gs.GET("/gwc/layers/:id/", getGWCLayers)
 		gs.GET("/gwc/layers/:id/:name/", getGWCLayer)
+		gs.GET("/styles/:id/", listGeoserverStyles)
+	}
+	//gstasks 发布与采集任务,按用户隔离
+	gsTasks := r.Group("/gs")
+	gsTasks.Use(AccessMidHandler())
+	gsTasks.Use(AuthMidHandler(authMid))
+	{
+		gsTasks.GET("/publish/:id/", listGeoserverPublishes)
+		gsTasks.POST("/publish/:id/:did/", publishToGeoserver)
+		gsTasks.GET("/gwc/harvest/:id/", listGwcHarvests)
+		gsTasks.POST("/gwc/harvest/:id/:name/", harvestGWCLayer)
 	}
 
 	//serve3d 其他接口
@@ -631,6 +677,40 @@ func setupRouter() *gin.Engine {
 	{
 		proxy.GET("/*uri", tilesProxy)
 	}
+
+	//proxies 代理上游服务
+	proxies := r.Group("/proxies")
+	proxies.Use(AccessMidHandler())
+	proxies.Use(AuthMidHandler(authMid))
+	{
+		proxies.GET("/", listUpstreams)
+		proxies.POST("/create/", createUpstream)
+		proxies.GET("/info/:id/", getUpstream)
+		proxies.POST("/info/:id/", updateUpstream)
+		proxies.DELETE("/delete/:ids/", deleteUpstream)
+		proxies.GET("/x/:id/*uri", proxyUpstream)
+		proxies.POST("/x/:id/*uri", proxyUpstream)
+	}
+	//tilecache 数据集与服务图层的瓦片缓存管理
+	tilecache := r.Group("/tilecache")
+	tilecache.Use(AuthMidHandler(authMid))
+	tilecache.Use(AdminMidHandler())
+	{
+		tilecache.GET("/", listLayerCaches)
+		tilecache.GET("/info/:id/", getLayerCache)
+		tilecache.POST("/purge/:id/", purgeLayerCacheTiles)
+		tilecache.POST("/ttl/:id/", setLayerCachePolicy)
+	}
+	//secrets 命名密钥与主密钥轮换
+	secrets := r.Group("/secrets")
+	secrets.Use(AuthMidHandler(authMid))
+	secrets.Use(AdminMidHandler())
+	{
+		secrets.GET("/", listSecrets)
+		secrets.POST("/", putSecret)
+		secrets.DELETE("/delete/:names/", deleteSecret)
+		secrets.POST("/rotate/", rotateSecrets)
+	}
 	//drivers 数据库驱动
 	r.GET("/drivers", drivers)
 	drivers := r.Group("/providers")
@@ -641,6 +721,15 @@ func setupRouter() *gin.Engine {
 		drivers.POST("/info/:id/", updateProviderInfo)
 		drivers.DELETE("/delete/:ids/", deleteProvider)
 	}
+	//drivers 驱动连接测试与结构发现,只能访问自己的驱动
+	prdSchema := r.Group("/providers")
+	prdSchema.Use(AccessMidHandler())
+	prdSchema.Use(AuthMidHandler(authMid))
+	{
+		prdSchema.POST("/test/", testProvider)
+		prdSchema.GET("/test/:id/", testProvider)
+		prdSchema.GET("/schema/:id/", getProviderSchema)
+	}
 
 	//vtlayers 注册图层列表
 	vtlayers := r.Group("/vtlayers")
@@ -654,6 +743,13 @@ func setupRouter() *gin.Engine {
 		vtlayers.GET("/x/:id/:z/:x/:y", getPrdLayerTiles)
 		vtlayers.GET("/view/:id/", prdLayerViewer)
 	}
+	//vtlayers 图层向导,需登录且只能使用自己的驱动
+	vtlWizard := r.Group("/vtlayers")
+	vtlWizard.Use(AccessMidHandler())
+	vtlWizard.Use(AuthMidHandler(authMid))
+	{
+		vtlWizard.POST("/prefill/", prefillProviderLayer)
+	}
 
 	//studio
 	studio := r.Group("/studio")
@@ -755,6 +851,8 @@ func setupRouter() *gin.Engine {
 		styles.POST("/save/:id/", saveStyle)
 		styles.POST("/update/:id/", updateStyle)
 		styles.POST("/replace/:id/", replaceStyle)
+		styles.POST("/patch/:id/", patchStyle)
+		styles.POST("/import/sld/", importSLD)
 		styles.GET("/download/:id/", downloadStyle)
 		styles.POST("/delete/:ids/", deleteStyle)
 
@@ -764,6 +862,12 @@ func setupRouter() *gin.Engine {
 		styles.POST("/icon/:id/:name/", updateIcon)
 		styles.POST("/icons/:id/", uploadIcons)
 		styles.POST("/icons/:id/delete/", deleteIcons)
+		styles.POST("/icons/:id/sdf/", convertSDFIcons)
+		styles.POST("/iconlibs/:id/", bindStyleIconLibs)
+		styles.GET("/revisions/:id/", listStyleRevisions)
+		styles.GET("/revision/:id/:rev/", getStyleRevision)
+		styles.GET("/diff/:id/", diffStyleRevisions)
+		styles.POST("/rollback/:id/:rev/", rollbackStyle)
 
 		styles.GET("/view/:id", getViewStyle)
 		styles.GET("/view/:id/", viewStyle) //view map style
@@ -771,6 +875,22 @@ func setupRouter() *gin.Engine {
 		styles.GET("/search/:id/", search)
 		styles.POST("/edit/:id/", updateStyle) //updateStyle
 	}
+	iconlibs := r.Group("/iconlibs")
+	iconlibs.Use(AccessMidHandler())
+	iconlibs.Use(AuthMidHandler(authMid))
+	{
+		// > icon libraries
+		iconlibs.GET("/", listIconLibs)
+		iconlibs.POST("/create/", createIconLib)
+		iconlibs.GET("/info/:id/", getIconLib)
+		iconlibs.POST("/info/:id/", updateIconLib)
+		iconlibs.POST("/delete/:ids/", deleteIconLibs)
+		iconlibs.POST("/icons/:id/", uploadLibIcons)
+		iconlibs.POST("/icons/:id/delete/", deleteLibIcons)
+		iconlibs.GET("/icon/:id/:name/", getLibIcon)
+		iconlibs.POST("/icon/:id/:name/", updateLibIcon)
+		iconlibs.GET("/search/", searchIcons)
+	}
 	fonts := r.Group("/fonts")
 	fonts.Use(AccessMidHandler())
 	fonts.Use(AuthMidHandler(authMid))
@@ -800,7 +920,9 @@ func setupRouter() *gin.Engine {
 		tilesets.POST("/update/:id/", createTilesetLite)
 		tilesets.GET("/download/:id/", downloadTileset)
 		tilesets.POST("/delete/:ids/", deleteTileset)
-		tilesets.POST("/merge/:ids/", getTile)
+		tilesets.GET("/merge/:ids/", getMergedTileJSON) //tilejson
+		tilesets.GET("/merge/:ids/:z/:x/:y", getMergedTile)
+		tilesets.GET("/inspect/:id/:z/:x/:y", inspectTilesetTile)
 
 		tilesets.GET("/view/:id/", viewTile) //view
 	}
@@ -835,10 +957,86 @@ func setupRouter() *gin.Engine {
 		datasets.GET("/x/:id/", getTileLayerJSON)
 		datasets.GET("/x/:id/:z/:x/:y", getLayerTiles)
 		datasets.POST("/x/:id/", createTileLayer)
+		datasets.POST("/rules/:id/", setTileLayerRules)
+		datasets.GET("/stats/:id/", getTileLayerStats)
+		datasets.GET("/inspect/:id/:z/:x/:y", inspectDatasetTile)
 
 		datasets.GET("/publish/:id/:min/:max/", publishToMBTiles)
+		datasets.POST("/publish/:id/", publishToMBTiles)
 
 	}
+	//features OGC API - Features 数据集要素服务
+	features := r.Group(ogcFeaturesPath)
+	features.Use(AccessMidHandler())
+	features.Use(AuthMidHandler(authMid))
+	{
+		features.GET("/", ogcLanding)
+		features.GET("/conformance", ogcConformanceClasses)
+		features.GET("/collections", ogcCollections)
+		features.GET("/collections/:cid", ogcCollectionInfo)
+		features.GET("/collections/:cid/items", ogcItems)
+		features.GET("/collections/:cid/items/:fid", ogcItem)
+	}
+	//ogcTiles OGC API - Tiles 数据集、瓦片集及瓦片数据集的瓦片服务,支持多瓦片矩阵集
+	ogcTiles := r.Group(ogcTilesPath)
+	ogcTiles.Use(AccessMidHandler())
+	ogcTiles.Use(AuthMidHandler(authMid))
+	{
+		ogcTiles.GET("/", ogcTilesLanding)
+		ogcTiles.GET("/conformance", ogcTilesConformanceClasses)
+		ogcTiles.GET("/tileMatrixSets", ogcTileMatrixSets)
+		ogcTiles.GET("/tileMatrixSets/:tms", ogcTileMatrixSet)
+		ogcTiles.GET("/collections", ogcTilesCollections)
+		ogcTiles.GET("/collections/:cid/tiles", ogcTileSetList(ogcDatasetTiles))
+		ogcTiles.GET("/collections/:cid/tiles/:tms", ogcTileSetInfo(ogcDatasetTiles))
+		ogcTiles.GET("/collections/:cid/tiles/:tms/:z/:row/:col", ogcTile(ogcDatasetTiles))
+		ogcTiles.GET("/tilesets/:id/tiles", ogcTileSetList(ogcTilesetTiles))
+		ogcTiles.GET("/tilesets/:id/tiles/:tms", ogcTileSetInfo(ogcTilesetTiles))
+		ogcTiles.GET("/tilesets/:id/tiles/:tms/:z/:row/:col", ogcTile(ogcTilesetTiles))
+		ogcTiles.GET("/tilemaps/:id/tiles", ogcTileSetList(ogcTileMapTiles))
+		ogcTiles.GET("/tilemaps/:id/tiles/:tms", ogcTileSetInfo(ogcTileMapTiles))
+		ogcTiles.GET("/tilemaps/:id/tiles/:tms/:z/:row/:col", ogcTile(ogcTileMapTiles))
+	}
+	//wfs WFS 2.0 数据集要素服务,支持事务编辑
+	wfs := r.Group(wfsPath)
+	wfs.Use(AccessMidHandler())
+	wfs.Use(AuthMidHandler(authMid))
+	{
+		wfs.GET("", serveWFS)
+		wfs.POST("", serveWFS)
+	}
+	//wmts WMTS 1.0 瓦片集服务,支持KVP及RESTful
+	wmts := r.Group(wmtsPath)
+	wmts.Use(AccessMidHandler())
+	wmts.Use(AuthMidHandler(authMid))
+	{
+		wmts.GET("", serveWMTS)
+		wmts.GET("/1.0.0/WMTSCapabilities.xml", getWMTSCapabilities)
+		wmts.GET("/tile/:layer/:style/:set/:z/:row/:col", getWMTSTile)
+	}
+	//tms TMS 1.0.0 瓦片集服务,行号自下而上
+	tms := r.Group(tmsPath)
+	tms.Use(AccessMidHandler())
+	tms.Use(AuthMidHandler(authMid))
+	{
+		tms.GET("/", getTMSService)
+		tms.GET("/:id", getTMSTileMap)
+		tms.GET("/:id/:z/:x/:y", getTMSTile)
+	}
+	tilemaps := r.Group("/tilemaps")
+	tilemaps.Use(AccessMidHandler())
+	tilemaps.Use(AuthMidHandler(authMid))
+	{
+		// > tilemaps 组合多个数据集与驱动图层的矢量瓦片服务
+		tilemaps.GET("/", listTileMaps)
+		tilemaps.POST("/create/", createTileMap)
+		tilemaps.GET("/info/:id/", getTileMapInfo)
+		tilemaps.POST("/info/:id/", updateTileMap)
+		tilemaps.POST("/delete/:ids/", deleteTileMaps)
+		tilemaps.GET("/x/:id/", getTileMapJSON)
+		tilemaps.GET("/x/:id/:z/:x/:y", getTileMap)
+		tilemaps.GET("/inspect/:id/:z/:x/:y", inspectTileMapTile)
+	}
 	tasks := r.Group("/tasks")
 	tasks.Use(AuthMidHandler(authMid))
 	tasks.Use(UserMidHandler())
@@ -846,6 +1044,7 @@ func setupRouter() *gin.Engine {
 		tasks.GET("/", listTasks)
 		tasks.GET("/info/:ids/", taskQuery)
 		tasks.GET("/stream/:id/", taskStreamQuery)
+		tasks.POST("/cancel/:id/", taskCancel)
 	}
 	//utilroute
 	utilroute := r.Group("/util")
@@ -975,12 +1174,25 @@ func main() {
 		cf = "conf.toml"
 	}
 	initConf(cf)
+	if err := initSecrets(); err != nil {
+		log.Fatalf("init master key error, details: %s", err)
+	}
+	//系统库连接参数只能引用环境变量提供的密钥
+	resolveConfigSecrets(false)
 	var err error
 	db, err = initSysDb()
 	if err != nil {
 		log.Fatalf("init sysdb error, details: %s", err)
 	}
 	defer db.Close()
+	if n, err := reencryptCredentials(); err != nil {
+		log.Fatalf("encrypt credentials error, details: %s", err)
+	} else if n > 0 {
+		log.Infof("%d credential(s) encrypted with master key", n)
+	}
+	if err := resolveConfigSecrets(true); err != nil {
+		log.Fatalf("resolve config secrets error, details: %s", err)
+	}
 
 	{
 		initOnlineSources()
@@ -995,6 +1207,9 @@ func main() {
 	{
 		provArr := make([]dict.Dicter, len(conf.Providers))
 		for i := range provArr {
+			if err := resolveDictSecrets(conf.Providers[i]); err != nil {
+				log.Fatalf("resolve provider secrets error, details: %s", err)
+			}
 			provArr[i] = conf.Providers[i]
 		}
 		providers, err = initProviders(provArr)
@@ -1025,6 +1240,7 @@ func main() {
 	}
 
 	initSystemUser()
+	initLegacyProxy()
 	if initf {
 		return
 	}
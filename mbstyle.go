@@ -29,6 +29,8 @@ type Source struct {
 	MaxZoom int `json:"maxzoom,omitempty"`
 	// url to TileJSON resource
 	URL string `json:"url,omitempty"`
+	// The minimum visual size to display tiles for this layer, raster only.
+	TileSize int `json:"tileSize,omitempty"`
 }
 
 //Light light
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/project"
+	log "github.com/sirupsen/logrus"
+)
+
+//OGC API - Features 常量
+const (
+	ogcFeaturesPath = "/ogc/features"
+	//CRS84 经纬度坐标(经度在前),数据集的存储坐标系
+	CRS84 = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+	//CRS4326 EPSG:4326,轴序为纬度在前
+	CRS4326 = "http://www.opengis.net/def/crs/EPSG/0/4326"
+	//CRS3857 EPSG:3857 Web墨卡托
+	CRS3857 = "http://www.opengis.net/def/crs/EPSG/0/3857"
+
+	ogcDefaultLimit = 10
+	ogcMaxLimit     = 10000
+)
+
+//ogcCRSList 要素接口支持的坐标系
+var ogcCRSList = []string{CRS84, CRS4326, CRS3857}
+
+//ogcConformance 要素接口的符合性类
+var ogcConformance = []string{
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+	"http://www.opengis.net/spec/ogcapi-features-2/1.0/conf/crs",
+}
+
+//OGCLink OGC API链接
+type OGCLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+//OGCExtent 集合范围
+type OGCExtent struct {
+	Spatial struct {
+		BBox [][]float64 `json:"bbox"`
+		CRS  string      `json:"crs"`
+	} `json:"spatial"`
+}
+
+//OGCCollection 要素集合描述
+type OGCCollection struct {
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	ItemType   string     `json:"itemType"`
+	Extent     *OGCExtent `json:"extent,omitempty"`
+	CRS        []string   `json:"crs"`
+	StorageCRS string     `json:"storageCrs"`
+	Links      []OGCLink  `json:"links"`
+}
+
+//OGCFeatureCollection 要素查询结果
+type OGCFeatureCollection struct {
+	Type           string             `json:"type"`
+	Features       []*geojson.Feature `json:"features"`
+	Links          []OGCLink          `json:"links,omitempty"`
+	TimeStamp      string             `json:"timeStamp"`
+	NumberMatched  int                `json:"numberMatched"`
+	NumberReturned int                `json:"numberReturned"`
+}
+
+//featureQuery 数据集要素查询条件,bbox为CRS84坐标,where为l.前缀的SQL条件
+type featureQuery struct {
+	bbox   *orb.Bound
+	where  []string
+	args   []interface{}
+	limit  int
+	offset int
+}
+
+//attributeFields 数据集属性字段,不含fid与geom
+func (dt *Dataset) attributeFields() []Field {
+	var out []Field
+	for _, f := range dt.fieldList() {
+		switch f.Name {
+		case "fid", "geom":
+		default:
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+//fieldTypes 数据集属性字段名及类型
+func (dt *Dataset) fieldTypes() map[string]FieldType {
+	types := make(map[string]FieldType)
+	for _, f := range dt.attributeFields() {
+		types[f.Name] = f.Type
+	}
+	return types
+}
+
+//queryFeatures 按条件分页查询数据集要素,返回匹配总数
+func (dt *Dataset) queryFeatures(ctx context.Context, q *featureQuery) (int, []*geojson.Feature, error) {
+	if dbType != Sqlite3 {
+		return 0, nil, fmt.Errorf("unsupported dirver")
+	}
+	table := strings.ToLower(dt.ID)
+	from := fmt.Sprintf(`"%s" l`, table)
+	where := append([]string{"l.geom IS NOT NULL"}, q.where...)
+	args := append([]interface{}{}, q.args...)
+	if q.bbox != nil {
+		from += fmt.Sprintf(` JOIN "rtree_%s_geom" si ON l.fid = si.id`, table)
+		where = append(where, "si.minx <= ? AND si.maxx >= ? AND si.miny <= ? AND si.maxy >= ?")
+		args = append(args, q.bbox.Max.X(), q.bbox.Min.X(), q.bbox.Max.Y(), q.bbox.Min.Y())
+	}
+	cond := strings.Join(where, " AND ")
+	var matched int
+	err := dataDB.DB().QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) FROM %s WHERE %s`, from, cond), args...).Scan(&matched)
+	if err != nil {
+		return 0, nil, err
+	}
+	features := []*geojson.Feature{}
+	if q.limit <= 0 || q.offset >= matched {
+		return matched, features, nil
+	}
+	rows, err := dataDB.DB().QueryContext(ctx, fmt.Sprintf(`SELECT l.* FROM %s WHERE %s ORDER BY l.fid LIMIT ? OFFSET ?`, from, cond), append(args, q.limit, q.offset)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	err = scanGpkgFeatures(rows, func(f *geojson.Feature) error {
+		features = append(features, f)
+		return nil
+	})
+	return matched, features, err
+}
+
+//transformGeometry 将CRS84几何转换到指定坐标系
+func transformGeometry(g orb.Geometry, crs string) orb.Geometry {
+	switch crs {
+	case CRS3857:
+		return project.Geometry(g, project.WGS84.ToMercator)
+	case CRS4326:
+		return project.Geometry(g, func(p orb.Point) orb.Point { return orb.Point{p[1], p[0]} })
+	}
+	return g
+}
+
+//toCRS84Bound 将指定坐标系的范围转换为CRS84
+func toCRS84Bound(b orb.Bound, crs string) orb.Bound {
+	switch crs {
+	case CRS3857:
+		return orb.Bound{Min: project.Mercator.ToWGS84(b.Min), Max: project.Mercator.ToWGS84(b.Max)}
+	case CRS4326:
+		return orb.Bound{Min: orb.Point{b.Min[1], b.Min[0]}, Max: orb.Point{b.Max[1], b.Max[0]}}
+	}
+	return b
+}
+
+//parseOGCCRS 解析crs参数,支持URI及EPSG:xxxx简写
+func parseOGCCRS(s string) (string, error) {
+	if s == "" {
+		return CRS84, nil
+	}
+	switch strings.ToUpper(strings.Trim(s, "[]")) {
+	case "EPSG:4326":
+		return CRS4326, nil
+	case "EPSG:3857":
+		return CRS3857, nil
+	case "OGC:CRS84", "CRS84":
+		return CRS84, nil
+	}
+	for _, crs := range ogcCRSList {
+		if s == crs {
+			return crs, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported crs %s", s)
+}
+
+//parseBBox 解析minx,miny,maxx,maxy或带高程的6个数
+func parseBBox(s string) (orb.Bound, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 && len(parts) != 6 {
+		return orb.Bound{}, fmt.Errorf("bbox should have 4 or 6 numbers")
+	}
+	var v []float64
+	for _, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return orb.Bound{}, fmt.Errorf("invalid bbox %s", s)
+		}
+		v = append(v, f)
+	}
+	if len(v) == 6 {
+		v = []float64{v[0], v[1], v[3], v[4]}
+	}
+	return orb.Bound{Min: orb.Point{v[0], v[1]}, Max: orb.Point{v[2], v[3]}}, nil
+}
+
+//ogcError OGC API异常
+func ogcError(c *gin.Context, status int, code, desc string) {
+	c.JSON(status, gin.H{
+		"code":        code,
+		"description": desc,
+	})
+}
+
+//ogcURL OGC API链接,保留access token等原有查询参数
+func ogcURL(c *gin.Context, path string, query url.Values) string {
+	return serviceURL(c, ogcFeaturesPath+path, query)
+}
+
+//serviceURL 服务链接,保留请求中的token及access_token
+func serviceURL(c *gin.Context, path string, query url.Values) string {
+	u := rootURL(c.Request) + path
+	for _, key := range []string{"token", "access_token"} {
+		if token := c.Query(key); token != "" {
+			if query == nil {
+				query = url.Values{}
+			}
+			query.Set(key, token)
+		}
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+//ogcCollection 数据集的集合描述
+func ogcCollection(c *gin.Context, dt *Dataset) OGCCollection {
+	col := OGCCollection{
+		ID:         dt.ID,
+		Title:      dt.Name,
+		ItemType:   "feature",
+		CRS:        ogcCRSList,
+		StorageCRS: CRS84,
+		Links: []OGCLink{
+			{Href: ogcURL(c, "/collections/"+dt.ID, nil), Rel: "self", Type: "application/json"},
+			{Href: ogcURL(c, "/collections/"+dt.ID+"/items", nil), Rel: "items", Type: "application/geo+json"},
+		},
+	}
+	if !dt.BBox.IsZero() {
+		col.Extent = &OGCExtent{}
+		col.Extent.Spatial.BBox = [][]float64{{dt.BBox.Min.X(), dt.BBox.Min.Y(), dt.BBox.Max.X(), dt.BBox.Max.Y()}}
+		col.Extent.Spatial.CRS = CRS84
+	}
+	return col
+}
+
+//ogcDataset 获取用户有权访问的集合
+func ogcDataset(c *gin.Context) *Dataset {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	did := c.Param("cid")
+	dt := userSet.dataset(uid, did)
+	if dt == nil {
+		log.Warnf(`ogcDataset, %s's dataset (%s) not found ^^`, uid, did)
+		ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("collection %s not found", did))
+	}
+	return dt
+}
+
+//ogcLanding 要素服务入口
+func ogcLanding(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"title":       "atlas features",
+		"description": "OGC API - Features for atlas datasets",
+		"links": []OGCLink{
+			{Href: ogcURL(c, "/", nil), Rel: "self", Type: "application/json"},
+			{Href: ogcURL(c, "/conformance", nil), Rel: "conformance", Type: "application/json"},
+			{Href: ogcURL(c, "/collections", nil), Rel: "data", Type: "application/json"},
+		},
+	})
+}
+
+//ogcConformanceClasses 符合性声明
+func ogcConformanceClasses(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"conformsTo": ogcConformance,
+	})
+}
+
+//ogcCollections 集合列表
+func ogcCollections(c *gin.Context) {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	cols := []OGCCollection{}
+	for _, dt := range userSet.datasets(uid) {
+		cols = append(cols, ogcCollection(c, dt))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links": []OGCLink{
+			{Href: ogcURL(c, "/collections", nil), Rel: "self", Type: "application/json"},
+		},
+		"crs":         ogcCRSList,
+		"collections": cols,
+	})
+}
+
+//ogcCollectionInfo 单个集合
+func ogcCollectionInfo(c *gin.Context) {
+	dt := ogcDataset(c)
+	if dt == nil {
+		return
+	}
+	c.JSON(http.StatusOK, ogcCollection(c, dt))
+}
+
+//ogcItems 查询集合要素,支持bbox/bbox-crs/limit/offset/crs及字段等值过滤
+func ogcItems(c *gin.Context) {
+	dt := ogcDataset(c)
+	if dt == nil {
+		return
+	}
+	crs, err := parseOGCCRS(c.Query("crs"))
+	if err != nil {
+		ogcError(c, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	q := &featureQuery{limit: ogcDefaultLimit}
+	if v := c.Query("limit"); v != "" {
+		q.limit, err = strconv.Atoi(v)
+		if err != nil || q.limit < 1 {
+			ogcError(c, http.StatusBadRequest, "InvalidParameterValue", "limit should be a positive integer")
+			return
+		}
+		if q.limit > ogcMaxLimit {
+			q.limit = ogcMaxLimit
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		q.offset, err = strconv.Atoi(v)
+		if err != nil || q.offset < 0 {
+			ogcError(c, http.StatusBadRequest, "InvalidParameterValue", "offset should be a non-negative integer")
+			return
+		}
+	}
+	if v := c.Query("bbox"); v != "" {
+		b, err := parseBBox(v)
+		if err != nil {
+			ogcError(c, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+			return
+		}
+		bcrs, err := parseOGCCRS(c.Query("bbox-crs"))
+		if err != nil {
+			ogcError(c, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+			return
+		}
+		b = toCRS84Bound(b, bcrs)
+		q.bbox = &b
+	}
+	fields := dt.fieldTypes()
+	for k, vs := range c.Request.URL.Query() {
+		if _, ok := fields[k]; ok {
+			q.where = append(q.where, fmt.Sprintf(`l."%s" = ?`, k))
+			q.args = append(q.args, vs[0])
+		}
+	}
+	matched, features, err := dt.queryFeatures(c.Request.Context(), q)
+	if err != nil {
+		log.Errorf("ogcItems, query %s error, details: %s", dt.ID, err)
+		ogcError(c, http.StatusInternalServerError, "ServerError", err.Error())
+		return
+	}
+	for _, f := range features {
+		f.Geometry = transformGeometry(f.Geometry, crs)
+	}
+	page := func(offset int) string {
+		query := c.Request.URL.Query()
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("limit", strconv.Itoa(q.limit))
+		return ogcURL(c, "/collections/"+dt.ID+"/items", query)
+	}
+	fc := OGCFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: features,
+		Links: []OGCLink{
+			{Href: page(q.offset), Rel: "self", Type: "application/geo+json"},
+			{Href: ogcURL(c, "/collections/"+dt.ID, nil), Rel: "collection", Type: "application/json"},
+		},
+		TimeStamp:      time.Now().UTC().Format(time.RFC3339),
+		NumberMatched:  matched,
+		NumberReturned: len(features),
+	}
+	if q.offset+len(features) < matched {
+		fc.Links = append(fc.Links, OGCLink{Href: page(q.offset + q.limit), Rel: "next", Type: "application/geo+json"})
+	}
+	if q.offset > 0 {
+		prev := q.offset - q.limit
+		if prev < 0 {
+			prev = 0
+		}
+		fc.Links = append(fc.Links, OGCLink{Href: page(prev), Rel: "prev", Type: "application/geo+json"})
+	}
+	c.Header("Content-Crs", "<"+crs+">")
+	c.Render(http.StatusOK, geoJSONRender{fc})
+}
+
+//ogcItem 获取单个要素
+func ogcItem(c *gin.Context) {
+	dt := ogcDataset(c)
+	if dt == nil {
+		return
+	}
+	crs, err := parseOGCCRS(c.Query("crs"))
+	if err != nil {
+		ogcError(c, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	fid, err := strconv.ParseInt(c.Param("fid"), 10, 64)
+	if err != nil {
+		ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("feature %s not found", c.Param("fid")))
+		return
+	}
+	_, features, err := dt.queryFeatures(c.Request.Context(), &featureQuery{where: []string{"l.fid = ?"}, args: []interface{}{fid}, limit: 1})
+	if err != nil {
+		log.Errorf("ogcItem, query %s error, details: %s", dt.ID, err)
+		ogcError(c, http.StatusInternalServerError, "ServerError", err.Error())
+		return
+	}
+	if len(features) == 0 {
+		ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("feature %d not found", fid))
+		return
+	}
+	f := features[0]
+	f.Geometry = transformGeometry(f.Geometry, crs)
+	data, err := json.Marshal(f)
+	if err != nil {
+		ogcError(c, http.StatusInternalServerError, "ServerError", err.Error())
+		return
+	}
+	item := make(map[string]interface{})
+	json.Unmarshal(data, &item)
+	item["links"] = []OGCLink{
+		{Href: ogcURL(c, fmt.Sprintf("/collections/%s/items/%d", dt.ID, fid), nil), Rel: "self", Type: "application/geo+json"},
+		{Href: ogcURL(c, "/collections/"+dt.ID, nil), Rel: "collection", Type: "application/json"},
+	}
+	c.Header("Content-Crs", "<"+crs+">")
+	c.Render(http.StatusOK, geoJSONRender{item})
+}
+
+//geoJSONRender 以application/geo+json返回
+type geoJSONRender struct {
+	data interface{}
+}
+
+func (r geoJSONRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	return json.NewEncoder(w).Encode(r.data)
+}
+
+func (r geoJSONRender) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/geo+json")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
+)
+
+//newTestDataset 创建GeoPackage数据表并加入用户服务集,pois有三个点
+func newTestDataset(t *testing.T, uid string) *Dataset {
+	t.Helper()
+	ddb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB, oldType, oldEnf := dataDB, dbType, casEnf
+	dataDB, dbType = ddb, Sqlite3
+	if casEnf == nil {
+		//无策略,只能访问自有数据集
+		casEnf = casbin.NewEnforcer("auth.conf")
+	}
+	t.Cleanup(func() {
+		ddb.Close()
+		dataDB, dbType, casEnf = oldDB, oldType, oldEnf
+		userSet.Delete(uid)
+	})
+	for _, stmt := range []string{
+		`CREATE TABLE pois (fid INTEGER PRIMARY KEY AUTOINCREMENT, geom BLOB, name TEXT, rank INTEGER)`,
+		`CREATE VIRTUAL TABLE rtree_pois_geom USING rtree(id, minx, maxx, miny, maxy)`,
+	} {
+		if err := ddb.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	pts := []orb.Point{{116.39, 39.91}, {116.40, 39.92}, {121.47, 31.23}}
+	for i, p := range pts {
+		ddb.Exec(`INSERT INTO pois (fid, geom, name, rank) VALUES (?, ?, ?, ?)`, i+1, buildGpkgGeom(p, 4326), fmt.Sprintf("p%d", i+1), i%2)
+		ddb.Exec(`INSERT INTO rtree_pois_geom VALUES (?, ?, ?, ?, ?)`, i+1, p.X(), p.X(), p.Y(), p.Y())
+	}
+	fields, _ := json.Marshal([]Field{{Name: "fid", Type: Int}, {Name: "geom", Type: Geojson}, {Name: "name", Type: String}, {Name: "rank", Type: Int}})
+	dt := &Dataset{ID: "pois", Name: "兴趣点", Owner: uid, Geotype: Point, Fields: fields, Total: len(pts),
+		BBox: orb.Bound{Min: orb.Point{116.39, 31.23}, Max: orb.Point{121.47, 39.92}}}
+	set := &ServiceSet{Owner: uid}
+	set.D.Store(dt.ID, dt)
+	userSet.Store(uid, set)
+	return dt
+}
+
+func TestOGCFeatures(t *testing.T) {
+	newTestDataset(t, ATLAS)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(userKey, ATLAS) })
+	r.GET(ogcFeaturesPath+"/collections", ogcCollections)
+	r.GET(ogcFeaturesPath+"/collections/:cid/items", ogcItems)
+	r.GET(ogcFeaturesPath+"/collections/:cid/items/:fid", ogcItem)
+	get := func(uri string, v interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", ogcFeaturesPath+uri, nil))
+		if v != nil {
+			json.Unmarshal(w.Body.Bytes(), v)
+		}
+		return w
+	}
+
+	var cols struct {
+		Collections []OGCCollection `json:"collections"`
+	}
+	get("/collections", &cols)
+	if len(cols.Collections) != 1 || cols.Collections[0].ID != "pois" || cols.Collections[0].Extent.Spatial.BBox[0][2] != 121.47 {
+		t.Fatalf("unexpected collections %+v", cols)
+	}
+
+	type page struct {
+		Features []struct {
+			ID       float64 `json:"id"`
+			Geometry struct {
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+		Links          []OGCLink `json:"links"`
+		NumberMatched  int       `json:"numberMatched"`
+		NumberReturned int       `json:"numberReturned"`
+	}
+	var p page
+	w := get("/collections/pois/items?limit=2&token=abc", &p)
+	if w.Header().Get("Content-Type") != "application/geo+json" || p.NumberMatched != 3 || p.NumberReturned != 2 {
+		t.Fatalf("unexpected first page %s", w.Body.String())
+	}
+	var next string
+	for _, l := range p.Links {
+		if l.Rel == "next" {
+			next = l.Href
+		}
+	}
+	if !strings.Contains(next, "offset=2") || !strings.Contains(next, "token=abc") {
+		t.Errorf("unexpected next link %s", next)
+	}
+	p = page{}
+	get("/collections/pois/items?bbox=116,39,117,40&rank=1", &p)
+	if p.NumberMatched != 1 || p.Features[0].ID != 2 {
+		t.Errorf("bbox and property filter should match feature 2, got %+v", p)
+	}
+	p = page{}
+	w = get("/collections/pois/items?bbox=39,116,40,117&bbox-crs=EPSG:4326&crs=EPSG:4326", &p)
+	if p.NumberMatched != 2 || p.Features[0].Geometry.Coordinates[0] != 39.91 || w.Header().Get("Content-Crs") != "<"+CRS4326+">" {
+		t.Errorf("EPSG:4326 should use lat/lon axis order, got %s", w.Body.String())
+	}
+	p = page{}
+	get("/collections/pois/items?crs="+CRS3857+"&offset=2", &p)
+	if p.NumberReturned != 1 || p.Features[0].Geometry.Coordinates[0] < 1e7 {
+		t.Errorf("unexpected mercator feature %+v", p)
+	}
+
+	var item struct {
+		ID         float64                `json:"id"`
+		Properties map[string]interface{} `json:"properties"`
+		Links      []OGCLink              `json:"links"`
+	}
+	if w := get("/collections/pois/items/3", &item); w.Code != http.StatusOK || item.ID != 3 || item.Properties["name"] != "p3" || len(item.Links) != 2 {
+		t.Errorf("unexpected item %s", w.Body.String())
+	}
+	if w := get("/collections/pois/items/9", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing item should be 404, got %d", w.Code)
+	}
+	if w := get("/collections/none/items", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing collection should be 404, got %d", w.Code)
+	}
+	if w := get("/collections/pois/items?crs=EPSG:2000", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported crs should be 400, got %d", w.Code)
+	}
+}
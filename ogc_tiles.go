@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/orb"
+	log "github.com/sirupsen/logrus"
+)
+
+//ogcTilesPath OGC API - Tiles 服务路径
+const ogcTilesPath = "/ogc/tiles"
+
+//ogcTilesConformance 瓦片接口的符合性类
+var ogcTilesConformance = []string{
+	"http://www.opengis.net/spec/ogcapi-tiles-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-tiles-1/1.0/conf/tileset",
+	"http://www.opengis.net/spec/ogcapi-tiles-1/1.0/conf/tilesets-list",
+	"http://www.opengis.net/spec/ogcapi-tiles-1/1.0/conf/geodata-tilesets",
+	"http://www.opengis.net/spec/ogcapi-tiles-1/1.0/conf/mvt",
+	"http://www.opengis.net/spec/ogcapi-tiles-1/1.0/conf/png",
+	"http://www.opengis.net/spec/tms/2.0/conf/json-tilematrixset",
+}
+
+//OGCTileMatrixLimits 瓦片矩阵的行列号范围
+type OGCTileMatrixLimits struct {
+	TileMatrix string `json:"tileMatrix"`
+	MinTileRow uint32 `json:"minTileRow"`
+	MaxTileRow uint32 `json:"maxTileRow"`
+	MinTileCol uint32 `json:"minTileCol"`
+	MaxTileCol uint32 `json:"maxTileCol"`
+}
+
+//OGCTileSet 瓦片集描述
+type OGCTileSet struct {
+	Title               string                `json:"title,omitempty"`
+	DataType            string                `json:"dataType"`
+	CRS                 string                `json:"crs"`
+	TileMatrixSetURI    string                `json:"tileMatrixSetURI,omitempty"`
+	TileMatrixSetLimits []OGCTileMatrixLimits `json:"tileMatrixSetLimits,omitempty"`
+	Links               []OGCLink             `json:"links"`
+}
+
+//ogcTileSource 可按瓦片矩阵集输出瓦片的数据集、瓦片集或瓦片数据集
+type ogcTileSource struct {
+	path     string //服务内路径,如/collections/{id}
+	title    string
+	format   TileFormat
+	bound    *orb.Bound
+	minZoom  int
+	maxZoom  int
+	matrices []*TileMatrixSet
+	tile     func(ctx context.Context, ms *TileMatrixSet, z int, x, y uint32) ([]byte, error)
+}
+
+//ogcDatasetTiles 数据集的瓦片源,支持全部瓦片矩阵集
+func ogcDatasetTiles(c *gin.Context) *ogcTileSource {
+	dt := ogcDataset(c)
+	if dt == nil {
+		return nil
+	}
+	if dt.tlayer == nil {
+		if _, err := dt.NewTileLayer(); err != nil {
+			log.Warnf(`ogcDatasetTiles, dataset (%s) has no tile layer, details: %s`, dt.ID, err)
+			ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("collection %s has no tiles", dt.ID))
+			return nil
+		}
+	}
+	src := &ogcTileSource{
+		path:     "/collections/" + dt.ID,
+		title:    dt.Name,
+		format:   PBF,
+		minZoom:  int(dt.tlayer.MinZoom),
+		maxZoom:  int(dt.tlayer.MaxZoom),
+		matrices: tileMatrixSets,
+		tile:     dt.MatrixTile,
+	}
+	if !dt.BBox.IsZero() {
+		b := dt.BBox
+		src.bound = &b
+	}
+	return src
+}
+
+//ogcTilesetTiles 瓦片集的瓦片源,仅支持发布时的瓦片矩阵集
+func ogcTilesetTiles(c *gin.Context) *ogcTileSource {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	ts := userSet.tileset(uid, id)
+	if ts == nil {
+		log.Warnf(`ogcTilesetTiles, %s's tileset (%s) not found ^^`, uid, id)
+		ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("tileset %s not found", id))
+		return nil
+	}
+	m, err := ts.meta()
+	if err != nil {
+		log.Errorf(`ogcTilesetTiles, read tileset (%s) metadata error, details: %s`, id, err)
+		ogcError(c, http.StatusInternalServerError, "ServerError", err.Error())
+		return nil
+	}
+	return &ogcTileSource{
+		path:     "/tilesets/" + ts.ID,
+		title:    ts.Name,
+		format:   ts.Format,
+		bound:    &m.bound,
+		minZoom:  m.minZoom,
+		maxZoom:  m.maxZoom,
+		matrices: []*TileMatrixSet{m.matrix},
+		tile: func(ctx context.Context, ms *TileMatrixSet, z int, x, y uint32) ([]byte, error) {
+			return ts.Tile(ctx, uint(z), uint(x), uint(ms.FlipY(z, y)))
+		},
+	}
+}
+
+//ogcTileMapTiles 瓦片数据集的瓦片源,引用驱动图层时仅支持WebMercatorQuad
+func ogcTileMapTiles(c *gin.Context) *ogcTileSource {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	id := c.Param("id")
+	tm, err := userTileMap(uid, id)
+	if err != nil {
+		log.Warnf(`ogcTileMapTiles, %s's tilemap (%s) not found, details: %s`, uid, id, err)
+		ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("tilemap %s not found", id))
+		return nil
+	}
+	src := &ogcTileSource{
+		path:     "/tilemaps/" + tm.ID,
+		title:    tm.Name,
+		format:   PBF,
+		minZoom:  maxTileZoom,
+		matrices: tileMatrixSets,
+		tile:     tm.MatrixTile,
+	}
+	for _, l := range tm.Layers {
+		if l.source == nil {
+			src.matrices = []*TileMatrixSet{WebMercatorQuad}
+		}
+		if int(l.MinZoom) < src.minZoom {
+			src.minZoom = int(l.MinZoom)
+		}
+		if l.MaxZoom == 0 {
+			src.maxZoom = maxTileZoom
+		} else if int(l.MaxZoom) > src.maxZoom {
+			src.maxZoom = int(l.MaxZoom)
+		}
+	}
+	if tm.Bounds != nil {
+		src.bound = &orb.Bound{Min: orb.Point{tm.Bounds.MinX(), tm.Bounds.MinY()}, Max: orb.Point{tm.Bounds.MaxX(), tm.Bounds.MaxY()}}
+	}
+	return src
+}
+
+//matrix 瓦片源支持的瓦片矩阵集,不支持时返回nil
+func (src *ogcTileSource) matrix(id string) *TileMatrixSet {
+	ms := getTileMatrixSet(id)
+	for _, m := range src.matrices {
+		if m == ms {
+			return ms
+		}
+	}
+	return nil
+}
+
+//zooms 瓦片源在矩阵集中的级别范围
+func (src *ogcTileSource) zooms(ms *TileMatrixSet) (int, int) {
+	min, max := src.minZoom, src.maxZoom
+	if min < ms.MinZoom {
+		min = ms.MinZoom
+	}
+	if max > ms.MaxZoom {
+		max = ms.MaxZoom
+	}
+	return min, max
+}
+
+//dataType 瓦片数据类型
+func (src *ogcTileSource) dataType() string {
+	if src.format == PBF {
+		return "vector"
+	}
+	return "map"
+}
+
+//tileSet 瓦片源在矩阵集中的瓦片集描述
+func (src *ogcTileSource) tileSet(c *gin.Context, ms *TileMatrixSet, limits bool) OGCTileSet {
+	base := src.path + "/tiles/" + ms.ID
+	set := OGCTileSet{
+		Title:            src.title,
+		DataType:         src.dataType(),
+		CRS:              ms.CRS,
+		TileMatrixSetURI: ms.URI,
+		Links: []OGCLink{
+			{Href: serviceURL(c, ogcTilesPath+base, nil), Rel: "self", Type: "application/json"},
+			{Href: serviceURL(c, ogcTilesPath+"/tileMatrixSets/"+ms.ID, nil), Rel: "http://www.opengis.net/def/rel/ogc/1.0/tiling-scheme", Type: "application/json"},
+			{Href: serviceURL(c, ogcTilesPath+base+"/{tileMatrix}/{tileRow}/{tileCol}", nil), Rel: "item", Type: wmtsFormat(src.format)},
+		},
+	}
+	if !limits {
+		return set
+	}
+	min, max := src.zooms(ms)
+	for z := min; z <= max; z++ {
+		l := OGCTileMatrixLimits{TileMatrix: ms.Matrix(z).ID}
+		if src.bound != nil {
+			l.MinTileCol, l.MinTileRow, l.MaxTileCol, l.MaxTileRow = ms.TileRange(*src.bound, z)
+		} else {
+			w, h := ms.Size(z)
+			l.MaxTileCol, l.MaxTileRow = w-1, h-1
+		}
+		set.TileMatrixSetLimits = append(set.TileMatrixSetLimits, l)
+	}
+	return set
+}
+
+//ogcTileSetList 瓦片源在各矩阵集中的瓦片集列表
+func ogcTileSetList(resolve func(c *gin.Context) *ogcTileSource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		src := resolve(c)
+		if src == nil {
+			return
+		}
+		sets := []OGCTileSet{}
+		for _, ms := range src.matrices {
+			sets = append(sets, src.tileSet(c, ms, false))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"links": []OGCLink{
+				{Href: serviceURL(c, ogcTilesPath+src.path+"/tiles", nil), Rel: "self", Type: "application/json"},
+			},
+			"tilesets": sets,
+		})
+	}
+}
+
+//ogcTileSetInfo 瓦片源在指定矩阵集中的瓦片集描述及行列号范围
+func ogcTileSetInfo(resolve func(c *gin.Context) *ogcTileSource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		src := resolve(c)
+		if src == nil {
+			return
+		}
+		ms := src.matrix(c.Param("tms"))
+		if ms == nil {
+			ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("tile matrix set %s not supported", c.Param("tms")))
+			return
+		}
+		c.JSON(http.StatusOK, src.tileSet(c, ms, true))
+	}
+}
+
+//ogcTile 瓦片源在指定矩阵集中的瓦片,行号自上而下,无数据时返回204
+func ogcTile(resolve func(c *gin.Context) *ogcTileSource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		src := resolve(c)
+		if src == nil {
+			return
+		}
+		ms := src.matrix(c.Param("tms"))
+		if ms == nil {
+			ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("tile matrix set %s not supported", c.Param("tms")))
+			return
+		}
+		z, x, y, ok := parseTileIndex(ms, c.Param("z"), c.Param("col"), c.Param("row"))
+		if !ok {
+			ogcError(c, http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("tile %s/%s/%s out of range", c.Param("z"), c.Param("row"), c.Param("col")))
+			return
+		}
+		data, err := src.tile(c.Request.Context(), ms, z, x, y)
+		if err != nil {
+			if err != context.Canceled {
+				log.Errorf(`ogcTile, encode %s tile %d/%d/%d of %s error, details: %s`, ms.ID, z, y, x, src.path, err)
+				ogcError(c, http.StatusInternalServerError, "ServerError", err.Error())
+			}
+			return
+		}
+		if len(data) <= 1 {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.Header("Content-Type", wmtsFormat(src.format))
+		if src.format == PBF {
+			c.Header("Content-Encoding", "gzip")
+		}
+		c.Writer.Write(data)
+	}
+}
+
+//ogcTilesLanding 瓦片服务入口
+func ogcTilesLanding(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"title":       "atlas tiles",
+		"description": "OGC API - Tiles for atlas datasets, tilesets and tilemaps",
+		"links": []OGCLink{
+			{Href: serviceURL(c, ogcTilesPath+"/", nil), Rel: "self", Type: "application/json"},
+			{Href: serviceURL(c, ogcTilesPath+"/conformance", nil), Rel: "conformance", Type: "application/json"},
+			{Href: serviceURL(c, ogcTilesPath+"/tileMatrixSets", nil), Rel: "http://www.opengis.net/def/rel/ogc/1.0/tiling-schemes", Type: "application/json"},
+			{Href: serviceURL(c, ogcTilesPath+"/collections", nil), Rel: "data", Type: "application/json"},
+		},
+	})
+}
+
+//ogcTilesConformanceClasses 符合性声明
+func ogcTilesConformanceClasses(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"conformsTo": ogcTilesConformance,
+	})
+}
+
+//ogcTileMatrixSets 瓦片矩阵集列表
+func ogcTileMatrixSets(c *gin.Context) {
+	var sets []gin.H
+	for _, ms := range tileMatrixSets {
+		sets = append(sets, gin.H{
+			"id":    ms.ID,
+			"title": ms.Title,
+			"uri":   ms.URI,
+			"links": []OGCLink{
+				{Href: serviceURL(c, ogcTilesPath+"/tileMatrixSets/"+ms.ID, nil), Rel: "http://www.opengis.net/def/rel/ogc/1.0/tiling-scheme", Type: "application/json"},
+			},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tileMatrixSets": sets,
+	})
+}
+
+//ogcTileMatrixSet 瓦片矩阵集定义,OGC Two Dimensional Tile Matrix Set 2.0
+func ogcTileMatrixSet(c *gin.Context) {
+	ms := getTileMatrixSet(c.Param("tms"))
+	if ms == nil {
+		ogcError(c, http.StatusNotFound, "NotFound", fmt.Sprintf("tile matrix set %s not found", c.Param("tms")))
+		return
+	}
+	axes := []string{"X", "Y"}
+	if ms.Geographic {
+		axes = []string{"Lon", "Lat"}
+		if ms.LatLon {
+			axes = []string{"Lat", "Lon"}
+		}
+	}
+	var matrices []TileMatrix
+	for z := ms.MinZoom; z <= ms.MaxZoom; z++ {
+		matrices = append(matrices, ms.Matrix(z))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":                ms.ID,
+		"title":             ms.Title,
+		"uri":               ms.URI,
+		"crs":               ms.CRS,
+		"wellKnownScaleSet": ms.WellKnown,
+		"orderedAxes":       axes,
+		"tileMatrices":      matrices,
+	})
+}
+
+//ogcTilesCollections 有瓦片的集合列表
+func ogcTilesCollections(c *gin.Context) {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	cols := []OGCCollection{}
+	for _, dt := range userSet.datasets(uid) {
+		col := ogcCollection(c, dt)
+		col.Links = append(col.Links, OGCLink{
+			Href: serviceURL(c, ogcTilesPath+"/collections/"+dt.ID+"/tiles", nil),
+			Rel:  "http://www.opengis.net/def/rel/ogc/1.0/tilesets-vector",
+			Type: "application/json",
+		})
+		cols = append(cols, col)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links": []OGCLink{
+			{Href: serviceURL(c, ogcTilesPath+"/collections", nil), Rel: "self", Type: "application/json"},
+		},
+		"collections": cols,
+	})
+}
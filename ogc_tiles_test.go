@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/orb/encoding/mvt"
+)
+
+func TestOGCTiles(t *testing.T) {
+	dt := newTestDataset(t, ATLAS)
+	src, err := dt.tileSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.tlayer = &TileLayer{ID: dt.ID, Name: dt.ID, MaxZoom: 19, source: src}
+	newTestTileset(t, ATLAS)
+	userSet.service(ATLAS).D.Store(dt.ID, dt)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(userKey, ATLAS) })
+	r.GET(ogcTilesPath+"/tileMatrixSets/:tms", ogcTileMatrixSet)
+	r.GET(ogcTilesPath+"/collections/:cid/tiles", ogcTileSetList(ogcDatasetTiles))
+	r.GET(ogcTilesPath+"/collections/:cid/tiles/:tms", ogcTileSetInfo(ogcDatasetTiles))
+	r.GET(ogcTilesPath+"/collections/:cid/tiles/:tms/:z/:row/:col", ogcTile(ogcDatasetTiles))
+	r.GET(ogcTilesPath+"/tilesets/:id/tiles/:tms", ogcTileSetInfo(ogcTilesetTiles))
+	r.GET(ogcTilesPath+"/tilesets/:id/tiles/:tms/:z/:row/:col", ogcTile(ogcTilesetTiles))
+	get := func(uri string, v interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", ogcTilesPath+uri, nil))
+		if v != nil {
+			json.Unmarshal(w.Body.Bytes(), v)
+		}
+		return w
+	}
+
+	var tms struct {
+		CRS          string       `json:"crs"`
+		OrderedAxes  []string     `json:"orderedAxes"`
+		TileMatrices []TileMatrix `json:"tileMatrices"`
+	}
+	get("/tileMatrixSets/EPSG:4490", &tms)
+	if tms.CRS != CRS4490 || tms.OrderedAxes[0] != "Lat" || len(tms.TileMatrices) != 21 || tms.TileMatrices[0].ID != "1" {
+		t.Errorf("unexpected tile matrix set %+v", tms)
+	}
+	if w := get("/tileMatrixSets/none", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown tile matrix set should be 404, got %d", w.Code)
+	}
+
+	var list struct {
+		TileSets []OGCTileSet `json:"tilesets"`
+	}
+	get("/collections/pois/tiles", &list)
+	if len(list.TileSets) != len(tileMatrixSets) {
+		t.Errorf("dataset should be tiled in all tile matrix sets, got %d", len(list.TileSets))
+	}
+	var set OGCTileSet
+	get("/collections/pois/tiles/WorldCRS84Quad?access_token=abc", &set)
+	if set.DataType != "vector" || set.CRS != CRS84 || len(set.TileMatrixSetLimits) != 20 ||
+		set.TileMatrixSetLimits[3] != (OGCTileMatrixLimits{TileMatrix: "3", MinTileRow: 2, MaxTileRow: 2, MinTileCol: 13, MaxTileCol: 13}) ||
+		!strings.HasSuffix(set.Links[2].Href, "/ogc/tiles/collections/pois/tiles/WorldCRS84Quad/{tileMatrix}/{tileRow}/{tileCol}?access_token=abc") {
+		t.Errorf("unexpected tileset %+v", set)
+	}
+	//3级每瓦片22.5度,北京和上海均位于第13列第2行
+	w := get("/collections/pois/tiles/WorldCRS84Quad/3/2/13", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/vnd.mapbox-vector-tile" {
+		t.Fatalf("unexpected dataset tile %d", w.Code)
+	}
+	layers, err := mvt.UnmarshalGzipped(w.Body.Bytes())
+	if err != nil || len(layers) != 1 || len(layers[0].Features) != 3 {
+		t.Errorf("tile should contain three features, %v", err)
+	}
+	if w := get("/collections/pois/tiles/WorldCRS84Quad/3/0/0", nil); w.Code != http.StatusNoContent {
+		t.Errorf("empty tile should be 204, got %d", w.Code)
+	}
+	if w := get("/collections/pois/tiles/WorldCRS84Quad/3/8/0", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("out of range tile should be 400, got %d", w.Code)
+	}
+
+	//服务图层级别按WebMercator级别过滤,WorldCRS84Quad 3级对应4级
+	tm := TileMap{Layers: []TileLayer{{ID: dt.ID, Name: dt.ID, MinZoom: 4, MaxZoom: 4, source: src}}}
+	if data, err := tm.MatrixTile(context.Background(), WorldCRS84Quad, 3, 13, 2); err != nil || len(data) == 0 {
+		t.Errorf("level 3 should render the zoom 4 layer, %v", err)
+	}
+	if data, err := tm.MatrixTile(context.Background(), WorldCRS84Quad, 4, 26, 5); err != nil || len(data) != 0 {
+		t.Errorf("level 4 should skip the zoom 4 layer, %v", err)
+	}
+
+	//瓦片集仅支持其发布时的矩阵集
+	get("/tilesets/base/tiles/WebMercatorQuad", &set)
+	if len(set.TileMatrixSetLimits) != 2 || set.TileMatrixSetLimits[0].MinTileCol != 1 || set.DataType != "map" {
+		t.Errorf("unexpected tileset %+v", set)
+	}
+	if w := get("/tilesets/base/tiles/WorldCRS84Quad", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unsupported tile matrix set should be 404, got %d", w.Code)
+	}
+	tile := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x01}
+	if w := get("/tilesets/base/tiles/WebMercatorQuad/1/0/1", nil); !bytes.Equal(w.Body.Bytes(), tile) || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("unexpected tileset tile %v", w.Body.Bytes())
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//olmapCaches 在线底图瓦片缓存,按底图ID
+var olmapCaches sync.Map
+
+//olmapClient 回源请求
+var olmapClient = &http.Client{Timeout: 15 * time.Second}
+
+//Cache 底图缓存,首次使用时按olmaps.cache配置创建
+func (o *Olmap) Cache() (TileCache, error) {
+	if v, ok := olmapCaches.Load(o.ID); ok {
+		return v.(TileCache), nil
+	}
+	cache, err := NewTileCache(viper.GetString("olmaps.cache.backend"), filepath.Join(viper.GetString("olmaps.cache.path"), o.ID))
+	if err != nil {
+		return nil, err
+	}
+	v, loaded := olmapCaches.LoadOrStore(o.ID, cache)
+	if loaded {
+		cache.Close()
+	}
+	return v.(TileCache), nil
+}
+
+//closeOlmapCache 关闭底图缓存,底图删除时调用
+func closeOlmapCache(id string) {
+	if v, ok := olmapCaches.Load(id); ok {
+		olmapCaches.Delete(id)
+		v.(TileCache).Close()
+	}
+}
+
+//accessKey 底图访问密钥,未单独配置时使用olmaps.keys下按requireField配置的密钥
+func (o *Olmap) accessKey() string {
+	if o.Key != "" {
+		return o.Key
+	}
+	if o.Require == "" {
+		return ""
+	}
+	return viper.GetString("olmaps.keys." + o.Require)
+}
+
+//TileURL 回源地址,服务端注入requireField密钥,按文本替换,保持其它参数的顺序与编码不变
+func (o *Olmap) TileURL(z, x, y uint32) (string, error) {
+	r := strings.NewReplacer(
+		"{z}", strconv.Itoa(int(z)),
+		"{x}", strconv.Itoa(int(x)),
+		"{y}", strconv.Itoa(int(y)),
+		"{-y}", strconv.Itoa(int((uint32(1)<<z)-1-y)),
+	)
+	turl := r.Replace(o.URL)
+	if _, err := url.Parse(turl); err != nil {
+		return "", err
+	}
+	if o.Require == "" {
+		return turl, nil
+	}
+	base, query := turl, ""
+	if i := strings.IndexByte(turl, '?'); i >= 0 {
+		base, query = turl[:i], turl[i+1:]
+	}
+	key := url.QueryEscape(o.Require)
+	param := key + "=" + url.QueryEscape(o.accessKey())
+	var params []string
+	replaced := false
+	if query != "" {
+		params = strings.Split(query, "&")
+	}
+	//替换模板中已有的同名参数
+	for i, p := range params {
+		if p == key || strings.HasPrefix(p, key+"=") {
+			params[i] = param
+			replaced = true
+		}
+	}
+	if !replaced {
+		params = append(params, param)
+	}
+	return base + "?" + strings.Join(params, "&"), nil
+}
+
+//fetchTile 回源获取瓦片
+func (o *Olmap) fetchTile(z, x, y uint32) ([]byte, error) {
+	turl, err := o.TileURL(z, x, y)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", turl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", viper.GetString("olmaps.useragent"))
+	resp, err := olmapClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		//不在日志中输出带密钥的地址
+		return nil, fmt.Errorf("fetch olmap (%s) tile %d/%d/%d error, status %d", o.ID, z, x, y, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+//Tile 获取底图瓦片,缓存未过期或离线时使用缓存,回源失败时使用过期缓存,
+//返回缓存状态HIT,MISS,STALE
+func (o *Olmap) Tile(z, x, y uint32) ([]byte, string, error) {
+	cache, err := o.Cache()
+	if err != nil {
+		return nil, "", err
+	}
+	data, updated, ok := cache.Get(z, x, y)
+	offline := viper.GetBool("olmaps.offline")
+	ttl := viper.GetDuration("olmaps.cache.ttl")
+	if ok && (offline || ttl <= 0 || time.Since(updated) < ttl) {
+		return data, "HIT", nil
+	}
+	if offline {
+		return nil, "MISS", nil
+	}
+	fresh, err := o.fetchTile(z, x, y)
+	if err != nil {
+		if ok {
+			return data, "STALE", nil
+		}
+		return nil, "MISS", err
+	}
+	err = cache.Put(z, x, y, fresh)
+	if err != nil {
+		log.Warnf("cache olmap (%s) tile %d/%d/%d error, details: %s", o.ID, z, x, y, err)
+	}
+	return fresh, "MISS", nil
+}
@@ -24,19 +24,35 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-//Provider 数据库驱动
+//Provider 数据库驱动,文件驱动(geopackage/shapefile/geojson)使用Path指定文件
 type Provider struct {
-	ID             string `json:"id" toml:"id" gorm:"primaryKey"`
-	Name           string `json:"name" toml:"name" binding:"required"`
-	Type           string `json:"type" toml:"type"`
-	Owner          string `json:"owner" toml:"owner,omitempty" gorm:"index"`
-	Host           string `json:"host" toml:"host" binding:"required"`
-	Port           int    `json:"port" toml:"port" binding:"required"`
-	User           string `json:"user" toml:"user" binding:"required"`
-	Password       string `json:"password" toml:"password" binding:"required"`
-	Database       string `json:"database" toml:"database" binding:"required"`
-	SRID           int    `json:"srid" toml:"srid" binding:"required"  gorm:"column:srid"`
-	MaxConnections int    `json:"maxConnections" toml:"max_connections,omitempty"`
+	ID             string     `json:"id" toml:"id" gorm:"primaryKey"`
+	Name           string     `json:"name" toml:"name" binding:"required"`
+	Type           string     `json:"type" toml:"type"`
+	Owner          string     `json:"owner" toml:"owner,omitempty" gorm:"index"`
+	Host           string     `json:"host" toml:"host"`
+	Port           int        `json:"port" toml:"port"`
+	User           string     `json:"user" toml:"user"`
+	Password       Credential `json:"password" toml:"password"`
+	Database       string     `json:"database" toml:"database"`
+	Path           string     `json:"path" toml:"filepath,omitempty"`
+	SRID           int        `json:"srid" toml:"srid" gorm:"column:srid"`
+	MaxConnections int        `json:"maxConnections" toml:"max_connections,omitempty"`
+}
+
+//Validate 按驱动类型校验连接参数
+func (prd *Provider) Validate() error {
+	if isFileProvider(prd.Type) {
+		if prd.Path == "" {
+			return fmt.Errorf("文件驱动必须指定文件路径")
+		}
+		_, err := providerFilePath(prd.Path)
+		return err
+	}
+	if prd.Host == "" || prd.Port == 0 || prd.User == "" || prd.Password == "" || prd.Database == "" || prd.SRID == 0 {
+		return fmt.Errorf("数据库驱动必须指定host,port,user,password,database,srid")
+	}
+	return nil
 }
 
 func toDicter(v interface{}) (dict.Dicter, error) {
@@ -162,7 +178,9 @@ func RegisterProviderLayer(player *ProviderLayer) error {
 			return err
 		}
 	}
-	if prd.Std != nil {
+	if fp, ok := prd.Std.(*fileProvider); ok {
+		player.Type = fp.typ
+	} else if prd.Std != nil {
 		player.Type = "postgis"
 	} else if prd.Mvt != nil {
 		player.Type = "mvt_postgis"
@@ -264,7 +282,7 @@ func AutoMap4ProviderLayer(plyrID string) error {
 	if err != nil {
 		return err
 	}
-	log.Info(` auto register map(%s) of vtlyr(%s) ^^`, plyrID, player.ID)
+	log.Infof(` auto register map(%s) of vtlyr(%s) ^^`, plyrID, player.ID)
 	return nil
 }
 
@@ -290,6 +308,21 @@ func drivers(c *gin.Context) {
 			"postgis",
 			"postgis",
 			"^v2.4",
+		},
+		{
+			GeoPackageProvider,
+			"file",
+			"v1.2+",
+		},
+		{
+			ShapefileProvider,
+			"file",
+			"",
+		},
+		{
+			GeoJSONProvider,
+			"file",
+			"",
 		}}
 	resp.DoneData(c, drivers)
 }
@@ -356,10 +389,16 @@ func registerProvider(c *gin.Context) {
 		provider.Type = "mvt_postgis"
 	}
 
-	if provider.MaxConnections == 0 {
+	if provider.MaxConnections == 0 && !isFileProvider(provider.Type) {
 		provider.MaxConnections = 100
 	}
 
+	err = provider.Validate()
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+
 	_, err = RegisterProvider(provider)
 	if err != nil {
 		log.Error(err)
@@ -409,10 +448,10 @@ func updateProviderInfo(c *gin.Context) {
 
 	id := c.Param("id")
 	type bind struct {
-		Name           string `json:"name"`
-		User           string `json:"user"`
-		Password       string `json:"password"`
-		MaxConnections int    `json:"maxConnections"`
+		Name           string     `json:"name"`
+		User           string     `json:"user"`
+		Password       Credential `json:"password"`
+		MaxConnections int        `json:"maxConnections"`
 	}
 	prd := &bind{}
 	err := c.Bind(prd)
@@ -421,6 +460,8 @@ func updateProviderInfo(c *gin.Context) {
 		resp.Fail(c, 4001)
 		return
 	}
+	//空密码不更新
+	prd.Password.Unmask("")
 	if prd.MaxConnections < 0 || prd.MaxConnections > 1024 {
 		resp.FailMsg(c, "最大连接数可以按照实际情况设置为(0,1024]之间的任意整数")
 		return
@@ -509,6 +550,24 @@ func createProviderLayer(c *gin.Context) {
 		resp.Fail(c, 4001)
 		return
 	}
+	prd, err := loadProvider(uid, player.ProviderID)
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	tile, err := sampleTile(c)
+	if err != nil {
+		resp.Fail(c, 4003)
+		return
+	}
+	//按表结构补全图层参数,SQL图层用样例瓦片校验
+	ctx, cancel := context.WithTimeout(c.Request.Context(), providerTimeout)
+	defer cancel()
+	err = prd.PrepareLayer(ctx, &player, tile)
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
 	player.ID = ShortID()
 	err = RegisterProviderLayer(&player)
 	if err != nil {
@@ -583,6 +642,11 @@ func updateProviderLayerInfo(c *gin.Context) {
 		resp.Fail(c, 5001)
 		return
 	}
+	//图层SQL变更后缓存全部失效
+	_, err = purgeLayerCache(prdCacheID(id), -1, nil)
+	if err != nil {
+		log.Warnf("purge layer cache (%s) error, details: %s", id, err)
+	}
 
 	resp.DoneData(c, gin.H{
 		"affected": dbres.RowsAffected,
@@ -608,6 +672,9 @@ func deleteProviderLayer(c *gin.Context) {
 		resp.Fail(c, 5001)
 		return
 	}
+	for _, id := range sids {
+		removeLayerCache(prdCacheID(id))
+	}
 	resp.DoneData(c, gin.H{
 		"affected": dbres.RowsAffected,
 	})
@@ -742,7 +809,9 @@ func getPrdLayerTiles(c *gin.Context) {
 	// amap = amap.FilterLayersByZoom(z)
 
 	tile := slippy.NewTile(z, x, y)
-	pbyte, err := amap.Encode(c.Request.Context(), tile)
+	pbyte, status, err := layerTile(prdCacheID(plryid), uint32(z), uint32(x), uint32(y), func() ([]byte, error) {
+		return amap.Encode(c.Request.Context(), tile)
+	})
 	if err != nil {
 		switch err {
 		case context.Canceled:
@@ -755,6 +824,13 @@ func getPrdLayerTiles(c *gin.Context) {
 			return
 		}
 	}
+	etag := tileETag(pbyte)
+	c.Header("ETag", etag)
+	c.Header("X-Cache", status)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
 	// c.Header("Content-Type", mvt.MimeType)
 	c.Header("Content-Encoding", "gzip")
 	c.Header("Content-Type", "application/x-protobuf")
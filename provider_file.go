@@ -0,0 +1,739 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/axgle/mahonia"
+	"github.com/go-spatial/geom"
+	gwkb "github.com/go-spatial/geom/encoding/wkb"
+	"github.com/go-spatial/tegola/dict"
+	aprd "github.com/go-spatial/tegola/provider"
+	shp "github.com/jonas-p/go-shp"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/project"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+//文件驱动类型,直接读取本地文件,不导入数据库
+const (
+	GeoPackageProvider = "geopackage"
+	ShapefileProvider  = "shapefile"
+	GeoJSONProvider    = "geojson"
+)
+
+//fileProviders 已打开的文件驱动,退出时关闭
+var fileProviders sync.Map
+
+func init() {
+	for _, name := range []string{GeoPackageProvider, ShapefileProvider, GeoJSONProvider} {
+		typ := name
+		aprd.Register(typ, func(cfg dict.Dicter) (aprd.Tiler, error) {
+			return newFileProvider(typ, cfg)
+		}, cleanupFileProviders)
+	}
+}
+
+//isFileProvider 是否为文件驱动类型
+func isFileProvider(typ string) bool {
+	switch typ {
+	case GeoPackageProvider, ShapefileProvider, GeoJSONProvider:
+		return true
+	}
+	return false
+}
+
+//providerFilePath 解析文件驱动路径,相对路径基于paths.providers,且不允许超出该目录
+func providerFilePath(p string) (string, error) {
+	base, err := filepath.Abs(viper.GetString("paths.providers"))
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+	p = filepath.Clean(p)
+	rel, err := filepath.Rel(base, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %s is outside of the providers directory", p)
+	}
+	return p, nil
+}
+
+//fileProvider 文件驱动,GeoPackage有rtree时使用磁盘索引,其余加载到内存网格索引
+type fileProvider struct {
+	typ    string
+	path   string
+	srid   uint64
+	db     *sql.DB
+	mem    *memorySource
+	lock   sync.RWMutex
+	layers map[string]*fileLayer
+}
+
+//fileLayer 文件驱动图层
+type fileLayer struct {
+	id       string
+	name     string
+	fields   []string
+	idField  string
+	geomType geom.Geometry
+	srid     uint64
+	src      tileSource
+	bound    orb.Bound
+}
+
+func (l *fileLayer) ID() string              { return l.id }
+func (l *fileLayer) Name() string            { return l.name }
+func (l *fileLayer) GeomType() geom.Geometry { return l.geomType }
+func (l *fileLayer) SRID() uint64            { return l.srid }
+
+//newFileProvider 打开文件驱动,srid支持4326与3857
+func newFileProvider(typ string, cfg dict.Dicter) (*fileProvider, error) {
+	path, err := cfg.String("filepath", nil)
+	if err != nil {
+		return nil, err
+	}
+	path, err = providerFilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	srid := 4326
+	srid, err = cfg.Int("srid", &srid)
+	if err != nil {
+		return nil, err
+	}
+	if srid == 0 {
+		srid = 4326
+	}
+	if srid != 4326 && srid != 3857 {
+		return nil, fmt.Errorf("unsupported srid %d, only 4326 and 3857", srid)
+	}
+	p := &fileProvider{typ: typ, path: path, srid: uint64(srid), layers: make(map[string]*fileLayer)}
+	switch typ {
+	case GeoPackageProvider:
+		p.db, err = sql.Open("sqlite3", "file:"+path+"?mode=ro")
+		if err == nil {
+			err = p.db.Ping()
+		}
+	case ShapefileProvider, GeoJSONProvider:
+		var fc *geojson.FeatureCollection
+		if typ == ShapefileProvider {
+			fc, err = readShapefile(path)
+		} else {
+			fc, err = readGeoJSONFile(path)
+		}
+		if err == nil {
+			p.mem = newMemorySource(toWGS84(fc, p.srid))
+		}
+	default:
+		err = fmt.Errorf("unknown file provider type %s", typ)
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	layers, _ := cfg.MapSlice("layers")
+	for _, l := range layers {
+		if err := p.AddLayer(l); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	fileProviders.Store(p, true)
+	log.Infof("open %s file provider %s", typ, path)
+	return p, nil
+}
+
+//Close 关闭文件驱动
+func (p *fileProvider) Close() error {
+	fileProviders.Delete(p)
+	if p.db != nil {
+		return p.db.Close()
+	}
+	return nil
+}
+
+//cleanupFileProviders 关闭全部文件驱动
+func cleanupFileProviders() {
+	fileProviders.Range(func(k, v interface{}) bool {
+		k.(*fileProvider).Close()
+		return true
+	})
+}
+
+func (p *fileProvider) Layer(id string) (aprd.LayerInfo, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	l, ok := p.layers[id]
+	return l, ok
+}
+
+func (p *fileProvider) Layers() ([]aprd.LayerInfo, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var ls []aprd.LayerInfo
+	for _, l := range p.layers {
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+//AddLayer 添加图层,GeoPackage通过tablename指定要素表,只有一个要素表时可省略
+func (p *fileProvider) AddLayer(cfg dict.Dicter) error {
+	empty := ""
+	name, err := cfg.String("name", &empty)
+	if err != nil {
+		return err
+	}
+	id, err := cfg.String("id", &name)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("layer id or name is required")
+	}
+	l := &fileLayer{id: id, name: name, srid: p.srid}
+	if l.name == "" {
+		l.name = id
+	}
+	if l.idField, err = cfg.String("id_fieldname", &empty); err != nil {
+		return err
+	}
+	fields, err := cfg.String("fields", &empty)
+	if err != nil {
+		return err
+	}
+	for _, f := range strings.Split(fields, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			l.fields = append(l.fields, f)
+		}
+	}
+	if p.db != nil {
+		table, err := cfg.String("tablename", &empty)
+		if err != nil {
+			return err
+		}
+		if err := p.gpkgLayer(l, table); err != nil {
+			return err
+		}
+	} else {
+		l.src = p.mem
+		if len(p.mem.features) > 0 {
+			l.geomType = geomTypeOf(p.mem.features[0].Geometry)
+		}
+	}
+	err = l.src.Bounds(func(b orb.Bound) error {
+		if l.bound.IsZero() {
+			l.bound = b
+		} else {
+			l.bound = l.bound.Union(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.layers[id] = l
+	p.lock.Unlock()
+	return nil
+}
+
+//gpkgLayer 读取GeoPackage要素表信息,有rtree索引时按范围查询,否则加载到内存
+func (p *fileProvider) gpkgLayer(l *fileLayer, table string) error {
+	q := `SELECT table_name, column_name, geometry_type_name FROM gpkg_geometry_columns`
+	args := []interface{}{}
+	if table != "" {
+		q += ` WHERE table_name = ?`
+		args = append(args, table)
+	}
+	rows, err := p.db.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	var tables, cols, types []string
+	for rows.Next() {
+		var t, c, g string
+		if err := rows.Scan(&t, &c, &g); err != nil {
+			rows.Close()
+			return err
+		}
+		tables, cols, types = append(tables, t), append(cols, c), append(types, g)
+	}
+	rows.Close()
+	switch {
+	case len(tables) == 0:
+		return fmt.Errorf("feature table %s not found in %s", table, filepath.Base(p.path))
+	case len(tables) > 1:
+		return fmt.Errorf("tablename is required, %s has tables %s", filepath.Base(p.path), strings.Join(tables, ","))
+	}
+	l.geomType = geomTypeOfName(types[0])
+	src := &gpkgFileSource{db: p.db, table: tables[0], geom: cols[0], mercator: p.srid == 3857}
+	var n int
+	err = p.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, src.rtree()).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		l.src = src
+		return nil
+	}
+	log.Warnf("%s has no rtree index for %s, loading into memory", filepath.Base(p.path), src.table)
+	fc := geojson.NewFeatureCollection()
+	err = src.scan(context.Background(), fmt.Sprintf(`SELECT rowid AS "__fid", * FROM "%s"`, src.table), nil, func(f *geojson.Feature) error {
+		fc.Append(f)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.src = newMemorySource(fc)
+	return nil
+}
+
+func (p *fileProvider) LayerExtent(id string) (geom.Extent, error) {
+	l, ok := p.Layer(id)
+	if !ok {
+		return geom.Extent{-180.0, -85.05112877980659, 180.0, 85.0511287798066}, fmt.Errorf("layer id not exist")
+	}
+	b := l.(*fileLayer).bound
+	return geom.Extent{b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y()}, nil
+}
+
+func (p *fileProvider) LayerMinZoom(id string) int {
+	return 0
+}
+
+func (p *fileProvider) LayerMaxZoom(id string) int {
+	return 16
+}
+
+//TileFeatures 按瓦片缓冲范围读取要素,输出为3857坐标
+func (p *fileProvider) TileFeatures(ctx context.Context, id string, tile aprd.Tile, fn func(f *aprd.Feature) error) error {
+	li, ok := p.Layer(id)
+	if !ok {
+		return fmt.Errorf("layer %s not found", id)
+	}
+	l := li.(*fileLayer)
+	ext, _ := tile.BufferedExtent()
+	b := orb.Bound{
+		Min: project.Mercator.ToWGS84(orb.Point{ext.MinX(), ext.MinY()}),
+		Max: project.Mercator.ToWGS84(orb.Point{ext.MaxX(), ext.MaxY()}),
+	}
+	var seq uint64
+	return l.src.Features(ctx, b, 1, func(f *geojson.Feature) error {
+		seq++
+		data, err := wkb.Marshal(project.Geometry(orb.Clone(f.Geometry), project.WGS84.ToMercator))
+		if err != nil {
+			return err
+		}
+		g, err := gwkb.DecodeBytes(data)
+		if err != nil {
+			return err
+		}
+		tags := make(map[string]interface{})
+		if len(l.fields) == 0 {
+			for k, v := range f.Properties {
+				if v != nil {
+					tags[k] = v
+				}
+			}
+		} else {
+			for _, k := range l.fields {
+				if v, ok := f.Properties[k]; ok && v != nil {
+					tags[k] = v
+				}
+			}
+		}
+		fid := seq
+		var v interface{} = f.ID
+		if l.idField != "" {
+			v = f.Properties[l.idField]
+		}
+		if v != nil {
+			if id, err := aprd.ConvertFeatureID(v); err == nil {
+				fid = id
+			}
+		}
+		return fn(&aprd.Feature{ID: fid, Geometry: g, SRID: 3857, Tags: tags})
+	})
+}
+
+//gpkgFileSource 外部GeoPackage要素表数据源,通过rtree索引按范围查询,输出4326坐标
+type gpkgFileSource struct {
+	db       *sql.DB
+	table    string
+	geom     string
+	mercator bool
+}
+
+func (gs *gpkgFileSource) rtree() string {
+	return fmt.Sprintf("rtree_%s_%s", gs.table, gs.geom)
+}
+
+//query 查询范围转换为数据坐标
+func (gs *gpkgFileSource) query(b orb.Bound) []interface{} {
+	if gs.mercator {
+		b = orb.Bound{Min: project.WGS84.ToMercator(b.Min), Max: project.WGS84.ToMercator(b.Max)}
+	}
+	return []interface{}{b.Max.X(), b.Min.X(), b.Max.Y(), b.Min.Y()}
+}
+
+func (gs *gpkgFileSource) Bounds(fn func(b orb.Bound) error) error {
+	rows, err := gs.db.Query(fmt.Sprintf(`SELECT minx, maxx, miny, maxy FROM "%s"`, gs.rtree()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var minx, maxx, miny, maxy float64
+		if err := rows.Scan(&minx, &maxx, &miny, &maxy); err != nil {
+			return err
+		}
+		b := orb.Bound{Min: orb.Point{minx, miny}, Max: orb.Point{maxx, maxy}}
+		if gs.mercator {
+			b = orb.Bound{Min: project.Mercator.ToWGS84(b.Min), Max: project.Mercator.ToWGS84(b.Max)}
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (gs *gpkgFileSource) Count(b orb.Bound) (int, error) {
+	var n int
+	err := gs.db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM "%s" WHERE minx <= ? AND maxx >= ? AND miny <= ? AND maxy >= ?`, gs.rtree()),
+		gs.query(b)...).Scan(&n)
+	return n, err
+}
+
+func (gs *gpkgFileSource) Features(ctx context.Context, b orb.Bound, skip int, fn func(f *geojson.Feature) error) error {
+	if skip < 1 {
+		skip = 1
+	}
+	qtext := fmt.Sprintf(`SELECT l.rowid AS "__fid", l.* FROM "%s" l JOIN "%s" si ON l.rowid = si.id WHERE si.minx <= ? AND si.maxx >= ? AND si.miny <= ? AND si.maxy >= ? AND si.id %% ? = 0 ORDER BY l.rowid`, gs.table, gs.rtree())
+	return gs.scan(ctx, qtext, append(gs.query(b), skip), fn)
+}
+
+//scan 读取要素,__fid为要素编号,几何列按GeoPackage二进制解析
+func (gs *gpkgFileSource) scan(ctx context.Context, qtext string, args []interface{}, fn func(f *geojson.Feature) error) error {
+	rows, err := gs.db.QueryContext(ctx, qtext, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		for i := range vals {
+			vals[i] = nil
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		f := geojson.NewFeature(nil)
+		for i, col := range cols {
+			switch v := vals[i].(type) {
+			case nil:
+			case []byte:
+				if col != gs.geom {
+					f.Properties[col] = string(v)
+					continue
+				}
+				g, err := gpkgGeometry(v)
+				if err != nil {
+					return err
+				}
+				if gs.mercator {
+					g = project.Geometry(g, project.Mercator.ToWGS84)
+				}
+				f.Geometry = g
+			default:
+				if col == "__fid" {
+					f.ID = v
+				} else if col != gs.geom {
+					f.Properties[col] = v
+				}
+			}
+		}
+		if f.Geometry == nil {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//gpkgGeometry 解析GeoPackage二进制几何,头部长度由envelope标志决定
+func gpkgGeometry(data []byte) (orb.Geometry, error) {
+	if len(data) < 8 || data[0] != 'G' || data[1] != 'P' {
+		return nil, fmt.Errorf("invalid geopackage geometry")
+	}
+	size := 8
+	switch (data[3] >> 1) & 0x07 {
+	case 0:
+	case 1:
+		size += 32
+	case 2, 3:
+		size += 48
+	case 4:
+		size += 64
+	default:
+		return nil, fmt.Errorf("invalid geopackage envelope")
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("invalid geopackage geometry")
+	}
+	return wkb.Unmarshal(data[size:])
+}
+
+//readGeoJSONFile 读取GeoJSON要素集文件
+func readGeoJSONFile(path string) (*geojson.FeatureCollection, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range fc.Features {
+		if f.ID == nil {
+			f.ID = uint64(i + 1)
+		}
+	}
+	return fc, nil
+}
+
+//readShapefile 读取Shapefile,属性按dbf字段类型转换,中文编码自动识别
+func readShapefile(path string) (*geojson.FeatureCollection, error) {
+	shape, err := shp.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer shape.Close()
+	fields := shape.Fields()
+	names := make([]string, len(fields))
+	for i, fd := range fields {
+		names[i] = fd.String()
+		if s, err := simplifiedchinese.GB18030.NewDecoder().String(names[i]); err == nil {
+			names[i] = s
+		}
+	}
+	var dec mahonia.Decoder
+	switch enc := likelyEncoding(strings.TrimSuffix(path, filepath.Ext(path)) + ".dbf"); enc {
+	case "gbk", "big5", "gb18030":
+		dec = mahonia.NewDecoder(enc)
+	}
+	fc := geojson.NewFeatureCollection()
+	for shape.Next() {
+		n, s := shape.Shape()
+		g := shpGeometry(s)
+		if g == nil {
+			continue
+		}
+		f := geojson.NewFeature(g)
+		f.ID = uint64(n + 1)
+		for k, fd := range fields {
+			v := strings.Trim(shape.Attribute(k), " \x00")
+			if v == "" {
+				continue
+			}
+			if dec != nil {
+				v = dec.ConvertString(v)
+			}
+			f.Properties[names[k]] = shpValue(fd, v)
+		}
+		fc.Append(f)
+	}
+	return fc, shape.Err()
+}
+
+//shpValue 按dbf字段类型转换属性值
+func shpValue(fd shp.Field, v string) interface{} {
+	switch fd.Fieldtype {
+	case 'N':
+		if fd.Precision == 0 {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return n
+			}
+		}
+		fallthrough
+	case 'F':
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+	case 'L':
+		switch v {
+		case "T", "t", "Y", "y":
+			return true
+		case "F", "f", "N", "n":
+			return false
+		}
+	}
+	return v
+}
+
+//shpGeometry Shapefile几何转换,Z/M值丢弃
+func shpGeometry(s shp.Shape) orb.Geometry {
+	switch g := s.(type) {
+	case *shp.Point:
+		return orb.Point{g.X, g.Y}
+	case *shp.PointZ:
+		return orb.Point{g.X, g.Y}
+	case *shp.PointM:
+		return orb.Point{g.X, g.Y}
+	case *shp.MultiPoint:
+		return orb.MultiPoint(shpPoints(g.Points))
+	case *shp.MultiPointZ:
+		return orb.MultiPoint(shpPoints(g.Points))
+	case *shp.MultiPointM:
+		return orb.MultiPoint(shpPoints(g.Points))
+	case *shp.PolyLine:
+		return shpLines(g.Parts, g.Points)
+	case *shp.PolyLineZ:
+		return shpLines(g.Parts, g.Points)
+	case *shp.PolyLineM:
+		return shpLines(g.Parts, g.Points)
+	case *shp.Polygon:
+		return shpPolygons(g.Parts, g.Points)
+	case *shp.PolygonZ:
+		return shpPolygons(g.Parts, g.Points)
+	case *shp.PolygonM:
+		return shpPolygons(g.Parts, g.Points)
+	}
+	return nil
+}
+
+func shpPoints(points []shp.Point) []orb.Point {
+	out := make([]orb.Point, len(points))
+	for i, p := range points {
+		out[i] = orb.Point{p.X, p.Y}
+	}
+	return out
+}
+
+//shpParts 按分段索引拆分点集
+func shpParts(parts []int32, points []shp.Point) [][]orb.Point {
+	var out [][]orb.Point
+	for i, start := range parts {
+		end := int32(len(points))
+		if i+1 < len(parts) {
+			end = parts[i+1]
+		}
+		if start < 0 || start >= end || end > int32(len(points)) {
+			continue
+		}
+		out = append(out, shpPoints(points[start:end]))
+	}
+	return out
+}
+
+func shpLines(parts []int32, points []shp.Point) orb.Geometry {
+	var mls orb.MultiLineString
+	for _, part := range shpParts(parts, points) {
+		mls = append(mls, orb.LineString(part))
+	}
+	switch len(mls) {
+	case 0:
+		return nil
+	case 1:
+		return mls[0]
+	}
+	return mls
+}
+
+//shpPolygons 顺时针环为外环,逆时针环为前一外环的洞
+func shpPolygons(parts []int32, points []shp.Point) orb.Geometry {
+	var mp orb.MultiPolygon
+	for _, part := range shpParts(parts, points) {
+		r := orb.Ring(part)
+		if len(mp) == 0 || r.Orientation() == orb.CW {
+			mp = append(mp, orb.Polygon{r})
+			continue
+		}
+		mp[len(mp)-1] = append(mp[len(mp)-1], r)
+	}
+	switch len(mp) {
+	case 0:
+		return nil
+	case 1:
+		return mp[0]
+	}
+	return mp
+}
+
+//toWGS84 3857数据转换为4326
+func toWGS84(fc *geojson.FeatureCollection, srid uint64) *geojson.FeatureCollection {
+	if srid == 3857 {
+		for _, f := range fc.Features {
+			if f.Geometry != nil {
+				f.Geometry = project.Geometry(f.Geometry, project.Mercator.ToWGS84)
+			}
+		}
+	}
+	return fc
+}
+
+//geomTypeOf 图层几何类型
+func geomTypeOf(g orb.Geometry) geom.Geometry {
+	switch g.(type) {
+	case orb.Point:
+		return geom.Point{}
+	case orb.MultiPoint:
+		return geom.MultiPoint{}
+	case orb.LineString:
+		return geom.LineString{}
+	case orb.MultiLineString:
+		return geom.MultiLineString{}
+	case orb.Polygon, orb.Ring:
+		return geom.Polygon{}
+	case orb.MultiPolygon:
+		return geom.MultiPolygon{}
+	}
+	return nil
+}
+
+//geomTypeOfName GeoPackage几何类型名称对应的几何类型
+func geomTypeOfName(name string) geom.Geometry {
+	switch strings.ToUpper(name) {
+	case "POINT":
+		return geom.Point{}
+	case "MULTIPOINT":
+		return geom.MultiPoint{}
+	case "LINESTRING":
+		return geom.LineString{}
+	case "MULTILINESTRING":
+		return geom.MultiLineString{}
+	case "POLYGON":
+		return geom.Polygon{}
+	case "MULTIPOLYGON":
+		return geom.MultiPolygon{}
+	}
+	return nil
+}
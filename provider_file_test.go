@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-spatial/tegola"
+	aprd "github.com/go-spatial/tegola/provider"
+	shp "github.com/jonas-p/go-shp"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/spf13/viper"
+)
+
+//fileTileFeatures 注册文件驱动图层并读取点所在瓦片的要素
+func fileTileFeatures(t *testing.T, prd *Provider, player *ProviderLayer, pt orb.Point) []*aprd.Feature {
+	t.Helper()
+	if err := prd.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := toDicter(prd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tu, err := aprd.For(prd.Type, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tu.Std.(*fileProvider).Close()
+	lcfg, err := toDicter(player)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tu.Std.AddLayer(lcfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tu.Layer(player.ID); !ok {
+		t.Fatalf("layer %s should be registered", player.ID)
+	}
+	ext, err := tu.Std.LayerExtent(player.ID)
+	if err != nil || ext.MinX() > pt.X() || ext.MaxX() < pt.X() {
+		t.Errorf("unexpected layer extent %v %v", ext, err)
+	}
+	mt := maptile.At(pt, 10)
+	var features []*aprd.Feature
+	err = tu.Std.TileFeatures(context.Background(), player.ID, aprd.NewTile(10, uint(mt.X), uint(mt.Y), 64, tegola.WebMercator), func(f *aprd.Feature) error {
+		features = append(features, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return features
+}
+
+//writeTestGpkg 创建带rtree索引的GeoPackage,parks表有两个多边形
+func writeTestGpkg(t *testing.T, path string) {
+	t.Helper()
+	gdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gdb.Close()
+	for _, stmt := range []string{
+		`CREATE TABLE gpkg_contents (table_name TEXT, data_type TEXT, min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER)`,
+		`INSERT INTO gpkg_contents VALUES ('parks', 'features', 10, 10, 113.3, 23.2, 4326)`,
+		`CREATE TABLE gpkg_geometry_columns (table_name TEXT, column_name TEXT, geometry_type_name TEXT, srs_id INTEGER, z TINYINT, m TINYINT)`,
+		`INSERT INTO gpkg_geometry_columns VALUES ('parks', 'shape', 'POLYGON', 4326, 0, 0)`,
+		`CREATE TABLE parks (fid INTEGER PRIMARY KEY, shape BLOB, name TEXT)`,
+		`CREATE VIRTUAL TABLE rtree_parks_shape USING rtree(id, minx, maxx, miny, maxy)`,
+	} {
+		if _, err := gdb.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parks := []orb.Polygon{
+		{{{113.2, 23.1}, {113.3, 23.1}, {113.3, 23.2}, {113.2, 23.2}, {113.2, 23.1}}},
+		{{{10, 10}, {11, 10}, {11, 11}, {10, 11}, {10, 10}}},
+	}
+	for i, p := range parks {
+		b := p.Bound()
+		gdb.Exec(`INSERT INTO parks VALUES (?, ?, ?)`, i+1, buildGpkgGeom(p, 4326), "park")
+		gdb.Exec(`INSERT INTO rtree_parks_shape VALUES (?, ?, ?, ?, ?)`, i+1, b.Min.X(), b.Max.X(), b.Min.Y(), b.Max.Y())
+	}
+}
+
+func TestFileProviders(t *testing.T) {
+	dir := t.TempDir()
+	old := viper.GetString("paths.providers")
+	viper.Set("paths.providers", dir)
+	defer viper.Set("paths.providers", old)
+
+	//GeoJSON,内存索引
+	gj := `{"type":"FeatureCollection","features":[
+		{"type":"Feature","id":7,"geometry":{"type":"Point","coordinates":[116.39,39.91]},"properties":{"name":"a","rank":1}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[-70,-30]},"properties":{"name":"far"}}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "pois.geojson"), []byte(gj), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := fileTileFeatures(t, &Provider{ID: "gj", Name: "gj", Type: GeoJSONProvider, Path: "pois.geojson"},
+		&ProviderLayer{ID: "pois", Name: "pois", Fields: "name"}, orb.Point{116.39, 39.91})
+	if len(fs) != 1 || fs[0].ID != 7 || fs[0].Tags["name"] != "a" || fs[0].Tags["rank"] != nil || fs[0].SRID != tegola.WebMercator {
+		t.Errorf("unexpected geojson features %+v", fs)
+	}
+
+	//Shapefile,内存索引
+	w, err := shp.Create(filepath.Join(dir, "roads.shp"), shp.POINT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetFields([]shp.Field{shp.StringField("name", 20), shp.NumberField("lanes", 4)})
+	w.Write(&shp.Point{X: 121.47, Y: 31.23})
+	w.WriteAttribute(0, 0, "bund")
+	w.WriteAttribute(0, 1, 4)
+	w.Close()
+	//go-shp写入的dbf文件名缺少"."
+	if err := os.Rename(filepath.Join(dir, "roadsdbf"), filepath.Join(dir, "roads.dbf")); err != nil {
+		t.Fatal(err)
+	}
+	fs = fileTileFeatures(t, &Provider{ID: "shp", Name: "shp", Type: ShapefileProvider, Path: "roads.shp"},
+		&ProviderLayer{ID: "roads", Name: "roads", IDField: "lanes"}, orb.Point{121.47, 31.23})
+	if len(fs) != 1 || fs[0].ID != 4 || fs[0].Tags["name"] != "bund" || fs[0].Tags["lanes"] != int64(4) {
+		t.Errorf("unexpected shapefile features %+v", fs)
+	}
+
+	//GeoPackage,rtree磁盘索引
+	writeTestGpkg(t, filepath.Join(dir, "parks.gpkg"))
+	fs = fileTileFeatures(t, &Provider{ID: "gpkg", Name: "gpkg", Type: GeoPackageProvider, Path: "parks.gpkg"},
+		&ProviderLayer{ID: "parks", Name: "parks"}, orb.Point{113.25, 23.15})
+	if len(fs) != 1 || fs[0].ID != 1 || fs[0].Tags["name"] != "park" || fs[0].Tags["shape"] != nil {
+		t.Errorf("unexpected geopackage features %+v", fs)
+	}
+
+	if (&Provider{Type: GeoJSONProvider, Path: "../outside.geojson"}).Validate() == nil {
+		t.Errorf("file outside of the providers directory should be rejected")
+	}
+	if (&Provider{Type: "postgis", Host: "localhost"}).Validate() == nil {
+		t.Errorf("database provider without connection should be rejected")
+	}
+}
+
+func TestShpPolygons(t *testing.T) {
+	//外环顺时针,洞逆时针,第二个外环
+	points := []shp.Point{
+		{X: 0, Y: 0}, {X: 0, Y: 10}, {X: 10, Y: 10}, {X: 10, Y: 0}, {X: 0, Y: 0},
+		{X: 2, Y: 2}, {X: 4, Y: 2}, {X: 4, Y: 4}, {X: 2, Y: 4}, {X: 2, Y: 2},
+		{X: 20, Y: 0}, {X: 20, Y: 5}, {X: 25, Y: 5}, {X: 25, Y: 0}, {X: 20, Y: 0},
+	}
+	mp, ok := shpPolygons([]int32{0, 5, 10}, points).(orb.MultiPolygon)
+	if !ok || len(mp) != 2 || len(mp[0]) != 2 || len(mp[1]) != 1 {
+		t.Errorf("unexpected polygons %v", mp)
+	}
+}
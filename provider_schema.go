@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-spatial/geom/slippy"
+	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+	log "github.com/sirupsen/logrus"
+)
+
+//providerTimeout 连接测试与结构发现的超时时间
+const providerTimeout = 10 * time.Second
+
+//ProviderField 驱动表字段
+type ProviderField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+//ProviderTable 驱动中的空间表或视图,Extent为4326范围
+type ProviderTable struct {
+	Schema    string          `json:"schema,omitempty"`
+	Name      string          `json:"name"`
+	Kind      string          `json:"kind"`
+	GeomField string          `json:"geomField"`
+	GeomType  string          `json:"geomType"`
+	SRID      int             `json:"srid"`
+	IDField   string          `json:"idField"`
+	Fields    []ProviderField `json:"fields"`
+	Estimate  int64           `json:"estimate"`
+	Extent    []float64       `json:"extent"`
+}
+
+//TableName 带模式的表名
+func (t *ProviderTable) TableName() string {
+	if t.Schema == "" {
+		return t.Name
+	}
+	return t.Schema + "." + t.Name
+}
+
+//ProviderStatus 驱动连接测试结果,Latency为毫秒
+type ProviderStatus struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	Latency int64  `json:"latency"`
+	Tables  int    `json:"tables"`
+}
+
+//isPostGIS 是否为PostGIS数据库驱动
+func (prd *Provider) isPostGIS() bool {
+	return prd.Type == "postgis" || prd.Type == "mvt_postgis"
+}
+
+//dsnValue 连接串参数值,加单引号并转义反斜杠与单引号
+func dsnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+//dsn PostGIS连接串
+func (prd *Provider) dsn() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable connect_timeout=%d",
+		dsnValue(prd.Host), prd.Port, dsnValue(prd.User), dsnValue(string(prd.Password)), dsnValue(prd.Database), int(providerTimeout.Seconds()))
+}
+
+//open 打开PostGIS数据库连接
+func (prd *Provider) open() (*sql.DB, error) {
+	if !prd.isPostGIS() {
+		return nil, fmt.Errorf("unsupported provider type %s", prd.Type)
+	}
+	return sql.Open("postgres", prd.dsn())
+}
+
+//openFile 打开文件驱动,用完需关闭
+func (prd *Provider) openFile() (*fileProvider, error) {
+	cfg, err := toDicter(prd)
+	if err != nil {
+		return nil, err
+	}
+	return newFileProvider(prd.Type, cfg)
+}
+
+//Test 测试驱动连接,PostGIS同时检查扩展版本与SRID
+func (prd *Provider) Test(ctx context.Context) (*ProviderStatus, error) {
+	start := time.Now()
+	st := &ProviderStatus{Type: prd.Type}
+	if isFileProvider(prd.Type) {
+		fp, err := prd.openFile()
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		tables, err := fp.tables("")
+		if err != nil {
+			return nil, err
+		}
+		st.Tables = len(tables)
+		st.Latency = time.Since(start).Milliseconds()
+		return st, nil
+	}
+	pdb, err := prd.open()
+	if err != nil {
+		return nil, err
+	}
+	defer pdb.Close()
+	if err := pdb.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("连接失败, %s", err)
+	}
+	if err := pdb.QueryRowContext(ctx, `SELECT postgis_lib_version()`).Scan(&st.Version); err != nil {
+		return nil, fmt.Errorf("数据库未安装PostGIS扩展, %s", err)
+	}
+	var n int
+	if err := pdb.QueryRowContext(ctx, `SELECT count(*) FROM spatial_ref_sys WHERE srid = $1`, prd.SRID).Scan(&n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("SRID %d 不存在于spatial_ref_sys", prd.SRID)
+	}
+	if err := pdb.QueryRowContext(ctx, `SELECT count(*) FROM geometry_columns`).Scan(&st.Tables); err != nil {
+		return nil, err
+	}
+	st.Latency = time.Since(start).Milliseconds()
+	return st, nil
+}
+
+//Discover 发现驱动中的空间表,table不为空时只返回该表,可带模式名
+func (prd *Provider) Discover(ctx context.Context, table string) ([]ProviderTable, error) {
+	if isFileProvider(prd.Type) {
+		fp, err := prd.openFile()
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		return fp.tables(table)
+	}
+	pdb, err := prd.open()
+	if err != nil {
+		return nil, err
+	}
+	defer pdb.Close()
+	return discoverPostGIS(ctx, pdb, table)
+}
+
+//discoverPostGIS 读取geometry_columns,行数取统计估计值,范围取ST_EstimatedExtent
+func discoverPostGIS(ctx context.Context, pdb *sql.DB, table string) ([]ProviderTable, error) {
+	q := `SELECT g.f_table_schema, g.f_table_name, g.f_geometry_column, g.type, g.srid, c.relkind, c.reltuples::bigint
+		FROM geometry_columns g
+		JOIN pg_namespace n ON n.nspname = g.f_table_schema
+		JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = g.f_table_name`
+	var args []interface{}
+	if table != "" {
+		schema, name := "", table
+		if i := strings.Index(table, "."); i > 0 {
+			schema, name = table[:i], table[i+1:]
+		}
+		q += ` WHERE g.f_table_name = $1`
+		args = append(args, name)
+		if schema != "" {
+			q += ` AND g.f_table_schema = $2`
+			args = append(args, schema)
+		}
+	}
+	q += ` ORDER BY g.f_table_schema, g.f_table_name`
+	rows, err := pdb.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	var tables []ProviderTable
+	for rows.Next() {
+		var t ProviderTable
+		var kind string
+		if err := rows.Scan(&t.Schema, &t.Name, &t.GeomField, &t.GeomType, &t.SRID, &kind, &t.Estimate); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.Kind = "table"
+		if kind == "v" || kind == "m" {
+			t.Kind = "view"
+		}
+		if t.Estimate < 0 {
+			t.Estimate = 0
+		}
+		if strings.EqualFold(t.GeomType, "GEOMETRY") {
+			t.GeomType = ""
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range tables {
+		t := &tables[i]
+		ident := fmt.Sprintf(`"%s"."%s"`, t.Schema, t.Name)
+		crows, err := pdb.QueryContext(ctx, `SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position`, t.Schema, t.Name)
+		if err != nil {
+			return nil, err
+		}
+		for crows.Next() {
+			var f ProviderField
+			if err := crows.Scan(&f.Name, &f.Type); err != nil {
+				crows.Close()
+				return nil, err
+			}
+			if f.Name != t.GeomField {
+				t.Fields = append(t.Fields, f)
+			}
+		}
+		crows.Close()
+		pdb.QueryRowContext(ctx, `SELECT a.attname FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+			WHERE i.indrelid = $1::regclass AND i.indisprimary LIMIT 1`, ident).Scan(&t.IDField)
+		var minx, miny, maxx, maxy sql.NullFloat64
+		err = pdb.QueryRowContext(ctx, `SELECT ST_XMin(e), ST_YMin(e), ST_XMax(e), ST_YMax(e) FROM
+			(SELECT ST_Transform(ST_SetSRID(ST_EstimatedExtent($1, $2, $3)::geometry, $4), 4326) AS e) t`,
+			t.Schema, t.Name, t.GeomField, t.SRID).Scan(&minx, &miny, &maxx, &maxy)
+		if err != nil {
+			log.Warnf("discover %s extent error, details: %s", ident, err)
+			continue
+		}
+		if minx.Valid && maxy.Valid {
+			t.Extent = []float64{minx.Float64, miny.Float64, maxx.Float64, maxy.Float64}
+		}
+	}
+	return tables, nil
+}
+
+//tables 文件驱动的空间表,Shapefile与GeoJSON以文件名为表名
+func (p *fileProvider) tables(table string) ([]ProviderTable, error) {
+	if p.db == nil {
+		t := ProviderTable{Name: strings.TrimSuffix(filepath.Base(p.path), filepath.Ext(p.path)), Kind: "file", SRID: int(p.srid), Estimate: int64(len(p.mem.features))}
+		if table != "" && table != t.Name {
+			return nil, nil
+		}
+		types := make(map[string]string)
+		var bound orb.Bound
+		for i, f := range p.mem.features {
+			if i == 0 {
+				t.GeomType = strings.ToUpper(f.Geometry.GeoJSONType())
+				bound = p.mem.bounds[i]
+			} else {
+				bound = bound.Union(p.mem.bounds[i])
+			}
+			for k, v := range f.Properties {
+				if _, ok := types[k]; !ok || types[k] == "" {
+					types[k] = valueType(v)
+				}
+			}
+		}
+		for k, v := range types {
+			t.Fields = append(t.Fields, ProviderField{Name: k, Type: v})
+		}
+		sort.Slice(t.Fields, func(i, j int) bool { return t.Fields[i].Name < t.Fields[j].Name })
+		if len(p.mem.features) > 0 {
+			t.Extent = []float64{bound.Min.X(), bound.Min.Y(), bound.Max.X(), bound.Max.Y()}
+		}
+		return []ProviderTable{t}, nil
+	}
+	q := `SELECT g.table_name, g.column_name, g.geometry_type_name, g.srs_id, c.min_x, c.min_y, c.max_x, c.max_y
+		FROM gpkg_geometry_columns g LEFT JOIN gpkg_contents c ON c.table_name = g.table_name`
+	var args []interface{}
+	if table != "" {
+		q += ` WHERE g.table_name = ?`
+		args = append(args, table)
+	}
+	rows, err := p.db.Query(q+` ORDER BY g.table_name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var tables []ProviderTable
+	for rows.Next() {
+		t := ProviderTable{Kind: "table"}
+		var minx, miny, maxx, maxy sql.NullFloat64
+		if err := rows.Scan(&t.Name, &t.GeomField, &t.GeomType, &t.SRID, &minx, &miny, &maxx, &maxy); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if minx.Valid && maxy.Valid {
+			t.Extent = []float64{minx.Float64, miny.Float64, maxx.Float64, maxy.Float64}
+			if t.SRID == 3857 {
+				min := project.Mercator.ToWGS84(orb.Point{minx.Float64, miny.Float64})
+				max := project.Mercator.ToWGS84(orb.Point{maxx.Float64, maxy.Float64})
+				t.Extent = []float64{min.X(), min.Y(), max.X(), max.Y()}
+			}
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	for i := range tables {
+		t := &tables[i]
+		crows, err := p.db.Query(fmt.Sprintf(`PRAGMA table_info("%s")`, t.Name))
+		if err != nil {
+			return nil, err
+		}
+		for crows.Next() {
+			var cid, notnull, pk int
+			var name, typ string
+			var dflt interface{}
+			if err := crows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+				crows.Close()
+				return nil, err
+			}
+			switch {
+			case pk > 0:
+				t.IDField = name
+			case name != t.GeomField:
+				t.Fields = append(t.Fields, ProviderField{Name: name, Type: strings.ToLower(typ)})
+			}
+		}
+		crows.Close()
+		p.db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM "%s"`, t.Name)).Scan(&t.Estimate)
+	}
+	return tables, nil
+}
+
+//valueType 属性值类型名称
+func valueType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return "boolean"
+	case int, int32, int64, uint, uint32, uint64:
+		return "integer"
+	case float32, float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return "json"
+}
+
+//Prefill 按发现的表结构补全未指定的图层参数,只有一个表时可不指定表名
+func (player *ProviderLayer) Prefill(tables []ProviderTable) error {
+	var t *ProviderTable
+	for i := range tables {
+		if (player.TabLeName == "" && len(tables) == 1) || player.TabLeName == tables[i].TableName() || player.TabLeName == tables[i].Name {
+			t = &tables[i]
+			break
+		}
+	}
+	if t == nil {
+		if player.TabLeName == "" {
+			return fmt.Errorf("驱动中有%d个空间表,需指定表名", len(tables))
+		}
+		return fmt.Errorf("空间表%s不存在", player.TabLeName)
+	}
+	if player.TabLeName == "" {
+		player.TabLeName = t.TableName()
+	}
+	if player.GeomField == "" {
+		player.GeomField = t.GeomField
+	}
+	if player.IDField == "" {
+		player.IDField = t.IDField
+	}
+	if player.GeomType == "" {
+		player.GeomType = t.GeomType
+	}
+	if player.SRID == 0 {
+		player.SRID = t.SRID
+	}
+	if player.Fields == "" {
+		var names []string
+		for _, f := range t.Fields {
+			if f.Name != player.IDField && f.Name != player.GeomField {
+				names = append(names, f.Name)
+			}
+		}
+		player.Fields = strings.Join(names, ",")
+	}
+	return nil
+}
+
+//sqlTokenRe 图层SQL中的变量
+var sqlTokenRe = regexp.MustCompile(`![a-zA-Z0-9_-]+!`)
+
+//checkLayerSQL 检查图层SQL变量,必须包含!BBOX!
+func checkLayerSQL(q string) error {
+	q = strings.Replace(strings.Replace(q, "!BOX!", "!BBOX!", -1), "!bbox!", "!BBOX!", -1)
+	if !strings.Contains(q, "!BBOX!") {
+		return fmt.Errorf("SQL缺少必需的变量!BBOX!")
+	}
+	for _, tk := range sqlTokenRe.FindAllString(q, -1) {
+		switch strings.ToUpper(tk) {
+		case "!BBOX!", "!ZOOM!", "!X!", "!Y!", "!Z!", "!SCALE_DENOMINATOR!", "!PIXEL_WIDTH!", "!PIXEL_HEIGHT!", "!ID_FIELD!", "!GEOM_FIELD!", "!GEOM_TYPE!":
+		default:
+			return fmt.Errorf("SQL包含不支持的变量%s", tk)
+		}
+	}
+	return nil
+}
+
+//sampleLayerSQL 按样例瓦片替换图层SQL变量,与瓦片查询时的替换规则一致
+func sampleLayerSQL(player *ProviderLayer, tile *slippy.Tile) string {
+	b := maptile.New(uint32(tile.X), uint32(tile.Y), maptile.Zoom(tile.Z)).Bound()
+	min := project.WGS84.ToMercator(b.Min)
+	max := project.WGS84.ToMercator(b.Max)
+	bbox := fmt.Sprintf("ST_MakeEnvelope(%g,%g,%g,%g,3857)", min.X(), min.Y(), max.X(), max.Y())
+	switch player.SRID {
+	case 3857:
+	case 4326:
+		bbox = fmt.Sprintf("ST_MakeEnvelope(%g,%g,%g,%g,4326)", b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y())
+	default:
+		if player.SRID > 0 {
+			bbox = fmt.Sprintf("ST_Transform(%s,%d)", bbox, player.SRID)
+		}
+	}
+	pixel := (max.X() - min.X()) / 256
+	z := strconv.FormatUint(uint64(tile.Z), 10)
+	r := strings.NewReplacer(
+		"!BBOX!", bbox,
+		"!ZOOM!", z,
+		"!Z!", z,
+		"!X!", strconv.FormatUint(uint64(tile.X), 10),
+		"!Y!", strconv.FormatUint(uint64(tile.Y), 10),
+		"!SCALE_DENOMINATOR!", strconv.FormatFloat(pixel/0.00028, 'f', -1, 64),
+		"!PIXEL_WIDTH!", strconv.FormatFloat(pixel, 'f', -1, 64),
+		"!PIXEL_HEIGHT!", strconv.FormatFloat(pixel, 'f', -1, 64),
+		"!ID_FIELD!", player.IDField,
+		"!GEOM_FIELD!", player.GeomField,
+		"!GEOM_TYPE!", player.GeomType,
+	)
+	q := strings.Replace(strings.Replace(player.SQL, "!BOX!", "!BBOX!", -1), "!bbox!", "!BBOX!", -1)
+	return r.Replace(sqlTokenRe.ReplaceAllStringFunc(q, strings.ToUpper))
+}
+
+//TestSQL 用样例瓦片在只读事务中执行图层SQL,返回结果列,执行后回滚
+func (prd *Provider) TestSQL(ctx context.Context, player *ProviderLayer, tile *slippy.Tile) ([]string, error) {
+	if err := checkLayerSQL(player.SQL); err != nil {
+		return nil, err
+	}
+	pdb, err := prd.open()
+	if err != nil {
+		return nil, err
+	}
+	defer pdb.Close()
+	tx, err := pdb.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("连接失败, %s", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`SET LOCAL statement_timeout = %d`, providerTimeout.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM (%s) AS q LIMIT 1`, sampleLayerSQL(player, tile)))
+	if err != nil {
+		return nil, fmt.Errorf("SQL在样例瓦片%d/%d/%d执行失败, %s", tile.Z, tile.X, tile.Y, err)
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+//PrepareLayer 补全并校验驱动图层,指定SQL时用样例瓦片执行校验
+func (prd *Provider) PrepareLayer(ctx context.Context, player *ProviderLayer, tile *slippy.Tile) error {
+	if player.SQL == "" {
+		tables, err := prd.Discover(ctx, player.TabLeName)
+		if err != nil {
+			return err
+		}
+		return player.Prefill(tables)
+	}
+	if !prd.isPostGIS() {
+		return fmt.Errorf("%s驱动不支持SQL图层", prd.Type)
+	}
+	cols, err := prd.TestSQL(ctx, player, tile)
+	if err != nil {
+		return err
+	}
+	if player.GeomField == "" {
+		player.GeomField = "geom"
+	}
+	found := false
+	var names []string
+	for _, col := range cols {
+		switch col {
+		case player.GeomField:
+			found = true
+		case player.IDField:
+		default:
+			names = append(names, col)
+		}
+	}
+	if !found {
+		return fmt.Errorf("SQL结果中缺少几何字段%s", player.GeomField)
+	}
+	if player.Fields == "" {
+		player.Fields = strings.Join(names, ",")
+	}
+	if player.SRID == 0 {
+		player.SRID = prd.SRID
+	}
+	return nil
+}
+
+//sampleTile 从请求参数z/x/y读取样例瓦片,默认0/0/0
+func sampleTile(c *gin.Context) (*slippy.Tile, error) {
+	var zxy [3]uint64
+	for i, k := range []string{"z", "x", "y"} {
+		if v := c.Query(k); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s", k, v)
+			}
+			zxy[i] = n
+		}
+	}
+	if zxy[0] > 22 || zxy[1] >= 1<<zxy[0] || zxy[2] >= 1<<zxy[0] {
+		return nil, fmt.Errorf("invalid sample tile %d/%d/%d", zxy[0], zxy[1], zxy[2])
+	}
+	return slippy.NewTile(uint(zxy[0]), uint(zxy[1]), uint(zxy[2])), nil
+}
+
+//loadProvider 读取用户的驱动记录,ATLAS可读取全部驱动
+func loadProvider(uid, id string) (*Provider, error) {
+	prd := &Provider{}
+	if err := db.Where("id = ?", id).First(prd).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, fmt.Errorf("%s", MsgList[40410])
+		}
+		return nil, err
+	}
+	if prd.Owner != uid && uid != ATLAS {
+		return nil, fmt.Errorf("%s", MsgList[40410])
+	}
+	return prd, nil
+}
+
+//testProvider 测试驱动连接,指定id时测试已注册驱动,否则测试请求中的驱动参数
+func testProvider(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	prd := &Provider{}
+	if id := c.Param("id"); id != "" {
+		var err error
+		prd, err = loadProvider(uid, id)
+		if err != nil {
+			resp.FailMsg(c, err.Error())
+			return
+		}
+	} else {
+		if err := c.ShouldBindJSON(prd); err != nil {
+			resp.Fail(c, 4001)
+			return
+		}
+		if prd.Type == "" {
+			prd.Type = "mvt_postgis"
+		}
+		if err := prd.Validate(); err != nil {
+			resp.FailMsg(c, err.Error())
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), providerTimeout)
+	defer cancel()
+	st, err := prd.Test(ctx)
+	if err != nil {
+		log.Warnf("test provider (%s) error, details: %s", prd.Name, err)
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	resp.DoneData(c, st)
+}
+
+//getProviderSchema 获取驱动中的空间表结构,可用table参数指定表
+func getProviderSchema(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	prd, err := loadProvider(uid, c.Param("id"))
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), providerTimeout)
+	defer cancel()
+	tables, err := prd.Discover(ctx, c.Query("table"))
+	if err != nil {
+		log.Warnf("discover provider (%s) error, details: %s", prd.ID, err)
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	if tables == nil {
+		tables = []ProviderTable{}
+	}
+	resp.DoneData(c, tables)
+}
+
+//prefillProviderLayer 图层向导,补全并校验图层参数但不注册
+func prefillProviderLayer(c *gin.Context) {
+	resp := NewResp()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	player := &ProviderLayer{}
+	if err := c.ShouldBindJSON(player); err != nil {
+		resp.Fail(c, 4001)
+		return
+	}
+	prd, err := loadProvider(uid, player.ProviderID)
+	if err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	tile, err := sampleTile(c)
+	if err != nil {
+		resp.Fail(c, 4003)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), providerTimeout)
+	defer cancel()
+	if err := prd.PrepareLayer(ctx, player, tile); err != nil {
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	resp.DoneData(c, player)
+}
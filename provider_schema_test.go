@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-spatial/geom/slippy"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+func TestProviderSchema(t *testing.T) {
+	dir := t.TempDir()
+	old := viper.GetString("paths.providers")
+	viper.Set("paths.providers", dir)
+	defer viper.Set("paths.providers", old)
+	writeTestGpkg(t, filepath.Join(dir, "parks.gpkg"))
+	gj := `{"type":"FeatureCollection","features":[
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[116.39,39.91]},"properties":{"name":"a","rank":1}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[-70,-30]},"properties":{"name":"b","open":true}}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "pois.geojson"), []byte(gj), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	gpkg := &Provider{ID: "gpkg", Name: "gpkg", Type: GeoPackageProvider, Path: "parks.gpkg"}
+	st, err := gpkg.Test(ctx)
+	if err != nil || st.Tables != 1 {
+		t.Fatalf("unexpected test result %+v %v", st, err)
+	}
+	tables, err := gpkg.Discover(ctx, "")
+	if err != nil || len(tables) != 1 {
+		t.Fatalf("unexpected tables %+v %v", tables, err)
+	}
+	tb := tables[0]
+	if tb.Name != "parks" || tb.GeomField != "shape" || tb.GeomType != "POLYGON" || tb.SRID != 4326 || tb.IDField != "fid" ||
+		tb.Estimate != 2 || len(tb.Fields) != 1 || tb.Fields[0].Name != "name" || len(tb.Extent) != 4 || tb.Extent[2] != 113.3 {
+		t.Errorf("unexpected gpkg table %+v", tb)
+	}
+	player := &ProviderLayer{ProviderID: "gpkg", Name: "parks"}
+	if err := gpkg.PrepareLayer(ctx, player, slippy.NewTile(0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if player.TabLeName != "parks" || player.GeomField != "shape" || player.IDField != "fid" || player.Fields != "name" || player.GeomType != "POLYGON" || player.SRID != 4326 {
+		t.Errorf("unexpected prefilled layer %+v", player)
+	}
+	if err := gpkg.PrepareLayer(ctx, &ProviderLayer{TabLeName: "lakes"}, slippy.NewTile(0, 0, 0)); err == nil {
+		t.Errorf("unknown table should be rejected")
+	}
+	if err := gpkg.PrepareLayer(ctx, &ProviderLayer{SQL: "SELECT * FROM parks WHERE !BBOX!"}, slippy.NewTile(0, 0, 0)); err == nil {
+		t.Errorf("sql layer should be rejected for file providers")
+	}
+
+	tables, err = (&Provider{Type: GeoJSONProvider, Path: "pois.geojson"}).Discover(ctx, "")
+	if err != nil || len(tables) != 1 {
+		t.Fatalf("unexpected tables %+v %v", tables, err)
+	}
+	tb = tables[0]
+	if tb.Name != "pois" || tb.GeomType != "POINT" || tb.Estimate != 2 || len(tb.Fields) != 3 || tb.Fields[0].Name != "name" || tb.Fields[1].Type != "boolean" || tb.Fields[2].Type != "number" {
+		t.Errorf("unexpected geojson table %+v", tb)
+	}
+	if _, err := (&Provider{Type: GeoJSONProvider, Path: "missing.geojson"}).Test(ctx); err == nil {
+		t.Errorf("missing file should fail the connection test")
+	}
+}
+
+func TestLayerSQL(t *testing.T) {
+	if checkLayerSQL("SELECT gid, geom FROM roads") == nil {
+		t.Errorf("sql without !BBOX! should be rejected")
+	}
+	if checkLayerSQL("SELECT gid, geom FROM roads WHERE geom && !BBOX! AND !LEVEL! > 3") == nil {
+		t.Errorf("unknown token should be rejected")
+	}
+	player := &ProviderLayer{SQL: "SELECT gid, geom FROM roads WHERE geom && !bbox! AND min_zoom <= !zoom!", SRID: 4326}
+	if err := checkLayerSQL(player.SQL); err != nil {
+		t.Fatal(err)
+	}
+	q := sampleLayerSQL(player, slippy.NewTile(1, 1, 0))
+	if !strings.Contains(q, "ST_MakeEnvelope(0,0,180,85.0511") || !strings.Contains(q, "min_zoom <= 1") {
+		t.Errorf("unexpected sample sql %s", q)
+	}
+	player.SRID = 4490
+	if q := sampleLayerSQL(player, slippy.NewTile(0, 0, 0)); !strings.Contains(q, "ST_Transform(ST_MakeEnvelope(") || !strings.HasSuffix(strings.SplitN(q, "3857),", 2)[1], "4490) AND min_zoom <= 0") {
+		t.Errorf("unexpected sample sql %s", q)
+	}
+}
+
+func TestProviderDSN(t *testing.T) {
+	prd := &Provider{Host: "db.local", Port: 5432, User: "gis", Password: `p a'ss\`, Database: "my db"}
+	want := `host='db.local' port=5432 user='gis' password='p a\'ss\\' dbname='my db' sslmode=disable connect_timeout=10`
+	if got := prd.dsn(); got != want {
+		t.Errorf("unexpected dsn %s", got)
+	}
+}
+
+func TestLoadProviderOwner(t *testing.T) {
+	tdb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&Provider{})
+	oldDB := db
+	db = tdb
+	defer func() { db = oldDB }()
+	tdb.Create(&Provider{ID: "p1", Name: "p1", Type: GeoJSONProvider, Owner: "u"})
+	if _, err := loadProvider("u", "p1"); err != nil {
+		t.Errorf("owner should load provider, %v", err)
+	}
+	if _, err := loadProvider(ATLAS, "p1"); err != nil {
+		t.Errorf("atlas should load provider, %v", err)
+	}
+	if _, err := loadProvider("other", "p1"); err == nil {
+		t.Errorf("other user should not load provider")
+	}
+}
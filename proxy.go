@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+//Upstream 代理的上游服务,按认证方式签名或注入密钥
+//auth: none,query(KeyName参数),header(KeyName请求头),basic(AppID/Secret),
+//md5(MD5(appid+secret+uri+ms)大写),hmac(HMAC-SHA256(secret, appid+uri+ms)),
+//签名通过SignIn指定的query,header或body(JSON)传递
+type Upstream struct {
+	ID        string          `form:"id" json:"id" gorm:"primary_key"`
+	Name      string          `form:"name" json:"name" binding:"required"`
+	Host      string          `form:"host" json:"host" binding:"required"`
+	Method    string          `form:"method" json:"method"`
+	Auth      string          `form:"auth" json:"auth"`
+	KeyName   string          `form:"key_name" json:"key_name"`
+	AppID     string          `form:"appid" json:"appid"`
+	Secret    Credential      `form:"secret" json:"secret,omitempty"`
+	SignIn    string          `form:"sign_in" json:"sign_in"`
+	Headers   json.RawMessage `form:"-" json:"headers" gorm:"type:json"`
+	Rewrite   string          `form:"rewrite" json:"rewrite"`
+	RewriteTo string          `form:"rewrite_to" json:"rewrite_to"`
+	CacheTTL  int             `form:"cache_ttl" json:"cache_ttl"`
+	Public    bool            `form:"public" json:"public"`
+	Owner     string          `form:"-" json:"owner" gorm:"index"`
+	CreatedAt time.Time       `form:"-" json:"created_at"`
+	UpdatedAt time.Time       `form:"-" json:"updated_at"`
+}
+
+//proxyHeaders 转发到上游的客户端请求头
+var proxyHeaders = []string{"Accept", "Accept-Language", "Content-Type", "If-None-Match", "If-Modified-Since", "Range"}
+
+//proxyRespHeaders 返回给客户端的上游响应头
+var proxyRespHeaders = []string{"Content-Type", "Content-Encoding", "Cache-Control", "ETag", "Last-Modified", "Expires"}
+
+//upstreamTransport 上游请求传输,默认拒绝连接内网与回环地址
+var upstreamTransport = publicTransport(func() bool { return viper.GetBool("proxy.allowprivate") })
+
+//publicTransport 拒绝连接内网与回环地址的HTTP传输,在拨号时校验解析后的地址(含重定向),
+//allowPrivate返回true时不限制
+func publicTransport(allowPrivate func() bool) *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if allowPrivate != nil && allowPrivate() {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("address %s is not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+//publicIP 是否为公网地址
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+//LoadUpstream 获取上游服务
+func LoadUpstream(id string) (*Upstream, error) {
+	up := &Upstream{}
+	err := db.Where("id = ?", id).First(up).Error
+	if err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+//Validate 校验认证方式与改写规则
+func (up *Upstream) Validate() error {
+	switch up.Auth {
+	case "", "none", "basic", "md5", "hmac":
+	case "query", "header":
+		if up.KeyName == "" {
+			return fmt.Errorf("key_name is required for %s auth", up.Auth)
+		}
+	default:
+		return fmt.Errorf("unsupported auth %s", up.Auth)
+	}
+	switch up.SignIn {
+	case "", "query", "header", "body":
+	default:
+		return fmt.Errorf("unsupported sign_in %s", up.SignIn)
+	}
+	u, err := url.Parse(up.Host)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("host should be an http or https url")
+	}
+	if up.Rewrite != "" {
+		if _, err := regexp.Compile(up.Rewrite); err != nil {
+			return err
+		}
+	}
+	if len(up.Headers) > 0 {
+		var headers map[string]string
+		if err := json.Unmarshal(up.Headers, &headers); err != nil {
+			return fmt.Errorf("headers should be a string map, details: %s", err)
+		}
+	}
+	return nil
+}
+
+//Redact 去除密钥,用于返回客户端
+func (up *Upstream) Redact() {
+	up.Secret = ""
+}
+
+//Sign 计算签名
+func (up *Upstream) Sign(uri, ms string) string {
+	switch up.Auth {
+	case "md5":
+		hash := md5.New()
+		hash.Write([]byte(up.AppID + string(up.Secret) + uri + ms))
+		return strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
+	case "hmac":
+		mac := hmac.New(sha256.New, []byte(up.Secret))
+		mac.Write([]byte(up.AppID + uri + ms))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	return ""
+}
+
+//rewrite 按规则改写请求路径
+func (up *Upstream) rewrite(uri string) string {
+	if up.Rewrite == "" {
+		return uri
+	}
+	re, err := regexp.Compile(up.Rewrite)
+	if err != nil {
+		return uri
+	}
+	return re.ReplaceAllString(uri, up.RewriteTo)
+}
+
+//NewRequest 构建上游请求,uri为相对Host的路径,query为客户端查询参数
+func (up *Upstream) NewRequest(method, uri string, query url.Values, header http.Header, body io.Reader, now time.Time) (*http.Request, error) {
+	uri = up.rewrite(uri)
+	if up.Method != "" {
+		method = up.Method
+	}
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	hs := http.Header{}
+	for _, k := range proxyHeaders {
+		if v := header.Get(k); v != "" {
+			hs.Set(k, v)
+		}
+	}
+	if len(up.Headers) > 0 {
+		var extra map[string]string
+		if err := json.Unmarshal(up.Headers, &extra); err == nil {
+			for k, v := range extra {
+				hs.Set(k, v)
+			}
+		}
+	}
+	switch up.Auth {
+	case "query":
+		q.Set(up.KeyName, string(up.Secret))
+	case "header":
+		hs.Set(up.KeyName, string(up.Secret))
+	case "md5", "hmac":
+		ms := strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+		token := up.Sign(uri, ms)
+		switch up.SignIn {
+		case "query":
+			q.Set("appId", up.AppID)
+			q.Set("ms", ms)
+			q.Set("token", token)
+		case "body":
+			claims := fmt.Sprintf(`{"appId":%q,"ms":%s,"token":%q}`, up.AppID, ms, token)
+			body = bytes.NewBufferString(claims)
+			hs.Set("Content-Type", "application/json;charset=utf-8")
+		default:
+			hs.Set("X-App-Id", up.AppID)
+			hs.Set("X-Timestamp", ms)
+			hs.Set("X-Signature", token)
+		}
+	}
+	target := strings.TrimSuffix(up.Host, "/") + uri
+	if len(q) > 0 {
+		target += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = hs
+	if up.Auth == "basic" {
+		req.SetBasicAuth(up.AppID, string(up.Secret))
+	}
+	return req, nil
+}
+
+//proxyCacheFile 代理响应缓存文件,按上游与请求地址区分
+func proxyCacheFile(id, uri string, query url.Values) string {
+	sum := md5.Sum([]byte(uri + "?" + query.Encode()))
+	return filepath.Join(viper.GetString("proxy.cache"), id, hex.EncodeToString(sum[:]))
+}
+
+//CachedResponse 读取未过期的缓存响应
+func (up *Upstream) CachedResponse(uri string, query url.Values) ([]byte, string, bool) {
+	if up.CacheTTL <= 0 {
+		return nil, "", false
+	}
+	file := proxyCacheFile(up.ID, uri, query)
+	stat, err := os.Stat(file)
+	if err != nil || time.Since(stat.ModTime()) > time.Duration(up.CacheTTL)*time.Second {
+		return nil, "", false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, "", false
+	}
+	ct, _ := ioutil.ReadFile(file + ".type")
+	return data, string(ct), true
+}
+
+//CacheResponse 缓存响应
+func (up *Upstream) CacheResponse(uri string, query url.Values, data []byte, contentType string) error {
+	if up.CacheTTL <= 0 {
+		return nil
+	}
+	file := proxyCacheFile(up.ID, uri, query)
+	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file+".type", []byte(contentType), 0644)
+	if err != nil {
+		return err
+	}
+	tmp := file + "." + ShortID()
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+//clearProxyCache 删除上游的缓存
+func clearProxyCache(id string) error {
+	return os.RemoveAll(filepath.Join(viper.GetString("proxy.cache"), id))
+}
+
+//initLegacyProxy 将配置文件中的proxy转为上游服务dh3dts,兼容原有接口
+func initLegacyProxy() {
+	host := viper.GetString("proxy.host")
+	if host == "" {
+		return
+	}
+	_, err := LoadUpstream("dh3dts")
+	if err == nil || !gorm.IsRecordNotFoundError(err) {
+		return
+	}
+	up := &Upstream{
+		ID:     "dh3dts",
+		Name:   "dh3dts",
+		Host:   host,
+		Method: "PUT",
+		Auth:   "md5",
+		AppID:  viper.GetString("proxy.appid"),
+		Secret: Credential(viper.GetString("proxy.key")),
+		SignIn: "body",
+		Public: true,
+		Owner:  ATLAS,
+	}
+	db.Create(up)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+func TestUpstreamRequest(t *testing.T) {
+	var got *http.Request
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		buf, _ := ioutil.ReadAll(r.Body)
+		body = string(buf)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	now := time.Unix(1603949582, 0)
+	do := func(up *Upstream, method, uri string, query url.Values) {
+		if err := up.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		req, err := up.NewRequest(method, uri, query, http.Header{"Accept": {"image/png"}, "Cookie": {"token=x"}}, nil, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	do(&Upstream{Host: server.URL, Auth: "query", KeyName: "tk", Secret: "s1"}, "GET", "/tiles/1/2/3.png", url.Values{"a": {"b"}})
+	if got.URL.Query().Get("tk") != "s1" || got.URL.Query().Get("a") != "b" || got.URL.Path != "/tiles/1/2/3.png" {
+		t.Errorf("query auth, unexpected request %s", got.URL)
+	}
+	if got.Header.Get("Accept") != "image/png" || got.Header.Get("Cookie") != "" {
+		t.Errorf("only whitelisted client headers should be forwarded, got %v", got.Header)
+	}
+
+	headers, _ := json.Marshal(map[string]string{"Referer": "http://atlas"})
+	do(&Upstream{Host: server.URL + "/", Auth: "header", KeyName: "Authorization", Secret: "Bearer s2", Headers: headers,
+		Rewrite: `^/v1/(.*)$`, RewriteTo: "/api/v2/$1"}, "GET", "/v1/layers", nil)
+	if got.Header.Get("Authorization") != "Bearer s2" || got.Header.Get("Referer") != "http://atlas" || got.URL.Path != "/api/v2/layers" {
+		t.Errorf("header auth, unexpected request %s %v", got.URL, got.Header)
+	}
+
+	do(&Upstream{Host: server.URL, Auth: "basic", AppID: "u", Secret: "p"}, "GET", "/", nil)
+	if u, p, ok := got.BasicAuth(); !ok || u != "u" || p != "p" {
+		t.Errorf("basic auth, got %s %s %v", u, p, ok)
+	}
+
+	do(&Upstream{Host: server.URL, Auth: "hmac", AppID: "app", Secret: "key"}, "GET", "/t/1", nil)
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("app" + "/t/1" + "1603949582000"))
+	if got.Header.Get("X-Timestamp") != "1603949582000" || got.Header.Get("X-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("hmac auth, unexpected headers %v", got.Header)
+	}
+
+	//原dh3dts签名方式,PUT并在body中传递
+	legacy := &Upstream{Host: server.URL, Method: "PUT", Auth: "md5", AppID: "app", Secret: "key", SignIn: "body"}
+	do(legacy, "GET", "/3dtiles/tileset.json", nil)
+	var claims struct {
+		AppID string `json:"appId"`
+		MS    int64  `json:"ms"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(body), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "PUT" || claims.AppID != "app" || claims.MS != 1603949582000 || claims.Token != legacy.Sign("/3dtiles/tileset.json", "1603949582000") {
+		t.Errorf("md5 body auth, unexpected %s %s", got.Method, body)
+	}
+	if len(claims.Token) != 32 || strings.ToUpper(claims.Token) != claims.Token {
+		t.Errorf("md5 token should be upper hex, got %s", claims.Token)
+	}
+
+	for _, up := range []*Upstream{
+		{Host: server.URL, Auth: "query"},
+		{Host: server.URL, Auth: "oauth"},
+		{Host: server.URL, SignIn: "cookie"},
+		{Host: server.URL, Rewrite: "("},
+		{Host: server.URL, Headers: json.RawMessage(`[1]`)},
+		{Host: "file:///etc/passwd"},
+		{Host: "gopher://127.0.0.1:70/"},
+		{Host: "/relative"},
+	} {
+		if up.Validate() == nil {
+			t.Errorf("expected invalid upstream %+v", up)
+		}
+	}
+}
+
+func TestUpstreamCache(t *testing.T) {
+	viper.Set("proxy.cache", t.TempDir())
+	defer viper.Set("proxy.cache", nil)
+
+	up := &Upstream{ID: "up1", CacheTTL: 60}
+	q := url.Values{"x": {"1"}}
+	if _, _, ok := up.CachedResponse("/a", q); ok {
+		t.Fatal("unexpected cache hit")
+	}
+	if err := up.CacheResponse("/a", q, []byte("tile"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	data, ct, ok := up.CachedResponse("/a", q)
+	if !ok || string(data) != "tile" || ct != "image/png" {
+		t.Errorf("unexpected cache %q %s %v", data, ct, ok)
+	}
+	if _, _, ok := up.CachedResponse("/a", url.Values{"x": {"2"}}); ok {
+		t.Error("different query should miss")
+	}
+	clearProxyCache(up.ID)
+	if _, _, ok := up.CachedResponse("/a", q); ok {
+		t.Error("cache should be cleared")
+	}
+}
+
+func TestServeUpstreamAccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	tdb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&Upstream{})
+	oldDB, oldEnf := db, casEnf
+	db = tdb
+	if casEnf == nil {
+		casEnf = casbin.NewEnforcer("auth.conf")
+	}
+	defer func() { db, casEnf = oldDB, oldEnf }()
+	tdb.Create(&Upstream{ID: "up1", Name: "private", Host: server.URL, Owner: "u"})
+	viper.Set("proxy.allowprivate", true)
+	defer viper.Set("proxy.allowprivate", false)
+
+	gin.SetMode(gin.TestMode)
+	serve := func(uid string) int {
+		r := gin.New()
+		r.Use(func(c *gin.Context) { c.Set(userKey, uid) })
+		r.GET("/proxies/x/:id/*uri", proxyUpstream)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/proxies/x/up1/a", nil))
+		var res struct {
+			Status int `json:"status"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if res.Status != 0 {
+			return res.Status
+		}
+		return w.Code
+	}
+	if code := serve("u"); code != http.StatusOK {
+		t.Errorf("owner should access private upstream, got %d", code)
+	}
+	if code := serve("other"); code != 403 {
+		t.Errorf("other user should be forbidden, got %d", code)
+	}
+
+	//默认拒绝代理到回环地址
+	viper.Set("proxy.allowprivate", false)
+	upstreamTransport.CloseIdleConnections()
+	if code := serve("u"); code != 503 {
+		t.Errorf("loopback upstream should be refused, got %d", code)
+	}
+}
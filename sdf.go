@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	//SDFICONS sdf图标清单文件,位于样式icons目录下
+	SDFICONS = "sdf.json"
+	//SDFBUFFER sdf图标四周留白像素(1x)
+	SDFBUFFER = 3
+	//SDFRADIUS sdf距离场半径像素(1x)
+	SDFRADIUS = 8
+	//SDFCUTOFF sdf边界阈值,与mapbox-gl的0.75边界值对应
+	SDFCUTOFF = 0.25
+	sdfINF    = 1e20
+)
+
+// GenSDF 根据图标的alpha通道生成有向距离场(signed distance field)图像,
+// 距离值写入alpha通道,rgb统一为白色,与mapbox-gl的sdf图标约定一致.
+// 返回图像四周各扩展buffer像素.
+func GenSDF(img image.Image, buffer int, radius, cutoff float64) *image.NRGBA {
+	rect := img.Bounds()
+	w := rect.Dx() + 2*buffer
+	h := rect.Dy() + 2*buffer
+	size := w * h
+	outer := make([]float64, size)
+	inner := make([]float64, size)
+	for i := range outer {
+		outer[i] = sdfINF
+	}
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			_, _, _, a := img.At(rect.Min.X+x, rect.Min.Y+y).RGBA()
+			alpha := float64(a) / 0xffff
+			i := (y+buffer)*w + x + buffer
+			switch {
+			case alpha >= 1:
+				outer[i] = 0
+				inner[i] = sdfINF
+			case alpha <= 0:
+				outer[i] = sdfINF
+				inner[i] = 0
+			default:
+				d := 0.5 - alpha
+				outer[i] = math.Pow(math.Max(0, d), 2)
+				inner[i] = math.Pow(math.Max(0, -d), 2)
+			}
+		}
+	}
+	n := w
+	if h > n {
+		n = h
+	}
+	f := make([]float64, n)
+	z := make([]float64, n+1)
+	v := make([]int, n)
+	edt(outer, w, h, f, v, z)
+	edt(inner, w, h, f, v, z)
+
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < size; i++ {
+		d := math.Sqrt(outer[i]) - math.Sqrt(inner[i])
+		val := math.Round(255 - 255*(d/radius+cutoff))
+		if val < 0 {
+			val = 0
+		}
+		if val > 255 {
+			val = 255
+		}
+		out.SetNRGBA(i%w, i/w, color.NRGBA{255, 255, 255, uint8(val)})
+	}
+	return out
+}
+
+//edt 二维欧氏距离变换,先列后行
+func edt(data []float64, w, h int, f []float64, v []int, z []float64) {
+	for x := 0; x < w; x++ {
+		edt1d(data, x, w, h, f, v, z)
+	}
+	for y := 0; y < h; y++ {
+		edt1d(data, y*w, 1, w, f, v, z)
+	}
+}
+
+//edt1d 一维平方距离变换,Felzenszwalb & Huttenlocher
+func edt1d(grid []float64, offset, stride, length int, f []float64, v []int, z []float64) {
+	for q := 0; q < length; q++ {
+		f[q] = grid[offset+q*stride]
+	}
+	v[0] = 0
+	z[0] = -sdfINF
+	z[1] = sdfINF
+	k := 0
+	for q := 1; q < length; q++ {
+		var s float64
+		for {
+			r := v[k]
+			s = (f[q] - f[r] + float64(q*q-r*r)) / float64(q-r) / 2
+			if s <= z[k] && k > 0 {
+				k--
+				continue
+			}
+			if s <= z[k] {
+				k--
+			}
+			break
+		}
+		k++
+		v[k] = q
+		z[k] = s
+		z[k+1] = sdfINF
+	}
+	k = 0
+	for q := 0; q < length; q++ {
+		for z[k+1] < float64(q) {
+			k++
+		}
+		r := v[k]
+		grid[offset+q*stride] = f[r] + float64((q-r)*(q-r))
+	}
+}
+
+// IsMonochrome 判断图标是否为单色图标(忽略透明像素),
+// tolerance为各通道允许的色差,用于容忍抗锯齿边缘.
+func IsMonochrome(img image.Image, tolerance uint8) bool {
+	rect := img.Bounds()
+	var ref color.NRGBA
+	found := false
+	diff := func(a, b uint8) uint8 {
+		if a > b {
+			return a - b
+		}
+		return b - a
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			//忽略接近透明的边缘像素
+			if c.A < 32 {
+				continue
+			}
+			if !found {
+				ref = c
+				found = true
+				continue
+			}
+			if diff(c.R, ref.R) > tolerance || diff(c.G, ref.G) > tolerance || diff(c.B, ref.B) > tolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//sdfIcons 读取样式中标记为sdf的图标
+func (s *Style) sdfIcons() map[string]bool {
+	set := make(map[string]bool)
+	buf, err := ioutil.ReadFile(filepath.Join(s.Path, "icons", SDFICONS))
+	if err != nil {
+		return set
+	}
+	var names []string
+	if err := json.Unmarshal(buf, &names); err != nil {
+		return set
+	}
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+//markSDF 标记/取消标记sdf图标
+func (s *Style) markSDF(names []string, sdf bool) error {
+	set := s.sdfIcons()
+	for _, name := range names {
+		if sdf {
+			set[name] = true
+		} else {
+			delete(set, name)
+		}
+	}
+	var out []string
+	for name := range set {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	buf, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.Path, "icons")
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, SDFICONS), buf, os.ModePerm)
+}
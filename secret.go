@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	//credentialPrefix 加密凭据前缀,格式为enc:v1:<密钥ID>:<base64(nonce+密文)>
+	credentialPrefix = "enc:v1:"
+	//credentialMask 凭据在接口返回中的脱敏值
+	credentialMask = "******"
+	//masterKeyEnv 主密钥环境变量,多个密钥以逗号分隔,第一个用于加密,其余只用于解密
+	masterKeyEnv = "ATLAS_MASTER_KEY"
+	//secretEnvPrefix 配置引用的密钥可由环境变量ATLAS_SECRET_<NAME>提供
+	secretEnvPrefix = "ATLAS_SECRET_"
+)
+
+var (
+	//secretRefRe 配置中的密钥引用,如${secret:smtp}
+	secretRefRe = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_.-]+)\}`)
+	//secretNameRe 密钥名
+	secretNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+//masterKey 主密钥,id为密钥摘要前8位,写入密文用于轮换后定位解密密钥
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+//keyring 主密钥环,current用于加密,keys按id解密,file为空表示密钥来自环境变量
+type keyring struct {
+	current   *masterKey
+	keys      map[string]*masterKey
+	materials []string
+	file      string
+}
+
+var (
+	keysLock   sync.RWMutex
+	masterKeys *keyring
+)
+
+func newMasterKey(material string) (*masterKey, error) {
+	sum := sha256.Sum256([]byte(material))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(sum[:])
+	return &masterKey{id: hex.EncodeToString(id[:4]), aead: aead}, nil
+}
+
+//newKeyring 按顺序创建密钥环,第一个有效密钥为当前密钥
+func newKeyring(materials []string, file string) (*keyring, error) {
+	kr := &keyring{keys: make(map[string]*masterKey), file: file}
+	for _, m := range materials {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		k, err := newMasterKey(m)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := kr.keys[k.id]; ok {
+			continue
+		}
+		if kr.current == nil {
+			kr.current = k
+		}
+		kr.keys[k.id] = k
+		kr.materials = append(kr.materials, m)
+	}
+	if kr.current == nil {
+		return nil, fmt.Errorf("master key is empty")
+	}
+	return kr, nil
+}
+
+//randomKeyMaterial 生成随机主密钥
+func randomKeyMaterial() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+//writeKeyFile 写入密钥文件,每行一个密钥,当前密钥在第一行
+func writeKeyFile(file string, materials []string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(materials, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+//loadKeyring 优先从环境变量读取主密钥,否则读取secrets.keyfile,文件不存在时自动生成
+func loadKeyring() (*keyring, error) {
+	if env := os.Getenv(masterKeyEnv); env != "" {
+		return newKeyring(strings.Split(env, ","), "")
+	}
+	file := viper.GetString("secrets.keyfile")
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		material, err := randomKeyMaterial()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeKeyFile(file, []string{material}); err != nil {
+			return nil, err
+		}
+		log.Warnf("master key generated at %s, back it up, encrypted credentials can not be recovered without it", file)
+		return newKeyring([]string{material}, file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newKeyring(strings.Split(string(data), "\n"), file)
+}
+
+//initSecrets 加载主密钥
+func initSecrets() error {
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+	setKeyring(kr)
+	log.Infof("master key %s loaded, %d key(s) in keyring", kr.current.id, len(kr.keys))
+	return nil
+}
+
+func setKeyring(kr *keyring) {
+	keysLock.Lock()
+	masterKeys = kr
+	keysLock.Unlock()
+}
+
+func currentKeyring() *keyring {
+	keysLock.RLock()
+	defer keysLock.RUnlock()
+	return masterKeys
+}
+
+//credentialKeyID 返回密文使用的主密钥id,明文返回空
+func credentialKeyID(s string) string {
+	if !strings.HasPrefix(s, credentialPrefix) {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(s, credentialPrefix), ":", 2)[0]
+}
+
+//encryptCredential 使用当前主密钥加密凭据,空值与已加密的值原样返回
+func encryptCredential(plain string) (string, error) {
+	if plain == "" || strings.HasPrefix(plain, credentialPrefix) {
+		return plain, nil
+	}
+	kr := currentKeyring()
+	if kr == nil {
+		return "", fmt.Errorf("master key not initialized")
+	}
+	k := kr.current
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(plain), []byte(k.id))
+	return credentialPrefix + k.id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+//decryptCredential 解密凭据,未加密的旧数据原样返回
+func decryptCredential(s string) (string, error) {
+	if !strings.HasPrefix(s, credentialPrefix) {
+		return s, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, credentialPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed credential")
+	}
+	kr := currentKeyring()
+	if kr == nil {
+		return "", fmt.Errorf("master key not initialized")
+	}
+	k, ok := kr.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("master key %s not found in keyring", parts[0])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", fmt.Errorf("malformed credential")
+	}
+	n := k.aead.NonceSize()
+	plain, err := k.aead.Open(nil, sealed[:n], sealed[n:], []byte(k.id))
+	if err != nil {
+		return "", fmt.Errorf("decrypt credential error, details: %s", err)
+	}
+	return string(plain), nil
+}
+
+//Credential 凭据字段,入库时用主密钥加密,读出时解密,JSON输出时脱敏
+//提交脱敏值******时保持原值不变
+type Credential string
+
+//Value 加密入库
+func (cr Credential) Value() (driver.Value, error) {
+	return encryptCredential(string(cr))
+}
+
+//Scan 读出解密
+func (cr *Credential) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("unsupported credential type %T", src)
+	}
+	plain, err := decryptCredential(s)
+	if err != nil {
+		return err
+	}
+	*cr = Credential(plain)
+	return nil
+}
+
+//MarshalJSON 脱敏输出
+func (cr Credential) MarshalJSON() ([]byte, error) {
+	if cr == "" {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(credentialMask)
+}
+
+//UnmarshalJSON 脱敏值不覆盖原值
+func (cr *Credential) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == credentialMask {
+		return nil
+	}
+	*cr = Credential(s)
+	return nil
+}
+
+//Unmask 表单绑定不经过UnmarshalJSON,提交的脱敏值恢复为原值
+func (cr *Credential) Unmask(old Credential) {
+	if *cr == credentialMask {
+		*cr = old
+	}
+}
+
+//Secret 命名密钥,配置项可使用${secret:name}引用,修改后重启生效
+type Secret struct {
+	Name        string     `json:"name" gorm:"primary_key"`
+	Value       Credential `json:"value" binding:"required"`
+	Description string     `json:"description"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+//lookupSecret 查找命名密钥,环境变量优先,useDB时再查询系统库
+func lookupSecret(name string, useDB bool) (string, bool) {
+	env := secretEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+	if v, ok := os.LookupEnv(env); ok {
+		return v, true
+	}
+	if !useDB || db == nil {
+		return "", false
+	}
+	s := &Secret{}
+	if err := db.Where("name = ?", name).First(s).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Errorf("lookup secret %s error, details: %s", name, err)
+		}
+		return "", false
+	}
+	return string(s.Value), true
+}
+
+//resolveSecretRefs 替换字符串中的密钥引用,返回未找到的密钥名
+func resolveSecretRefs(s string, useDB bool) (string, []string) {
+	var missing []string
+	out := secretRefRe.ReplaceAllStringFunc(s, func(ref string) string {
+		name := secretRefRe.FindStringSubmatch(ref)[1]
+		v, ok := lookupSecret(name, useDB)
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		return v
+	})
+	return out, missing
+}
+
+//resolveConfigSecrets 替换配置项中的密钥引用,系统库初始化前只使用环境变量且忽略未找到的引用
+func resolveConfigSecrets(useDB bool) error {
+	var missing []string
+	for _, key := range viper.AllKeys() {
+		v, ok := viper.Get(key).(string)
+		if !ok || !secretRefRe.MatchString(v) {
+			continue
+		}
+		r, miss := resolveSecretRefs(v, useDB)
+		if len(miss) > 0 {
+			missing = append(missing, miss...)
+			continue
+		}
+		viper.Set(key, r)
+	}
+	if useDB && len(missing) > 0 {
+		return fmt.Errorf("secrets not found: %s", strings.Join(missing, ","))
+	}
+	return nil
+}
+
+//resolveDictSecrets 替换驱动配置中的密钥引用
+func resolveDictSecrets(d map[string]interface{}) error {
+	for k, v := range d {
+		s, ok := v.(string)
+		if !ok || !secretRefRe.MatchString(s) {
+			continue
+		}
+		r, missing := resolveSecretRefs(s, true)
+		if len(missing) > 0 {
+			return fmt.Errorf("secrets not found: %s", strings.Join(missing, ","))
+		}
+		d[k] = r
+	}
+	return nil
+}
+
+//credentialColumns 存储凭据的表字段
+var credentialColumns = []struct {
+	model  interface{}
+	column string
+}{
+	{&Provider{}, "password"},
+	{&Geoserver{}, "password"},
+	{&Upstream{}, "secret"},
+	{&Secret{}, "value"},
+}
+
+//reencryptCredentials 将明文及旧密钥加密的凭据用当前主密钥重新加密,返回更新条数
+func reencryptCredentials() (int, error) {
+	kr := currentKeyring()
+	if kr == nil {
+		return 0, fmt.Errorf("master key not initialized")
+	}
+	n := 0
+	tx := db.Begin()
+	for _, cc := range credentialColumns {
+		scope := tx.NewScope(cc.model)
+		table, pk := scope.TableName(), scope.PrimaryKey()
+		rows, err := tx.Table(table).Select(pk + ", " + cc.column).Rows()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		values := make(map[string]string)
+		for rows.Next() {
+			var id, v string
+			if err := rows.Scan(&id, &v); err != nil {
+				rows.Close()
+				tx.Rollback()
+				return 0, err
+			}
+			if v != "" && credentialKeyID(v) != kr.current.id {
+				values[id] = v
+			}
+		}
+		rows.Close()
+		for id, v := range values {
+			plain, err := decryptCredential(v)
+			if err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("%s(%s).%s: %s", table, id, cc.column, err)
+			}
+			enc, err := encryptCredential(plain)
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+			err = tx.Table(table).Where(pk+" = ?", id).UpdateColumn(cc.column, enc).Error
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+			n++
+		}
+	}
+	return n, tx.Commit().Error
+}
+
+//rotateMasterKey 生成新的主密钥写入密钥文件,重新加密全部凭据后退役旧密钥,
+//重新加密失败时保留旧密钥以便重试
+func rotateMasterKey() (string, int, error) {
+	kr := currentKeyring()
+	if kr == nil {
+		return "", 0, fmt.Errorf("master key not initialized")
+	}
+	if kr.file == "" {
+		return "", 0, fmt.Errorf("主密钥来自环境变量%s,请将新密钥置于首位、旧密钥置后并重启", masterKeyEnv)
+	}
+	material, err := randomKeyMaterial()
+	if err != nil {
+		return "", 0, err
+	}
+	nkr, err := newKeyring(append([]string{material}, kr.materials...), kr.file)
+	if err != nil {
+		return "", 0, err
+	}
+	//先写密钥文件,重新加密失败时旧密钥仍可解密
+	if err := writeKeyFile(kr.file, nkr.materials); err != nil {
+		return "", 0, err
+	}
+	setKeyring(nkr)
+	n, err := reencryptCredentials()
+	if err != nil {
+		return nkr.current.id, n, err
+	}
+	rkr, err := newKeyring([]string{material}, kr.file)
+	if err != nil {
+		return nkr.current.id, n, err
+	}
+	if err := writeKeyFile(kr.file, rkr.materials); err != nil {
+		return rkr.current.id, n, err
+	}
+	setKeyring(rkr)
+	return rkr.current.id, n, nil
+}
+
+//listSecrets 获取命名密钥列表,值已脱敏
+func listSecrets(c *gin.Context) {
+	resp := NewResp()
+	var secrets []Secret
+	err := db.Find(&secrets).Error
+	if err != nil {
+		resp.Fail(c, 5001)
+		return
+	}
+	resp.DoneData(c, secrets)
+}
+
+//putSecret 创建或更新命名密钥
+func putSecret(c *gin.Context) {
+	resp := NewResp()
+	s := &Secret{}
+	err := c.Bind(s)
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 4001)
+		return
+	}
+	if !secretNameRe.MatchString(s.Name) {
+		resp.FailMsg(c, "密钥名只能包含字母、数字及._-")
+		return
+	}
+	s.Value.Unmask("")
+	if s.Value == "" {
+		resp.Fail(c, 4001)
+		return
+	}
+	err = db.Save(s).Error
+	if err != nil {
+		log.Error(err)
+		resp.Fail(c, 5001)
+		return
+	}
+	resp.Done(c, "")
+}
+
+//deleteSecret 删除命名密钥
+func deleteSecret(c *gin.Context) {
+	resp := NewResp()
+	names := strings.Split(c.Param("names"), ",")
+	dbres := db.Where("name in (?)", names).Delete(Secret{})
+	if dbres.Error != nil {
+		log.Error(dbres.Error)
+		resp.Fail(c, 5001)
+		return
+	}
+	resp.DoneData(c, gin.H{
+		"affected": dbres.RowsAffected,
+	})
+}
+
+//rotateSecrets 轮换主密钥
+func rotateSecrets(c *gin.Context) {
+	resp := NewResp()
+	id, n, err := rotateMasterKey()
+	if err != nil {
+		log.Errorf("rotateSecrets, details: %s", err)
+		resp.FailMsg(c, err.Error())
+		return
+	}
+	resp.DoneData(c, gin.H{
+		"key":         id,
+		"reencrypted": n,
+	})
+}
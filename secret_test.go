@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+)
+
+func TestCredential(t *testing.T) {
+	old := currentKeyring()
+	defer setKeyring(old)
+	kr, err := newKeyring([]string{"k1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setKeyring(kr)
+
+	a, _ := Credential("pass").Value()
+	b, _ := Credential("pass").Value()
+	if a == b || credentialKeyID(a.(string)) != kr.current.id {
+		t.Errorf("ciphertexts should be random and carry key id, got %v %v", a, b)
+	}
+	var cr Credential
+	if err := cr.Scan([]byte(a.(string))); err != nil || cr != "pass" {
+		t.Errorf("unexpected decrypted %q %v", cr, err)
+	}
+	if err := cr.Scan("legacy"); err != nil || cr != "legacy" {
+		t.Errorf("plaintext should be accepted, got %q %v", cr, err)
+	}
+
+	prd := Provider{Name: "pg", Password: "pass"}
+	data, _ := json.Marshal(prd)
+	if strings.Contains(string(data), "pass\"") || !strings.Contains(string(data), credentialMask) {
+		t.Errorf("password should be redacted, got %s", data)
+	}
+	if err := json.Unmarshal([]byte(`{"password":"******"}`), &prd); err != nil || prd.Password != "pass" {
+		t.Errorf("mask should keep the original value, got %q", prd.Password)
+	}
+
+	//表单绑定提交脱敏值
+	up := &Upstream{Secret: "pass"}
+	req := httptest.NewRequest("POST", "/", strings.NewReader("name=u&host=h&secret=******"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	prev := up.Secret
+	if err := binding.Form.Bind(req, up); err != nil {
+		t.Fatal(err)
+	}
+	up.Secret.Unmask(prev)
+	if up.Secret != "pass" {
+		t.Errorf("form mask should keep the original value, got %q", up.Secret)
+	}
+
+	//旧密钥加密的数据在轮换后仍可解密
+	kr2, _ := newKeyring([]string{"k2", "k1"}, "")
+	setKeyring(kr2)
+	if err := cr.Scan(a); err != nil || cr != "pass" {
+		t.Errorf("previous key should decrypt, got %q %v", cr, err)
+	}
+	setKeyring(kr)
+	c, _ := Credential("pass").Value()
+	kr3, _ := newKeyring([]string{"k3"}, "")
+	setKeyring(kr3)
+	if err := cr.Scan(c); err == nil {
+		t.Errorf("unknown key should fail")
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	tdb, err := gorm.Open("sqlite3", filepath.Join(dir, "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&Provider{}, &Geoserver{}, &Upstream{}, &Secret{})
+	oldDB, oldKeys, oldFile := db, currentKeyring(), viper.GetString("secrets.keyfile")
+	db = tdb
+	defer func() { db, masterKeys = oldDB, oldKeys; viper.Set("secrets.keyfile", oldFile) }()
+	keyfile := filepath.Join(dir, "keys", "master.key")
+	viper.Set("secrets.keyfile", keyfile)
+	if err := initSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	first := currentKeyring().current.id
+
+	//旧版本明文存储的数据
+	tdb.Exec(`INSERT INTO providers (id, name, password) VALUES ('p1', 'pg', 'plain')`)
+	if err := tdb.Create(&Secret{Name: "smtp", Value: "mailpass"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	raw := func(table, col string) string {
+		var v string
+		tdb.Table(table).Select(col).Row().Scan(&v)
+		return v
+	}
+	if credentialKeyID(raw("secrets", "value")) != first {
+		t.Errorf("secret should be stored encrypted, got %s", raw("secrets", "value"))
+	}
+	if n, err := reencryptCredentials(); err != nil || n != 1 || credentialKeyID(raw("providers", "password")) != first {
+		t.Errorf("plaintext password should be encrypted, got %d %v %s", n, err, raw("providers", "password"))
+	}
+
+	id, n, err := rotateMasterKey()
+	if err != nil || n != 2 || id == first {
+		t.Fatalf("unexpected rotation %s %d %v", id, n, err)
+	}
+	if credentialKeyID(raw("providers", "password")) != id || credentialKeyID(raw("secrets", "value")) != id {
+		t.Errorf("credentials should be encrypted with new key")
+	}
+	data, _ := ioutil.ReadFile(keyfile)
+	if lines := strings.Fields(string(data)); len(lines) != 1 || len(currentKeyring().keys) != 1 {
+		t.Errorf("previous key should be retired, got %d keys", len(lines))
+	}
+	prd := &Provider{}
+	if err := tdb.Where("id = ?", "p1").First(prd).Error; err != nil || prd.Password != "plain" {
+		t.Errorf("unexpected password %q %v", prd.Password, err)
+	}
+
+	//配置引用
+	os.Setenv("ATLAS_SECRET_JWT_KEY", "envkey")
+	defer os.Unsetenv("ATLAS_SECRET_JWT_KEY")
+	viper.Set("test.smtp", "${secret:smtp}")
+	viper.Set("test.jwt", "pre-${secret:jwt.key}")
+	if err := resolveConfigSecrets(true); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("test.smtp") != "mailpass" || viper.GetString("test.jwt") != "pre-envkey" {
+		t.Errorf("unexpected resolved config %s %s", viper.GetString("test.smtp"), viper.GetString("test.jwt"))
+	}
+	viper.Set("test.missing", "${secret:nope}")
+	if resolveConfigSecrets(false) != nil || resolveConfigSecrets(true) == nil {
+		t.Errorf("missing secret should only fail once the system db is available")
+	}
+	viper.Set("test.missing", "")
+}
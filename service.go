@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -135,6 +136,66 @@ func (us *UserSet) dataset(uid, did string) *Dataset {
 	return nil
 }
 
+//tilesets 用户可访问的瓦片集,包括自有瓦片集及有权限的公开瓦片集,按ID排序
+func (us *UserSet) tilesets(uid string) []*Tileset {
+	var tss []*Tileset
+	seen := make(map[string]bool)
+	collect := func(set *ServiceSet, public bool) {
+		set.T.Range(func(k, v interface{}) bool {
+			ts, ok := v.(*Tileset)
+			if !ok || seen[ts.ID] {
+				return true
+			}
+			if public && (!ts.Public || !(DISABLEACCESSTOKEN || casEnf.Enforce(uid, ts.ID, "GET"))) {
+				return true
+			}
+			seen[ts.ID] = true
+			tss = append(tss, ts)
+			return true
+		})
+	}
+	if set := us.service(uid); set != nil {
+		collect(set, false)
+	}
+	if uid != ATLAS {
+		if set := us.service(ATLAS); set != nil {
+			collect(set, true)
+		}
+	}
+	sort.Slice(tss, func(i, j int) bool { return tss[i].ID < tss[j].ID })
+	return tss
+}
+
+//datasets 用户可访问的数据集,包括自有数据集及有权限的公开数据集,按ID排序
+func (us *UserSet) datasets(uid string) []*Dataset {
+	var dss []*Dataset
+	seen := make(map[string]bool)
+	collect := func(set *ServiceSet, public bool) {
+		set.D.Range(func(k, v interface{}) bool {
+			dt, ok := v.(*Dataset)
+			if !ok || seen[dt.ID] {
+				return true
+			}
+			if public && (!dt.Public || !(DISABLEACCESSTOKEN || casEnf.Enforce(uid, dt.ID, "GET"))) {
+				return true
+			}
+			seen[dt.ID] = true
+			dss = append(dss, dt)
+			return true
+		})
+	}
+	if set := us.service(uid); set != nil {
+		collect(set, false)
+	}
+	if uid != ATLAS {
+		if set := us.service(ATLAS); set != nil {
+			collect(set, true)
+		}
+	}
+	sort.Slice(dss, func(i, j int) bool { return dss[i].ID < dss[j].ID })
+	return dss
+}
+
 // ServiceSet 服务集，S->style样式服务，F->font字体服务，T->tileset瓦片服务，D->dataset数据服务.
 type ServiceSet struct {
 	// ID    string
@@ -0,0 +1,1020 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//SLDSCALE0 0级比例尺分母,OGC标准像素0.28mm,256瓦片
+const SLDSCALE0 = 559082264.0287178
+
+//GLSCALE0 Mapbox GL 0级比例尺分母,GL使用512瓦片,比SLD级别小1
+const GLSCALE0 = SLDSCALE0 / 2
+
+//SLDOptions SLD转换参数
+type SLDOptions struct {
+	Source      string //样式中的数据源ID
+	SourceLayer string //矢量数据源图层,为空时使用NamedLayer名称
+	Raster      bool   //栅格数据源
+}
+
+//SLDIcon SLD外部图形,需要导入到样式图标
+type SLDIcon struct {
+	Name   string `json:"name"`
+	Href   string `json:"href"`
+	Format string `json:"format"`
+}
+
+//SLDResult SLD转换结果
+type SLDResult struct {
+	Layers   []map[string]interface{} `json:"layers"`
+	Icons    []*SLDIcon               `json:"icons"`
+	Warnings []string                 `json:"warnings"`
+	sizes    map[string]interface{}   //图标图层的SLD尺寸
+}
+
+//sldNode 通用XML节点,保留子节点与文本顺序,忽略命名空间(兼容SLD 1.0与SE 1.1)
+type sldNode struct {
+	Name     string
+	Attrs    map[string]string
+	Text     string
+	Children []*sldNode
+}
+
+//UnmarshalXML 解析XML节点
+func (n *sldNode) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	n.Name = start.Name.Local
+	n.Attrs = make(map[string]string)
+	for _, a := range start.Attr {
+		n.Attrs[a.Name.Local] = a.Value
+	}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child := &sldNode{}
+			err := child.UnmarshalXML(d, t)
+			if err != nil {
+				return err
+			}
+			n.Children = append(n.Children, child)
+		case xml.CharData:
+			s := string(t)
+			if strings.TrimSpace(s) != "" {
+				n.Children = append(n.Children, &sldNode{Text: s})
+				n.Text += s
+			}
+		case xml.EndElement:
+			n.Text = strings.TrimSpace(n.Text)
+			return nil
+		}
+	}
+}
+
+func (n *sldNode) child(name string) *sldNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *sldNode) children(name string) []*sldNode {
+	var out []*sldNode
+	if n == nil {
+		return out
+	}
+	for _, c := range n.Children {
+		if c.Name == name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (n *sldNode) elements() []*sldNode {
+	var out []*sldNode
+	if n == nil {
+		return out
+	}
+	for _, c := range n.Children {
+		if c.Name != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (n *sldNode) childText(name string) string {
+	c := n.child(name)
+	if c == nil {
+		return ""
+	}
+	return c.Text
+}
+
+//params CssParameter/SvgParameter参数
+func (n *sldNode) params() map[string]*sldNode {
+	out := make(map[string]*sldNode)
+	if n == nil {
+		return out
+	}
+	for _, c := range n.Children {
+		if c.Name == "CssParameter" || c.Name == "SvgParameter" {
+			out[c.Attrs["name"]] = c
+		}
+	}
+	return out
+}
+
+type sldConverter struct {
+	opts   SLDOptions
+	res    *SLDResult
+	ids    map[string]int
+	icons  map[string]bool
+	layer  string
+	ruleID string
+}
+
+//ConvertSLD 将SLD/SE样式转换为Mapbox GL样式图层,无法转换的部分记录在Warnings中
+func ConvertSLD(data []byte, opts SLDOptions) (*SLDResult, error) {
+	root := &sldNode{}
+	err := xml.Unmarshal(data, root)
+	if err != nil {
+		return nil, fmt.Errorf("parse sld error, details: %s", err)
+	}
+	if root.Name != "StyledLayerDescriptor" {
+		return nil, fmt.Errorf("not a StyledLayerDescriptor document, root element is %s", root.Name)
+	}
+	cv := &sldConverter{
+		opts:  opts,
+		res:   &SLDResult{sizes: make(map[string]interface{})},
+		ids:   make(map[string]int),
+		icons: make(map[string]bool),
+	}
+	for _, nl := range root.elements() {
+		if nl.Name != "NamedLayer" && nl.Name != "UserLayer" {
+			continue
+		}
+		cv.convertNamedLayer(nl)
+	}
+	if len(cv.res.Layers) == 0 {
+		cv.warn("no style layers generated")
+	}
+	return cv.res, nil
+}
+
+func (cv *sldConverter) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if cv.ruleID != "" {
+		msg = cv.ruleID + ": " + msg
+	}
+	cv.res.Warnings = append(cv.res.Warnings, msg)
+}
+
+func (cv *sldConverter) convertNamedLayer(nl *sldNode) {
+	cv.layer = nl.childText("Name")
+	if i := strings.LastIndex(cv.layer, ":"); i >= 0 {
+		cv.layer = cv.layer[i+1:]
+	}
+	if nl.child("NamedStyle") != nil {
+		cv.warn("layer %s: NamedStyle references a server side style, ignored", cv.layer)
+	}
+	styles := nl.children("UserStyle")
+	if len(styles) == 0 {
+		return
+	}
+	us := styles[0]
+	for _, s := range styles {
+		if v := s.childText("IsDefault"); v == "1" || v == "true" {
+			us = s
+			break
+		}
+	}
+	if len(styles) > 1 {
+		cv.warn("layer %s: %d user styles found, only %s converted", cv.layer, len(styles), us.childText("Name"))
+	}
+	for _, fts := range us.elements() {
+		if fts.Name != "FeatureTypeStyle" && fts.Name != "CoverageStyle" {
+			continue
+		}
+		if fts.child("Transformation") != nil {
+			cv.warn("layer %s: rendering transformation not supported", cv.layer)
+		}
+		cv.convertFeatureTypeStyle(fts)
+	}
+}
+
+func (cv *sldConverter) convertFeatureTypeStyle(fts *sldNode) {
+	rules := fts.children("Rule")
+	//ElseFilter需要其它规则的过滤条件
+	filters := make([]interface{}, len(rules))
+	errs := make([]error, len(rules))
+	for i, r := range rules {
+		if f := r.child("Filter"); f != nil {
+			filters[i], errs[i] = cv.filter(f)
+		}
+	}
+	for i, r := range rules {
+		name := r.childText("Name")
+		if name == "" {
+			name = r.childText("Title")
+		}
+		if name == "" {
+			name = fmt.Sprintf("rule%d", i+1)
+		}
+		cv.ruleID = cv.layer + "/" + name
+		if errs[i] != nil {
+			cv.warn("rule skipped, %s", errs[i])
+			continue
+		}
+		filter := filters[i]
+		if r.child("ElseFilter") != nil {
+			var others []interface{}
+			skip := false
+			for j := range rules {
+				if j == i || rules[j].child("ElseFilter") != nil {
+					continue
+				}
+				if errs[j] != nil {
+					skip = true
+					break
+				}
+				if filters[j] == nil {
+					//存在无条件规则,ElseFilter永不生效
+					skip = true
+					break
+				}
+				others = append(others, filters[j])
+			}
+			if skip {
+				cv.warn("ElseFilter can not be translated, rule skipped")
+				continue
+			}
+			if len(others) > 0 {
+				filter = []interface{}{"!", append([]interface{}{"any"}, others...)}
+			}
+		}
+		minzoom, maxzoom := -1.0, -1.0
+		if v, err := strconv.ParseFloat(r.childText("MaxScaleDenominator"), 64); err == nil && v > 0 {
+			minzoom = scaleToZoom(v)
+		}
+		if v, err := strconv.ParseFloat(r.childText("MinScaleDenominator"), 64); err == nil && v > 0 {
+			maxzoom = scaleToZoom(v)
+		}
+		base := slugID(cv.layer + "-" + name)
+		for _, sym := range r.elements() {
+			if !strings.HasSuffix(sym.Name, "Symbolizer") {
+				continue
+			}
+			for _, l := range cv.symbolizer(sym, base) {
+				if filter != nil {
+					l["filter"] = filter
+				}
+				if minzoom > 0 {
+					l["minzoom"] = minzoom
+				}
+				if maxzoom >= 0 {
+					l["maxzoom"] = maxzoom
+				}
+				l["metadata"] = map[string]interface{}{"sld:rule": name, "sld:layer": cv.layer}
+				cv.res.Layers = append(cv.res.Layers, l)
+			}
+		}
+	}
+	cv.ruleID = ""
+}
+
+//scaleToZoom 比例尺分母转换为Mapbox GL缩放级别
+func scaleToZoom(denom float64) float64 {
+	z := math.Log2(GLSCALE0 / denom)
+	if z < 0 {
+		z = 0
+	}
+	if z > 24 {
+		z = 24
+	}
+	return math.Round(z*100) / 100
+}
+
+var slugReg = regexp.MustCompile(`[^\p{L}\p{N}_-]+`)
+
+func slugID(s string) string {
+	s = strings.Trim(slugReg.ReplaceAllString(s, "_"), "_")
+	if s == "" {
+		s = "layer"
+	}
+	return s
+}
+
+func (cv *sldConverter) newLayer(base, typ string) map[string]interface{} {
+	id := base + "-" + typ
+	cv.ids[id]++
+	if n := cv.ids[id]; n > 1 {
+		id = fmt.Sprintf("%s-%d", id, n)
+	}
+	l := map[string]interface{}{
+		"id":     id,
+		"type":   typ,
+		"source": cv.opts.Source,
+		"paint":  map[string]interface{}{},
+		"layout": map[string]interface{}{},
+	}
+	if typ != "raster" {
+		layer := cv.opts.SourceLayer
+		if layer == "" {
+			layer = cv.layer
+		}
+		l["source-layer"] = layer
+	}
+	return l
+}
+
+func (cv *sldConverter) symbolizer(sym *sldNode, base string) []map[string]interface{} {
+	if cv.opts.Raster != (sym.Name == "RasterSymbolizer") {
+		cv.warn("%s not applicable to the %s source, skipped", sym.Name, cv.opts.Source)
+		return nil
+	}
+	if sym.child("Geometry") != nil {
+		cv.warn("%s geometry expression ignored", sym.Name)
+	}
+	var layers []map[string]interface{}
+	switch sym.Name {
+	case "PolygonSymbolizer":
+		if fill := sym.child("Fill"); fill != nil {
+			l := cv.newLayer(base, "fill")
+			cv.fillPaint(fill, l)
+			if d := sym.child("Displacement"); d != nil {
+				l["paint"].(map[string]interface{})["fill-translate"] = []interface{}{cv.number(d.child("DisplacementX"), 0), cv.negate(cv.number(d.child("DisplacementY"), 0))}
+			}
+			layers = append(layers, l)
+		}
+		if stroke := sym.child("Stroke"); stroke != nil {
+			l := cv.newLayer(base, "line")
+			cv.strokePaint(stroke, l)
+			layers = append(layers, l)
+		}
+		if sym.child("PerpendicularOffset") != nil {
+			cv.warn("PolygonSymbolizer PerpendicularOffset not supported")
+		}
+	case "LineSymbolizer":
+		l := cv.newLayer(base, "line")
+		stroke := sym.child("Stroke")
+		if stroke == nil {
+			stroke = &sldNode{Name: "Stroke"}
+		}
+		cv.strokePaint(stroke, l)
+		if off := sym.child("PerpendicularOffset"); off != nil {
+			l["paint"].(map[string]interface{})["line-offset"] = cv.negate(cv.number(off, 0))
+		}
+		layers = append(layers, l)
+	case "PointSymbolizer":
+		if l := cv.graphic(sym.child("Graphic"), base); l != nil {
+			layers = append(layers, l)
+		}
+	case "TextSymbolizer":
+		if l := cv.text(sym, base); l != nil {
+			layers = append(layers, l)
+		}
+	case "RasterSymbolizer":
+		l := cv.newLayer(base, "raster")
+		if op := sym.child("Opacity"); op != nil {
+			l["paint"].(map[string]interface{})["raster-opacity"] = cv.number(op, 1)
+		}
+		for _, n := range []string{"ChannelSelection", "ColorMap", "ContrastEnhancement", "ShadedRelief", "ImageOutline", "OverlapBehavior"} {
+			if sym.child(n) != nil {
+				cv.warn("RasterSymbolizer %s not supported", n)
+			}
+		}
+		layers = append(layers, l)
+	default:
+		cv.warn("%s not supported", sym.Name)
+	}
+	for _, n := range sym.children("VendorOption") {
+		cv.warn("vendor option %s ignored", n.Attrs["name"])
+	}
+	for _, l := range layers {
+		if len(l["paint"].(map[string]interface{})) == 0 {
+			delete(l, "paint")
+		}
+		if len(l["layout"].(map[string]interface{})) == 0 {
+			delete(l, "layout")
+		}
+	}
+	return layers
+}
+
+func (cv *sldConverter) fillPaint(fill *sldNode, l map[string]interface{}) {
+	paint := l["paint"].(map[string]interface{})
+	if g := fill.child("GraphicFill"); g != nil {
+		if icon := cv.externalGraphic(g.child("Graphic")); icon != "" {
+			paint["fill-pattern"] = icon
+		} else {
+			cv.warn("GraphicFill with marks not supported, use fill color")
+		}
+	}
+	ps := fill.params()
+	paint["fill-color"] = cv.value(ps["fill"], "#808080")
+	if p, ok := ps["fill-opacity"]; ok {
+		paint["fill-opacity"] = cv.number(p, 1)
+	}
+}
+
+func (cv *sldConverter) strokePaint(stroke *sldNode, l map[string]interface{}) {
+	paint := l["paint"].(map[string]interface{})
+	layout := l["layout"].(map[string]interface{})
+	if stroke.child("GraphicStroke") != nil || stroke.child("GraphicFill") != nil {
+		cv.warn("graphic stroke not supported, use stroke color")
+	}
+	ps := stroke.params()
+	paint["line-color"] = cv.value(ps["stroke"], "#000000")
+	width := cv.number(ps["stroke-width"], 1)
+	paint["line-width"] = width
+	if p, ok := ps["stroke-opacity"]; ok {
+		paint["line-opacity"] = cv.number(p, 1)
+	}
+	if p, ok := ps["stroke-dasharray"]; ok {
+		w, _ := width.(float64)
+		if w <= 0 {
+			w = 1
+		}
+		var dashes []interface{}
+		for _, s := range strings.FieldsFunc(p.Text, func(r rune) bool { return r == ' ' || r == ',' }) {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				dashes = nil
+				break
+			}
+			//GL虚线长度以线宽为单位
+			dashes = append(dashes, math.Round(v/w*100)/100)
+		}
+		if len(dashes) > 0 {
+			paint["line-dasharray"] = dashes
+		} else {
+			cv.warn("stroke-dasharray %q not supported", p.Text)
+		}
+	}
+	if p, ok := ps["stroke-dashoffset"]; ok && p.Text != "0" {
+		cv.warn("stroke-dashoffset not supported")
+	}
+	if p, ok := ps["stroke-linejoin"]; ok {
+		switch p.Text {
+		case "mitre", "miter":
+			layout["line-join"] = "miter"
+		case "round", "bevel":
+			layout["line-join"] = p.Text
+		}
+	}
+	if p, ok := ps["stroke-linecap"]; ok {
+		switch p.Text {
+		case "butt", "round", "square":
+			layout["line-cap"] = p.Text
+		}
+	}
+}
+
+//externalGraphic 外部图形转为图标名称
+func (cv *sldConverter) externalGraphic(g *sldNode) string {
+	eg := g.child("ExternalGraphic")
+	if eg == nil {
+		return ""
+	}
+	href := eg.child("OnlineResource").attr("href")
+	if href == "" {
+		if eg.child("InlineContent") != nil {
+			cv.warn("inline graphic content not supported")
+		}
+		return ""
+	}
+	file := path.Base(strings.SplitN(href, "?", 2)[0])
+	name := slugID(strings.TrimSuffix(file, path.Ext(file)))
+	if !cv.icons[name] {
+		cv.icons[name] = true
+		cv.res.Icons = append(cv.res.Icons, &SLDIcon{Name: name, Href: href, Format: eg.childText("Format")})
+	}
+	return name
+}
+
+func (n *sldNode) attr(name string) string {
+	if n == nil {
+		return ""
+	}
+	return n.Attrs[name]
+}
+
+func (cv *sldConverter) graphic(g *sldNode, base string) map[string]interface{} {
+	if g == nil {
+		cv.warn("PointSymbolizer without graphic, skipped")
+		return nil
+	}
+	size := cv.number(g.child("Size"), 6)
+	//外部图形优先
+	if icon := cv.externalGraphic(g); icon != "" {
+		l := cv.newLayer(base, "symbol")
+		layout := l["layout"].(map[string]interface{})
+		layout["icon-image"] = icon
+		layout["icon-allow-overlap"] = true
+		if g.child("Size") != nil {
+			//图标尺寸在导入图标后按实际高度换算
+			cv.res.sizes[l["id"].(string)] = size
+		}
+		if r := g.child("Rotation"); r != nil {
+			layout["icon-rotate"] = cv.number(r, 0)
+		}
+		if op := g.child("Opacity"); op != nil {
+			l["paint"].(map[string]interface{})["icon-opacity"] = cv.number(op, 1)
+		}
+		return l
+	}
+	mark := g.child("Mark")
+	if mark == nil {
+		cv.warn("graphic without usable mark or external graphic, skipped")
+		return nil
+	}
+	wkn := mark.childText("WellKnownName")
+	if wkn != "" && wkn != "circle" {
+		cv.warn("mark %s rendered as circle", wkn)
+	}
+	l := cv.newLayer(base, "circle")
+	paint := l["paint"].(map[string]interface{})
+	if s, ok := size.(float64); ok {
+		paint["circle-radius"] = s / 2
+	} else {
+		paint["circle-radius"] = []interface{}{"/", size, 2}
+	}
+	fill, stroke := mark.child("Fill"), mark.child("Stroke")
+	if fill == nil && stroke == nil {
+		fill, stroke = &sldNode{Name: "Fill"}, &sldNode{Name: "Stroke"}
+	}
+	if fill != nil {
+		ps := fill.params()
+		paint["circle-color"] = cv.value(ps["fill"], "#808080")
+		if p, ok := ps["fill-opacity"]; ok {
+			paint["circle-opacity"] = cv.number(p, 1)
+		}
+	} else {
+		paint["circle-opacity"] = 0.0
+	}
+	if stroke != nil {
+		ps := stroke.params()
+		paint["circle-stroke-color"] = cv.value(ps["stroke"], "#000000")
+		paint["circle-stroke-width"] = cv.number(ps["stroke-width"], 1)
+		if p, ok := ps["stroke-opacity"]; ok {
+			paint["circle-stroke-opacity"] = cv.number(p, 1)
+		}
+	}
+	if op := g.child("Opacity"); op != nil {
+		cv.warn("graphic opacity merged into fill opacity")
+		if _, ok := paint["circle-opacity"]; !ok {
+			paint["circle-opacity"] = cv.number(op, 1)
+		}
+	}
+	if g.child("Rotation") != nil && wkn != "" && wkn != "circle" {
+		cv.warn("mark rotation ignored")
+	}
+	return l
+}
+
+func (cv *sldConverter) text(sym *sldNode, base string) map[string]interface{} {
+	label := sym.child("Label")
+	if label == nil {
+		cv.warn("TextSymbolizer without label, skipped")
+		return nil
+	}
+	field, err := cv.expr(label)
+	if err != nil {
+		cv.warn("label %s, skipped", err)
+		return nil
+	}
+	if s, ok := field.(string); ok {
+		field = strings.TrimSpace(s)
+	}
+	l := cv.newLayer(base, "symbol")
+	layout := l["layout"].(map[string]interface{})
+	paint := l["paint"].(map[string]interface{})
+	layout["text-field"] = field
+	font := sym.child("Font").params()
+	family := "Noto Sans"
+	if p, ok := font["font-family"]; ok && p.Text != "" {
+		family = strings.TrimSpace(strings.Split(p.Text, ",")[0])
+	}
+	style := "Regular"
+	if p, ok := font["font-weight"]; ok && p.Text == "bold" {
+		style = "Bold"
+	} else if p, ok := font["font-style"]; ok && (p.Text == "italic" || p.Text == "oblique") {
+		style = "Italic"
+	}
+	layout["text-font"] = []interface{}{family + " " + style}
+	size := cv.number(font["font-size"], 10)
+	layout["text-size"] = size
+	fill := sym.child("Fill").params()
+	paint["text-color"] = cv.value(fill["fill"], "#000000")
+	if p, ok := fill["fill-opacity"]; ok {
+		paint["text-opacity"] = cv.number(p, 1)
+	}
+	if halo := sym.child("Halo"); halo != nil {
+		paint["text-halo-width"] = cv.number(halo.child("Radius"), 1)
+		paint["text-halo-color"] = cv.value(halo.child("Fill").params()["fill"], "#ffffff")
+	}
+	placement := sym.child("LabelPlacement")
+	if pp := placement.child("PointPlacement"); pp != nil {
+		if ap := pp.child("AnchorPoint"); ap != nil {
+			x, _ := strconv.ParseFloat(ap.childText("AnchorPointX"), 64)
+			y, _ := strconv.ParseFloat(ap.childText("AnchorPointY"), 64)
+			layout["text-anchor"] = textAnchor(x, y)
+		}
+		if d := pp.child("Displacement"); d != nil {
+			s, ok := size.(float64)
+			dx, errx := strconv.ParseFloat(d.childText("DisplacementX"), 64)
+			dy, erry := strconv.ParseFloat(d.childText("DisplacementY"), 64)
+			if ok && s > 0 && errx == nil && erry == nil {
+				//SLD像素位移,y轴向上;GL以字号为单位,y轴向下
+				layout["text-offset"] = []interface{}{math.Round(dx/s*100) / 100, math.Round(-dy/s*100) / 100}
+			} else {
+				cv.warn("label displacement not supported")
+			}
+		}
+		if r := pp.child("Rotation"); r != nil {
+			layout["text-rotate"] = cv.number(r, 0)
+		}
+	}
+	if lp := placement.child("LinePlacement"); lp != nil {
+		layout["symbol-placement"] = "line"
+		if lp.child("PerpendicularOffset") != nil {
+			cv.warn("label perpendicular offset not supported")
+		}
+	}
+	if sym.child("Graphic") != nil {
+		cv.warn("label graphic (shield) not supported")
+	}
+	if sym.child("Priority") != nil {
+		cv.warn("label priority not supported")
+	}
+	return l
+}
+
+//textAnchor SLD锚点(0,0为左下)转换为GL文字锚点
+func textAnchor(x, y float64) string {
+	h, v := "", ""
+	if x < 0.25 {
+		h = "left"
+	} else if x > 0.75 {
+		h = "right"
+	}
+	if y < 0.25 {
+		v = "bottom"
+	} else if y > 0.75 {
+		v = "top"
+	}
+	switch {
+	case h == "" && v == "":
+		return "center"
+	case h == "":
+		return v
+	case v == "":
+		return h
+	}
+	return v + "-" + h
+}
+
+//expr 表达式转换,支持Literal、PropertyName、混合文本与四则运算
+func (cv *sldConverter) expr(n *sldNode) (interface{}, error) {
+	var parts []interface{}
+	for _, c := range n.Children {
+		switch c.Name {
+		case "":
+			parts = append(parts, c.Text)
+		default:
+			v, err := cv.operand(c)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, v)
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return "", nil
+	case 1:
+		return parts[0], nil
+	}
+	out := []interface{}{"concat"}
+	for _, p := range parts {
+		if _, ok := p.(string); ok {
+			out = append(out, p)
+		} else {
+			out = append(out, []interface{}{"to-string", p})
+		}
+	}
+	return out, nil
+}
+
+func (cv *sldConverter) operand(n *sldNode) (interface{}, error) {
+	switch n.Name {
+	case "Literal":
+		return n.Text, nil
+	case "PropertyName", "ValueReference":
+		prop := n.Text
+		if i := strings.LastIndex(prop, ":"); i >= 0 {
+			prop = prop[i+1:]
+		}
+		return []interface{}{"get", prop}, nil
+	case "Add", "Sub", "Mul", "Div":
+		ops := map[string]string{"Add": "+", "Sub": "-", "Mul": "*", "Div": "/"}
+		args := n.elements()
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s requires two operands", n.Name)
+		}
+		out := []interface{}{ops[n.Name]}
+		for _, a := range args {
+			v, err := cv.operand(a)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, toNumber(v))
+		}
+		return out, nil
+	case "Function":
+		return nil, fmt.Errorf("function %s not supported", n.Attrs["name"])
+	}
+	return nil, fmt.Errorf("expression %s not supported", n.Name)
+}
+
+func toNumber(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return f
+		}
+		return s
+	}
+	return []interface{}{"to-number", v}
+}
+
+//value 字符串属性值,缺省返回def
+func (cv *sldConverter) value(n *sldNode, def string) interface{} {
+	if n == nil {
+		return def
+	}
+	v, err := cv.expr(n)
+	if err != nil {
+		cv.warn("%s, use default %s", err, def)
+		return def
+	}
+	if s, ok := v.(string); ok {
+		return strings.TrimSpace(s)
+	}
+	return v
+}
+
+//number 数值属性值,缺省返回def
+func (cv *sldConverter) number(n *sldNode, def float64) interface{} {
+	if n == nil {
+		return def
+	}
+	v, err := cv.expr(n)
+	if err != nil {
+		cv.warn("%s, use default %v", err, def)
+		return def
+	}
+	v = toNumber(v)
+	if s, ok := v.(string); ok {
+		cv.warn("invalid number %q, use default %v", s, def)
+		return def
+	}
+	return v
+}
+
+func (cv *sldConverter) negate(v interface{}) interface{} {
+	if f, ok := v.(float64); ok {
+		if f == 0 {
+			return 0.0
+		}
+		return -f
+	}
+	return []interface{}{"-", v}
+}
+
+//filter OGC Filter转换为GL表达式
+func (cv *sldConverter) filter(f *sldNode) (interface{}, error) {
+	els := f.elements()
+	if len(els) == 0 {
+		return nil, nil
+	}
+	//FeatureId/ResourceId可以有多个
+	var ids []interface{}
+	for _, e := range els {
+		if e.Name != "FeatureId" && e.Name != "ResourceId" && e.Name != "GmlObjectId" {
+			break
+		}
+		id := e.Attrs["fid"]
+		if id == "" {
+			id = e.Attrs["rid"]
+		}
+		if id == "" {
+			id = e.Attrs["id"]
+		}
+		if i := strings.LastIndex(id, "."); i >= 0 {
+			id = id[i+1:]
+		}
+		if n, err := strconv.ParseFloat(id, 64); err == nil {
+			ids = append(ids, n)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == len(els) {
+		return []interface{}{"in", []interface{}{"id"}, []interface{}{"literal", ids}}, nil
+	}
+	if len(els) > 1 {
+		return nil, fmt.Errorf("filter with multiple predicates not supported")
+	}
+	return cv.predicate(els[0])
+}
+
+var sldComparisons = map[string]string{
+	"PropertyIsEqualTo":              "==",
+	"PropertyIsNotEqualTo":           "!=",
+	"PropertyIsLessThan":             "<",
+	"PropertyIsLessThanOrEqualTo":    "<=",
+	"PropertyIsGreaterThan":          ">",
+	"PropertyIsGreaterThanOrEqualTo": ">=",
+}
+
+func (cv *sldConverter) predicate(n *sldNode) (interface{}, error) {
+	switch n.Name {
+	case "And", "Or":
+		op := "all"
+		if n.Name == "Or" {
+			op = "any"
+		}
+		out := []interface{}{op}
+		for _, c := range n.elements() {
+			v, err := cv.predicate(c)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case "Not":
+		els := n.elements()
+		if len(els) != 1 {
+			return nil, fmt.Errorf("Not requires one predicate")
+		}
+		v, err := cv.predicate(els[0])
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{"!", v}, nil
+	case "PropertyIsNull", "PropertyIsNil":
+		els := n.elements()
+		if len(els) != 1 {
+			return nil, fmt.Errorf("%s requires one operand", n.Name)
+		}
+		v, err := cv.operand(els[0])
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{"==", v, nil}, nil
+	case "PropertyIsBetween":
+		els := n.elements()
+		if len(els) != 3 {
+			return nil, fmt.Errorf("PropertyIsBetween requires expression and boundaries")
+		}
+		v, err := cv.operand(els[0])
+		if err != nil {
+			return nil, err
+		}
+		lo, err := cv.boundary(n.child("LowerBoundary"))
+		if err != nil {
+			return nil, err
+		}
+		hi, err := cv.boundary(n.child("UpperBoundary"))
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{"all", []interface{}{">=", v, lo}, []interface{}{"<=", v, hi}}, nil
+	case "PropertyIsLike":
+		return cv.like(n)
+	}
+	if op, ok := sldComparisons[n.Name]; ok {
+		els := n.elements()
+		if len(els) != 2 {
+			return nil, fmt.Errorf("%s requires two operands", n.Name)
+		}
+		var args []interface{}
+		for _, e := range els {
+			v, err := cv.operand(e)
+			if err != nil {
+				return nil, err
+			}
+			if e.Name == "Literal" {
+				v = toNumber(v)
+			}
+			if n.Attrs["matchCase"] == "false" {
+				v = []interface{}{"downcase", []interface{}{"to-string", v}}
+			}
+			args = append(args, v)
+		}
+		return []interface{}{op, args[0], args[1]}, nil
+	}
+	return nil, fmt.Errorf("filter %s not supported", n.Name)
+}
+
+func (cv *sldConverter) boundary(n *sldNode) (interface{}, error) {
+	els := n.elements()
+	if len(els) != 1 {
+		return nil, fmt.Errorf("invalid between boundary")
+	}
+	v, err := cv.operand(els[0])
+	if err != nil {
+		return nil, err
+	}
+	return toNumber(v), nil
+}
+
+//like PropertyIsLike仅支持前缀、后缀、包含匹配
+func (cv *sldConverter) like(n *sldNode) (interface{}, error) {
+	prop := n.child("PropertyName")
+	if prop == nil {
+		prop = n.child("ValueReference")
+	}
+	lit := n.child("Literal")
+	if prop == nil || lit == nil {
+		return nil, fmt.Errorf("PropertyIsLike requires property and literal")
+	}
+	get, err := cv.operand(prop)
+	if err != nil {
+		return nil, err
+	}
+	wc, sc := n.Attrs["wildCard"], n.Attrs["singleChar"]
+	if wc == "" {
+		wc = "*"
+	}
+	esc := n.Attrs["escapeChar"]
+	if esc == "" {
+		esc = n.Attrs["escape"]
+	}
+	pattern := lit.Text
+	if (sc != "" && strings.Contains(pattern, sc)) || (esc != "" && strings.Contains(pattern, esc)) {
+		return nil, fmt.Errorf("like pattern %q not supported", pattern)
+	}
+	prefix := strings.HasSuffix(pattern, wc)
+	suffix := strings.HasPrefix(pattern, wc)
+	mid := strings.TrimSuffix(strings.TrimPrefix(pattern, wc), wc)
+	if strings.Contains(mid, wc) {
+		return nil, fmt.Errorf("like pattern %q not supported", pattern)
+	}
+	var s interface{} = []interface{}{"to-string", get}
+	var value interface{} = mid
+	if n.Attrs["matchCase"] == "false" {
+		s = []interface{}{"downcase", s}
+		value = strings.ToLower(mid)
+	}
+	size := utf8.RuneCountInString(mid)
+	switch {
+	case mid == "":
+		return []interface{}{"!=", get, nil}, nil
+	case prefix && suffix:
+		return []interface{}{"in", value, s}, nil
+	case prefix:
+		return []interface{}{"==", []interface{}{"slice", s, 0, size}, value}, nil
+	case suffix:
+		return []interface{}{"==", []interface{}{"slice", s, []interface{}{"-", []interface{}{"length", s}, size}}, value}, nil
+	}
+	return []interface{}{"==", s, value}, nil
+}
+
+//ScaleIcons 按导入图标的实际高度换算图标尺寸
+func (r *SLDResult) ScaleIcons(heights map[string]int) {
+	for _, l := range r.Layers {
+		size, ok := r.sizes[l["id"].(string)]
+		if !ok {
+			continue
+		}
+		layout, _ := l["layout"].(map[string]interface{})
+		name, _ := layout["icon-image"].(string)
+		h := heights[name]
+		if h <= 0 {
+			continue
+		}
+		if s, ok := size.(float64); ok {
+			layout["icon-size"] = math.Round(s/float64(h)*100) / 100
+		} else {
+			layout["icon-size"] = []interface{}{"/", size, h}
+		}
+	}
+}
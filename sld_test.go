@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSLD10 = `<?xml version="1.0" encoding="UTF-8"?>
+<StyledLayerDescriptor version="1.0.0" xmlns="http://www.opengis.net/sld" xmlns:ogc="http://www.opengis.net/ogc" xmlns:xlink="http://www.w3.org/1999/xlink">
+  <NamedLayer>
+    <Name>topp:roads</Name>
+    <UserStyle>
+      <Name>roads</Name>
+      <FeatureTypeStyle>
+        <Rule>
+          <Name>highway</Name>
+          <ogc:Filter>
+            <ogc:And>
+              <ogc:PropertyIsEqualTo><ogc:PropertyName>type</ogc:PropertyName><ogc:Literal>highway</ogc:Literal></ogc:PropertyIsEqualTo>
+              <ogc:PropertyIsGreaterThan><ogc:PropertyName>lanes</ogc:PropertyName><ogc:Literal>2</ogc:Literal></ogc:PropertyIsGreaterThan>
+            </ogc:And>
+          </ogc:Filter>
+          <MaxScaleDenominator>1091957.53</MaxScaleDenominator>
+          <LineSymbolizer>
+            <Stroke>
+              <CssParameter name="stroke">#FF0000</CssParameter>
+              <CssParameter name="stroke-width">2</CssParameter>
+              <CssParameter name="stroke-dasharray">4 2</CssParameter>
+            </Stroke>
+          </LineSymbolizer>
+          <TextSymbolizer>
+            <Label>No. <ogc:PropertyName>ref</ogc:PropertyName></Label>
+            <Font><CssParameter name="font-family">Arial</CssParameter><CssParameter name="font-size">12</CssParameter><CssParameter name="font-weight">bold</CssParameter></Font>
+            <LabelPlacement><LinePlacement/></LabelPlacement>
+            <Halo><Radius>2</Radius></Halo>
+          </TextSymbolizer>
+        </Rule>
+        <Rule>
+          <Name>spatial</Name>
+          <ogc:Filter><ogc:BBOX><ogc:PropertyName>geom</ogc:PropertyName></ogc:BBOX></ogc:Filter>
+          <LineSymbolizer/>
+        </Rule>
+        <Rule>
+          <Name>named</Name>
+          <ogc:Filter><ogc:PropertyIsLike wildCard="*" singleChar="." escape="!"><ogc:PropertyName>name</ogc:PropertyName><ogc:Literal>Main*</ogc:Literal></ogc:PropertyIsLike></ogc:Filter>
+          <LineSymbolizer/>
+        </Rule>
+      </FeatureTypeStyle>
+    </UserStyle>
+  </NamedLayer>
+</StyledLayerDescriptor>`
+
+const testSE11 = `<StyledLayerDescriptor version="1.1.0" xmlns="http://www.opengis.net/sld" xmlns:se="http://www.opengis.net/se" xmlns:ogc="http://www.opengis.net/ogc" xmlns:xlink="http://www.w3.org/1999/xlink">
+  <NamedLayer>
+    <se:Name>poi</se:Name>
+    <UserStyle>
+      <se:FeatureTypeStyle>
+        <se:Rule>
+          <se:Name>school</se:Name>
+          <ogc:Filter><ogc:PropertyIsEqualTo><ogc:PropertyName>kind</ogc:PropertyName><ogc:Literal>school</ogc:Literal></ogc:PropertyIsEqualTo></ogc:Filter>
+          <se:MinScaleDenominator>1000</se:MinScaleDenominator>
+          <se:PointSymbolizer>
+            <se:Graphic>
+              <se:ExternalGraphic><se:OnlineResource xlink:type="simple" xlink:href="http://example.com/icons/school.png"/><se:Format>image/png</se:Format></se:ExternalGraphic>
+              <se:Size>24</se:Size>
+            </se:Graphic>
+          </se:PointSymbolizer>
+        </se:Rule>
+        <se:Rule>
+          <se:Name>other</se:Name>
+          <se:ElseFilter/>
+          <se:PointSymbolizer>
+            <se:Graphic>
+              <se:Mark><se:WellKnownName>square</se:WellKnownName><se:Fill><se:SvgParameter name="fill">#00ff00</se:SvgParameter></se:Fill></se:Mark>
+              <se:Size><ogc:Function name="env"><ogc:Literal>size</ogc:Literal></ogc:Function></se:Size>
+            </se:Graphic>
+          </se:PointSymbolizer>
+        </se:Rule>
+      </se:FeatureTypeStyle>
+    </UserStyle>
+  </NamedLayer>
+</StyledLayerDescriptor>`
+
+func toJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSpace(buf.String())
+}
+
+func TestConvertSLD(t *testing.T) {
+	res, err := ConvertSLD([]byte(testSLD10), SLDOptions{Source: "ds1", SourceLayer: "ds1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d: %s", len(res.Layers), toJSON(res.Layers))
+	}
+	line := res.Layers[0]
+	if line["type"] != "line" || line["source-layer"] != "ds1" || line["minzoom"] != 8.0 {
+		t.Errorf("unexpected line layer %s", toJSON(line))
+	}
+	want := `["all",["==",["get","type"],"highway"],[">",["get","lanes"],2]]`
+	if got := toJSON(line["filter"]); got != want {
+		t.Errorf("filter = %s, want %s", got, want)
+	}
+	paint := line["paint"].(map[string]interface{})
+	if paint["line-color"] != "#FF0000" || paint["line-width"] != 2.0 || !reflect.DeepEqual(paint["line-dasharray"], []interface{}{2.0, 1.0}) {
+		t.Errorf("unexpected line paint %s", toJSON(paint))
+	}
+	label := res.Layers[1]
+	layout := label["layout"].(map[string]interface{})
+	if got := toJSON(layout["text-field"]); got != `["concat","No. ",["to-string",["get","ref"]]]` {
+		t.Errorf("text-field = %s", got)
+	}
+	if layout["symbol-placement"] != "line" || toJSON(layout["text-font"]) != `["Arial Bold"]` {
+		t.Errorf("unexpected label layout %s", toJSON(layout))
+	}
+	if got := toJSON(res.Layers[2]["filter"]); got != `["==",["slice",["to-string",["get","name"]],0,4],"Main"]` {
+		t.Errorf("like filter = %s", got)
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "BBOX") {
+		t.Errorf("unexpected warnings %v", res.Warnings)
+	}
+}
+
+func TestConvertSE11(t *testing.T) {
+	res, err := ConvertSLD([]byte(testSE11), SLDOptions{Source: "ts1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %s", toJSON(res.Layers))
+	}
+	icon := res.Layers[0]
+	if icon["source-layer"] != "poi" || icon["maxzoom"] != 18.09 {
+		t.Errorf("unexpected icon layer %s", toJSON(icon))
+	}
+	if len(res.Icons) != 1 || res.Icons[0].Name != "school" || res.Icons[0].Href != "http://example.com/icons/school.png" {
+		t.Errorf("unexpected icons %s", toJSON(res.Icons))
+	}
+	res.ScaleIcons(map[string]int{"school": 48})
+	if size := icon["layout"].(map[string]interface{})["icon-size"]; size != 0.5 {
+		t.Errorf("icon-size = %v", size)
+	}
+	other := res.Layers[1]
+	if got := toJSON(other["filter"]); got != `["!",["any",["==",["get","kind"],"school"]]]` {
+		t.Errorf("else filter = %s", got)
+	}
+	paint := other["paint"].(map[string]interface{})
+	if paint["circle-color"] != "#00ff00" || paint["circle-radius"] != 3.0 {
+		t.Errorf("unexpected circle paint %s", toJSON(paint))
+	}
+	if len(res.Warnings) != 2 {
+		t.Errorf("expected mark and function warnings, got %v", res.Warnings)
+	}
+	_, err = ConvertSLD([]byte(`<foo/>`), SLDOptions{})
+	if err == nil {
+		t.Errorf("expected error for non sld document")
+	}
+}
+
+func TestImportSLDIconAddress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("png"))
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	for _, href := range []string{ts.URL + "/a.png", "file:///etc/passwd", "ftp://example.com/a.png"} {
+		if _, err := importSLDIcon(&SLDIcon{Name: "a", Href: href}, dir, nil, ""); err == nil {
+			t.Errorf("%s should be rejected", href)
+		}
+	}
+	for ip, ok := range map[string]bool{"127.0.0.1": false, "10.1.2.3": false, "169.254.169.254": false, "::1": false, "0.0.0.0": false, "8.8.8.8": true} {
+		if publicIP(net.ParseIP(ip)) != ok {
+			t.Errorf("publicIP(%s) should be %v", ip, ok)
+		}
+	}
+}
@@ -406,6 +406,126 @@ func (sp *ShelfPack) allocShelf(shelf *Shelf, id, w, h int) *Bin {
 	return bin
 }
 
+//PackBin 打包状态中的bin
+type PackBin struct {
+	ID    int  `json:"id"`
+	X     int  `json:"x"`
+	Y     int  `json:"y"`
+	W     int  `json:"w"`
+	H     int  `json:"h"`
+	MaxW  int  `json:"maxw"`
+	MaxH  int  `json:"maxh"`
+	Ref   int  `json:"ref"`
+	Shelf int  `json:"shelf"`
+	Free  bool `json:"free,omitempty"`
+}
+
+//PackShelf 打包状态中的shelf
+type PackShelf struct {
+	X     int `json:"x"`
+	Y     int `json:"y"`
+	W     int `json:"w"`
+	H     int `json:"h"`
+	WFree int `json:"wfree"`
+}
+
+//PackState ShelfPack打包状态,用于增量打包
+type PackState struct {
+	MaxID   int            `json:"maxid"`
+	Width   int            `json:"width"`
+	Height  int            `json:"height"`
+	Shelves []PackShelf    `json:"shelves"`
+	Bins    []PackBin      `json:"bins"`
+	Names   map[string]int `json:"names"`
+}
+
+//State 导出打包状态
+func (sp *ShelfPack) State() *PackState {
+	st := &PackState{
+		MaxID:  sp.maxid,
+		Width:  sp.width,
+		Height: sp.height,
+		Names:  make(map[string]int),
+	}
+	free := make(map[*Bin]bool)
+	for _, b := range sp.freebins {
+		free[b] = true
+	}
+	for i, shelf := range sp.shelves {
+		st.Shelves = append(st.Shelves, PackShelf{X: shelf.x, Y: shelf.y, W: shelf.w, H: shelf.h, WFree: shelf.wfree})
+		for _, b := range shelf.bins {
+			st.Bins = append(st.Bins, PackBin{
+				ID: b.id, X: b.x, Y: b.y, W: b.w, H: b.h, MaxW: b.maxw, MaxH: b.maxh,
+				Ref: b.refcount, Shelf: i, Free: free[b],
+			})
+		}
+	}
+	return st
+}
+
+//RestoreShelfPack 从打包状态恢复ShelfPack
+func RestoreShelfPack(st *PackState, spo ShelfPackOptions) *ShelfPack {
+	sp := NewShelfPack(st.Width, st.Height, spo)
+	sp.width = st.Width
+	sp.height = st.Height
+	sp.maxid = st.MaxID
+	for _, s := range st.Shelves {
+		sp.shelves = append(sp.shelves, &Shelf{x: s.X, y: s.Y, w: s.W, h: s.H, wfree: s.WFree})
+	}
+	for _, pb := range st.Bins {
+		if pb.Shelf < 0 || pb.Shelf >= len(sp.shelves) {
+			continue
+		}
+		b := &Bin{id: pb.ID, x: pb.X, y: pb.Y, w: pb.W, h: pb.H, maxw: pb.MaxW, maxh: pb.MaxH, refcount: pb.Ref}
+		shelf := sp.shelves[pb.Shelf]
+		shelf.bins = append(shelf.bins, b)
+		if pb.Free {
+			sp.freebins = append(sp.freebins, b)
+			continue
+		}
+		sp.usedbins[b.id] = b
+		if b.refcount > 0 {
+			sp.stats[b.h]++
+		}
+	}
+	return sp
+}
+
+//Release 释放bin,释放后的空间可被后续打包复用
+func (sp *ShelfPack) Release(id int) {
+	bin := sp.getBin(id)
+	for sp.unref(bin) > 0 {
+	}
+}
+
+//Fragmentation 碎片率,空闲bin面积/已用shelf面积
+func (sp *ShelfPack) Fragmentation() float64 {
+	total := 0
+	for _, shelf := range sp.shelves {
+		total += shelf.w * shelf.h
+	}
+	if total == 0 {
+		return 0
+	}
+	free := 0
+	for _, b := range sp.freebins {
+		free += b.maxw * b.maxh
+	}
+	return float64(free) / float64(total)
+}
+
+//Bounds 已使用区域的宽高
+func (sp *ShelfPack) Bounds() (int, int) {
+	w, h := 0, 0
+	for _, shelf := range sp.shelves {
+		h += shelf.h
+		if used := shelf.w - shelf.wfree; used > w {
+			w = used
+		}
+	}
+	return w, h
+}
+
 func svg2png(svgfile string, scale float64) ([]byte, error) {
 	var params []string
 	if scale > 0 && scale != 1.0 {
@@ -487,6 +607,7 @@ type Symbol struct {
 	Y       int         `json:"y"`
 	Scale   float64     `json:"pixelRatio"`
 	Visible bool        `json:"visible"`
+	SDF     bool        `json:"sdf,omitempty"`
 	Data    []byte      `json:"-"`
 	Image   image.Image `json:"-" gorm:"-"`
 }
@@ -505,95 +626,72 @@ func ReadIcons(dir string, scale float64) []*Symbol {
 			continue
 		}
 		name := item.Name()
-		ext := filepath.Ext(name)
-		base := strings.TrimSuffix(name, ext)
-		pathfile := filepath.Join(dir, name)
-		lowext := strings.ToLower(ext)
-		w, h := 0, 0
-		switch lowext {
-		case ".svg":
-			buf, err := svg2png(pathfile, scale)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			b := bytes.NewBuffer(buf)
-			img, _, err := image.Decode(b)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			rect := img.Bounds()
-			w = rect.Dx()
-			h = rect.Dy()
-			// var out bytes.Buffer
-			// err = png.Encode(&out, img)
-			// if err != nil {
-			// 	log.Error(err)
-			// 	continue
-			// }
-			id++
-			symbol := &Symbol{
-				ID:      id,
-				Name:    base,
-				Width:   w,
-				Height:  h,
-				Scale:   scale,
-				Visible: true,
-				// Data:   buf.Bytes(),
-				Image: img,
-			}
-
-			symbols = append(symbols, symbol)
-			log.Printf("id:%d,name:%s,w:%d,h:%d\n", symbol.ID, symbol.Name, symbol.Width, symbol.Height)
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".json":
+			//sdf.json等图标配置
+			continue
+		}
+		symbol, err := ReadIcon(filepath.Join(dir, name), scale)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		id++
+		symbol.ID = id
+		symbols = append(symbols, symbol)
+		log.Printf("id:%d,name:%s,w:%d,h:%d\n", symbol.ID, symbol.Name, symbol.Width, symbol.Height)
+	}
 
-		case ".png", ".jpg", ".jpeg", ".bmp", ".gif":
-			file, err := os.Open(pathfile)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
+	return symbols
+}
 
-			img, _, err := image.Decode(file)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
+// ReadIcon 加载单个Icon为Symbol结构.
+func ReadIcon(pathfile string, scale float64) (*Symbol, error) {
+	name := filepath.Base(pathfile)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	var img image.Image
+	switch strings.ToLower(ext) {
+	case ".svg":
+		buf, err := svg2png(pathfile, scale)
+		if err != nil {
+			return nil, err
+		}
+		img, _, err = image.Decode(bytes.NewBuffer(buf))
+		if err != nil {
+			return nil, err
+		}
+	case ".png", ".jpg", ".jpeg", ".bmp", ".gif":
+		file, err := os.Open(pathfile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		img, _, err = image.Decode(file)
+		if err != nil {
+			return nil, err
+		}
+		if scale != 1.0 {
 			rect := img.Bounds()
-			w = rect.Dx()
-			h = rect.Dy()
-			if scale != 1.0 {
-				if scale > 0 && scale < 2 {
-					w = int(float64(w) * scale)
-					h = int(float64(h) * scale)
-				}
-				img = resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+			w, h := rect.Dx(), rect.Dy()
+			if scale > 0 && scale < 2 {
+				w = int(float64(w) * scale)
+				h = int(float64(h) * scale)
 			}
-			// var buf bytes.Buffer
-			// err = png.Encode(&buf, img)
-			// if err != nil {
-			// 	log.Error(err)
-			// 	continue
-			// }
-			id++
-			symbol := &Symbol{
-				ID:      id,
-				Name:    base,
-				Width:   w,
-				Height:  h,
-				Scale:   scale,
-				Visible: true,
-				// Data:   buf.Bytes(),
-				Image: img,
-			}
-			symbols = append(symbols, symbol)
-			log.Printf("id:%d,name:%s,w:%d,h:%d\n", symbol.ID, symbol.Name, symbol.Width, symbol.Height)
-		default:
-			log.Printf("unkown file format: %s", name)
+			img = resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
 		}
-	}
-
-	return symbols
+	default:
+		return nil, fmt.Errorf("unkown file format: %s", name)
+	}
+	rect := img.Bounds()
+	return &Symbol{
+		Name:    base,
+		Width:   rect.Dx(),
+		Height:  rect.Dy(),
+		Scale:   scale,
+		Visible: true,
+		Image:   img,
+	}, nil
 }
 
 // GenIconsFromSprite 加载样式.
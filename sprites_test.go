@@ -2,7 +2,17 @@ package main
 
 import (
 	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestPack1(t *testing.T) {
@@ -310,3 +320,102 @@ func TestPackone10(t *testing.T) {
 		t.Errorf("sprite: [%v,%v], actually: [%v,%v]", 20, 20, sprite.width, sprite.height)
 	}
 }
+
+func TestGenSDF(t *testing.T) {
+	t.Log("GenSDF() pads the icon and encodes inside/outside distance in alpha")
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 4; y < 12; y++ {
+		for x := 4; x < 12; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+		}
+	}
+	sdf := GenSDF(img, SDFBUFFER, SDFRADIUS, SDFCUTOFF)
+	if sdf.Bounds().Dx() != 16+2*SDFBUFFER || sdf.Bounds().Dy() != 16+2*SDFBUFFER {
+		t.Errorf("GenSDF: unexpected size %v", sdf.Bounds())
+	}
+	edge := uint8(math.Round(255 * (1 - SDFCUTOFF)))
+	center := sdf.NRGBAAt(8+SDFBUFFER, 8+SDFBUFFER).A
+	corner := sdf.NRGBAAt(0, 0).A
+	if center <= edge {
+		t.Errorf("GenSDF: inside alpha %d should be greater than edge %d", center, edge)
+	}
+	if corner >= edge {
+		t.Errorf("GenSDF: outside alpha %d should be less than edge %d", corner, edge)
+	}
+}
+
+func TestIsMonochrome(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.SetNRGBA(1, 1, color.NRGBA{10, 10, 10, 255})
+	img.SetNRGBA(2, 2, color.NRGBA{12, 10, 10, 128})
+	if !IsMonochrome(img, 16) {
+		t.Errorf("IsMonochrome: expected monochrome icon")
+	}
+	img.SetNRGBA(3, 3, color.NRGBA{255, 0, 0, 255})
+	if IsMonochrome(img, 16) {
+		t.Errorf("IsMonochrome: expected colored icon")
+	}
+}
+
+func TestPackStateRestore(t *testing.T) {
+	t.Log("restored pack keeps positions and reuses released bins")
+	sprite := NewShelfPack(64, 64, ShelfPackOptions{})
+	var bins []*Bin
+	bins = append(bins, NewBin(-1, 10, 10, -1, -1, -1, -1))
+	bins = append(bins, NewBin(-1, 10, 10, -1, -1, -1, -1))
+	bins = append(bins, NewBin(-1, 10, 10, -1, -1, -1, -1))
+	sprite.Pack(bins, PackOptions{})
+
+	restored := RestoreShelfPack(sprite.State(), ShelfPackOptions{})
+	if got := restored.getBin(2).String(); got != "id:2,x:10,y:0,w:10,h:10" {
+		t.Errorf("RestoreShelfPack: bin 2 actually: [%v]", got)
+	}
+	restored.Release(2)
+	if restored.getBin(2) != nil {
+		t.Errorf("Release: bin 2 should be freed")
+	}
+	if f := restored.Fragmentation(); f <= 0 {
+		t.Errorf("Fragmentation: expected > 0, actually: %v", f)
+	}
+	bin := restored.PackOne(-1, 10, 10)
+	if bin.String() != "id:4,x:10,y:0,w:10,h:10" {
+		t.Errorf("PackOne: expected reuse of freed bin, actually: [%v]", bin)
+	}
+	if f := restored.Fragmentation(); f != 0 {
+		t.Errorf("Fragmentation: expected 0, actually: %v", f)
+	}
+}
+
+func TestSpriteETag(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "sprite.png"), []byte{0x89, 'P', 'N', 'G'}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	style := &Style{ID: "etag", Owner: ATLAS, Path: dir}
+	set := &ServiceSet{Owner: ATLAS}
+	set.S.Store(style.ID, style)
+	userSet.Store(ATLAS, set)
+	defer userSet.Delete(ATLAS)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(userKey, ATLAS) })
+	r.GET("/styles/x/:id/sprite:fmt", getSprite)
+	get := func(uri, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", uri, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	png := get("/styles/x/etag/sprite.png", "").Header().Get("ETag")
+	w := get("/styles/x/etag/sprite.png?base64=1", png)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "data:image/png;base64,") {
+		t.Fatalf("base64 sprite should not match the png etag, got %d", w.Code)
+	}
+	b64 := w.Header().Get("ETag")
+	if b64 == png || get("/styles/x/etag/sprite.png?base64=1", b64).Code != http.StatusNotModified {
+		t.Errorf("unexpected base64 etag %s", b64)
+	}
+}
@@ -4,9 +4,15 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -14,6 +20,7 @@ import (
 
 	"github.com/fogleman/gg"
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,6 +39,7 @@ type Style struct {
 	Status    bool            `json:"status"`
 	Thumbnail string          `json:"thumbnail"`
 	Data      json.RawMessage `json:"-" gorm:"type:json"`
+	IconLibs  pq.StringArray  `json:"iconlibs" gorm:"type:varchar[]"`
 	CreatedAt time.Time       `json:"created_at"`
 	UpdatedAt time.Time       `json:"updated_at"`
 }
@@ -58,6 +66,7 @@ func (s *Style) Copy() *Style {
 		URL:  s.URL,
 		// Status:s.Status,
 		Thumbnail: s.Thumbnail,
+		IconLibs:  append(pq.StringArray{}, s.IconLibs...),
 	}
 	// out.Data = make([]byte, len(s.Data))
 	// copy(out.Data, s.Data)
@@ -125,17 +134,35 @@ func (s *Style) PackStyle() (*bytes.Buffer, error) {
 	return buf, nil
 }
 
-//GenSprite 生成sprites
-func (s *Style) GenSprite(sprite string) error {
+//spriteScale 根据sprite文件名获取像素比,sprite@2x.png->2
+func spriteScale(sprite string) float64 {
 	scale := 1.0
 	prefix := "sprite@"
 	if strings.HasPrefix(sprite, prefix) {
 		pos := strings.Index(sprite, "x.")
+		if pos < 0 {
+			pos = len(sprite) - 1
+		}
 		s, err := strconv.ParseFloat(sprite[len(prefix):pos], 64)
 		if err == nil {
 			scale = s
 		}
 	}
+	return scale
+}
+
+//toSDF 将符号转换为sdf符号
+func (sym *Symbol) toSDF(scale float64) {
+	buffer := int(math.Round(SDFBUFFER * scale))
+	sym.Image = GenSDF(sym.Image, buffer, SDFRADIUS*scale, SDFCUTOFF)
+	sym.Width += 2 * buffer
+	sym.Height += 2 * buffer
+	sym.SDF = true
+}
+
+//GenSprite 生成sprites
+func (s *Style) GenSprite(sprite string) error {
+	scale := spriteScale(sprite)
 
 	dir := filepath.Join(s.Path, "icons")
 
@@ -148,6 +175,27 @@ func (s *Style) GenSprite(sprite string) error {
 	}
 
 	symbols := ReadIcons(dir, scale) //readIcons(dir, 1)
+	sdfs := s.sdfIcons()
+	//合并引用的共享图标库
+	if len(s.IconLibs) > 0 {
+		exists := make(map[string]bool)
+		for _, sym := range symbols {
+			exists[sym.Name] = true
+		}
+		libs, libsdfs := s.libSymbols(scale, exists)
+		symbols = append(symbols, libs...)
+		for name := range libsdfs {
+			sdfs[name] = true
+		}
+		for i, sym := range symbols {
+			sym.ID = i + 1
+		}
+	}
+	for _, sym := range symbols {
+		if sdfs[sym.Name] {
+			sym.toSDF(scale)
+		}
+	}
 	sort.Slice(symbols, func(i, j int) bool {
 		if symbols[j].Height == symbols[i].Height {
 			return symbols[i].ID < symbols[j].ID
@@ -197,6 +245,240 @@ func (s *Style) GenSprite(sprite string) error {
 		log.Errorf("save json file error, details: %s", err)
 		return err
 	}
+	//保存打包状态,供增量更新使用
+	state := sprites.State()
+	for _, sym := range symbols {
+		state.Names[sym.Name] = sym.ID
+	}
+	err = saveSpriteState(pathname, state)
+	if err != nil {
+		log.Warnf("save sprite pack state error, details: %s", err)
+	}
+	return nil
+}
+
+//SPRITEFRAGMENTATION 增量更新后碎片率超过该值时全量重新打包
+const SPRITEFRAGMENTATION = 0.3
+
+//spriteState 读取sprite打包状态
+func spriteState(pathname string) (*PackState, error) {
+	buf, err := ioutil.ReadFile(pathname + ".pack.json")
+	if err != nil {
+		return nil, err
+	}
+	state := &PackState{}
+	err = json.Unmarshal(buf, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Names == nil {
+		state.Names = make(map[string]int)
+	}
+	return state, nil
+}
+
+//saveSpriteState 保存sprite打包状态
+func saveSpriteState(pathname string, state *PackState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pathname+".pack.json", buf, os.ModePerm)
+}
+
+//sprites 已生成的sprite列表,如sprite.png,sprite@2x.png
+func (s *Style) sprites() []string {
+	var out []string
+	items, err := ioutil.ReadDir(s.Path)
+	if err != nil {
+		return out
+	}
+	spritePat := regexp.MustCompile(`^sprite(@[234]x)?\.png$`)
+	for _, item := range items {
+		if !item.IsDir() && spritePat.MatchString(item.Name()) {
+			out = append(out, item.Name())
+		}
+	}
+	return out
+}
+
+//PatchSprites 增量更新已生成的sprites,updates为新增或修改的图标,removes为删除的图标,
+//未变化的图标位置保持不变
+func (s *Style) PatchSprites(updates, removes []string) {
+	for _, sprite := range s.sprites() {
+		//删除的图标可能覆盖了图标库中的同名图标,需全量生成
+		if len(s.IconLibs) > 0 && len(removes) > 0 {
+			err := s.GenSprite(sprite)
+			if err != nil {
+				log.Errorf("regenerate sprite %s error, details: %s", sprite, err)
+			}
+			continue
+		}
+		err := s.PatchSprite(sprite, updates, removes)
+		if err != nil {
+			log.Warnf("patch sprite %s error, regenerate it, details: %s", sprite, err)
+			err = s.GenSprite(sprite)
+			if err != nil {
+				log.Errorf("regenerate sprite %s error, details: %s", sprite, err)
+			}
+		}
+	}
+}
+
+//PatchSprite 增量更新指定sprite,新图标打包到空闲位置,删除的图标释放其位置,
+//碎片率超过SPRITEFRAGMENTATION时全量重新打包
+func (s *Style) PatchSprite(sprite string, updates, removes []string) error {
+	scale := spriteScale(sprite)
+	name := strings.TrimSuffix(sprite, filepath.Ext(sprite))
+	pathname := filepath.Join(s.Path, name)
+	state, err := spriteState(pathname)
+	if err != nil {
+		return err
+	}
+	jsonbuf, err := ioutil.ReadFile(pathname + ".json")
+	if err != nil {
+		return err
+	}
+	layout := make(map[string]*Symbol)
+	err = json.Unmarshal(jsonbuf, &layout)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(pathname + ".png")
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	canvas := image.NewNRGBA(src.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	sp := RestoreShelfPack(state, ShelfPackOptions{autoResize: true})
+	release := func(name string) {
+		if sym, ok := layout[name]; ok {
+			rect := image.Rect(sym.X, sym.Y, sym.X+sym.Width, sym.Y+sym.Height)
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+			delete(layout, name)
+		}
+		if id, ok := state.Names[name]; ok {
+			sp.Release(id)
+			delete(state.Names, name)
+		}
+	}
+	for _, name := range removes {
+		release(name)
+	}
+
+	dir := filepath.Join(s.Path, "icons")
+	sdfs := s.sdfIcons()
+	var symbols []*Symbol
+	for _, name := range updates {
+		pathfile := autoAppendExt(filepath.Join(dir, name))
+		if pathfile == "" {
+			release(name)
+			continue
+		}
+		sym, err := ReadIcon(pathfile, scale)
+		if err != nil {
+			log.Warnf("read icon %s error, details: %s", name, err)
+			continue
+		}
+		if sdfs[sym.Name] {
+			sym.toSDF(scale)
+		}
+		//尺寸不变时原位替换
+		if old, ok := layout[sym.Name]; ok && old.Width == sym.Width && old.Height == sym.Height {
+			sym.ID = state.Names[sym.Name]
+			sym.X, sym.Y = old.X, old.Y
+			rect := image.Rect(sym.X, sym.Y, sym.X+sym.Width, sym.Y+sym.Height)
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+			draw.Draw(canvas, rect, sym.Image, sym.Image.Bounds().Min, draw.Over)
+			layout[sym.Name] = sym
+			continue
+		}
+		release(sym.Name)
+		symbols = append(symbols, sym)
+	}
+	//高度降序打包新图标,减少浪费
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[j].Height < symbols[i].Height
+	})
+	for _, sym := range symbols {
+		bin := sp.PackOne(-1, sym.Width, sym.Height)
+		if bin == nil {
+			return fmt.Errorf("no room for icon %s", sym.Name)
+		}
+		sym.ID = bin.id
+		sym.X, sym.Y = bin.x, bin.y
+		state.Names[sym.Name] = bin.id
+		layout[sym.Name] = sym
+	}
+	if sp.Fragmentation() > SPRITEFRAGMENTATION {
+		log.Infof("sprite %s fragmentation %.2f, repack", sprite, sp.Fragmentation())
+		return s.GenSprite(sprite)
+	}
+	//画布扩展
+	w, h := sp.Bounds()
+	rect := canvas.Bounds()
+	if w > rect.Dx() || h > rect.Dy() {
+		if rect.Dx() > w {
+			w = rect.Dx()
+		}
+		if rect.Dy() > h {
+			h = rect.Dy()
+		}
+		grown := image.NewNRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(grown, rect, canvas, rect.Min, draw.Src)
+		canvas = grown
+	}
+	for _, sym := range symbols {
+		rect := image.Rect(sym.X, sym.Y, sym.X+sym.Width, sym.Y+sym.Height)
+		draw.Draw(canvas, rect, sym.Image, sym.Image.Bounds().Min, draw.Over)
+	}
+
+	var out bytes.Buffer
+	err = png.Encode(&out, canvas)
+	if err != nil {
+		return err
+	}
+	jsonbuf, err = json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(pathname+".png", out.Bytes(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(pathname+".json", jsonbuf, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	names := state.Names
+	state = sp.State()
+	state.Names = names
+	return saveSpriteState(pathname, state)
+}
+
+//cleanSprites 删除已生成的sprite文件,下次请求时重新生成
+func (s *Style) cleanSprites() error {
+	items, err := ioutil.ReadDir(s.Path)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(item.Name(), "sprite") {
+			err = os.Remove(filepath.Join(s.Path, item.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
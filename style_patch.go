@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//PatchOp JSON Patch操作(RFC 6902),图层路径使用图层ID,如 /layers/road/paint/line-color
+type PatchOp struct {
+	Op    string      `json:"op" binding:"required"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"` //move,copy的源路径
+	Value interface{} `json:"value,omitempty"`
+}
+
+//styleLocks 样式写锁,按样式ID
+var styleLocks sync.Map
+
+//lockStyle 锁定样式,返回解锁函数
+func lockStyle(id string) func() {
+	v, _ := styleLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+//matchETag 判断If-Match/If-None-Match头是否匹配
+func matchETag(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		v = strings.TrimPrefix(v, "W/")
+		if v == "*" || strings.Trim(v, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//ApplyStylePatch 应用JSON Patch到样式
+func ApplyStylePatch(data []byte, ops []PatchOp) ([]byte, error) {
+	var doc interface{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("decode style error, details: %s", err)
+	}
+	for i, op := range ops {
+		doc, err = applyStylePatchOp(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("op %d (%s %s): %s", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+//applyStylePatchOp 应用单个操作,move与copy先取出源值再添加到目标路径
+func applyStylePatchOp(doc interface{}, op PatchOp) (interface{}, error) {
+	switch op.Op {
+	case "add", "remove", "replace", "test":
+		tokens, err := patchTokens(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return applyPatchOp(doc, tokens, op.Op, op.Value)
+	case "move", "copy":
+		from, err := patchTokens(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := patchValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if op.Path == op.From {
+				return doc, nil
+			}
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, fmt.Errorf("cannot move %s into its child", op.From)
+			}
+			doc, err = applyPatchOp(doc, from, "remove", nil)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			//复制为独立副本
+			buf, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			value = nil
+			json.Unmarshal(buf, &value)
+		}
+		tokens, err := patchTokens(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return applyPatchOp(doc, tokens, "add", value)
+	}
+	return nil, fmt.Errorf("unsupported op %s", op.Op)
+}
+
+//patchValue 按路径取值
+func patchValue(node interface{}, tokens []string) (interface{}, error) {
+	for _, key := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[key]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", key)
+			}
+			node = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("invalid index %s", key)
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("%s not found", key)
+		}
+	}
+	return node, nil
+}
+
+//patchTokens 解析JSON Pointer,将图层ID转换为图层序号
+func patchTokens(doc interface{}, path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid path %s", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	if len(tokens) > 1 && tokens[0] == "layers" && tokens[1] != "-" {
+		root, _ := doc.(map[string]interface{})
+		layers, _ := root["layers"].([]interface{})
+		for i, l := range layers {
+			layer, _ := l.(map[string]interface{})
+			if id, _ := layer["id"].(string); id == tokens[1] {
+				tokens[1] = strconv.Itoa(i)
+				return tokens, nil
+			}
+		}
+		if _, err := strconv.Atoi(tokens[1]); err != nil {
+			return nil, fmt.Errorf("layer %s not found", tokens[1])
+		}
+	}
+	return tokens, nil
+}
+
+func applyPatchOp(node interface{}, tokens []string, op string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		switch op {
+		case "add", "replace":
+			return value, nil
+		case "test":
+			if !reflect.DeepEqual(node, value) {
+				return nil, fmt.Errorf("test failed")
+			}
+			return node, nil
+		}
+		return nil, fmt.Errorf("unsupported op")
+	}
+	key := tokens[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[key]
+		if len(tokens) > 1 {
+			if !ok {
+				return nil, fmt.Errorf("%s not found", key)
+			}
+			v, err := applyPatchOp(child, tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			n[key] = v
+			return n, nil
+		}
+		switch op {
+		case "add":
+			n[key] = value
+		case "replace":
+			if !ok {
+				return nil, fmt.Errorf("%s not found", key)
+			}
+			n[key] = value
+		case "remove":
+			if !ok {
+				return nil, fmt.Errorf("%s not found", key)
+			}
+			delete(n, key)
+		case "test":
+			if !reflect.DeepEqual(child, value) {
+				return nil, fmt.Errorf("test failed")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported op")
+		}
+		return n, nil
+	case []interface{}:
+		idx := len(n)
+		if key != "-" {
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i > len(n) {
+				return nil, fmt.Errorf("invalid index %s", key)
+			}
+			idx = i
+		}
+		if idx == len(n) && !(op == "add" && len(tokens) == 1) {
+			return nil, fmt.Errorf("index %s out of range", key)
+		}
+		if len(tokens) > 1 {
+			v, err := applyPatchOp(n[idx], tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			n[idx] = v
+			return n, nil
+		}
+		switch op {
+		case "add":
+			n = append(n, nil)
+			copy(n[idx+1:], n[idx:])
+			n[idx] = value
+		case "replace":
+			n[idx] = value
+		case "remove":
+			n = append(n[:idx], n[idx+1:]...)
+		case "test":
+			if !reflect.DeepEqual(n[idx], value) {
+				return nil, fmt.Errorf("test failed")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported op")
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("%s not found", key)
+}
+
+//patchScope 操作影响范围,图层与数据源按ID区分,其它按根属性
+func patchScope(op PatchOp) string {
+	if op.Path == "" {
+		return ""
+	}
+	tokens := strings.Split(op.Path[1:], "/")
+	switch tokens[0] {
+	case "layers":
+		if len(tokens) < 2 {
+			return "layers"
+		}
+		if tokens[1] == "-" {
+			if layer, ok := op.Value.(map[string]interface{}); ok {
+				if id, ok := layer["id"].(string); ok {
+					return "layers/" + id
+				}
+			}
+			return "layers"
+		}
+		if _, err := strconv.Atoi(tokens[1]); err == nil {
+			//序号受其它编辑影响
+			return "layers"
+		}
+		return "layers/" + tokens[1]
+	case "sources":
+		if len(tokens) < 2 {
+			return "sources"
+		}
+		return "sources/" + tokens[1]
+	}
+	return tokens[0]
+}
+
+//Scopes 差异涉及的范围
+func (d *StyleDiff) Scopes() map[string]bool {
+	scopes := make(map[string]bool)
+	for _, ch := range d.Root {
+		scopes[ch.Path] = true
+	}
+	for _, list := range [][]string{d.SourcesAdded, d.SourcesRemoved, d.SourcesChanged} {
+		for _, id := range list {
+			scopes["sources/"+id] = true
+		}
+	}
+	for _, list := range [][]string{d.LayersAdded, d.LayersRemoved} {
+		for _, id := range list {
+			scopes["layers/"+id] = true
+		}
+	}
+	for _, ch := range d.LayersChanged {
+		scopes["layers/"+ch.ID] = true
+	}
+	if d.LayersOrder {
+		scopes["layers"] = true
+	}
+	return scopes
+}
+
+//PatchConflicts 检查补丁操作与服务端已有修改是否冲突,返回冲突的路径
+func PatchConflicts(diff *StyleDiff, ops []PatchOp) []string {
+	scopes := diff.Scopes()
+	var conflicts []string
+	for _, op := range ops {
+		conflict := patchConflict(scopes, patchScope(op))
+		if op.From != "" {
+			conflict = conflict || patchConflict(scopes, patchScope(PatchOp{Path: op.From}))
+		}
+		if conflict {
+			conflicts = append(conflicts, op.Path)
+		}
+	}
+	return conflicts
+}
+
+//patchConflict 操作范围是否与服务端修改范围重叠
+func patchConflict(scopes map[string]bool, scope string) bool {
+	switch scope {
+	case "":
+		return len(scopes) > 0
+	case "layers", "sources":
+		for s := range scopes {
+			if strings.HasPrefix(s, scope) {
+				return true
+			}
+		}
+	}
+	return scopes[scope]
+}
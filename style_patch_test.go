@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const patchBase = `{"version":8,"name":"a","sources":{"s1":{"type":"vector"}},
+"layers":[{"id":"bg","type":"background","paint":{"background-color":"#fff"}},
+{"id":"road","type":"line","source":"s1","paint":{"line-width":1}}]}`
+
+func TestApplyStylePatch(t *testing.T) {
+	ops := []PatchOp{
+		{Op: "test", Path: "/layers/road/paint/line-width", Value: 1.0},
+		{Op: "replace", Path: "/layers/road/paint/line-width", Value: 2.0},
+		{Op: "add", Path: "/layers/road/paint/line-color", Value: "#f00"},
+		{Op: "add", Path: "/layers/bg", Value: map[string]interface{}{"id": "sky", "type": "sky"}},
+		{Op: "add", Path: "/layers/-", Value: map[string]interface{}{"id": "poi", "type": "symbol"}},
+		{Op: "remove", Path: "/layers/bg"},
+	}
+	data, err := ApplyStylePatch([]byte(patchBase), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root struct {
+		Layers []struct {
+			ID string `json:"id"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &root); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, l := range root.Layers {
+		ids = append(ids, l.ID)
+	}
+	if len(ids) != 3 || ids[0] != "sky" || ids[1] != "road" || ids[2] != "poi" {
+		t.Errorf("layers = %v", ids)
+	}
+	_, err = ApplyStylePatch([]byte(patchBase), []PatchOp{{Op: "test", Path: "/layers/road/paint/line-width", Value: 3.0}})
+	if err == nil {
+		t.Errorf("expected test op failure")
+	}
+	_, err = ApplyStylePatch([]byte(patchBase), []PatchOp{{Op: "replace", Path: "/layers/none/paint/x", Value: 1}})
+	if err == nil {
+		t.Errorf("expected missing layer failure")
+	}
+}
+
+func TestStylePatchMoveCopy(t *testing.T) {
+	ops := []PatchOp{
+		{Op: "copy", From: "/layers/road", Path: "/layers/-"},
+		{Op: "replace", Path: "/layers/2/id", Value: "road2"},
+		{Op: "move", From: "/layers/road", Path: "/layers/0"},
+		{Op: "copy", From: "/layers/road/paint/line-width", Path: "/layers/road2/paint/line-gap-width"},
+		{Op: "move", From: "/name", Path: "/metadata"},
+	}
+	data, err := ApplyStylePatch([]byte(patchBase), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root struct {
+		Name     string `json:"name"`
+		Metadata string `json:"metadata"`
+		Layers   []struct {
+			ID    string                 `json:"id"`
+			Paint map[string]interface{} `json:"paint"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &root); err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Layers) != 3 || root.Layers[0].ID != "road" || root.Layers[1].ID != "bg" || root.Layers[2].ID != "road2" ||
+		root.Layers[2].Paint["line-gap-width"] != 1.0 || root.Layers[0].Paint["line-gap-width"] != nil {
+		t.Errorf("unexpected layers %+v", root.Layers)
+	}
+	if root.Name != "" || root.Metadata != "a" {
+		t.Errorf("name should be moved, got %q %q", root.Name, root.Metadata)
+	}
+	for _, op := range []PatchOp{
+		{Op: "move", From: "/sources", Path: "/sources/s2"},
+		{Op: "copy", From: "/none", Path: "/x"},
+		{Op: "merge", Path: "/name"},
+	} {
+		if _, err := ApplyStylePatch([]byte(patchBase), []PatchOp{op}); err == nil {
+			t.Errorf("expected %s failure", op.Op)
+		}
+	}
+}
+
+func TestStyleIfMatchRequired(t *testing.T) {
+	tdb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&StyleRevision{})
+	oldDB := db
+	db = tdb
+	defer func() { db = oldDB }()
+	style := &Style{ID: "ifmatch", Owner: ATLAS, Data: []byte(patchBase)}
+	set := &ServiceSet{Owner: ATLAS}
+	set.S.Store(style.ID, style)
+	userSet.Store(ATLAS, set)
+	defer userSet.Delete(ATLAS)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(userKey, ATLAS) })
+	r.POST("/styles/update/:id/", updateStyle)
+	r.POST("/styles/save/:id/", saveStyle)
+	r.POST("/styles/patch/:id/", patchStyle)
+	post := func(uri, body, ifMatch string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", uri, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, uri := range []string{"/styles/update/ifmatch/", "/styles/save/ifmatch/", "/styles/patch/ifmatch/"} {
+		body := patchBase
+		if strings.HasPrefix(uri, "/styles/patch") {
+			body = `[{"op":"replace","path":"/name","value":"b"}]`
+		}
+		if code := post(uri, body, ""); code != http.StatusPreconditionRequired {
+			t.Errorf("%s without If-Match should be 428, got %d", uri, code)
+		}
+		if code := post(uri, body, `"stale"`); code != http.StatusConflict {
+			t.Errorf("%s with stale If-Match should be 409, got %d", uri, code)
+		}
+	}
+}
+
+func TestPatchConflicts(t *testing.T) {
+	//服务端修改了road图层
+	server, err := ApplyStylePatch([]byte(patchBase), []PatchOp{{Op: "replace", Path: "/layers/road/paint/line-width", Value: 5.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := DiffStyle([]byte(patchBase), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := PatchConflicts(diff, []PatchOp{{Op: "replace", Path: "/layers/bg/paint/background-color", Value: "#000"}}); len(c) != 0 {
+		t.Errorf("unexpected conflicts %v", c)
+	}
+	if c := PatchConflicts(diff, []PatchOp{{Op: "add", Path: "/layers/road/paint/line-color", Value: "#000"}}); len(c) != 1 {
+		t.Errorf("expected conflict on road, got %v", c)
+	}
+	if c := PatchConflicts(diff, []PatchOp{{Op: "remove", Path: "/layers/1"}}); len(c) != 1 {
+		t.Errorf("expected conflict on index path, got %v", c)
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	if !matchETag(`"a", W/"b"`, "b") || matchETag(`"a"`, "b") || !matchETag("*", "b") {
+		t.Errorf("matchETag mismatch")
+	}
+}
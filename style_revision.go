@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//StyleRevision 样式历史版本,只追加
+type StyleRevision struct {
+	ID        int             `json:"-" gorm:"primary_key"`
+	StyleID   string          `json:"style_id" gorm:"unique_index:idx_style_rev"`
+	Rev       int             `json:"rev" gorm:"unique_index:idx_style_rev"`
+	Author    string          `json:"author"`
+	Message   string          `json:"message"`
+	Size      int             `json:"size"`
+	Hash      string          `json:"hash" gorm:"index"`
+	Data      json.RawMessage `json:"data,omitempty" gorm:"type:json"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+//PropChange 属性变化
+type PropChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+//LayerChange 图层变化
+type LayerChange struct {
+	ID      string       `json:"id"`
+	Changes []PropChange `json:"changes"`
+}
+
+//StyleDiff 两个样式版本之间的结构化差异
+type StyleDiff struct {
+	From           int           `json:"from"`
+	To             int           `json:"to"`
+	Root           []PropChange  `json:"root,omitempty"`
+	SourcesAdded   []string      `json:"sources_added,omitempty"`
+	SourcesRemoved []string      `json:"sources_removed,omitempty"`
+	SourcesChanged []string      `json:"sources_changed,omitempty"`
+	LayersAdded    []string      `json:"layers_added,omitempty"`
+	LayersRemoved  []string      `json:"layers_removed,omitempty"`
+	LayersChanged  []LayerChange `json:"layers_changed,omitempty"`
+	LayersOrder    bool          `json:"layers_reordered,omitempty"`
+}
+
+//LatestRevision 最新版本
+func (s *Style) LatestRevision() (*StyleRevision, error) {
+	rev := &StyleRevision{}
+	err := db.Where("style_id = ?", s.ID).Order("rev desc").First(rev).Error
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+//Revision 获取指定版本
+func (s *Style) Revision(rev int) (*StyleRevision, error) {
+	out := &StyleRevision{}
+	err := db.Where("style_id = ? and rev = ?", s.ID, rev).First(out).Error
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//RevisionByHash 按内容摘要获取版本
+func (s *Style) RevisionByHash(hash string) (*StyleRevision, error) {
+	out := &StyleRevision{}
+	err := db.Where("style_id = ? and hash = ?", s.ID, hash).Order("rev desc").First(out).Error
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//Revisions 版本列表,不含样式内容
+func (s *Style) Revisions() ([]*StyleRevision, error) {
+	var revs []*StyleRevision
+	err := db.Select("id, style_id, rev, author, message, size, hash, created_at").Where("style_id = ?", s.ID).Order("rev desc").Find(&revs).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	return revs, nil
+}
+
+//styleCommitRetries 并发提交版本号冲突时的重试次数
+const styleCommitRetries = 5
+
+//Commit 记录当前样式为新版本,内容未变化时不记录,版本号冲突时重新读取最新版本后重试
+func (s *Style) Commit(author, message string) (*StyleRevision, error) {
+	data, err := compactJSON(s.Data)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		next := 1
+		latest, err := s.LatestRevision()
+		if err == nil {
+			if bytes.Equal(latest.Data, data) {
+				return latest, nil
+			}
+			next = latest.Rev + 1
+		} else if !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+		rev := &StyleRevision{
+			StyleID: s.ID,
+			Rev:     next,
+			Author:  author,
+			Message: message,
+			Size:    len(data),
+			Hash:    fmt.Sprintf("%x", md5.Sum(data)),
+			Data:    data,
+		}
+		err = db.Create(rev).Error
+		if err != nil {
+			if isUniqueConflict(err) && i < styleCommitRetries {
+				continue
+			}
+			return nil, err
+		}
+		err = s.pruneRevisions()
+		if err != nil {
+			log.Warnf(`prune style (%s) revisions error, details: %s`, s.ID, err)
+		}
+		return rev, nil
+	}
+}
+
+//isUniqueConflict 是否为唯一约束冲突,兼容sqlite与postgres
+func isUniqueConflict(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "duplicate key value")
+}
+
+//pruneRevisions 版本保留策略,最多保留styles.revisions.max个版本,
+//超过styles.revisions.maxage的旧版本删除,最新版本始终保留
+func (s *Style) pruneRevisions() error {
+	latest, err := s.LatestRevision()
+	if err != nil {
+		return err
+	}
+	max := viper.GetInt("styles.revisions.max")
+	if max > 0 {
+		err = db.Where("style_id = ? and rev <= ?", s.ID, latest.Rev-max).Delete(StyleRevision{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	maxage := viper.GetDuration("styles.revisions.maxage")
+	if maxage > 0 {
+		err = db.Where("style_id = ? and rev < ? and created_at < ?", s.ID, latest.Rev, time.Now().Add(-maxage)).Delete(StyleRevision{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//removeRevisions 删除样式的全部版本
+func (s *Style) removeRevisions() error {
+	return db.Where("style_id = ?", s.ID).Delete(StyleRevision{}).Error
+}
+
+//Hash 样式内容摘要,与版本摘要一致,用作ETag
+func (s *Style) Hash() string {
+	data, err := compactJSON(s.Data)
+	if err != nil {
+		data = s.Data
+	}
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func compactJSON(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := json.Compact(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//DiffStyle 比较两个样式,按根属性、数据源、图层给出差异
+func DiffStyle(from, to []byte) (*StyleDiff, error) {
+	var a, b map[string]interface{}
+	if err := json.Unmarshal(from, &a); err != nil {
+		return nil, fmt.Errorf("decode old style error, details: %s", err)
+	}
+	if err := json.Unmarshal(to, &b); err != nil {
+		return nil, fmt.Errorf("decode new style error, details: %s", err)
+	}
+	diff := &StyleDiff{}
+	//根属性
+	for _, k := range unionKeys(a, b) {
+		if k == "layers" || k == "sources" {
+			continue
+		}
+		if !reflect.DeepEqual(a[k], b[k]) {
+			diff.Root = append(diff.Root, PropChange{Path: k, Old: a[k], New: b[k]})
+		}
+	}
+	//数据源
+	sa, _ := a["sources"].(map[string]interface{})
+	sb, _ := b["sources"].(map[string]interface{})
+	for _, k := range unionKeys(sa, sb) {
+		va, oka := sa[k]
+		vb, okb := sb[k]
+		switch {
+		case !oka:
+			diff.SourcesAdded = append(diff.SourcesAdded, k)
+		case !okb:
+			diff.SourcesRemoved = append(diff.SourcesRemoved, k)
+		case !reflect.DeepEqual(va, vb):
+			diff.SourcesChanged = append(diff.SourcesChanged, k)
+		}
+	}
+	//图层
+	la, ida := indexLayers(a["layers"])
+	lb, idb := indexLayers(b["layers"])
+	var common []string
+	for _, id := range ida {
+		if _, ok := lb[id]; !ok {
+			diff.LayersRemoved = append(diff.LayersRemoved, id)
+			continue
+		}
+		common = append(common, id)
+		if changes := diffLayer(la[id], lb[id]); len(changes) > 0 {
+			diff.LayersChanged = append(diff.LayersChanged, LayerChange{ID: id, Changes: changes})
+		}
+	}
+	var order []string
+	for _, id := range idb {
+		if _, ok := la[id]; !ok {
+			diff.LayersAdded = append(diff.LayersAdded, id)
+			continue
+		}
+		order = append(order, id)
+	}
+	diff.LayersOrder = !reflect.DeepEqual(common, order)
+	return diff, nil
+}
+
+//diffLayer 比较图层属性,paint/layout展开到子属性
+func diffLayer(a, b map[string]interface{}) []PropChange {
+	var changes []PropChange
+	for _, k := range unionKeys(a, b) {
+		if k == "paint" || k == "layout" {
+			pa, _ := a[k].(map[string]interface{})
+			pb, _ := b[k].(map[string]interface{})
+			for _, p := range unionKeys(pa, pb) {
+				if !reflect.DeepEqual(pa[p], pb[p]) {
+					changes = append(changes, PropChange{Path: k + "." + p, Old: pa[p], New: pb[p]})
+				}
+			}
+			continue
+		}
+		if !reflect.DeepEqual(a[k], b[k]) {
+			changes = append(changes, PropChange{Path: k, Old: a[k], New: b[k]})
+		}
+	}
+	return changes
+}
+
+func indexLayers(v interface{}) (map[string]map[string]interface{}, []string) {
+	index := make(map[string]map[string]interface{})
+	var ids []string
+	layers, _ := v.([]interface{})
+	for i, l := range layers {
+		layer, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := layer["id"].(string)
+		if id == "" {
+			id = fmt.Sprintf("#%d", i)
+		}
+		index[id] = layer
+		ids = append(ids, id)
+	}
+	return index, ids
+}
+
+func unionKeys(a, b map[string]interface{}) []string {
+	set := make(map[string]bool)
+	for k := range a {
+		set[k] = true
+	}
+	for k := range b {
+		set[k] = true
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestDiffStyle(t *testing.T) {
+	from := []byte(`{"version":8,"name":"a","sources":{"s1":{"type":"vector"},"s2":{"type":"raster"}},
+	"layers":[{"id":"bg","type":"background","paint":{"background-color":"#fff"}},
+	{"id":"road","type":"line","source":"s1","paint":{"line-width":1},"layout":{"visibility":"visible"}},
+	{"id":"poi","type":"symbol","source":"s1"}]}`)
+	to := []byte(`{"version":8,"name":"b","sources":{"s1":{"type":"vector","url":"x"},"s3":{"type":"geojson"}},
+	"layers":[{"id":"road","type":"line","source":"s1","paint":{"line-width":2,"line-color":"#f00"},"layout":{"visibility":"visible"}},
+	{"id":"bg","type":"background","paint":{"background-color":"#fff"}},
+	{"id":"water","type":"fill","source":"s3"}]}`)
+	diff, err := DiffStyle(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Root) != 1 || diff.Root[0].Path != "name" {
+		t.Errorf("root changes = %+v", diff.Root)
+	}
+	if len(diff.SourcesAdded) != 1 || diff.SourcesAdded[0] != "s3" {
+		t.Errorf("sources added = %v", diff.SourcesAdded)
+	}
+	if len(diff.SourcesRemoved) != 1 || diff.SourcesRemoved[0] != "s2" {
+		t.Errorf("sources removed = %v", diff.SourcesRemoved)
+	}
+	if len(diff.SourcesChanged) != 1 || diff.SourcesChanged[0] != "s1" {
+		t.Errorf("sources changed = %v", diff.SourcesChanged)
+	}
+	if len(diff.LayersAdded) != 1 || diff.LayersAdded[0] != "water" {
+		t.Errorf("layers added = %v", diff.LayersAdded)
+	}
+	if len(diff.LayersRemoved) != 1 || diff.LayersRemoved[0] != "poi" {
+		t.Errorf("layers removed = %v", diff.LayersRemoved)
+	}
+	if len(diff.LayersChanged) != 1 || diff.LayersChanged[0].ID != "road" {
+		t.Fatalf("layers changed = %+v", diff.LayersChanged)
+	}
+	paths := map[string]bool{}
+	for _, ch := range diff.LayersChanged[0].Changes {
+		paths[ch.Path] = true
+	}
+	if len(paths) != 2 || !paths["paint.line-width"] || !paths["paint.line-color"] {
+		t.Errorf("road changes = %+v", diff.LayersChanged[0].Changes)
+	}
+	if !diff.LayersOrder {
+		t.Errorf("expected layers reordered")
+	}
+}
+
+func TestStyleCommitConflict(t *testing.T) {
+	tdb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "sys.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&StyleRevision{})
+	oldDB := db
+	db = tdb
+	defer func() { db = oldDB }()
+
+	//唯一索引拒绝重复版本号
+	tdb.Create(&StyleRevision{StyleID: "s", Rev: 1})
+	if err := tdb.Create(&StyleRevision{StyleID: "s", Rev: 1}).Error; err == nil || !isUniqueConflict(err) {
+		t.Fatalf("duplicate revision should conflict, got %v", err)
+	}
+
+	//并发提交版本号各不相同
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := &Style{ID: "s", Data: []byte(fmt.Sprintf(`{"version":8,"name":"%d"}`, i))}
+			_, errs[i] = s.Commit(ATLAS, "edit")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	revs, _ := (&Style{ID: "s"}).Revisions()
+	if len(revs) != 5 || revs[0].Rev != 5 {
+		t.Errorf("unexpected revisions %d", len(revs))
+	}
+}
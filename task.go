@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3" // import sqlite3 driver
@@ -39,3 +41,31 @@ func (task *Task) update() error {
 	}
 	return nil
 }
+
+//taskCancels 可取消任务的取消函数,按任务ID
+var taskCancels sync.Map
+
+//cancelable 创建可取消的任务上下文,任务结束后需调用release
+func (task *Task) cancelable() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	taskCancels.Store(task.ID, cancel)
+	return ctx
+}
+
+//release 释放任务上下文
+func (task *Task) release() {
+	if v, ok := taskCancels.Load(task.ID); ok {
+		taskCancels.Delete(task.ID)
+		v.(context.CancelFunc)()
+	}
+}
+
+//cancelTask 取消任务,任务不存在或不可取消时返回false
+func cancelTask(id string) bool {
+	v, ok := taskCancels.Load(id)
+	if !ok {
+		return false
+	}
+	v.(context.CancelFunc)()
+	return true
+}
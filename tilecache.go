@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//TileCache 瓦片缓存,按xyz行列号存取
+type TileCache interface {
+	//Get 获取缓存瓦片及写入时间
+	Get(z, x, y uint32) ([]byte, time.Time, bool)
+	//Put 写入缓存
+	Put(z, x, y uint32, data []byte) error
+	//DeleteRange 删除z级行列号范围内的瓦片,返回删除数量
+	DeleteRange(z, minx, miny, maxx, maxy uint32) (int, error)
+	//Clear 清空缓存
+	Clear() error
+	//Stats 缓存统计
+	Stats() (TileCacheStats, error)
+	//Close 关闭缓存
+	Close() error
+}
+
+//TileCacheStats 缓存统计,Zooms为各级瓦片数
+type TileCacheStats struct {
+	Tiles int            `json:"tiles"`
+	Size  int64          `json:"size"`
+	Zooms map[uint32]int `json:"zooms"`
+}
+
+//NewTileCache 创建瓦片缓存,backend为file时按目录存储,mbtiles时存储到单个MBTiles文件
+func NewTileCache(backend, path string) (TileCache, error) {
+	switch backend {
+	case "", "file":
+		err := os.MkdirAll(path, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		return &fileTileCache{dir: path}, nil
+	case "mbtiles":
+		return newMBTilesCache(path + MBTILESEXT)
+	}
+	return nil, fmt.Errorf("unsupported tile cache backend %s", backend)
+}
+
+//fileTileCache 目录缓存,z/x/y
+type fileTileCache struct {
+	dir string
+}
+
+func (fc *fileTileCache) file(z, x, y uint32) string {
+	return filepath.Join(fc.dir, strconv.Itoa(int(z)), strconv.Itoa(int(x)), strconv.Itoa(int(y)))
+}
+
+func (fc *fileTileCache) Get(z, x, y uint32) ([]byte, time.Time, bool) {
+	file := fc.file(z, x, y)
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return data, stat.ModTime(), true
+}
+
+func (fc *fileTileCache) Put(z, x, y uint32, data []byte) error {
+	file := fc.file(z, x, y)
+	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	//先写临时文件再重命名,避免并发读到不完整的瓦片
+	tmp := file + "." + ShortID()
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (fc *fileTileCache) DeleteRange(z, minx, miny, maxx, maxy uint32) (int, error) {
+	zdir := filepath.Join(fc.dir, strconv.Itoa(int(z)))
+	xs, err := ioutil.ReadDir(zdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	//按目录遍历,避免高级别下逐个行列号检查
+	n := 0
+	for _, xd := range xs {
+		x, err := strconv.ParseUint(xd.Name(), 10, 32)
+		if err != nil || !xd.IsDir() || uint32(x) < minx || uint32(x) > maxx {
+			continue
+		}
+		ys, err := ioutil.ReadDir(filepath.Join(zdir, xd.Name()))
+		if err != nil {
+			return n, err
+		}
+		for _, yf := range ys {
+			y, err := strconv.ParseUint(yf.Name(), 10, 32)
+			if err != nil || uint32(y) < miny || uint32(y) > maxy {
+				continue
+			}
+			err = os.Remove(filepath.Join(zdir, xd.Name(), yf.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (fc *fileTileCache) Clear() error {
+	err := os.RemoveAll(fc.dir)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(fc.dir, os.ModePerm)
+}
+
+func (fc *fileTileCache) Stats() (TileCacheStats, error) {
+	stats := TileCacheStats{Zooms: make(map[uint32]int)}
+	err := filepath.Walk(fc.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(fc.dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		//跳过未完成写入的临时文件
+		if _, err := strconv.ParseUint(parts[2], 10, 32); err != nil {
+			return nil
+		}
+		z, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil
+		}
+		stats.Tiles++
+		stats.Size += info.Size()
+		stats.Zooms[uint32(z)]++
+		return nil
+	})
+	return stats, err
+}
+
+func (fc *fileTileCache) Close() error {
+	return nil
+}
+
+//mbtilesCache MBTiles缓存,tiles表附加写入时间
+type mbtilesCache struct {
+	db *sql.DB
+}
+
+func newMBTilesCache(pathfile string) (*mbtilesCache, error) {
+	err := os.MkdirAll(filepath.Dir(pathfile), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", pathfile+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	stmts := []string{
+		"create table if not exists tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob, updated_at integer)",
+		"create table if not exists metadata (name text, value text)",
+		"create unique index if not exists name on metadata (name)",
+		"create unique index if not exists tile_index on tiles (zoom_level, tile_column, tile_row)",
+	}
+	for _, st := range stmts {
+		_, err = db.Exec(st)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &mbtilesCache{db: db}, nil
+}
+
+func (mc *mbtilesCache) Get(z, x, y uint32) ([]byte, time.Time, bool) {
+	var data []byte
+	var updated int64
+	err := mc.db.QueryRow("select tile_data, updated_at from tiles where zoom_level = ? and tile_column = ? and tile_row = ?", z, x, (uint32(1)<<z)-1-y).Scan(&data, &updated)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return data, time.Unix(updated, 0), true
+}
+
+func (mc *mbtilesCache) Put(z, x, y uint32, data []byte) error {
+	_, err := mc.db.Exec("insert or replace into tiles (zoom_level, tile_column, tile_row, tile_data, updated_at) values (?, ?, ?, ?, ?)", z, x, (uint32(1)<<z)-1-y, data, time.Now().Unix())
+	return err
+}
+
+func (mc *mbtilesCache) DeleteRange(z, minx, miny, maxx, maxy uint32) (int, error) {
+	n := (uint32(1) << z) - 1
+	res, err := mc.db.Exec("delete from tiles where zoom_level = ? and tile_column between ? and ? and tile_row between ? and ?", z, minx, maxx, n-maxy, n-miny)
+	if err != nil {
+		return 0, err
+	}
+	cnt, err := res.RowsAffected()
+	return int(cnt), err
+}
+
+func (mc *mbtilesCache) Clear() error {
+	_, err := mc.db.Exec("delete from tiles")
+	return err
+}
+
+func (mc *mbtilesCache) Stats() (TileCacheStats, error) {
+	stats := TileCacheStats{Zooms: make(map[uint32]int)}
+	rows, err := mc.db.Query("select zoom_level, count(*), coalesce(sum(length(tile_data)), 0) from tiles group by zoom_level")
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var z uint32
+		var cnt int
+		var size int64
+		if err := rows.Scan(&z, &cnt, &size); err != nil {
+			return stats, err
+		}
+		stats.Tiles += cnt
+		stats.Size += size
+		stats.Zooms[z] = cnt
+	}
+	return stats, rows.Err()
+}
+
+func (mc *mbtilesCache) Close() error {
+	return mc.db.Close()
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"html"
-	"io/ioutil"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-spatial/geom"
 	"github.com/go-spatial/geom/slippy"
@@ -19,13 +16,17 @@ import (
 	"github.com/go-spatial/tegola/atlas"
 	"github.com/go-spatial/tegola/basic"
 	"github.com/go-spatial/tegola/config"
+	"github.com/go-spatial/tegola/dict"
 	aprd "github.com/go-spatial/tegola/provider"
 	"github.com/go-spatial/tegola/provider/debug"
 
 	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb/maptile"
 
 	"github.com/go-spatial/geom/encoding/mvt"
 	proto "github.com/golang/protobuf/proto"
+	"github.com/paulmach/orb"
+	orbmvt "github.com/paulmach/orb/encoding/mvt"
 
 	// "github.com/jackc/pgx"
 	// "github.com/jackc/pgx/pgtype"
@@ -46,29 +47,34 @@ const (
 var TileBuffer = tegola.DefaultTileBuffer
 var isSelectQuery = regexp.MustCompile(`(?i)^((\s*)(--.*\n)?)*select`)
 
-//TileMap 瓦片数据集
+//TileMap 瓦片数据集,组合多个数据集与驱动图层为一个矢量瓦片服务,
+//图层配置以json存储在Config中
 type TileMap struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID    string `json:"id" gorm:"primary_key"`
+	Name  string `json:"name" binding:"required"`
+	Owner string `json:"owner" gorm:"index"`
 	// Contains an attribution to be displayed when the map is shown to a user.
 	// 	This string is sanatized so it can't be abused as a vector for XSS or beacon tracking.
 	Attribution string `json:"attribution"`
 	// The maximum extent of available map tiles in WGS:84
 	// latitude and longitude values, in the order left, bottom, right, top.
 	// Default: [-180, -85, 180, 85]
-	Bounds *geom.Extent
+	Bounds *geom.Extent `json:"bounds" gorm:"-"`
 
 	// The first value is the longitude, the second is latitude (both in
 	// WGS:84 values), the third value is the zoom level.
-	Center [3]float64  `json:"center"`
-	Layers []TileLayer `json:"layers"`
+	Center [3]float64  `json:"center" gorm:"-"`
+	Layers []TileLayer `json:"layers" gorm:"-"`
+	Config []byte      `json:"-" gorm:"type:json"`
 
-	SRID uint64
+	SRID uint64 `json:"-"`
 	// MVT output values
-	TileExtent uint64
-	TileBuffer uint64
+	TileExtent uint64 `json:"-"`
+	TileBuffer uint64 `json:"-"`
 
-	Format TileFormat
+	Format    TileFormat `json:"-"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
 }
 
 //TileLayer tile layer
@@ -77,14 +83,20 @@ type TileLayer struct {
 	Name            string                 `json:"name" toml:"name" binding:"required"`
 	MinZoom         uint                   `json:"min_zoom"`
 	MaxZoom         uint                   `json:"max_zoom"`
-	Bounds          *geom.Extent           `gorm:"-"`
-	Provider        aprd.TilerUnion        `gorm:"-"`
+	Bounds          *geom.Extent           `json:"-" gorm:"-"`
+	Provider        aprd.TilerUnion        `json:"-" gorm:"-"`
 	ProviderLayerID string                 `json:"provider_layer" toml:"provider_layer" binding:"required"`
-	GeomType        geom.Geometry          `gorm:"-"`
+	GeomType        geom.Geometry          `json:"-" gorm:"-"`
 	DefaultTags     map[string]interface{} `json:"default_tags" gorm:"-"`
 	DontSimplify    bool                   `json:"dont_simplify" toml:"dont_simplify" `
 	DontClip        bool                   `json:"dont_clip" toml:"dont_clip" `
 	SRID            uint64
+	Cluster         ClusterOptions  `json:"cluster" toml:"cluster" gorm:"embedded;embedded_prefix:cluster_"`
+	Dataset         string          `json:"dataset" toml:"dataset"` //瓦片数据集中引用的数据集,为空时引用驱动图层
+	Fields          []string        `json:"fields" toml:"fields" gorm:"-"`
+	Rules           json.RawMessage `json:"rules" toml:"-" gorm:"type:json"` //按级别的综合规则ZoomRules
+	source          tileSource      //点聚合读取要素的数据源
+	amap            *atlas.Map      //瓦片数据集中的单图层地图
 }
 
 //UpInsert 创建更新瓦片集服务
@@ -104,11 +116,7 @@ func (tl *TileLayer) UpInsert() error {
 		}
 		return err
 	}
-	err = db.Model(&TileLayer{}).Update(tl).Error
-	if err != nil {
-		return err
-	}
-	return nil
+	return db.Save(tl).Error
 }
 
 // MVTName will return the value that will be encoded in the Name field when the layer is encoded as MVT
@@ -128,6 +136,18 @@ func (tl *TileLayer) FilterByZoom(zoom uint) bool {
 	return true
 }
 
+//ClusterEncode 编码聚合瓦片
+func (tl *TileLayer) ClusterEncode(ctx context.Context, tile maptile.Tile) ([]byte, error) {
+	if tl.source == nil {
+		return nil, fmt.Errorf("tile layer (%s) has no feature source for clustering", tl.ID)
+	}
+	ci, err := loadClusterIndex(ctx, dsCacheID(tl.ID), tl.source, tl.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	return ci.Encode(tl.MVTName(), tile)
+}
+
 //MVTEncode encode for mvt_postgis
 func (tl *TileLayer) MVTEncode(ctx context.Context, tile *slippy.Tile) ([]byte, error) {
 	if tl.Provider.Mvt == nil {
@@ -165,23 +185,8 @@ func (tl *TileLayer) MVTEncode(ctx context.Context, tile *slippy.Tile) ([]byte,
 		return nil, ctx.Err()
 	}
 
-	// buffer to store our compressed bytes
-	var gzipBuf bytes.Buffer
-
-	// compress the encoded bytes
-	w := gzip.NewWriter(&gzipBuf)
-	_, err = w.Write(data)
-	if err != nil {
-		return nil, err
-	}
-
-	// flush and close the writer
-	if err = w.Close(); err != nil {
-		return nil, err
-	}
-
-	// return encoded, gzipped tile
-	return gzipBuf.Bytes(), nil
+	// apply zoom rules and compress
+	return tl.generalize(tile.Z, data)
 }
 
 //Encode TODO (arolek): support for max zoom
@@ -260,23 +265,8 @@ func (tl *TileLayer) Encode(ctx context.Context, tile *slippy.Tile) ([]byte, err
 		return nil, err
 	}
 
-	// buffer to store our compressed bytes
-	var gzipBuf bytes.Buffer
-
-	// compress the encoded bytes
-	w := gzip.NewWriter(&gzipBuf)
-	_, err = w.Write(tileBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	// flush and close the writer
-	if err = w.Close(); err != nil {
-		return nil, err
-	}
-
-	// return encoded, gzipped tile
-	return gzipBuf.Bytes(), nil
+	// apply zoom rules and compress
+	return tl.generalize(tile.Z, tileBytes)
 }
 
 // TileFormat returns the TileFormat of the DB.
@@ -284,12 +274,12 @@ func (tm TileMap) TileFormat() TileFormat {
 	return tm.Format
 }
 
-//Tile 获取瓦片
-func (tm TileMap) Tile(ctx context.Context, z uint8, x uint, y uint) ([]byte, error) {
+//Tile 获取瓦片,debug为true时附加瓦片边框与中心点调试图层
+func (tm TileMap) Tile(ctx context.Context, z uint8, x uint, y uint, debug bool) ([]byte, error) {
 	tile := slippy.NewTile(uint(z), x, y)
 
-	// check for the debug query string
-	if true {
+	// debug layers are opt-in, see the debug query string
+	if debug {
 		tm = tm.AddDebugLayers()
 	}
 	pbyte, err := tm.Encode(ctx, tile)
@@ -308,6 +298,48 @@ func (tm TileMap) Tile(ctx context.Context, z uint8, x uint, y uint) ([]byte, er
 	return pbyte, nil
 }
 
+//MatrixTile 按瓦片矩阵集获取瓦片,行号自上而下,WebMercatorQuad使用Tile,
+//其他矩阵集由各数据集图层读取要素编码,驱动图层不支持非WebMercatorQuad
+func (tm TileMap) MatrixTile(ctx context.Context, ms *TileMatrixSet, z int, x, y uint32) ([]byte, error) {
+	if ms == WebMercatorQuad {
+		return tm.Tile(ctx, uint8(z), uint(x), uint(y), false)
+	}
+	t := maptile.New(x, y, maptile.Zoom(z))
+	//图层级别与规则按WebMercator级别定义
+	zoom := uint(ms.WebMercatorZoom(z))
+	var out orbmvt.Layers
+	for i := range tm.Layers {
+		l := tm.Layers[i]
+		if l.source == nil || l.FilterByZoom(zoom) {
+			continue
+		}
+		tl := NewTiler(l.MVTName(), z, z)
+		tl.Matrix = ms
+		tl.Fields = l.Fields
+		data, err := tl.renderTile(ctx, l.source, t)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		lyrs, err := orbmvt.UnmarshalGzipped(data)
+		if err != nil {
+			return nil, err
+		}
+		if rule := l.rules().Match(zoom); rule != nil {
+			for _, lyr := range lyrs {
+				rule.Apply(lyr)
+			}
+		}
+		out = append(out, lyrs...)
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return orbmvt.MarshalGzipped(out)
+}
+
 // AddDebugLayers returns a copy of a Map with the debug layers appended to the layer list
 func (tm TileMap) AddDebugLayers() TileMap {
 	// make an explicit copy of the layers
@@ -316,26 +348,36 @@ func (tm TileMap) AddDebugLayers() TileMap {
 	tm.Layers = layers
 
 	// setup a debug provider
-	// debugProvider, _ := debug.NewTileProvider(dict.Dict{})
+	debugProvider, _ := debug.NewTileProvider(dict.Dict{})
 
-	tm.Layers = append(layers, []TileLayer{
+	for _, dl := range []TileLayer{
 		{
 			Name:            debug.LayerDebugTileOutline,
 			ProviderLayerID: debug.LayerDebugTileOutline,
-			// Provider:          debugProvider,
-			GeomType: geom.LineString{},
-			MinZoom:  0,
-			MaxZoom:  22,
+			GeomType:        geom.LineString{},
+			MinZoom:         0,
+			MaxZoom:         22,
 		},
 		{
 			Name:            debug.LayerDebugTileCenter,
 			ProviderLayerID: debug.LayerDebugTileCenter,
-			// Provider:          debugProvider,
-			GeomType: geom.Point{},
-			MinZoom:  0,
-			MaxZoom:  22,
+			GeomType:        geom.Point{},
+			MinZoom:         0,
+			MaxZoom:         22,
 		},
-	}...)
+	} {
+		m := atlas.NewWebMercatorMap(tm.ID)
+		m.Layers = []atlas.Layer{{
+			ID:              dl.Name,
+			Name:            dl.Name,
+			ProviderLayerID: dl.ProviderLayerID,
+			Provider:        debugProvider,
+			GeomType:        dl.GeomType,
+			MaxZoom:         dl.MaxZoom,
+		}}
+		dl.amap = &m
+		tm.Layers = append(tm.Layers, dl)
+	}
 
 	return tm
 }
@@ -379,172 +421,212 @@ func (tm TileMap) FilterLayersByName(names ...string) TileMap {
 	return tm
 }
 
-//Encode TODO (arolek): support for max zoom
+//Encode 并发编码各图层,按图层选择的字段过滤属性后合并为一个瓦片
 func (tm TileMap) Encode(ctx context.Context, tile *slippy.Tile) ([]byte, error) {
-	// tile container
-	var mvtTile mvt.Tile
-	// wait group for concurrent layer fetching
 	var wg sync.WaitGroup
-
-	// layer stack
-	mvtLayers := make([]*mvt.Layer, len(tm.Layers))
-
-	// set our waitgroup count
-	wg.Add(len(tm.Layers))
-
-	// iterate our layers
-	for i, layer := range tm.Layers {
-
-		// go routine for fetching the layer concurrently
-		go func(i int, l TileLayer) {
-			mvtLayer := mvt.Layer{
-				Name: l.MVTName(),
-			}
-			// on completion let the wait group know
+	layers := make([]orbmvt.Layers, len(tm.Layers))
+	errs := make([]error, len(tm.Layers))
+	for i := range tm.Layers {
+		l := tm.Layers[i]
+		if l.amap == nil || l.FilterByZoom(tile.Z) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
 			defer wg.Done()
-
-			if l.Provider.Std == nil {
+			data, err := l.amap.Encode(ctx, tile)
+			if err != nil {
+				errs[i] = err
 				return
 			}
-			ptile := aprd.NewTile(tile.Z, tile.X, tile.Y,
-				uint(TileBuffer), uint(tm.SRID))
-			// fetch layer from data provider
-			err := l.Provider.Std.TileFeatures(ctx, l.ProviderLayerID, ptile, func(f *aprd.Feature) error {
-				// TODO: remove this geom conversion step once the mvt package has adopted the new geom package
-				geo, err := ToTegola(f.Geometry)
-				if err != nil {
-					return err
+			lyrs, err := orbmvt.UnmarshalGzipped(data)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			rule := l.rules().Match(tile.Z)
+			for _, lyr := range lyrs {
+				lyr.Name = l.MVTName()
+				if rule != nil {
+					rule.Apply(lyr)
 				}
-				// add default tags, but don't overwrite a tag that already exists
-				for k, v := range l.DefaultTags {
-					if _, ok := f.Tags[k]; !ok {
-						f.Tags[k] = v
-					}
+				if len(l.Fields) == 0 {
+					continue
 				}
-
-				mvtLayer.AddFeatures(mvt.Feature{
-					ID:       &f.ID,
-					Tags:     f.Tags,
-					Geometry: geo,
-				})
-
-				return nil
-			})
-			if err != nil {
-				switch err {
-				case context.Canceled:
-					// TODO (arolek): add debug logs
-					return
-				default:
-					z, x, y := tile.ZXY()
-					// TODO (arolek): should we return an error to the response or just log the error?
-					// we can't just write to the response as the waitgroup is going to write to the response as well
-					log.Printf("err fetching tile (z: %v, x: %v, y: %v) features: %v", z, x, y, err)
-					if err.Error() != "too much features" {
-						return
+				keep := make(map[string]bool)
+				for _, name := range l.Fields {
+					keep[name] = true
+				}
+				for _, f := range lyr.Features {
+					for k := range f.Properties {
+						if !keep[k] {
+							delete(f.Properties, k)
+						}
 					}
 				}
 			}
-
-			// add the layer to the slice position
-			mvtLayers[i] = &mvtLayer
-		}(i, layer)
+			layers[i] = lyrs
+		}(i)
 	}
-
-	// wait for the waitgroup to finish
 	wg.Wait()
 
-	// stop processing if the context has an error. this check is necessary
-	// otherwise the server continues processing even if the request was canceled
-	// as the waitgroup was not notified of the cancel
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
+	var out orbmvt.Layers
+	for i, lyrs := range layers {
+		if errs[i] != nil {
+			z, x, y := tile.ZXY()
+			log.Errorf("err encoding layer %s of tilemap (%s) at tile (z: %v, x: %v, y: %v): %v", tm.Layers[i].MVTName(), tm.ID, z, x, y, errs[i])
+			continue
+		}
+		out = append(out, lyrs...)
+	}
+	return orbmvt.MarshalGzipped(out)
+}
 
-	// add layers to our tile
-	mvtTile.AddLayers(mvtLayers...)
-
-	// generate our tile
-	vtile, err := mvtTile.VTile(ctx)
-
-	if err != nil {
-		return nil, err
+//Prepare 解析各图层引用的数据集与驱动图层,计算范围与中心点
+func (tm *TileMap) Prepare() error {
+	if len(tm.Layers) == 0 {
+		return fmt.Errorf("tilemap should have at least one layer")
+	}
+	buffer := tm.TileBuffer
+	if buffer == 0 {
+		buffer = uint64(TileBuffer)
 	}
+	var bound *orb.Bound
+	extend := func(b orb.Bound) {
+		if bound == nil {
+			bound = &b
+			return
+		}
+		*bound = bound.Union(b)
+	}
+	names := make(map[string]bool)
+	for i := range tm.Layers {
+		l := &tm.Layers[i]
+		if l.MaxZoom != 0 && l.MinZoom > l.MaxZoom {
+			return fmt.Errorf("layer %s has invalid zoom range %d-%d", l.MVTName(), l.MinZoom, l.MaxZoom)
+		}
+		m := atlas.NewWebMercatorMap(tm.ID)
+		m.TileBuffer = buffer
+		var layer atlas.Layer
+		switch {
+		case l.Dataset != "":
+			dts := userSet.dataset(tm.Owner, l.Dataset)
+			if dts == nil {
+				return fmt.Errorf("dataset %s not found", l.Dataset)
+			}
+			if dts.tlayer == nil {
+				if _, err := dts.NewTileLayer(); err != nil {
+					return err
+				}
+			}
+			if len(l.Fields) > 0 {
+				fields := make(map[string]bool)
+				for _, f := range dts.fieldList() {
+					fields[f.Name] = true
+				}
+				for _, name := range l.Fields {
+					if !fields[name] {
+						return fmt.Errorf("field %s not found in dataset %s", name, l.Dataset)
+					}
+				}
+			}
+			l.source = dts.tlayer.source
+			prd := dts.tlayer.Provider
+			if prd.Mvt != nil {
+				m.SetMVTProvider(PROVIDERID, prd.Mvt)
+			}
+			layer = atlas.Layer{Provider: prd.Std, ProviderLayerID: dts.ID}
+			if l.Name == "" {
+				l.Name = dts.Name
+			}
+			extend(dts.BBox)
+		case l.ProviderLayerID != "":
+			amap, err := atlas.GetMap(l.ProviderLayerID)
+			if err != nil {
+				err = AutoMap4ProviderLayer(l.ProviderLayerID)
+				if err != nil {
+					return fmt.Errorf("provider layer %s not found", l.ProviderLayerID)
+				}
+				amap, _ = atlas.GetMap(l.ProviderLayerID)
+			}
+			if len(amap.Layers) == 0 {
+				return fmt.Errorf("provider layer %s not found", l.ProviderLayerID)
+			}
+			m = amap
+			m.Name = tm.ID
+			m.TileBuffer = buffer
+			layer = amap.Layers[0]
+			if amap.Bounds != nil {
+				extend(orb.Bound{Min: orb.Point{amap.Bounds.MinX(), amap.Bounds.MinY()}, Max: orb.Point{amap.Bounds.MaxX(), amap.Bounds.MaxY()}})
+			}
+		default:
+			return fmt.Errorf("layer %d should reference a dataset or a provider layer", i)
+		}
+		if names[l.MVTName()] {
+			return fmt.Errorf("duplicate layer name %s", l.MVTName())
+		}
+		names[l.MVTName()] = true
+		layer.ID = l.ID
+		layer.Name = l.MVTName()
+		layer.MinZoom = l.MinZoom
+		layer.MaxZoom = l.MaxZoom
+		layer.DontSimplify = l.DontSimplify
+		layer.DontClip = l.DontClip
+		layer.DefaultTags = l.DefaultTags
+		m.Layers = []atlas.Layer{layer}
+		l.GeomType = layer.GeomType
+		l.amap = &m
+	}
+	if bound != nil {
+		b := clampBound(*bound)
+		tm.Bounds = geom.NewExtent([2]float64{b.Min.X(), b.Min.Y()}, [2]float64{b.Max.X(), b.Max.Y()})
+		zoom := tm.Layers[0].MinZoom
+		for _, l := range tm.Layers {
+			if l.MinZoom < zoom {
+				zoom = l.MinZoom
+			}
+		}
+		tm.Center = [3]float64{b.Center().X(), b.Center().Y(), float64(zoom)}
+	}
+	return nil
+}
 
-	// encode our mvt tile
-	tileBytes, err := proto.Marshal(vtile)
+//Save 保存瓦片数据集
+func (tm *TileMap) Save() error {
+	cfg, err := json.Marshal(tm.Layers)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	tm.Config = cfg
+	return db.Save(tm).Error
+}
 
-	// buffer to store our compressed bytes
-	var gzipBuf bytes.Buffer
+//tileMaps 已解析的瓦片数据集,修改或删除时清除
+var tileMaps sync.Map
 
-	// compress the encoded bytes
-	w := gzip.NewWriter(&gzipBuf)
-	_, err = w.Write(tileBytes)
-	if err != nil {
-		return nil, err
+//LoadTileMap 加载瓦片数据集并解析图层
+func LoadTileMap(id string) (*TileMap, error) {
+	if v, ok := tileMaps.Load(id); ok {
+		return v.(*TileMap), nil
 	}
-
-	// flush and close the writer
-	if err = w.Close(); err != nil {
+	tm := &TileMap{}
+	err := db.Where("id = ?", id).First(tm).Error
+	if err != nil {
 		return nil, err
 	}
-
-	// return encoded, gzipped tile
-	return gzipBuf.Bytes(), nil
-}
-
-// LoadTileMap creates a new MBTiles instance.
-// Co123456789nnection is closed by runtime on application termination or by calling
-// its Close() method.
-func LoadTileMap(pathfile string) (*TileMap, error) {
-	//Saves last modified mbtiles time for setting Last-Modified header
-	// fStat, err := os.Stat(pathfile)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("could not read file stats for mbtiles file: %s", pathfile)
-	// }
-	// check the conf file exists
-	if _, err := os.Stat(pathfile); os.IsNotExist(err) {
-		return nil, fmt.Errorf("config file %v not found", pathfile)
-	}
-
-	buf, err := ioutil.ReadFile(pathfile)
+	err = json.Unmarshal(tm.Config, &tm.Layers)
 	if err != nil {
 		return nil, err
 	}
-
-	out := &TileMap{}
-	json.Unmarshal(buf, &out)
-
-	for i := range out.Layers {
-		out.Layers[i].Provider = providers["pg"]
-	}
-
-	return out, nil
-}
-
-//SaveTileMap 保存配置文件
-func SaveTileMap(pathfile string) error {
-	var layers []TileLayer
-	layer := TileLayer{
-		Name:            "places_a",
-		ProviderLayerID: "osm_places_a",
-		MinZoom:         5,
-		MaxZoom:         20,
-	}
-	layers = append(layers, layer)
-	out := &TileMap{
-		Name:   pathfile,
-		Layers: layers,
-	}
-	buf, err := json.Marshal(out)
-	err = ioutil.WriteFile(pathfile, buf, os.ModePerm)
+	err = tm.Prepare()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	tileMaps.Store(id, tm)
+	return tm, nil
 }
 
 // TileFormat returns the TileFormat of the DB.
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-spatial/geom"
+	"github.com/go-spatial/geom/slippy"
+	"github.com/go-spatial/tegola/atlas"
+	"github.com/go-spatial/tegola/dict"
+	aprd "github.com/go-spatial/tegola/provider"
+	"github.com/jinzhu/gorm"
+	"github.com/paulmach/orb"
+	orbmvt "github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/maptile"
+)
+
+//pointTiler 每个瓦片返回一个固定点的测试驱动
+type pointTiler struct{}
+
+func (pointTiler) Layer(string) (aprd.LayerInfo, bool)     { return nil, false }
+func (pointTiler) Layers() ([]aprd.LayerInfo, error)       { return nil, nil }
+func (pointTiler) AddLayer(dict.Dicter) error              { return nil }
+func (pointTiler) LayerExtent(string) (geom.Extent, error) { return geom.Extent{}, nil }
+func (pointTiler) LayerMinZoom(string) int                 { return 0 }
+func (pointTiler) LayerMaxZoom(string) int                 { return 22 }
+func (pointTiler) TileFeatures(ctx context.Context, lyrID string, t aprd.Tile, fn func(f *aprd.Feature) error) error {
+	return fn(&aprd.Feature{
+		ID:       1,
+		Geometry: geom.Point{100000, 100000},
+		SRID:     3857,
+		Tags:     map[string]interface{}{"name": lyrID, "rank": int64(3)},
+	})
+}
+
+func TestTileMapEncode(t *testing.T) {
+	tm := TileMap{ID: "tm", Layers: []TileLayer{
+		{Name: "roads", ProviderLayerID: "roads", Fields: []string{"name"}},
+		{Name: "pois", ProviderLayerID: "pois", MinZoom: 5, MaxZoom: 10},
+	}}
+	for i := range tm.Layers {
+		l := &tm.Layers[i]
+		m := atlas.NewWebMercatorMap(tm.ID)
+		m.Layers = []atlas.Layer{{Name: l.Name, ProviderLayerID: l.ProviderLayerID, Provider: pointTiler{}}}
+		l.amap = &m
+	}
+
+	pt := orb.Point{0.9, 0.9}
+	for z, want := range map[uint]int{3: 1, 6: 2, 11: 1} {
+		mt := maptile.At(pt, maptile.Zoom(z))
+		data, err := tm.Encode(context.Background(), slippy.NewTile(z, uint(mt.X), uint(mt.Y)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := orbmvt.UnmarshalGzipped(data)
+		if err != nil || len(layers) != want {
+			t.Fatalf("z%d: expected %d layers, got %d %v", z, want, len(layers), err)
+		}
+		for _, l := range layers {
+			props := l.Features[0].Properties
+			switch l.Name {
+			case "roads":
+				if len(props) != 1 || props["name"] != "roads" {
+					t.Errorf("z%d: roads should only keep selected fields, got %v", z, props)
+				}
+			case "pois":
+				if props["rank"] == nil {
+					t.Errorf("z%d: pois should keep all fields, got %v", z, props)
+				}
+			default:
+				t.Errorf("z%d: unexpected layer %s", z, l.Name)
+			}
+		}
+	}
+
+	if err := (&TileMap{}).Prepare(); err == nil {
+		t.Errorf("tilemap without layers should be rejected")
+	}
+	if err := (&TileMap{Layers: []TileLayer{{Name: "empty"}}}).Prepare(); err == nil {
+		t.Errorf("layer without dataset or provider layer should be rejected")
+	}
+}
+
+func TestTileMapSave(t *testing.T) {
+	tdb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&TileMap{})
+	old := db
+	db = tdb
+	defer func() { db = old }()
+
+	tm := &TileMap{ID: "tm", Name: "base", Owner: "u", Layers: []TileLayer{
+		{Name: "roads", Dataset: "d1", Fields: []string{"name"}, MaxZoom: 14, DontSimplify: true},
+	}}
+	if err := tm.Save(); err != nil {
+		t.Fatal(err)
+	}
+	tm.Name = "renamed"
+	if err := tm.Save(); err != nil {
+		t.Fatal(err)
+	}
+	got := &TileMap{}
+	if err := db.Where("id = ?", "tm").First(got).Error; err != nil {
+		t.Fatal(err)
+	}
+	var layers []TileLayer
+	if err := json.Unmarshal(got.Config, &layers); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "renamed" || len(layers) != 1 || layers[0].Dataset != "d1" || layers[0].Fields[0] != "name" || !layers[0].DontSimplify {
+		t.Errorf("unexpected saved tilemap %+v %+v", got, layers)
+	}
+}
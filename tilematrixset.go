@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+//瓦片矩阵集常量
+const (
+	//CRS4490 CGCS2000地理坐标系,轴序为纬度在前
+	CRS4490 = "http://www.opengis.net/def/crs/EPSG/0/4490"
+	//metersPerDegree 赤道上每度的米数,WGS84与CGCS2000长半轴相同
+	metersPerDegree = 6378137 * 2 * math.Pi / 360
+	//webMercatorExtent Web墨卡托半周长(米)
+	webMercatorExtent = 20037508.342789244
+	maxTileZoom       = 22
+	maxMercatorLat    = 85.0511287798066
+)
+
+//TileMatrixSet 瓦片矩阵集,原点在左上角,行号自上而下,
+//Geographic为经纬度等分矩阵,否则为Web墨卡托矩阵
+type TileMatrixSet struct {
+	ID         string  `json:"id"`
+	Title      string  `json:"title"`
+	URI        string  `json:"uri,omitempty"`
+	CRS        string  `json:"crs"`
+	WellKnown  string  `json:"wellKnownScaleSet,omitempty"`
+	SRS        string  `json:"-"` //WMTS中的坐标系名称
+	Geographic bool    `json:"-"`
+	LatLon     bool    `json:"-"` //坐标系轴序为纬度在前
+	MinZoom    int     `json:"-"` //首级矩阵标识
+	MaxZoom    int     `json:"-"`
+	Width      uint32  `json:"-"` //首级矩阵列数
+	Height     uint32  `json:"-"` //首级矩阵行数
+	CellSize   float64 `json:"-"` //首级分辨率,CRS单位/像素
+}
+
+//TileMatrix 瓦片矩阵,OGC Two Dimensional Tile Matrix Set 2.0
+type TileMatrix struct {
+	ID               string     `json:"id"`
+	ScaleDenominator float64    `json:"scaleDenominator"`
+	CellSize         float64    `json:"cellSize"`
+	CornerOfOrigin   string     `json:"cornerOfOrigin"`
+	PointOfOrigin    [2]float64 `json:"pointOfOrigin"`
+	TileWidth        int        `json:"tileWidth"`
+	TileHeight       int        `json:"tileHeight"`
+	MatrixWidth      uint32     `json:"matrixWidth"`
+	MatrixHeight     uint32     `json:"matrixHeight"`
+}
+
+//支持的瓦片矩阵集
+var (
+	//WebMercatorQuad Web墨卡托,与XYZ瓦片一致
+	WebMercatorQuad = &TileMatrixSet{
+		ID:        "WebMercatorQuad",
+		Title:     "Google Maps Compatible for the World",
+		URI:       "http://www.opengis.net/def/tilematrixset/OGC/1.0/WebMercatorQuad",
+		CRS:       CRS3857,
+		WellKnown: "urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible",
+		SRS:       "urn:ogc:def:crs:EPSG::3857",
+		MaxZoom:   maxTileZoom,
+		Width:     1,
+		Height:    1,
+		CellSize:  2 * webMercatorExtent / 256,
+	}
+	//WorldCRS84Quad 经纬度等分,0级为2x1
+	WorldCRS84Quad = &TileMatrixSet{
+		ID:         "WorldCRS84Quad",
+		Title:      "CRS84 for the World",
+		URI:        "http://www.opengis.net/def/tilematrixset/OGC/1.0/WorldCRS84Quad",
+		CRS:        CRS84,
+		WellKnown:  "http://www.opengis.net/def/wkss/OGC/1.0/GoogleCRS84Quad",
+		SRS:        "urn:ogc:def:crs:OGC:1.3:CRS84",
+		Geographic: true,
+		MaxZoom:    maxTileZoom - 1,
+		Width:      2,
+		Height:     1,
+		CellSize:   180.0 / 256,
+	}
+	//CGCS2000Quad CGCS2000经纬度等分,同天地图c矩阵,1级为2x1
+	CGCS2000Quad = &TileMatrixSet{
+		ID:         "CGCS2000Quad",
+		Title:      "CGCS2000 geographic quad (Tianditu c)",
+		CRS:        CRS4490,
+		SRS:        "urn:ogc:def:crs:EPSG::4490",
+		Geographic: true,
+		LatLon:     true,
+		MinZoom:    1,
+		MaxZoom:    maxTileZoom - 1,
+		Width:      2,
+		Height:     1,
+		CellSize:   180.0 / 256,
+	}
+	tileMatrixSets = []*TileMatrixSet{WebMercatorQuad, WorldCRS84Quad, CGCS2000Quad}
+	//tileMatrixSetAliases 常用别名,兼容WMTS及天地图的矩阵集名称
+	tileMatrixSetAliases = map[string]*TileMatrixSet{
+		"GoogleMapsCompatible": WebMercatorQuad,
+		"EPSG:3857":            WebMercatorQuad,
+		"EPSG:900913":          WebMercatorQuad,
+		"w":                    WebMercatorQuad,
+		"EPSG:4326":            WorldCRS84Quad,
+		"EPSG:4490":            CGCS2000Quad,
+		"c":                    CGCS2000Quad,
+	}
+)
+
+//getTileMatrixSet 按标识或别名获取瓦片矩阵集,空为WebMercatorQuad
+func getTileMatrixSet(id string) *TileMatrixSet {
+	if id == "" {
+		return WebMercatorQuad
+	}
+	for _, ms := range tileMatrixSets {
+		if ms.ID == id {
+			return ms
+		}
+	}
+	return tileMatrixSetAliases[id]
+}
+
+//level 矩阵标识对应的级数,首级为0
+func (ms *TileMatrixSet) level(z int) uint {
+	return uint(z - ms.MinZoom)
+}
+
+//Size 矩阵行列数
+func (ms *TileMatrixSet) Size(z int) (w, h uint32) {
+	return ms.Width << ms.level(z), ms.Height << ms.level(z)
+}
+
+//Contains 矩阵中是否有该瓦片
+func (ms *TileMatrixSet) Contains(z int, x, y uint32) bool {
+	if z < ms.MinZoom || z > ms.MaxZoom {
+		return false
+	}
+	w, h := ms.Size(z)
+	return x < w && y < h
+}
+
+//Resolution 分辨率,CRS单位/像素
+func (ms *TileMatrixSet) Resolution(z int) float64 {
+	return ms.CellSize / float64(uint(1)<<ms.level(z))
+}
+
+//WebMercatorZoom 与z级赤道分辨率相当的WebMercatorQuad级别,
+//WorldCRS84Quad的z级对应z+1级,CGCS2000Quad与级别标识一致
+func (ms *TileMatrixSet) WebMercatorZoom(z int) int {
+	if ms == WebMercatorQuad {
+		return z
+	}
+	res := ms.Resolution(z)
+	if ms.Geographic {
+		res *= metersPerDegree
+	}
+	return int(math.Round(math.Log2(WebMercatorQuad.CellSize / res)))
+}
+
+//Origin 左上角原点,经度/x在前
+func (ms *TileMatrixSet) Origin() orb.Point {
+	if ms.Geographic {
+		return orb.Point{-180, 90}
+	}
+	return orb.Point{-webMercatorExtent, webMercatorExtent}
+}
+
+//Matrix z级矩阵描述,原点按坐标系轴序
+func (ms *TileMatrixSet) Matrix(z int) TileMatrix {
+	res := ms.Resolution(z)
+	mpu := 1.0
+	if ms.Geographic {
+		mpu = metersPerDegree
+	}
+	o := ms.Origin()
+	origin := [2]float64{o.X(), o.Y()}
+	if ms.LatLon {
+		origin = [2]float64{o.Y(), o.X()}
+	}
+	w, h := ms.Size(z)
+	return TileMatrix{
+		ID:               strconv.Itoa(z),
+		ScaleDenominator: res * mpu / 0.00028,
+		CellSize:         res,
+		CornerOfOrigin:   "topLeft",
+		PointOfOrigin:    origin,
+		TileWidth:        256,
+		TileHeight:       256,
+		MatrixWidth:      w,
+		MatrixHeight:     h,
+	}
+}
+
+//tileDegrees 地理矩阵z级瓦片的经纬度跨度
+func (ms *TileMatrixSet) tileDegrees(z int) float64 {
+	return ms.Resolution(z) * 256
+}
+
+//TileBound 瓦片的经纬度范围
+func (ms *TileMatrixSet) TileBound(t maptile.Tile) orb.Bound {
+	if !ms.Geographic {
+		return t.Bound()
+	}
+	d := ms.tileDegrees(int(t.Z))
+	minx, maxy := -180+float64(t.X)*d, 90-float64(t.Y)*d
+	return orb.Bound{Min: orb.Point{minx, maxy - d}, Max: orb.Point{minx + d, maxy}}
+}
+
+//TileRange 经纬度范围在z级的行列号区间
+func (ms *TileMatrixSet) TileRange(b orb.Bound, z int) (minx, miny, maxx, maxy uint32) {
+	if !ms.Geographic {
+		return tileRange(clampBound(b), z)
+	}
+	d := ms.tileDegrees(z)
+	w, h := ms.Size(z)
+	index := func(v float64, n uint32) uint32 {
+		i := math.Floor(v / d)
+		if i < 0 {
+			return 0
+		}
+		if i >= float64(n) {
+			return n - 1
+		}
+		return uint32(i)
+	}
+	return index(b.Min.X()+180, w), index(90-b.Max.Y(), h), index(b.Max.X()+180, w), index(90-b.Min.Y(), h)
+}
+
+//FlipY 左上角行号与MBTiles左下角行号互换
+func (ms *TileMatrixSet) FlipY(z int, y uint32) uint32 {
+	_, h := ms.Size(z)
+	return h - 1 - y
+}
+
+//tileProjection 地理矩阵瓦片内的像素坐标投影,Web墨卡托使用mvt.ProjectToTile
+func (ms *TileMatrixSet) tileProjection(t maptile.Tile, extent float64) orb.Projection {
+	b := ms.TileBound(t)
+	d := b.Max.X() - b.Min.X()
+	return func(p orb.Point) orb.Point {
+		return orb.Point{(p.X() - b.Min.X()) / d * extent, (b.Max.Y() - p.Y()) / d * extent}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestTileMatrixSet(t *testing.T) {
+	if getTileMatrixSet("") != WebMercatorQuad || getTileMatrixSet("GoogleMapsCompatible") != WebMercatorQuad ||
+		getTileMatrixSet("c") != CGCS2000Quad || getTileMatrixSet("none") != nil {
+		t.Errorf("unexpected tile matrix set lookup")
+	}
+	m := CGCS2000Quad.Matrix(1)
+	if m.MatrixWidth != 2 || m.MatrixHeight != 1 || m.PointOfOrigin != [2]float64{90, -180} || math.Abs(m.ScaleDenominator-279541132.01) > 0.01 {
+		t.Errorf("unexpected CGCS2000Quad level 1 matrix %+v", m)
+	}
+	if m := WorldCRS84Quad.Matrix(0); m.MatrixWidth != 2 || m.PointOfOrigin != [2]float64{-180, 90} {
+		t.Errorf("unexpected WorldCRS84Quad level 0 matrix %+v", m)
+	}
+	if m := WebMercatorQuad.Matrix(2); m.MatrixWidth != 4 || math.Abs(m.ScaleDenominator-139770566.01) > 0.01 {
+		t.Errorf("unexpected WebMercatorQuad level 2 matrix %+v", m)
+	}
+
+	if WorldCRS84Quad.WebMercatorZoom(3) != 4 || CGCS2000Quad.WebMercatorZoom(3) != 3 || WebMercatorQuad.WebMercatorZoom(3) != 3 {
+		t.Errorf("unexpected equivalent web mercator zoom")
+	}
+
+	b := orb.Bound{Min: orb.Point{116.39, 39.91}, Max: orb.Point{116.39, 39.91}}
+	if minx, miny, maxx, maxy := CGCS2000Quad.TileRange(b, 3); minx != 6 || maxx != 6 || miny != 1 || maxy != 1 {
+		t.Errorf("unexpected tile range %d,%d,%d,%d", minx, miny, maxx, maxy)
+	}
+	want := orb.Bound{Min: orb.Point{90, 0}, Max: orb.Point{135, 45}}
+	if got := CGCS2000Quad.TileBound(maptile.New(6, 1, 3)); got != want {
+		t.Errorf("unexpected tile bound %v", got)
+	}
+	if CGCS2000Quad.Contains(0, 0, 0) || !CGCS2000Quad.Contains(3, 7, 3) || CGCS2000Quad.Contains(3, 0, 4) {
+		t.Errorf("unexpected tile containment")
+	}
+	if y := CGCS2000Quad.FlipY(3, 1); y != 2 {
+		t.Errorf("flipped row should be 2, got %d", y)
+	}
+}
+
+func TestPublishTileMatrixSet(t *testing.T) {
+	dt := &Dataset{Name: "pois", Fields: []byte(`[{"name":"name","type":"string"}]`)}
+	fc := geojson.NewFeatureCollection()
+	f := geojson.NewFeature(orb.Point{120.6, 31.3})
+	f.Properties["name"] = "poi"
+	fc.Append(f)
+	opts := &PublishOptions{MinZoom: 0, MaxZoom: 3, Matrix: CGCS2000Quad}
+	if err := opts.Validate(dt); err == nil {
+		t.Errorf("zoom below the first tile matrix should be rejected")
+	}
+	opts.MinZoom = 1
+	path := filepath.Join(t.TempDir(), "pois.mbtiles")
+	if err := dt.publishSource(context.Background(), path, newMemorySource(fc), opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	mdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+	var ms string
+	mdb.QueryRow("select value from metadata where name = 'tilematrixset'").Scan(&ms)
+	if ms != CGCS2000Quad.ID {
+		t.Errorf("tilematrixset metadata should be recorded, got %q", ms)
+	}
+	//3级4行,自上而下第1行即MBTiles第2行
+	var data []byte
+	if err := mdb.QueryRow("select tile_data from tiles where zoom_level = 3 and tile_column = 6 and tile_row = 2").Scan(&data); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := mvt.UnmarshalGzipped(data)
+	if err != nil || len(layers) != 1 || len(layers[0].Features) != 1 {
+		t.Fatalf("unexpected tile, %v", err)
+	}
+	p := layers[0].Features[0].Geometry.(orb.Point)
+	if math.Abs(p.X()-2785) > 1 || math.Abs(p.Y()-1247) > 1 {
+		t.Errorf("unexpected pixel position %v", p)
+	}
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/clip"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+	"github.com/paulmach/orb/simplify"
+	"github.com/spf13/viper"
+)
+
+//tileSource 切片数据源,按范围流式读取要素
+type tileSource interface {
+	//Bounds 遍历全部要素的外包框
+	Bounds(fn func(b orb.Bound) error) error
+	//Count 与范围相交的要素数
+	Count(b orb.Bound) (int, error)
+	//Features 按顺序读取与范围相交的要素,skip大于1时按要素编号每skip个保留一个
+	Features(ctx context.Context, b orb.Bound, skip int, fn func(f *geojson.Feature) error) error
+}
+
+//tileSource 数据集切片数据源,使用GeoPackage的rtree索引
+func (dt *Dataset) tileSource() (tileSource, error) {
+	if dbType != Sqlite3 {
+		return nil, fmt.Errorf("unsupported dirver")
+	}
+	return &gpkgSource{db: dataDB.DB(), table: strings.ToLower(dt.ID)}, nil
+}
+
+//gpkgSource GeoPackage数据源,通过rtree索引按范围查询,不加载全部要素
+type gpkgSource struct {
+	db    *sql.DB
+	table string
+}
+
+func (gs *gpkgSource) Bounds(fn func(b orb.Bound) error) error {
+	rows, err := gs.db.Query(fmt.Sprintf(`SELECT minx, maxx, miny, maxy FROM "rtree_%s_geom"`, gs.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var minx, maxx, miny, maxy float64
+		if err := rows.Scan(&minx, &maxx, &miny, &maxy); err != nil {
+			return err
+		}
+		if err := fn(orb.Bound{Min: orb.Point{minx, miny}, Max: orb.Point{maxx, maxy}}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (gs *gpkgSource) Count(b orb.Bound) (int, error) {
+	var n int
+	err := gs.db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM "rtree_%s_geom" WHERE minx <= ? AND maxx >= ? AND miny <= ? AND maxy >= ?`, gs.table),
+		b.Max.X(), b.Min.X(), b.Max.Y(), b.Min.Y()).Scan(&n)
+	return n, err
+}
+
+func (gs *gpkgSource) Features(ctx context.Context, b orb.Bound, skip int, fn func(f *geojson.Feature) error) error {
+	if skip < 1 {
+		skip = 1
+	}
+	qtext := fmt.Sprintf(`SELECT l.* FROM "%s" l JOIN "rtree_%s_geom" si ON l.fid = si.id WHERE si.minx <= ? AND si.maxx >= ? AND si.miny <= ? AND si.maxy >= ? AND si.id %% ? = 0 ORDER BY l.fid`, gs.table, gs.table)
+	rows, err := gs.db.QueryContext(ctx, qtext, b.Max.X(), b.Min.X(), b.Max.Y(), b.Min.Y(), skip)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return scanGpkgFeatures(rows, fn)
+}
+
+//memoryIndexZoom 内存数据源网格索引的级别
+const memoryIndexZoom = 12
+
+//memorySource 内存数据源,按网格索引要素,跨越网格过多的要素单独存放
+type memorySource struct {
+	features []*geojson.Feature
+	bounds   []orb.Bound
+	grid     map[uint64][]int
+	large    []int
+}
+
+//newMemorySource 由要素集创建内存数据源
+func newMemorySource(fc *geojson.FeatureCollection) *memorySource {
+	ms := &memorySource{grid: make(map[uint64][]int)}
+	for _, f := range fc.Features {
+		if f.Geometry == nil {
+			continue
+		}
+		i := len(ms.features)
+		b := clampBound(f.Geometry.Bound())
+		ms.features = append(ms.features, f)
+		ms.bounds = append(ms.bounds, b)
+		minx, miny, maxx, maxy := tileRange(b, memoryIndexZoom)
+		if (maxx-minx+1)*(maxy-miny+1) > 16 {
+			ms.large = append(ms.large, i)
+			continue
+		}
+		for x := minx; x <= maxx; x++ {
+			for y := miny; y <= maxy; y++ {
+				key := uint64(x)<<32 | uint64(y)
+				ms.grid[key] = append(ms.grid[key], i)
+			}
+		}
+	}
+	return ms
+}
+
+//query 与范围相交的要素序号,升序
+func (ms *memorySource) query(b orb.Bound) []int {
+	var candidates []int
+	minx, miny, maxx, maxy := tileRange(clampBound(b), memoryIndexZoom)
+	if int(maxx-minx+1)*int(maxy-miny+1) > len(ms.features) {
+		candidates = make([]int, len(ms.features))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	} else {
+		candidates = append(candidates, ms.large...)
+		for x := minx; x <= maxx; x++ {
+			for y := miny; y <= maxy; y++ {
+				candidates = append(candidates, ms.grid[uint64(x)<<32|uint64(y)]...)
+			}
+		}
+		sort.Ints(candidates)
+	}
+	out := candidates[:0]
+	last := -1
+	for _, i := range candidates {
+		if i == last || !ms.bounds[i].Intersects(b) {
+			continue
+		}
+		out = append(out, i)
+		last = i
+	}
+	return out
+}
+
+func (ms *memorySource) Bounds(fn func(b orb.Bound) error) error {
+	for _, b := range ms.bounds {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *memorySource) Count(b orb.Bound) (int, error) {
+	return len(ms.query(b)), nil
+}
+
+func (ms *memorySource) Features(ctx context.Context, b orb.Bound, skip int, fn func(f *geojson.Feature) error) error {
+	for _, i := range ms.query(b) {
+		if skip > 1 && i%skip != 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(ms.features[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//clampBound 限定在Web墨卡托有效范围内
+func clampBound(b orb.Bound) orb.Bound {
+	lat := 85.051129
+	return orb.Bound{
+		Min: orb.Point{math.Max(math.Min(b.Min.X(), 180), -180), math.Max(math.Min(b.Min.Y(), lat), -lat)},
+		Max: orb.Point{math.Max(math.Min(b.Max.X(), 180), -180), math.Max(math.Min(b.Max.Y(), lat), -lat)},
+	}
+}
+
+//Tiler 矢量切片器,自矩阵首级逐级由上级有要素的瓦片派生下级瓦片,并发按范围读取要素编码,去重写入MBTiles,
+//瓦片要素数或大小超过限制时合并属性相同的要素,仍超过时抽稀要素
+type Tiler struct {
+	Name            string
+	MinZoom         int
+	MaxZoom         int
+	Bound           *orb.Bound          //切片范围,nil为全部
+	Fields          []string            //保留的属性,空为全部
+	Tolerance       func(z int) float64 //按级别的简化容差,nil为1
+	Concurrency     int
+	MaxTileBytes    int
+	MaxTileFeatures int
+	Buffer          int            //瓦片缓冲区像素,瓦片范围4096
+	Matrix          *TileMatrixSet //瓦片矩阵集,nil为WebMercatorQuad
+	Extent          orb.Bound      //切片要素的范围
+	Tiles           int64          //写入的瓦片数
+	Unique          int64          //去重后的瓦片数
+	Dropped         int64          //因瓦片超限舍弃的要素数
+}
+
+//NewTiler 按tiler配置创建切片器
+func NewTiler(name string, minzoom, maxzoom int) *Tiler {
+	return &Tiler{
+		Name:            name,
+		MinZoom:         minzoom,
+		MaxZoom:         maxzoom,
+		Concurrency:     viper.GetInt("tiler.concurrency"),
+		MaxTileBytes:    viper.GetInt("tiler.maxtilebytes"),
+		MaxTileFeatures: viper.GetInt("tiler.maxtilefeatures"),
+		Buffer:          64,
+	}
+}
+
+//matrix 切片使用的瓦片矩阵集
+func (tl *Tiler) matrix() *TileMatrixSet {
+	if tl.Matrix == nil {
+		return WebMercatorQuad
+	}
+	return tl.Matrix
+}
+
+//projectFeatures 投影要素几何,要素已为副本
+func projectFeatures(features []*geojson.Feature, proj orb.Projection) []*geojson.Feature {
+	for _, f := range features {
+		f.Geometry = project.Geometry(f.Geometry, proj)
+	}
+	return features
+}
+
+//Run 切片写入mdb,mdb需由CreateDedupMBTileTables创建,ctx取消时返回ctx.Err()
+func (tl *Tiler) Run(ctx context.Context, src tileSource, mdb *sql.DB, task *Task) error {
+	concurrency := tl.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	err := tl.computeExtent(src)
+	if err != nil {
+		return err
+	}
+	ms := tl.matrix()
+	w := &tileWriter{db: mdb, ms: ms, seen: make(map[[16]byte]bool)}
+	levels := tl.MaxZoom - tl.MinZoom + 1
+	//上级有要素的瓦片,按行列编码升序,只保留一级
+	var parents []uint64
+	for z := ms.MinZoom; z <= tl.MaxZoom; z++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var total int
+		var tiles func(yield func(t maptile.Tile) bool)
+		if z == ms.MinZoom {
+			tiles, total = rootTiles(ms)
+		} else {
+			if len(parents) == 0 {
+				break
+			}
+			tiles, total = childTiles(parents, z)
+		}
+		zi := z - tl.MinZoom
+		parents, err = tl.runLevel(ctx, src, w, tiles, concurrency, z >= tl.MinZoom, z < tl.MaxZoom, func(done int) {
+			if task != nil && zi >= 0 {
+				task.Count = int(atomic.LoadInt64(&tl.Tiles))
+				task.Progress = (zi*99 + done*99/total) / levels
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if task != nil {
+		task.Count = int(tl.Tiles)
+		task.Progress = 99
+	}
+	tl.Unique = int64(len(w.seen))
+	return nil
+}
+
+//computeExtent 计算切片范围内要素的范围
+func (tl *Tiler) computeExtent(src tileSource) error {
+	extent := orb.Bound{Min: orb.Point{181, 91}, Max: orb.Point{-181, -91}}
+	err := src.Bounds(func(b orb.Bound) error {
+		if tl.Bound != nil {
+			if !tl.Bound.Intersects(b) {
+				return nil
+			}
+			b = intersectBound(b, *tl.Bound)
+		}
+		extent = extent.Union(b)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tl.Extent = extent
+	return nil
+}
+
+//intersectBound 两个相交范围的交集
+func intersectBound(a, b orb.Bound) orb.Bound {
+	return orb.Bound{
+		Min: orb.Point{math.Max(a.Min.X(), b.Min.X()), math.Max(a.Min.Y(), b.Min.Y())},
+		Max: orb.Point{math.Min(a.Max.X(), b.Max.X()), math.Min(a.Max.Y(), b.Max.Y())},
+	}
+}
+
+//rootTiles 矩阵首级的全部瓦片
+func rootTiles(ms *TileMatrixSet) (func(yield func(t maptile.Tile) bool), int) {
+	w, h := ms.Size(ms.MinZoom)
+	return func(yield func(t maptile.Tile) bool) {
+		for x := uint32(0); x < w; x++ {
+			for y := uint32(0); y < h; y++ {
+				if !yield(maptile.New(x, y, maptile.Zoom(ms.MinZoom))) {
+					return
+				}
+			}
+		}
+	}, int(w * h)
+}
+
+//childTiles z级中上级瓦片的子瓦片
+func childTiles(parents []uint64, z int) (func(yield func(t maptile.Tile) bool), int) {
+	return func(yield func(t maptile.Tile) bool) {
+		for _, k := range parents {
+			x, y := uint32(k>>32)*2, uint32(k)*2
+			for _, c := range [4][2]uint32{{x, y}, {x + 1, y}, {x, y + 1}, {x + 1, y + 1}} {
+				if !yield(maptile.New(c[0], c[1], maptile.Zoom(z))) {
+					return
+				}
+			}
+		}
+	}, len(parents) * 4
+}
+
+//tileCovered 瓦片在切片范围内的部分是否有要素(按要素外包框)
+func (tl *Tiler) tileCovered(src tileSource, t maptile.Tile) (bool, error) {
+	b := tl.matrix().TileBound(t)
+	if tl.Bound != nil {
+		if !tl.Bound.Intersects(b) {
+			return false, nil
+		}
+		b = intersectBound(b, *tl.Bound)
+	}
+	n, err := src.Count(b)
+	return n > 0, err
+}
+
+//runLevel 并发处理一级瓦片,render为true时编码并单线程分批写入,
+//collect为true时返回有要素的瓦片用于派生下级瓦片
+func (tl *Tiler) runLevel(ctx context.Context, src tileSource, w *tileWriter, tiles func(yield func(t maptile.Tile) bool), concurrency int, render, collect bool, progress func(done int)) ([]uint64, error) {
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		tile    maptile.Tile
+		covered bool
+		data    []byte
+	}
+	jobs := make(chan maptile.Tile)
+	results := make(chan result, concurrency*4)
+	var once sync.Once
+	var rerr error
+	fail := func(err error) {
+		once.Do(func() {
+			rerr = err
+			cancel()
+		})
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				covered, err := tl.tileCovered(src, t)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				var data []byte
+				if covered && render {
+					data, err = tl.renderTile(lctx, src, t)
+					if err != nil {
+						fail(err)
+						continue
+					}
+				}
+				results <- result{tile: t, covered: covered, data: data}
+			}
+		}()
+	}
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(results)
+		}()
+		tiles(func(t maptile.Tile) bool {
+			select {
+			case jobs <- t:
+				return true
+			case <-lctx.Done():
+				return false
+			}
+		})
+	}()
+
+	var covered []uint64
+	done := 0
+	var werr error
+	for r := range results {
+		done++
+		if done%100 == 0 {
+			progress(done)
+		}
+		if collect && r.covered {
+			covered = append(covered, uint64(r.tile.X)<<32|uint64(r.tile.Y))
+		}
+		if len(r.data) == 0 || werr != nil {
+			continue
+		}
+		werr = w.Put(r.tile, r.data)
+		if werr != nil {
+			cancel()
+			continue
+		}
+		atomic.AddInt64(&tl.Tiles, 1)
+	}
+	if werr != nil {
+		w.Rollback()
+		return nil, werr
+	}
+	if err := w.Commit(); err != nil {
+		return nil, err
+	}
+	if rerr != nil && rerr != context.Canceled {
+		return nil, rerr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	progress(done)
+	sort.Slice(covered, func(i, j int) bool { return covered[i] < covered[j] })
+	return covered, nil
+}
+
+//renderTile 读取瓦片缓冲范围内的要素并编码,要素过多时按编号抽稀读取,
+//编码后超过大小限制时先合并属性相同的要素,再逐次舍弃一半要素
+func (tl *Tiler) renderTile(ctx context.Context, src tileSource, t maptile.Tile) ([]byte, error) {
+	b := tl.matrix().TileBound(t)
+	pad := b.Pad((b.Max.X() - b.Min.X()) * float64(tl.Buffer) / 4096)
+	n, err := src.Count(pad)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	skip := 1
+	if tl.MaxTileFeatures > 0 && n > tl.MaxTileFeatures {
+		skip = (n + tl.MaxTileFeatures - 1) / tl.MaxTileFeatures
+	}
+	keep := make(map[string]bool)
+	for _, name := range tl.Fields {
+		keep[name] = true
+	}
+	var features []*geojson.Feature
+	read := 0
+	err = src.Features(ctx, pad, skip, func(f *geojson.Feature) error {
+		read++
+		if f.Geometry == nil {
+			return nil
+		}
+		if tl.Bound != nil && !tl.Bound.Intersects(f.Geometry.Bound()) {
+			return nil
+		}
+		g := f.Geometry
+		switch g.(type) {
+		case orb.Polygon, orb.MultiPolygon:
+			//多边形裁剪会修改原几何
+			g = orb.Clone(g)
+		}
+		g = clip.Geometry(pad, g)
+		if g == nil {
+			return nil
+		}
+		nf := geojson.NewFeature(g)
+		nf.ID = f.ID
+		if len(keep) == 0 {
+			nf.Properties = f.Properties
+		} else {
+			for k, v := range f.Properties {
+				if keep[k] {
+					nf.Properties[k] = v
+				}
+			}
+		}
+		features = append(features, nf)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if skip > 1 {
+		atomic.AddInt64(&tl.Dropped, int64(n-read))
+	}
+	tol := 1.0
+	if tl.Tolerance != nil {
+		tol = tl.Tolerance(int(t.Z))
+	}
+	data, err := tl.encode(t, features, tol)
+	for i := 0; err == nil && tl.MaxTileBytes > 0 && len(data) > tl.MaxTileBytes && len(features) > 1; i++ {
+		if i == 0 {
+			features = coalesceFeatures(features)
+		} else {
+			before := len(features)
+			features = dropFeatures(features)
+			atomic.AddInt64(&tl.Dropped, int64(before-len(features)))
+		}
+		data, err = tl.encode(t, features, tol)
+	}
+	return data, err
+}
+
+//encode 编码瓦片,投影会修改几何,使用副本
+func (tl *Tiler) encode(t maptile.Tile, features []*geojson.Feature, tolerance float64) ([]byte, error) {
+	fc := geojson.NewFeatureCollection()
+	for _, f := range features {
+		nf := geojson.NewFeature(orb.Clone(f.Geometry))
+		nf.ID = f.ID
+		nf.Properties = f.Properties
+		fc.Append(nf)
+	}
+	ms := tl.matrix()
+	if ms.Geographic {
+		fc.Features = projectFeatures(fc.Features, ms.tileProjection(t, 4096))
+	}
+	layer := mvt.NewLayer(tl.Name, fc)
+	if !ms.Geographic {
+		layer.ProjectToTile(t)
+	}
+	if tolerance > 0 {
+		layer.Simplify(simplify.DouglasPeucker(tolerance))
+	}
+	layer.RemoveEmpty(1.0, 1.0)
+	if len(layer.Features) == 0 {
+		return nil, nil
+	}
+	return mvt.MarshalGzipped(mvt.Layers{layer})
+}
+
+//coalesceFeatures 合并属性与几何维度相同的要素为多部件要素
+func coalesceFeatures(features []*geojson.Feature) []*geojson.Feature {
+	groups := make(map[string]*geojson.Feature)
+	var out []*geojson.Feature
+	for _, f := range features {
+		if _, ok := f.Geometry.(orb.Collection); ok {
+			out = append(out, f)
+			continue
+		}
+		props, _ := json.Marshal(f.Properties)
+		key := fmt.Sprintf("%d:%s", f.Geometry.Dimensions(), props)
+		g, ok := groups[key]
+		if !ok {
+			nf := geojson.NewFeature(f.Geometry)
+			nf.Properties = f.Properties
+			groups[key] = nf
+			out = append(out, nf)
+			continue
+		}
+		g.Geometry = mergeGeometry(g.Geometry, f.Geometry)
+	}
+	return out
+}
+
+//mergeGeometry 合并同维度的几何
+func mergeGeometry(a, b orb.Geometry) orb.Geometry {
+	switch a.Dimensions() {
+	case 0:
+		var mp orb.MultiPoint
+		for _, g := range []orb.Geometry{a, b} {
+			switch p := g.(type) {
+			case orb.Point:
+				mp = append(mp, p)
+			case orb.MultiPoint:
+				mp = append(mp, p...)
+			}
+		}
+		return mp
+	case 1:
+		var ml orb.MultiLineString
+		for _, g := range []orb.Geometry{a, b} {
+			switch l := g.(type) {
+			case orb.LineString:
+				ml = append(ml, l)
+			case orb.MultiLineString:
+				ml = append(ml, l...)
+			}
+		}
+		return ml
+	default:
+		var mp orb.MultiPolygon
+		for _, g := range []orb.Geometry{a, b} {
+			switch p := g.(type) {
+			case orb.Polygon:
+				mp = append(mp, p)
+			case orb.MultiPolygon:
+				mp = append(mp, p...)
+			}
+		}
+		return mp
+	}
+}
+
+//dropFeatures 舍弃一半要素
+func dropFeatures(features []*geojson.Feature) []*geojson.Feature {
+	out := make([]*geojson.Feature, 0, (len(features)+1)/2)
+	for i, f := range features {
+		if i%2 == 0 {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+//tileWriter 分批写入瓦片,内容相同的瓦片只存一份
+type tileWriter struct {
+	db    *sql.DB
+	ms    *TileMatrixSet
+	tx    *sql.Tx
+	img   *sql.Stmt
+	mp    *sql.Stmt
+	seen  map[[16]byte]bool
+	batch int
+}
+
+//Put 写入瓦片,每500个提交一次
+func (w *tileWriter) Put(t maptile.Tile, data []byte) error {
+	if w.tx == nil {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+		w.img, err = tx.Prepare("insert or ignore into images (tile_data, tile_id) values (?, ?)")
+		if err == nil {
+			w.mp, err = tx.Prepare("insert or replace into map (zoom_level, tile_column, tile_row, tile_id) values (?, ?, ?, ?)")
+		}
+		if err != nil {
+			w.Rollback()
+			return err
+		}
+	}
+	sum := md5.Sum(data)
+	id := fmt.Sprintf("%x", sum)
+	if !w.seen[sum] {
+		if _, err := w.img.Exec(data, id); err != nil {
+			return err
+		}
+		w.seen[sum] = true
+	}
+	if _, err := w.mp.Exec(t.Z, t.X, w.ms.FlipY(int(t.Z), t.Y), id); err != nil {
+		return err
+	}
+	w.batch++
+	if w.batch >= 500 {
+		return w.Commit()
+	}
+	return nil
+}
+
+//Commit 提交当前批次
+func (w *tileWriter) Commit() error {
+	if w.tx == nil {
+		return nil
+	}
+	w.img.Close()
+	w.mp.Close()
+	err := w.tx.Commit()
+	w.tx, w.batch = nil, 0
+	return err
+}
+
+//Rollback 回滚当前批次
+func (w *tileWriter) Rollback() {
+	if w.tx == nil {
+		return
+	}
+	if w.img != nil {
+		w.img.Close()
+	}
+	if w.mp != nil {
+		w.mp.Close()
+	}
+	w.tx.Rollback()
+	w.tx, w.img, w.mp, w.batch = nil, nil, nil, 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+//randomFC 在范围内随机生成n个点与少量多边形
+func randomFC(n int, b orb.Bound) *geojson.FeatureCollection {
+	r := rand.New(rand.NewSource(1))
+	fc := geojson.NewFeatureCollection()
+	for i := 0; i < n; i++ {
+		x := b.Min.X() + r.Float64()*(b.Max.X()-b.Min.X())
+		y := b.Min.Y() + r.Float64()*(b.Max.Y()-b.Min.Y())
+		var g orb.Geometry = orb.Point{x, y}
+		if i%10 == 5 {
+			d := 0.05
+			g = orb.Polygon{{{x, y}, {x + d, y}, {x + d, y + d}, {x, y + d}, {x, y}}}
+		}
+		f := geojson.NewFeature(g)
+		f.ID = i
+		f.Properties["kind"] = fmt.Sprintf("k%d", i%3)
+		fc.Append(f)
+	}
+	return fc
+}
+
+func TestMemorySource(t *testing.T) {
+	fc := randomFC(2000, orb.Bound{Min: orb.Point{120, 31}, Max: orb.Point{121, 32}})
+	//跨越大量网格的要素
+	fc.Append(geojson.NewFeature(orb.LineString{{100, 20}, {130, 40}}))
+	ms := newMemorySource(fc)
+	for _, b := range []orb.Bound{
+		{Min: orb.Point{120.2, 31.2}, Max: orb.Point{120.3, 31.3}},
+		{Min: orb.Point{120.5, 31.5}, Max: orb.Point{120.5, 31.5}},
+		{Min: orb.Point{0, 0}, Max: orb.Point{1, 1}},
+		{Min: orb.Point{-180, -85}, Max: orb.Point{180, 85}},
+	} {
+		var want []int
+		for i, f := range fc.Features {
+			if f.Geometry.Bound().Intersects(b) {
+				want = append(want, i)
+			}
+		}
+		got := ms.query(b)
+		if len(got) != len(want) {
+			t.Fatalf("query %v returned %d features, want %d", b, len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("query %v returned %v, want %v", b, got, want)
+			}
+		}
+	}
+}
+
+func TestTilerDedup(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	f := geojson.NewFeature(orb.Polygon{{{110, 20}, {130, 20}, {130, 40}, {110, 40}, {110, 20}}})
+	f.ID = 1
+	f.Properties["kind"] = "land"
+	fc.Append(f)
+
+	path := filepath.Join(t.TempDir(), "dedup.mbtiles")
+	mdb, err := CreateDedupMBTileTables(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+	tl := NewTiler("land", 4, 8)
+	err = tl.Run(context.Background(), newMemorySource(fc), mdb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tiles, images int64
+	mdb.QueryRow("select count(*) from tiles").Scan(&tiles)
+	mdb.QueryRow("select count(*) from images").Scan(&images)
+	if tiles != tl.Tiles || images != tl.Unique {
+		t.Errorf("tiles %d images %d, tiler reported %d %d", tiles, images, tl.Tiles, tl.Unique)
+	}
+	if images >= tiles {
+		t.Errorf("covered tiles should be deduplicated, %d images for %d tiles", images, tiles)
+	}
+	if tl.Extent.Min.X() != 110 || tl.Extent.Max.Y() != 40 {
+		t.Errorf("unexpected extent %v", tl.Extent)
+	}
+	//由上级派生的瓦片与按外包框计算的瓦片一致
+	want := int64(0)
+	for z := 4; z <= 8; z++ {
+		minx, miny, maxx, maxy := tileRange(f.Geometry.Bound(), z)
+		want += int64(maxx-minx+1) * int64(maxy-miny+1)
+	}
+	if tiles != want {
+		t.Errorf("expected %d tiles covering the polygon, got %d", want, tiles)
+	}
+}
+
+func TestTilerLimits(t *testing.T) {
+	fc := randomFC(1000, orb.Bound{Min: orb.Point{120, 31}, Max: orb.Point{120.5, 31.5}})
+	tile := maptile.New(0, 0, 0)
+	tl := NewTiler("pois", 0, 0)
+
+	tl.MaxTileFeatures = 100
+	data, err := tl.renderTile(context.Background(), newMemorySource(fc), tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, _ := mvt.UnmarshalGzipped(data)
+	if n := len(layers[0].Features); n > 100 || tl.Dropped != int64(1000-n) {
+		t.Errorf("expected at most 100 features, got %d, dropped %d", n, tl.Dropped)
+	}
+
+	//超过大小时先按属性合并为多部件要素
+	tl = NewTiler("pois", 0, 0)
+	full, err := tl.renderTile(context.Background(), newMemorySource(fc), tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.MaxTileBytes = len(full) - 1
+	data, err = tl.renderTile(context.Background(), newMemorySource(fc), tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, _ = mvt.UnmarshalGzipped(data)
+	if len(layers[0].Features) > 6 || tl.Dropped != 0 {
+		t.Errorf("expected coalesced features, got %d, dropped %d", len(layers[0].Features), tl.Dropped)
+	}
+
+	//合并后仍超过时舍弃要素
+	tl = NewTiler("pois", 0, 0)
+	tl.MaxTileBytes = 64
+	data, err = tl.renderTile(context.Background(), newMemorySource(fc), tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl.Dropped == 0 {
+		t.Errorf("oversized tile should drop features, got %d bytes", len(data))
+	}
+}
+
+func benchmarkFC() *geojson.FeatureCollection {
+	return randomFC(5000, orb.Bound{Min: orb.Point{120, 31}, Max: orb.Point{121, 32}})
+}
+
+func BenchmarkSplitTile(b *testing.B) {
+	fc := benchmarkFC()
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := CreateMBTileTables(filepath.Join(dir, fmt.Sprintf("split%d.mbtiles", i)), true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		SplitTile(db, fc, "bench", 0, 0, 0)
+		db.Close()
+	}
+}
+
+func BenchmarkTiler(b *testing.B) {
+	fc := benchmarkFC()
+	maxzoom := GuessMaxZoom(fc)
+	src := newMemorySource(fc)
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := CreateDedupMBTileTables(filepath.Join(dir, fmt.Sprintf("tiler%d.mbtiles", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		err = NewTiler("bench", 0, maxzoom).Run(context.Background(), src, db, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		db.Close()
+	}
+}
@@ -43,6 +43,8 @@ type Tileset struct {
 	timestamp time.Time  // timestamp of file, for cache control headers
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
+
+	tmeta *tilesetMeta // parsed metadata, reloaded with the service
 }
 
 //LoadTileset 创建更新瓦片集服务
@@ -105,6 +107,10 @@ func (ts *Tileset) Service() error {
 	}
 	ts.db = db
 	ts.timestamp = fStat.ModTime().Round(time.Second)
+	ts.tmeta = nil
+	if m, err := ts.loadMeta(); err == nil {
+		ts.tmeta = m
+	}
 	ts.Status = true
 	return nil
 }
@@ -351,3 +357,33 @@ func CreateMBTileTables(pathFile string, force bool) (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+//CreateDedupMBTileTables 初始化去重存储的MBTile库,瓦片存于images,行列号映射存于map,tiles为视图
+func CreateDedupMBTileTables(pathFile string) (*sql.DB, error) {
+	os.Remove(pathFile)
+	os.MkdirAll(filepath.Dir(pathFile), os.ModePerm)
+	db, err := sql.Open("sqlite3", pathFile)
+	if err != nil {
+		return nil, err
+	}
+	stmts := []string{
+		"PRAGMA synchronous=0",
+		"PRAGMA locking_mode=EXCLUSIVE",
+		"PRAGMA journal_mode=DELETE",
+		"create table map (zoom_level integer, tile_column integer, tile_row integer, tile_id text);",
+		"create unique index map_index on map (zoom_level, tile_column, tile_row);",
+		"create table images (tile_data blob, tile_id text);",
+		"create unique index images_id on images (tile_id);",
+		"create view tiles as select map.zoom_level as zoom_level, map.tile_column as tile_column, map.tile_row as tile_row, images.tile_data as tile_data from map join images on images.tile_id = map.tile_id;",
+		"create table metadata (name text, value text);",
+		"create unique index name on metadata (name);",
+	}
+	for _, st := range stmts {
+		_, err = db.Exec(st)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
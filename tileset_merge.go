@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // register jpeg decoder
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/paulmach/orb/encoding/mvt/vectortile"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register webp decoder
+)
+
+//mergeLayerNames 合并后的图层名,按瓦片集顺序,与前面瓦片集重名的图层改名为 图层名_瓦片集ID
+func mergeLayerNames(tids []string, layers [][]string) []map[string]string {
+	used := make(map[string]bool)
+	names := make([]map[string]string, len(tids))
+	for i, tid := range tids {
+		names[i] = make(map[string]string)
+		if i >= len(layers) {
+			continue
+		}
+		for _, name := range layers[i] {
+			out := name
+			if used[out] {
+				out = name + "_" + tid
+			}
+			used[out] = true
+			names[i][name] = out
+		}
+	}
+	return names
+}
+
+//mergedNamesEntry 合并图层名映射及计算时的瓦片集,瓦片集重新加载后失效
+type mergedNamesEntry struct {
+	tss   []*Tileset
+	names []map[string]string
+}
+
+//mergedNames 合并图层名映射缓存,按瓦片集ID列表,超过上限时清空
+var mergedNames = struct {
+	sync.Mutex
+	m map[string]*mergedNamesEntry
+}{m: make(map[string]*mergedNamesEntry)}
+
+const maxMergedNames = 1024
+
+//tilesetsMergeLayerNames 合并瓦片集的图层名映射,缓存未命中时读取元数据计算,
+//layers不为nil时使用已读取的图层
+func tilesetsMergeLayerNames(tids []string, tss []*Tileset, layers [][]string) []map[string]string {
+	key := strings.Join(tids, ",")
+	mergedNames.Lock()
+	e, ok := mergedNames.m[key]
+	mergedNames.Unlock()
+	if ok && sameTilesets(e.tss, tss) {
+		return e.names
+	}
+	complete := true
+	if layers == nil {
+		layers = make([][]string, len(tss))
+		for i, ts := range tss {
+			metadata, err := ts.GetInfo()
+			if err != nil {
+				complete = false
+				continue
+			}
+			layers[i] = tilesetLayerIDs(metadata)
+		}
+	}
+	names := mergeLayerNames(tids, layers)
+	if complete {
+		mergedNames.Lock()
+		if len(mergedNames.m) >= maxMergedNames {
+			mergedNames.m = make(map[string]*mergedNamesEntry)
+		}
+		mergedNames.m[key] = &mergedNamesEntry{tss: tss, names: names}
+		mergedNames.Unlock()
+	}
+	return names
+}
+
+//sameTilesets 是否为同一组瓦片集对象
+func sameTilesets(a, b []*Tileset) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//MergeVectorTiles 合并多个矢量瓦片的图层,tiles与names一一对应,空瓦片跳过,返回gzip压缩的MVT,
+//names中没有的图层重名时改名为 图层名_瓦片集ID
+func MergeVectorTiles(tids []string, tiles [][]byte, names []map[string]string) ([]byte, error) {
+	out := &vectortile.Tile{}
+	used := make(map[string]bool)
+	for i, data := range tiles {
+		if len(data) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(data, []byte("\x1f\x8b")) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			data, err = ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		vt := &vectortile.Tile{}
+		err := vt.Unmarshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode tile of %s error, details: %s", tids[i], err)
+		}
+		for _, l := range vt.Layers {
+			name := l.GetName()
+			if i < len(names) {
+				if n, ok := names[i][name]; ok {
+					name = n
+				}
+			}
+			if used[name] {
+				name = l.GetName() + "_" + tids[i]
+			}
+			used[name] = true
+			l.Name = &name
+			out.Layers = append(out.Layers, l)
+		}
+	}
+	if len(out.Layers) == 0 {
+		return nil, nil
+	}
+	data, err := out.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return gzipTile(data)
+}
+
+//BlendRasterTiles 按顺序叠加栅格瓦片,后面的在上层,按透明度混合,输出PNG,
+//瓦片大小不同时按第一个瓦片的大小缩放
+func BlendRasterTiles(tiles [][]byte) ([]byte, error) {
+	var canvas *image.RGBA
+	for _, data := range tiles {
+		if len(data) == 0 {
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if canvas == nil {
+			canvas = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		}
+		if img.Bounds().Size() == canvas.Bounds().Size() {
+			draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Over)
+			continue
+		}
+		xdraw.BiLinear.Scale(canvas, canvas.Bounds(), img, img.Bounds(), draw.Over, nil)
+	}
+	if canvas == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, canvas)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
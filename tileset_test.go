@@ -1,7 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"reflect"
 	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
 )
 
 func Test_TileFormat_ContentType(t *testing.T) {
@@ -22,3 +32,98 @@ func Test_TileFormat_ContentType(t *testing.T) {
 		}
 	}
 }
+
+func Test_MergeVectorTiles(t *testing.T) {
+	layer := func(name string, n int) *mvt.Layer {
+		fc := geojson.NewFeatureCollection()
+		for i := 0; i < n; i++ {
+			f := geojson.NewFeature(orb.Point{float64(i), float64(i)})
+			f.Properties["name"] = name
+			fc.Append(f)
+		}
+		return mvt.NewLayer(name, fc)
+	}
+	a, err := mvt.MarshalGzipped(mvt.Layers{layer("roads", 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := mvt.Marshal(mvt.Layers{layer("roads", 1), layer("pois", 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tids := []string{"base", "poi"}
+	names := mergeLayerNames(tids, [][]string{{"roads"}, {"roads", "pois"}})
+	if names[1]["roads"] != "roads_poi" || names[1]["pois"] != "pois" {
+		t.Errorf("unexpected layer names %v", names)
+	}
+	data, err := MergeVectorTiles(tids, [][]byte{a, b}, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := mvt.UnmarshalGzipped(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int)
+	for _, l := range layers {
+		got[l.Name] = len(l.Features)
+	}
+	want := map[string]int{"roads": 2, "roads_poi": 1, "pois": 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged layers %v, expected %v", got, want)
+	}
+	//缺失的瓦片跳过,元数据中没有的重名图层也改名
+	data, err = MergeVectorTiles(tids, [][]byte{nil, b}, nil)
+	if err != nil || data == nil {
+		t.Fatal(err)
+	}
+	if data, _ := MergeVectorTiles(tids, [][]byte{nil, nil}, nil); data != nil {
+		t.Error("expected empty merge")
+	}
+}
+
+func TestMergeLayerNamesCache(t *testing.T) {
+	ts := newTestTileset(t, ATLAS)
+	tids := []string{ts.ID}
+	names := tilesetsMergeLayerNames(tids, []*Tileset{ts}, [][]string{{"roads"}})
+	if names[0]["roads"] != "roads" {
+		t.Fatalf("unexpected layer names %v", names)
+	}
+	//同一瓦片集使用缓存,不再读取元数据
+	if names := tilesetsMergeLayerNames(tids, []*Tileset{ts}, nil); names[0]["roads"] != "roads" {
+		t.Errorf("cached layer names expected, got %v", names)
+	}
+	//瓦片集重新加载后重新计算
+	reloaded := *ts
+	if names := tilesetsMergeLayerNames(tids, []*Tileset{&reloaded}, nil); len(names[0]) != 0 {
+		t.Errorf("reloaded tileset should recompute layer names, got %v", names)
+	}
+}
+
+func Test_BlendRasterTiles(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		return buf.Bytes()
+	}
+	bottom := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(bottom, bottom.Bounds(), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.ZP, draw.Src)
+	top := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	draw.Draw(top, top.Bounds(), image.NewUniform(color.NRGBA{0, 0, 255, 128}), image.ZP, draw.Src)
+
+	data, err := BlendRasterTiles([][]byte{encode(bottom), nil, encode(top)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 4 {
+		t.Errorf("expected size of the first tile, got %v", img.Bounds())
+	}
+	r, g, b, a := img.At(1, 1).RGBA()
+	if r>>8 < 120 || r>>8 > 135 || g != 0 || b>>8 < 120 || b>>8 > 135 || a>>8 != 255 {
+		t.Errorf("unexpected blended color %d,%d,%d,%d", r>>8, g>>8, b>>8, a>>8)
+	}
+}
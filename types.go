@@ -114,6 +114,9 @@ const (
 	TSUPLOAD          = "tsupload" // encoding = deflate
 	TSIMPORT          = "tsimport" // encoding = deflate
 	DS2TS             = "ds2ts"    // encoding = deflate
+	DS2GS             = "ds2gs"    // 数据集发布到Geoserver
+	GS2TS             = "gs2ts"    // GWC图层采集到服务集
+	OL2TS             = "ol2ts"    // 在线底图预取到服务集
 )
 
 //TaskTypes 支持的瓦片类型
@@ -72,6 +72,12 @@ var codes = map[int]string{
 
 	408: "请求超时",
 
+	409:  "资源冲突",
+	4091: "样式已被修改,版本冲突",
+
+	428:  "缺少前置条件",
+	4281: "修改样式需要提供If-Match版本",
+
 	500:  "系统错误",
 	5001: "数据库错误",
 	5002: "文件读写错误",
@@ -228,6 +234,7 @@ func CreatePaths(name string) {
 	os.MkdirAll(filepath.Join(viper.GetString("paths.tilesets"), name), os.ModePerm)
 	os.MkdirAll(filepath.Join(viper.GetString("paths.datasets"), name), os.ModePerm)
 	os.MkdirAll(filepath.Join(viper.GetString("paths.uploads"), name), os.ModePerm)
+	os.MkdirAll(filepath.Join(viper.GetString("paths.icons"), name), os.ModePerm)
 	// os.MkdirAll(filepath.Join(viper.GetString("paths.fonts"), name), os.ModePerm)
 }
 
@@ -0,0 +1,1241 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+	log "github.com/sirupsen/logrus"
+)
+
+//WFS 2.0 常量
+const (
+	wfsPath         = "/ogc/wfs"
+	wfsNamespace    = "http://www.atlasdata.cn/atlas"
+	wfsPrefix       = "atlas"
+	wfsDefaultCount = 1000
+	wfsDefaultSRS   = "urn:ogc:def:crs:EPSG::4326"
+	gmlMime         = "application/gml+xml; version=3.2"
+)
+
+//wfsCRSNames WFS坐标系名称,EPSG:4326简写沿用经度在前的习惯
+var wfsCRSNames = map[string]string{
+	wfsDefaultSRS:                   CRS4326,
+	CRS4326:                         CRS4326,
+	"EPSG:4326":                     CRS84,
+	"urn:ogc:def:crs:OGC:1.3:CRS84": CRS84,
+	CRS84:                           CRS84,
+	"urn:ogc:def:crs:EPSG::3857":    CRS3857,
+	CRS3857:                         CRS3857,
+	"EPSG:3857":                     CRS3857,
+	"EPSG:900913":                   CRS3857,
+}
+
+//fesComparisons FES比较运算符
+var fesComparisons = map[string]string{
+	"PropertyIsEqualTo":              "=",
+	"PropertyIsNotEqualTo":           "<>",
+	"PropertyIsLessThan":             "<",
+	"PropertyIsGreaterThan":          ">",
+	"PropertyIsLessThanOrEqualTo":    "<=",
+	"PropertyIsGreaterThanOrEqualTo": ">=",
+}
+
+//OWSError OWS异常报告,WFS及WMTS共用
+type OWSError struct {
+	Status  int
+	Code    string
+	Locator string
+	Text    string
+}
+
+func (e *OWSError) Error() string {
+	return e.Text
+}
+
+func owsErrorf(status int, code, locator, format string, args ...interface{}) *OWSError {
+	return &OWSError{Status: status, Code: code, Locator: locator, Text: fmt.Sprintf(format, args...)}
+}
+
+//wfsRequest 解析后的WFS请求,KVP与XML编码共用
+type wfsRequest struct {
+	request      string
+	typeNames    []string
+	srsName      string
+	outputFormat string
+	resultType   string
+	count        int
+	startIndex   int
+	bbox         string
+	resourceIDs  []string
+	filter       *sldNode
+	root         *sldNode
+	query        url.Values
+}
+
+//xmlText 转义XML文本
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+//localName 去除命名空间前缀
+func localName(s string) string {
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
+
+//wfsCRS 解析srsName,默认为urn:ogc:def:crs:EPSG::4326
+func wfsCRS(srs string) (string, error) {
+	if srs == "" {
+		return CRS4326, nil
+	}
+	if crs, ok := wfsCRSNames[srs]; ok {
+		return crs, nil
+	}
+	return "", fmt.Errorf("unsupported srsName %s", srs)
+}
+
+//toCRS84Geometry 将指定坐标系的几何转换为CRS84
+func toCRS84Geometry(g orb.Geometry, crs string) orb.Geometry {
+	switch crs {
+	case CRS3857:
+		return project.Geometry(g, project.Mercator.ToWGS84)
+	case CRS4326:
+		return transformGeometry(g, CRS4326)
+	}
+	return g
+}
+
+//wfsTypeName 数据集要素类型名,以数字开头的ID加下划线
+func wfsTypeName(id string) string {
+	if id != "" && id[0] >= '0' && id[0] <= '9' {
+		return "_" + id
+	}
+	return id
+}
+
+//ncName 转换为合法的XML NCName,非法字符替换为下划线,首字符不是字母或下划线时加下划线
+func ncName(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if i == 0 && !unicode.IsLetter(r) && r != '_' {
+			b.WriteByte('_')
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+//wfsField 数据集属性字段及其要素属性名
+type wfsField struct {
+	Field
+	Property string
+}
+
+//wfsFields 数据集属性字段,字段名转换为NCName作为要素属性名,重名时加序号
+func (dt *Dataset) wfsFields() []wfsField {
+	used := map[string]bool{"geom": true}
+	var out []wfsField
+	for _, f := range dt.attributeFields() {
+		name := ncName(f.Name)
+		for i := 1; used[name]; i++ {
+			name = fmt.Sprintf("%s_%d", ncName(f.Name), i)
+		}
+		used[name] = true
+		out = append(out, wfsField{Field: f, Property: name})
+	}
+	return out
+}
+
+//wfsColumn 要素属性名对应的数据集字段,也接受原字段名
+func (dt *Dataset) wfsColumn(name string) (string, bool) {
+	fields := dt.wfsFields()
+	for _, f := range fields {
+		if f.Property == name {
+			return f.Name, true
+		}
+	}
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Name, true
+		}
+	}
+	return "", false
+}
+
+//wfsDataset 按要素类型名获取用户可访问的数据集
+func wfsDataset(uid, typeName string) (*Dataset, error) {
+	name := localName(typeName)
+	dt := userSet.dataset(uid, name)
+	if dt == nil && strings.HasPrefix(name, "_") {
+		dt = userSet.dataset(uid, name[1:])
+	}
+	if dt == nil {
+		return nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "typeNames", "unknown feature type %s", typeName)
+	}
+	return dt, nil
+}
+
+//wfsWritableDataset 获取用户可编辑的数据集,公开数据集只读
+func wfsWritableDataset(uid, typeName string) (*Dataset, error) {
+	dt, err := wfsDataset(uid, typeName)
+	if err != nil {
+		return nil, err
+	}
+	if dt.Owner != uid {
+		return nil, owsErrorf(http.StatusForbidden, "OperationProcessingFailed", "typeName", "feature type %s is read only", typeName)
+	}
+	return dt, nil
+}
+
+//parseWFSRequest 解析POST的XML请求或KVP请求,KVP参数名不区分大小写
+func parseWFSRequest(c *gin.Context) (*wfsRequest, error) {
+	req := &wfsRequest{count: wfsDefaultCount}
+	if c.Request.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			root := &sldNode{}
+			if err := xml.Unmarshal(body, root); err != nil {
+				return nil, owsErrorf(http.StatusBadRequest, "OperationParsingFailed", "", "parse request error, details: %s", err)
+			}
+			return req, req.parseXML(root)
+		}
+	}
+	req.query = c.Request.URL.Query()
+	kvp := make(map[string]string)
+	for k, v := range req.query {
+		kvp[strings.ToLower(k)] = v[0]
+	}
+	if s := kvp["service"]; s != "" && !strings.EqualFold(s, "WFS") {
+		return nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "service", "unsupported service %s", s)
+	}
+	req.request = kvp["request"]
+	if req.request == "" {
+		return nil, owsErrorf(http.StatusBadRequest, "MissingParameterValue", "request", "request is required")
+	}
+	names := kvp["typenames"]
+	if names == "" {
+		names = kvp["typename"]
+	}
+	if names != "" {
+		req.typeNames = strings.Split(names, ",")
+	}
+	req.srsName = kvp["srsname"]
+	req.outputFormat = kvp["outputformat"]
+	req.resultType = kvp["resulttype"]
+	req.bbox = kvp["bbox"]
+	if ids := kvp["resourceid"]; ids != "" {
+		req.resourceIDs = strings.Split(ids, ",")
+	}
+	count := kvp["count"]
+	if count == "" {
+		count = kvp["maxfeatures"]
+	}
+	if err := req.setPaging(count, kvp["startindex"]); err != nil {
+		return nil, err
+	}
+	if f := kvp["filter"]; f != "" {
+		req.filter = &sldNode{}
+		if err := xml.Unmarshal([]byte(f), req.filter); err != nil {
+			return nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "filter", "parse filter error, details: %s", err)
+		}
+	}
+	return req, nil
+}
+
+//parseXML 解析XML编码的请求
+func (req *wfsRequest) parseXML(root *sldNode) error {
+	req.request = root.Name
+	req.root = root
+	switch root.Name {
+	case "GetFeature":
+		req.outputFormat = root.Attrs["outputFormat"]
+		req.resultType = root.Attrs["resultType"]
+		if err := req.setPaging(root.Attrs["count"], root.Attrs["startIndex"]); err != nil {
+			return err
+		}
+		queries := root.children("Query")
+		if len(queries) != 1 {
+			return owsErrorf(http.StatusBadRequest, "OperationNotSupported", "Query", "exactly one query is supported")
+		}
+		q := queries[0]
+		if names := q.Attrs["typeNames"]; names != "" {
+			req.typeNames = strings.Fields(names)
+		}
+		req.srsName = q.Attrs["srsName"]
+		req.filter = q.child("Filter")
+	case "DescribeFeatureType":
+		for _, n := range root.children("TypeName") {
+			req.typeNames = append(req.typeNames, n.Text)
+		}
+	}
+	return nil
+}
+
+func (req *wfsRequest) setPaging(count, start string) error {
+	var err error
+	if count != "" {
+		req.count, err = strconv.Atoi(count)
+		if err != nil || req.count < 0 {
+			return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "count", "invalid count %s", count)
+		}
+		if req.count > ogcMaxLimit {
+			req.count = ogcMaxLimit
+		}
+	}
+	if start != "" {
+		req.startIndex, err = strconv.Atoi(start)
+		if err != nil || req.startIndex < 0 {
+			return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "startIndex", "invalid startIndex %s", start)
+		}
+	}
+	return nil
+}
+
+//serveWFS WFS 2.0服务入口
+func serveWFS(c *gin.Context) {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	req, err := parseWFSRequest(c)
+	if err == nil {
+		switch strings.ToLower(req.request) {
+		case "getcapabilities":
+			err = wfsCapabilities(c, uid)
+		case "describefeaturetype":
+			err = wfsDescribeFeatureType(c, uid, req)
+		case "getfeature":
+			err = wfsGetFeature(c, uid, req)
+		case "transaction":
+			if req.root == nil {
+				err = owsErrorf(http.StatusBadRequest, "OperationNotSupported", "request", "transaction requires XML encoding")
+				break
+			}
+			err = wfsTransaction(c, uid, req.root)
+		default:
+			err = owsErrorf(http.StatusBadRequest, "OperationNotSupported", "request", "unsupported request %s", req.request)
+		}
+	}
+	if err == nil {
+		return
+	}
+	writeOWSError(c, "serveWFS", "2.0.0", err)
+}
+
+//writeOWSError 输出OWS异常报告,非OWSError按服务端错误处理
+func writeOWSError(c *gin.Context, caller, version string, err error) {
+	oe, ok := err.(*OWSError)
+	if !ok {
+		log.Errorf("%s, details: %s", caller, err)
+		oe = owsErrorf(http.StatusInternalServerError, "NoApplicableCode", "", "%s", err)
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<ows:ExceptionReport xmlns:ows="http://www.opengis.net/ows/1.1" version="%s"><ows:Exception exceptionCode="%s" locator="%s"><ows:ExceptionText>%s</ows:ExceptionText></ows:Exception></ows:ExceptionReport>`,
+		version, oe.Code, xmlText(oe.Locator), xmlText(oe.Text))
+	c.Data(oe.Status, "application/xml", b.Bytes())
+}
+
+//wfsCapabilities 服务能力文档
+func wfsCapabilities(c *gin.Context, uid string) error {
+	href := xmlText(serviceURL(c, wfsPath, nil))
+	constraint := func(b *bytes.Buffer, prefix, name, value string) {
+		fmt.Fprintf(b, `<%s:Constraint name="%s"><ows:NoValues/><ows:DefaultValue>%s</ows:DefaultValue></%s:Constraint>`, prefix, name, value, prefix)
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<wfs:WFS_Capabilities version="2.0.0" xmlns:wfs="http://www.opengis.net/wfs/2.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" xmlns:fes="http://www.opengis.net/fes/2.0" xmlns:gml="http://www.opengis.net/gml/3.2" xmlns:%s="%s">`, wfsPrefix, wfsNamespace)
+	b.WriteString(`<ows:ServiceIdentification><ows:Title>atlas WFS</ows:Title><ows:ServiceType>WFS</ows:ServiceType><ows:ServiceTypeVersion>2.0.0</ows:ServiceTypeVersion></ows:ServiceIdentification>`)
+	b.WriteString(`<ows:OperationsMetadata>`)
+	for _, op := range []string{"GetCapabilities", "DescribeFeatureType", "GetFeature", "Transaction"} {
+		fmt.Fprintf(&b, `<ows:Operation name="%s"><ows:DCP><ows:HTTP><ows:Get xlink:href="%s"/><ows:Post xlink:href="%s"/></ows:HTTP></ows:DCP>`, op, href, href)
+		if op == "GetFeature" {
+			fmt.Fprintf(&b, `<ows:Parameter name="outputFormat"><ows:AllowedValues><ows:Value>%s</ows:Value><ows:Value>application/json</ows:Value></ows:AllowedValues></ows:Parameter>`, gmlMime)
+		}
+		b.WriteString(`</ows:Operation>`)
+	}
+	for _, name := range []string{"ImplementsBasicWFS", "ImplementsTransactionalWFS", "ImplementsResultPaging", "KVPEncoding", "XMLEncoding"} {
+		constraint(&b, "ows", name, "TRUE")
+	}
+	constraint(&b, "ows", "CountDefault", strconv.Itoa(wfsDefaultCount))
+	b.WriteString(`</ows:OperationsMetadata><wfs:FeatureTypeList>`)
+	for _, dt := range userSet.datasets(uid) {
+		fmt.Fprintf(&b, `<wfs:FeatureType><wfs:Name>%s:%s</wfs:Name><wfs:Title>%s</wfs:Title><wfs:DefaultCRS>%s</wfs:DefaultCRS><wfs:OtherCRS>urn:ogc:def:crs:EPSG::3857</wfs:OtherCRS>`,
+			wfsPrefix, wfsTypeName(dt.ID), xmlText(dt.Name), wfsDefaultSRS)
+		if !dt.BBox.IsZero() {
+			fmt.Fprintf(&b, `<ows:WGS84BoundingBox><ows:LowerCorner>%s %s</ows:LowerCorner><ows:UpperCorner>%s %s</ows:UpperCorner></ows:WGS84BoundingBox>`,
+				gmlNum(dt.BBox.Min.X()), gmlNum(dt.BBox.Min.Y()), gmlNum(dt.BBox.Max.X()), gmlNum(dt.BBox.Max.Y()))
+		}
+		b.WriteString(`</wfs:FeatureType>`)
+	}
+	b.WriteString(`</wfs:FeatureTypeList><fes:Filter_Capabilities><fes:Conformance>`)
+	for _, name := range []string{"ImplementsQuery", "ImplementsAdHocQuery", "ImplementsResourceId", "ImplementsMinStandardFilter", "ImplementsStandardFilter", "ImplementsMinSpatialFilter"} {
+		constraint(&b, "fes", name, "TRUE")
+	}
+	b.WriteString(`</fes:Conformance><fes:Id_Capabilities><fes:ResourceIdentifier name="fes:ResourceId"/></fes:Id_Capabilities>`)
+	b.WriteString(`<fes:Scalar_Capabilities><fes:LogicalOperators/><fes:ComparisonOperators>`)
+	for _, op := range []string{"PropertyIsEqualTo", "PropertyIsNotEqualTo", "PropertyIsLessThan", "PropertyIsGreaterThan", "PropertyIsLessThanOrEqualTo", "PropertyIsGreaterThanOrEqualTo", "PropertyIsLike", "PropertyIsNull", "PropertyIsBetween"} {
+		fmt.Fprintf(&b, `<fes:ComparisonOperator name="%s"/>`, op)
+	}
+	b.WriteString(`</fes:ComparisonOperators></fes:Scalar_Capabilities>`)
+	b.WriteString(`<fes:Spatial_Capabilities><fes:GeometryOperands><fes:GeometryOperand name="gml:Envelope"/></fes:GeometryOperands><fes:SpatialOperators><fes:SpatialOperator name="BBOX"/></fes:SpatialOperators></fes:Spatial_Capabilities>`)
+	b.WriteString(`</fes:Filter_Capabilities></wfs:WFS_Capabilities>`)
+	c.Data(http.StatusOK, "application/xml", b.Bytes())
+	return nil
+}
+
+//gmlGeometryType 数据集几何类型对应的GML属性类型
+func gmlGeometryType(t GeoType) string {
+	switch t {
+	case Point:
+		return "gml:PointPropertyType"
+	case MultiPoint:
+		return "gml:MultiPointPropertyType"
+	case LineString:
+		return "gml:CurvePropertyType"
+	case MultiLineString:
+		return "gml:MultiCurvePropertyType"
+	case Polygon:
+		return "gml:SurfacePropertyType"
+	case MultiPolygon:
+		return "gml:MultiSurfacePropertyType"
+	}
+	return "gml:GeometryPropertyType"
+}
+
+//xsdType 字段类型对应的XML Schema类型
+func xsdType(t FieldType) string {
+	switch t {
+	case Int:
+		return "xsd:long"
+	case Float:
+		return "xsd:double"
+	case Bool:
+		return "xsd:boolean"
+	case Date:
+		return "xsd:dateTime"
+	}
+	return "xsd:string"
+}
+
+//wfsDescribeFeatureType 由数据集字段生成要素类型的XML Schema
+func wfsDescribeFeatureType(c *gin.Context, uid string, req *wfsRequest) error {
+	var dss []*Dataset
+	if len(req.typeNames) == 0 {
+		dss = userSet.datasets(uid)
+	}
+	for _, name := range req.typeNames {
+		dt, err := wfsDataset(uid, name)
+		if err != nil {
+			return err
+		}
+		dss = append(dss, dt)
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<xsd:schema xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:gml="http://www.opengis.net/gml/3.2" xmlns:%s="%s" targetNamespace="%s" elementFormDefault="qualified" version="1.0">`, wfsPrefix, wfsNamespace, wfsNamespace)
+	b.WriteString(`<xsd:import namespace="http://www.opengis.net/gml/3.2" schemaLocation="http://schemas.opengis.net/gml/3.2.1/gml.xsd"/>`)
+	for _, dt := range dss {
+		name := wfsTypeName(dt.ID)
+		fmt.Fprintf(&b, `<xsd:complexType name="%sType"><xsd:complexContent><xsd:extension base="gml:AbstractFeatureType"><xsd:sequence>`, name)
+		fmt.Fprintf(&b, `<xsd:element name="geom" type="%s" minOccurs="0" maxOccurs="1" nillable="true"/>`, gmlGeometryType(dt.Geotype))
+		for _, f := range dt.wfsFields() {
+			fmt.Fprintf(&b, `<xsd:element name="%s" type="%s" minOccurs="0" maxOccurs="1" nillable="true"/>`, f.Property, xsdType(f.Type))
+		}
+		b.WriteString(`</xsd:sequence></xsd:extension></xsd:complexContent></xsd:complexType>`)
+		fmt.Fprintf(&b, `<xsd:element name="%s" type="%s:%sType" substitutionGroup="gml:AbstractFeature"/>`, name, wfsPrefix, name)
+	}
+	b.WriteString(`</xsd:schema>`)
+	c.Data(http.StatusOK, "application/xml", b.Bytes())
+	return nil
+}
+
+//wfsGetFeature 查询要素,输出GML 3.2或GeoJSON
+func wfsGetFeature(c *gin.Context, uid string, req *wfsRequest) error {
+	if len(req.typeNames) != 1 {
+		return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "typeNames", "exactly one feature type is supported")
+	}
+	dt, err := wfsDataset(uid, req.typeNames[0])
+	if err != nil {
+		return err
+	}
+	crs, err := wfsCRS(req.srsName)
+	if err != nil {
+		return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "srsName", "%s", err)
+	}
+	q := &featureQuery{limit: req.count, offset: req.startIndex}
+	if req.filter != nil {
+		where, args, err := fesSQL(req.filter, dt)
+		if err != nil {
+			return err
+		}
+		q.where, q.args = append(q.where, where), append(q.args, args...)
+	}
+	if len(req.resourceIDs) > 0 {
+		where, args, err := resourceIDSQL(req.resourceIDs)
+		if err != nil {
+			return err
+		}
+		q.where, q.args = append(q.where, where), append(q.args, args...)
+	}
+	if req.bbox != "" {
+		parts := strings.Split(req.bbox, ",")
+		bcrs := CRS4326
+		if len(parts) == 5 {
+			if bcrs, err = wfsCRS(parts[4]); err != nil {
+				return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "bbox", "%s", err)
+			}
+			parts = parts[:4]
+		}
+		b, err := parseBBox(strings.Join(parts, ","))
+		if err != nil {
+			return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "bbox", "%s", err)
+		}
+		b = toCRS84Bound(b, bcrs)
+		q.bbox = &b
+	}
+	if strings.EqualFold(req.resultType, "hits") {
+		q.limit = 0
+	}
+	matched, features, err := dt.queryFeatures(c.Request.Context(), q)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(req.outputFormat) {
+	case "application/json", "json", "geojson", "application/geo+json":
+		for _, f := range features {
+			if crs == CRS3857 {
+				f.Geometry = transformGeometry(f.Geometry, CRS3857)
+			}
+		}
+		c.Render(http.StatusOK, geoJSONRender{OGCFeatureCollection{
+			Type:           "FeatureCollection",
+			Features:       features,
+			TimeStamp:      time.Now().UTC().Format(time.RFC3339),
+			NumberMatched:  matched,
+			NumberReturned: len(features),
+		}})
+		return nil
+	case "", strings.ToLower(gmlMime), "gml32", "text/xml; subtype=gml/3.2", "application/gml+xml":
+	default:
+		return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "outputFormat", "unsupported outputFormat %s", req.outputFormat)
+	}
+
+	srs := req.srsName
+	if srs == "" {
+		srs = wfsDefaultSRS
+	}
+	name := wfsTypeName(dt.ID)
+	fields := dt.wfsFields()
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<wfs:FeatureCollection xmlns:wfs="http://www.opengis.net/wfs/2.0" xmlns:gml="http://www.opengis.net/gml/3.2" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:%s="%s" numberMatched="%d" numberReturned="%d" timeStamp="%s"`,
+		wfsPrefix, wfsNamespace, matched, len(features), time.Now().UTC().Format(time.RFC3339))
+	if req.query != nil && q.limit > 0 && q.offset+len(features) < matched {
+		next := url.Values{}
+		for k, v := range req.query {
+			switch strings.ToLower(k) {
+			case "startindex", "count", "maxfeatures":
+			default:
+				next[k] = v
+			}
+		}
+		next.Set("STARTINDEX", strconv.Itoa(q.offset+q.limit))
+		next.Set("COUNT", strconv.Itoa(q.limit))
+		fmt.Fprintf(&b, ` next="%s"`, xmlText(serviceURL(c, wfsPath, next)))
+	}
+	b.WriteString(`>`)
+	for _, f := range features {
+		fid := fmt.Sprint(f.ID)
+		fmt.Fprintf(&b, `<wfs:member><%s:%s gml:id="%s.%s">`, wfsPrefix, name, name, fid)
+		if f.Geometry != nil {
+			fmt.Fprintf(&b, `<%s:geom>`, wfsPrefix)
+			writeGML(&b, transformGeometry(f.Geometry, crs), name+"."+fid+".geom", srs)
+			fmt.Fprintf(&b, `</%s:geom>`, wfsPrefix)
+		}
+		for _, fd := range fields {
+			v, ok := f.Properties[fd.Name]
+			if !ok || v == nil {
+				continue
+			}
+			fmt.Fprintf(&b, `<%s:%s>%s</%s:%s>`, wfsPrefix, fd.Property, xmlText(fmt.Sprint(v)), wfsPrefix, fd.Property)
+		}
+		fmt.Fprintf(&b, `</%s:%s></wfs:member>`, wfsPrefix, name)
+	}
+	b.WriteString(`</wfs:FeatureCollection>`)
+	c.Data(http.StatusOK, gmlMime, b.Bytes())
+	return nil
+}
+
+//resourceIDSQL 资源ID条件,ID形如pois.1
+func resourceIDSQL(rids []string) (string, []interface{}, error) {
+	var marks []string
+	var args []interface{}
+	for _, rid := range rids {
+		fid, err := strconv.ParseInt(rid[strings.LastIndex(rid, ".")+1:], 10, 64)
+		if err != nil {
+			return "", nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "resourceId", "invalid resource id %s", rid)
+		}
+		marks = append(marks, "?")
+		args = append(args, fid)
+	}
+	return fmt.Sprintf("l.fid IN (%s)", strings.Join(marks, ",")), args, nil
+}
+
+//fesColumn FES属性名对应的数据集字段
+func fesColumn(n *sldNode, dt *Dataset) (string, error) {
+	name := n.childText("ValueReference")
+	if name == "" {
+		name = n.childText("PropertyName")
+	}
+	name = localName(name)
+	col, ok := dt.wfsColumn(name)
+	if !ok {
+		return "", owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "filter", "unknown property %s", name)
+	}
+	return fmt.Sprintf(`l."%s"`, col), nil
+}
+
+//likePattern 将FES通配符转换为SQL LIKE模式,以\转义
+func likePattern(s, wild, single, esc string) string {
+	var b strings.Builder
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		ch := string(rs[i])
+		switch {
+		case esc != "" && ch == esc && i+1 < len(rs):
+			i++
+			if next := rs[i]; next == '%' || next == '_' || next == '\\' {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(rs[i])
+		case ch == wild:
+			b.WriteString("%")
+		case ch == single:
+			b.WriteString("_")
+		case ch == "%" || ch == "_" || ch == "\\":
+			b.WriteString("\\" + ch)
+		default:
+			b.WriteString(ch)
+		}
+	}
+	return b.String()
+}
+
+//fesSQL 将FES 2.0过滤器转换为SQL条件,支持逻辑、比较、ResourceId及BBOX运算
+func fesSQL(n *sldNode, dt *Dataset) (string, []interface{}, error) {
+	join := func(nodes []*sldNode, op string) (string, []interface{}, error) {
+		var parts []string
+		var args []interface{}
+		var rids []string
+		for _, c := range nodes {
+			if c.Name == "ResourceId" {
+				rids = append(rids, c.Attrs["rid"])
+				continue
+			}
+			s, a, err := fesSQL(c, dt)
+			if err != nil {
+				return "", nil, err
+			}
+			parts = append(parts, s)
+			args = append(args, a...)
+		}
+		if len(rids) > 0 {
+			s, a, err := resourceIDSQL(rids)
+			if err != nil {
+				return "", nil, err
+			}
+			parts = append(parts, s)
+			args = append(args, a...)
+		}
+		if len(parts) == 0 {
+			return "1 = 1", nil, nil
+		}
+		return "(" + strings.Join(parts, op) + ")", args, nil
+	}
+	switch n.Name {
+	case "Filter", "And":
+		return join(n.elements(), " AND ")
+	case "Or":
+		return join(n.elements(), " OR ")
+	case "Not":
+		s, args, err := join(n.elements(), " AND ")
+		return "NOT " + s, args, err
+	case "PropertyIsLike":
+		col, err := fesColumn(n, dt)
+		if err != nil {
+			return "", nil, err
+		}
+		p := likePattern(n.childText("Literal"), n.Attrs["wildCard"], n.Attrs["singleChar"], n.Attrs["escapeChar"])
+		return col + ` LIKE ? ESCAPE '\'`, []interface{}{p}, nil
+	case "PropertyIsNull", "PropertyIsNil":
+		col, err := fesColumn(n, dt)
+		if err != nil {
+			return "", nil, err
+		}
+		return col + " IS NULL", nil, nil
+	case "PropertyIsBetween":
+		col, err := fesColumn(n, dt)
+		if err != nil {
+			return "", nil, err
+		}
+		lo, hi := n.child("LowerBoundary").childText("Literal"), n.child("UpperBoundary").childText("Literal")
+		return col + " BETWEEN ? AND ?", []interface{}{lo, hi}, nil
+	case "BBOX":
+		var env *sldNode
+		for _, c := range n.elements() {
+			if c.Name == "Envelope" {
+				env = c
+			}
+		}
+		if env == nil {
+			return "", nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "filter", "BBOX requires gml:Envelope")
+		}
+		crs, err := wfsCRS(env.Attrs["srsName"])
+		if err != nil {
+			return "", nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "filter", "%s", err)
+		}
+		lo, hi := strings.Fields(env.childText("lowerCorner")), strings.Fields(env.childText("upperCorner"))
+		if len(lo) < 2 || len(hi) < 2 {
+			return "", nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "filter", "invalid envelope")
+		}
+		bb, err := parseBBox(strings.Join([]string{lo[0], lo[1], hi[0], hi[1]}, ","))
+		if err != nil {
+			return "", nil, owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "filter", "%s", err)
+		}
+		bb = toCRS84Bound(bb, crs)
+		s := fmt.Sprintf(`l.fid IN (SELECT id FROM "rtree_%s_geom" WHERE minx <= ? AND maxx >= ? AND miny <= ? AND maxy >= ?)`, strings.ToLower(dt.ID))
+		return s, []interface{}{bb.Max.X(), bb.Min.X(), bb.Max.Y(), bb.Min.Y()}, nil
+	}
+	if op, ok := fesComparisons[n.Name]; ok {
+		col, err := fesColumn(n, dt)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%s %s ?", col, op), []interface{}{n.childText("Literal")}, nil
+	}
+	return "", nil, owsErrorf(http.StatusBadRequest, "OperationNotSupported", "filter", "unsupported filter operator %s", n.Name)
+}
+
+//gmlNum 坐标格式化
+func gmlNum(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func gmlPosList(b *bytes.Buffer, ps []orb.Point) {
+	b.WriteString(`<gml:posList>`)
+	for i, p := range ps {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(gmlNum(p[0]) + " " + gmlNum(p[1]))
+	}
+	b.WriteString(`</gml:posList>`)
+}
+
+//writeGML 输出GML 3.2几何,srs为空时不输出srsName
+func writeGML(b *bytes.Buffer, g orb.Geometry, id, srs string) {
+	attrs := fmt.Sprintf(` gml:id="%s"`, xmlText(id))
+	if srs != "" {
+		attrs += fmt.Sprintf(` srsName="%s"`, xmlText(srs))
+	}
+	polygon := func(p orb.Polygon) {
+		for i, r := range p {
+			tag := "gml:interior"
+			if i == 0 {
+				tag = "gml:exterior"
+			}
+			b.WriteString("<" + tag + "><gml:LinearRing>")
+			gmlPosList(b, r)
+			b.WriteString("</gml:LinearRing></" + tag + ">")
+		}
+	}
+	switch g := g.(type) {
+	case orb.Point:
+		fmt.Fprintf(b, `<gml:Point%s><gml:pos>%s %s</gml:pos></gml:Point>`, attrs, gmlNum(g[0]), gmlNum(g[1]))
+	case orb.LineString:
+		fmt.Fprintf(b, `<gml:LineString%s>`, attrs)
+		gmlPosList(b, g)
+		b.WriteString(`</gml:LineString>`)
+	case orb.Polygon:
+		fmt.Fprintf(b, `<gml:Polygon%s>`, attrs)
+		polygon(g)
+		b.WriteString(`</gml:Polygon>`)
+	case orb.MultiPoint:
+		fmt.Fprintf(b, `<gml:MultiPoint%s>`, attrs)
+		for i, p := range g {
+			b.WriteString(`<gml:pointMember>`)
+			writeGML(b, p, fmt.Sprintf("%s.%d", id, i), "")
+			b.WriteString(`</gml:pointMember>`)
+		}
+		b.WriteString(`</gml:MultiPoint>`)
+	case orb.MultiLineString:
+		fmt.Fprintf(b, `<gml:MultiCurve%s>`, attrs)
+		for i, ls := range g {
+			b.WriteString(`<gml:curveMember>`)
+			writeGML(b, ls, fmt.Sprintf("%s.%d", id, i), "")
+			b.WriteString(`</gml:curveMember>`)
+		}
+		b.WriteString(`</gml:MultiCurve>`)
+	case orb.MultiPolygon:
+		fmt.Fprintf(b, `<gml:MultiSurface%s>`, attrs)
+		for i, p := range g {
+			b.WriteString(`<gml:surfaceMember>`)
+			writeGML(b, p, fmt.Sprintf("%s.%d", id, i), "")
+			b.WriteString(`</gml:surfaceMember>`)
+		}
+		b.WriteString(`</gml:MultiSurface>`)
+	}
+}
+
+//gmlGeometryNames 支持解析的GML几何元素
+var gmlGeometryNames = map[string]bool{
+	"Point": true, "LineString": true, "Polygon": true,
+	"MultiPoint": true, "MultiCurve": true, "MultiLineString": true, "MultiSurface": true, "MultiPolygon": true,
+}
+
+//gmlChild 属性元素中的GML几何
+func gmlChild(n *sldNode) *sldNode {
+	for _, c := range n.elements() {
+		if gmlGeometryNames[c.Name] {
+			return c
+		}
+	}
+	return nil
+}
+
+//gmlPoints 读取pos/posList/coordinates坐标,忽略第三维
+func gmlPoints(n *sldNode) ([]orb.Point, error) {
+	var nums []string
+	dim := 2
+	for _, c := range n.elements() {
+		switch c.Name {
+		case "pos", "posList":
+			if d, err := strconv.Atoi(c.Attrs["srsDimension"]); err == nil && d > 0 {
+				dim = d
+			}
+			nums = append(nums, strings.Fields(c.Text)...)
+		case "coordinates":
+			for _, tuple := range strings.Fields(c.Text) {
+				xy := strings.Split(tuple, ",")
+				nums = append(nums, xy[0], xy[len(xy)-1])
+			}
+		}
+	}
+	if d, err := strconv.Atoi(n.Attrs["srsDimension"]); err == nil && d > 0 {
+		dim = d
+	}
+	if dim < 2 || len(nums) == 0 || len(nums)%dim != 0 {
+		return nil, fmt.Errorf("invalid coordinates in gml:%s", n.Name)
+	}
+	var ps []orb.Point
+	for i := 0; i < len(nums); i += dim {
+		x, err1 := strconv.ParseFloat(nums[i], 64)
+		y, err2 := strconv.ParseFloat(nums[i+1], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid coordinates in gml:%s", n.Name)
+		}
+		ps = append(ps, orb.Point{x, y})
+	}
+	return ps, nil
+}
+
+//gmlMembers 多部件几何的成员
+func gmlMembers(n *sldNode) []*sldNode {
+	var out []*sldNode
+	for _, c := range n.elements() {
+		if strings.HasSuffix(c.Name, "Member") || strings.HasSuffix(c.Name, "Members") {
+			out = append(out, c.elements()...)
+		}
+	}
+	return out
+}
+
+//gmlGeometry 解析GML几何,坐标保持原坐标系
+func gmlGeometry(n *sldNode) (orb.Geometry, error) {
+	ring := func(c *sldNode) (orb.Ring, error) {
+		lr := c.child("LinearRing")
+		if lr == nil {
+			return nil, fmt.Errorf("gml:%s requires gml:LinearRing", c.Name)
+		}
+		ps, err := gmlPoints(lr)
+		return orb.Ring(ps), err
+	}
+	switch n.Name {
+	case "Point":
+		ps, err := gmlPoints(n)
+		if err != nil {
+			return nil, err
+		}
+		return ps[0], nil
+	case "LineString":
+		ps, err := gmlPoints(n)
+		return orb.LineString(ps), err
+	case "Polygon":
+		var p orb.Polygon
+		for _, c := range n.elements() {
+			switch c.Name {
+			case "exterior", "outerBoundaryIs", "interior", "innerBoundaryIs":
+				r, err := ring(c)
+				if err != nil {
+					return nil, err
+				}
+				p = append(p, r)
+			}
+		}
+		if len(p) == 0 {
+			return nil, fmt.Errorf("gml:Polygon requires gml:exterior")
+		}
+		return p, nil
+	case "MultiPoint", "MultiCurve", "MultiLineString", "MultiSurface", "MultiPolygon":
+		var mp orb.MultiPoint
+		var mls orb.MultiLineString
+		var mpg orb.MultiPolygon
+		for _, c := range gmlMembers(n) {
+			g, err := gmlGeometry(c)
+			if err != nil {
+				return nil, err
+			}
+			switch g := g.(type) {
+			case orb.Point:
+				mp = append(mp, g)
+			case orb.LineString:
+				mls = append(mls, g)
+			case orb.Polygon:
+				mpg = append(mpg, g)
+			}
+		}
+		switch n.Name {
+		case "MultiPoint":
+			return mp, nil
+		case "MultiCurve", "MultiLineString":
+			return mls, nil
+		}
+		return mpg, nil
+	}
+	return nil, fmt.Errorf("unsupported geometry gml:%s", n.Name)
+}
+
+//parseGML 解析GML几何并按srsName转换为CRS84
+func parseGML(n *sldNode, srs string) (orb.Geometry, error) {
+	if s := n.Attrs["srsName"]; s != "" {
+		srs = s
+	}
+	crs, err := wfsCRS(srs)
+	if err != nil {
+		return nil, err
+	}
+	g, err := gmlGeometry(n)
+	if err != nil {
+		return nil, err
+	}
+	return toCRS84Geometry(g, crs), nil
+}
+
+//wfsEdit 事务中被编辑的数据集及变化范围
+type wfsEdit struct {
+	dt     *Dataset
+	bounds []orb.Bound
+}
+
+//wfsSelect 按条件查询要素编号及其rtree范围
+func wfsSelect(tx *sql.Tx, dt *Dataset, filter *sldNode) ([]int64, []orb.Bound, error) {
+	table := strings.ToLower(dt.ID)
+	where, args := "1 = 1", []interface{}{}
+	if filter != nil {
+		var err error
+		where, args, err = fesSQL(filter, dt)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	rows, err := tx.Query(fmt.Sprintf(`SELECT l.fid, si.minx, si.maxx, si.miny, si.maxy FROM "%s" l LEFT JOIN "rtree_%s_geom" si ON l.fid = si.id WHERE %s`, table, table, where), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var fids []int64
+	var bounds []orb.Bound
+	for rows.Next() {
+		var fid int64
+		var minx, maxx, miny, maxy sql.NullFloat64
+		if err := rows.Scan(&fid, &minx, &maxx, &miny, &maxy); err != nil {
+			return nil, nil, err
+		}
+		fids = append(fids, fid)
+		if minx.Valid {
+			bounds = append(bounds, orb.Bound{Min: orb.Point{minx.Float64, miny.Float64}, Max: orb.Point{maxx.Float64, maxy.Float64}})
+		}
+	}
+	return fids, bounds, rows.Err()
+}
+
+//wfsSetGeometry 写入几何并维护rtree索引
+func wfsSetGeometry(tx *sql.Tx, dt *Dataset, fid int64, g orb.Geometry) (orb.Bound, error) {
+	table := strings.ToLower(dt.ID)
+	_, err := tx.Exec(fmt.Sprintf(`UPDATE "%s" SET geom = ? WHERE fid = ?`, table), buildGpkgGeom(g, 4326), fid)
+	if err != nil {
+		return orb.Bound{}, err
+	}
+	b := g.Bound()
+	_, err = tx.Exec(fmt.Sprintf(`INSERT OR REPLACE INTO "rtree_%s_geom" VALUES (?, ?, ?, ?, ?)`, table), fid, b.Min.X(), b.Max.X(), b.Min.Y(), b.Max.Y())
+	return b, err
+}
+
+//wfsInsert 插入一个要素,返回要素编号及范围
+func wfsInsert(tx *sql.Tx, dt *Dataset, n *sldNode, srs string) (int64, orb.Bound, error) {
+	var cols, marks []string
+	var vals []interface{}
+	var geom orb.Geometry
+	for _, p := range n.elements() {
+		if gn := gmlChild(p); gn != nil {
+			g, err := parseGML(gn, srs)
+			if err != nil {
+				return 0, orb.Bound{}, owsErrorf(http.StatusBadRequest, "InvalidValue", p.Name, "%s", err)
+			}
+			geom = g
+			continue
+		}
+		col, ok := dt.wfsColumn(p.Name)
+		if !ok {
+			return 0, orb.Bound{}, owsErrorf(http.StatusBadRequest, "InvalidValue", p.Name, "unknown property %s", p.Name)
+		}
+		cols, marks = append(cols, fmt.Sprintf(`"%s"`, col)), append(marks, "?")
+		if p.Attrs["nil"] == "true" {
+			vals = append(vals, nil)
+		} else {
+			vals = append(vals, p.Text)
+		}
+	}
+	if geom == nil {
+		return 0, orb.Bound{}, owsErrorf(http.StatusBadRequest, "InvalidValue", n.Name, "feature geometry is required")
+	}
+	cols, marks, vals = append(cols, "geom"), append(marks, "?"), append(vals, buildGpkgGeom(geom, 4326))
+	res, err := tx.Exec(fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s)`, strings.ToLower(dt.ID), strings.Join(cols, ", "), strings.Join(marks, ", ")), vals...)
+	if err != nil {
+		return 0, orb.Bound{}, err
+	}
+	fid, err := res.LastInsertId()
+	if err != nil {
+		return 0, orb.Bound{}, err
+	}
+	b, err := wfsSetGeometry(tx, dt, fid, geom)
+	return fid, b, err
+}
+
+//wfsUpdate 按过滤条件更新属性或几何,返回更新数及新旧范围,必须指定过滤条件
+func wfsUpdate(tx *sql.Tx, dt *Dataset, op *sldNode) (int, []orb.Bound, error) {
+	filter := op.child("Filter")
+	if filter == nil {
+		return 0, nil, owsErrorf(http.StatusBadRequest, "MissingParameterValue", "Filter", "update requires a filter")
+	}
+	var sets []string
+	var vals []interface{}
+	var geom orb.Geometry
+	for _, p := range op.children("Property") {
+		name := p.childText("ValueReference")
+		if name == "" {
+			name = p.childText("Name")
+		}
+		name = localName(name)
+		v := p.child("Value")
+		if gn := gmlChild(v); gn != nil || name == "geom" {
+			if gn == nil {
+				return 0, nil, owsErrorf(http.StatusBadRequest, "InvalidValue", name, "geometry can not be null")
+			}
+			g, err := parseGML(gn, op.Attrs["srsName"])
+			if err != nil {
+				return 0, nil, owsErrorf(http.StatusBadRequest, "InvalidValue", name, "%s", err)
+			}
+			geom = g
+			continue
+		}
+		col, ok := dt.wfsColumn(name)
+		if !ok {
+			return 0, nil, owsErrorf(http.StatusBadRequest, "InvalidValue", name, "unknown property %s", name)
+		}
+		sets = append(sets, fmt.Sprintf(`"%s" = ?`, col))
+		if v == nil {
+			vals = append(vals, nil)
+		} else {
+			vals = append(vals, v.Text)
+		}
+	}
+	fids, bounds, err := wfsSelect(tx, dt, filter)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, fid := range fids {
+		if len(sets) > 0 {
+			_, err := tx.Exec(fmt.Sprintf(`UPDATE "%s" SET %s WHERE fid = ?`, strings.ToLower(dt.ID), strings.Join(sets, ", ")), append(vals, fid)...)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		if geom != nil {
+			b, err := wfsSetGeometry(tx, dt, fid, geom)
+			if err != nil {
+				return 0, nil, err
+			}
+			bounds = append(bounds, b)
+		}
+	}
+	return len(fids), bounds, nil
+}
+
+//wfsDelete 按过滤条件删除要素及其rtree索引,必须指定过滤条件
+func wfsDelete(tx *sql.Tx, dt *Dataset, op *sldNode) (int, []orb.Bound, error) {
+	filter := op.child("Filter")
+	if filter == nil {
+		return 0, nil, owsErrorf(http.StatusBadRequest, "MissingParameterValue", "Filter", "delete requires a filter")
+	}
+	fids, bounds, err := wfsSelect(tx, dt, filter)
+	if err != nil {
+		return 0, nil, err
+	}
+	table := strings.ToLower(dt.ID)
+	for _, fid := range fids {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE fid = ?`, table), fid); err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM "rtree_%s_geom" WHERE id = ?`, table), fid); err != nil {
+			return 0, nil, err
+		}
+	}
+	return len(fids), bounds, nil
+}
+
+//afterEdit 编辑后失效瓦片缓存,更新要素数与范围
+func (dt *Dataset) afterEdit(bounds []orb.Bound) {
+	invalidateLayerCache(dsCacheID(dt.ID), bounds...)
+	if _, err := dt.TotalCount(); err != nil {
+		log.Warnf("afterEdit, count %s error, details: %s", dt.ID, err)
+	}
+	for _, b := range bounds {
+		if dt.BBox.IsZero() {
+			dt.BBox = b
+			continue
+		}
+		dt.BBox = dt.BBox.Union(b)
+	}
+	dataDB.Exec(`UPDATE gpkg_contents SET min_x = ?, min_y = ?, max_x = ?, max_y = ? WHERE table_name = ?`,
+		dt.BBox.Min.X(), dt.BBox.Min.Y(), dt.BBox.Max.X(), dt.BBox.Max.Y(), strings.ToLower(dt.ID))
+	err := db.Model(&Dataset{}).Where("id = ?", dt.ID).Update("total", dt.Total).Error
+	if err != nil {
+		log.Warnf("afterEdit, update %s error, details: %s", dt.ID, err)
+	}
+}
+
+//wfsTransaction 执行Insert/Update/Delete事务,只允许编辑自有数据集
+func wfsTransaction(c *gin.Context, uid string, root *sldNode) error {
+	if dbType != Sqlite3 {
+		return fmt.Errorf("unsupported driver")
+	}
+	tx, err := dataDB.DB().Begin()
+	if err != nil {
+		return err
+	}
+	edits := make(map[string]*wfsEdit)
+	edit := func(dt *Dataset, bounds ...orb.Bound) {
+		e, ok := edits[dt.ID]
+		if !ok {
+			e = &wfsEdit{dt: dt}
+			edits[dt.ID] = e
+		}
+		e.bounds = append(e.bounds, bounds...)
+	}
+	var inserted []string
+	var updated, deleted int
+	err = func() error {
+		for _, op := range root.elements() {
+			switch op.Name {
+			case "Insert":
+				for _, fn := range op.elements() {
+					dt, err := wfsWritableDataset(uid, fn.Name)
+					if err != nil {
+						return err
+					}
+					fid, b, err := wfsInsert(tx, dt, fn, op.Attrs["srsName"])
+					if err != nil {
+						return err
+					}
+					edit(dt, b)
+					inserted = append(inserted, fmt.Sprintf("%s.%d", wfsTypeName(dt.ID), fid))
+				}
+			case "Update", "Delete":
+				dt, err := wfsWritableDataset(uid, op.Attrs["typeName"])
+				if err != nil {
+					return err
+				}
+				var n int
+				var bounds []orb.Bound
+				if op.Name == "Update" {
+					n, bounds, err = wfsUpdate(tx, dt, op)
+					updated += n
+				} else {
+					n, bounds, err = wfsDelete(tx, dt, op)
+					deleted += n
+				}
+				if err != nil {
+					return err
+				}
+				edit(dt, bounds...)
+			default:
+				return owsErrorf(http.StatusBadRequest, "OperationNotSupported", op.Name, "unsupported transaction action %s", op.Name)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, e := range edits {
+		e.dt.afterEdit(e.bounds)
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<wfs:TransactionResponse xmlns:wfs="http://www.opengis.net/wfs/2.0" xmlns:fes="http://www.opengis.net/fes/2.0" version="2.0.0">`)
+	fmt.Fprintf(&b, `<wfs:TransactionSummary><wfs:totalInserted>%d</wfs:totalInserted><wfs:totalUpdated>%d</wfs:totalUpdated><wfs:totalReplaced>0</wfs:totalReplaced><wfs:totalDeleted>%d</wfs:totalDeleted></wfs:TransactionSummary>`,
+		len(inserted), updated, deleted)
+	if len(inserted) > 0 {
+		b.WriteString(`<wfs:InsertResults>`)
+		for _, rid := range inserted {
+			fmt.Fprintf(&b, `<wfs:Feature><fes:ResourceId rid="%s"/></wfs:Feature>`, rid)
+		}
+		b.WriteString(`</wfs:InsertResults>`)
+	}
+	b.WriteString(`</wfs:TransactionResponse>`)
+	c.Data(http.StatusOK, "application/xml", b.Bytes())
+	return nil
+}
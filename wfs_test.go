@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+func TestWFS(t *testing.T) {
+	dt := newTestDataset(t, "u")
+	tdb, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "sys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	tdb.AutoMigrate(&Dataset{})
+	tdb.Create(dt)
+	oldDB := db
+	db = tdb
+	defer func() { db = oldDB }()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(userKey, "u") })
+	r.GET(wfsPath, serveWFS)
+	r.POST(wfsPath, serveWFS)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", wfsPath+"?SERVICE=WFS&VERSION=2.0.0&"+query, nil))
+		return w
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", wfsPath, strings.NewReader(body)))
+		return w
+	}
+
+	w := get("REQUEST=GetCapabilities")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<wfs:Name>atlas:pois</wfs:Name>") {
+		t.Fatalf("unexpected capabilities %s", w.Body.String())
+	}
+	w = get("REQUEST=DescribeFeatureType&TYPENAMES=atlas:pois")
+	if !strings.Contains(w.Body.String(), `name="rank" type="xsd:long"`) || !strings.Contains(w.Body.String(), "gml:PointPropertyType") {
+		t.Errorf("unexpected schema %s", w.Body.String())
+	}
+
+	filter := `<fes:Filter xmlns:fes="http://www.opengis.net/fes/2.0"><fes:PropertyIsLike wildCard="*" singleChar="." escapeChar="!"><fes:ValueReference>name</fes:ValueReference><fes:Literal>p*</fes:Literal></fes:PropertyIsLike></fes:Filter>`
+	w = get("REQUEST=GetFeature&TYPENAMES=pois&COUNT=1&FILTER=" + url.QueryEscape(filter))
+	body := w.Body.String()
+	if w.Header().Get("Content-Type") != gmlMime || !strings.Contains(body, `numberMatched="3" numberReturned="1"`) ||
+		!strings.Contains(body, `gml:id="pois.1"`) || !strings.Contains(body, "<gml:pos>39.91 116.39</gml:pos>") || !strings.Contains(body, "STARTINDEX=1") {
+		t.Errorf("unexpected gml %s", body)
+	}
+	var fc struct {
+		NumberMatched int `json:"numberMatched"`
+		Features      []struct {
+			ID float64 `json:"id"`
+		} `json:"features"`
+	}
+	w = get("REQUEST=GetFeature&TYPENAMES=pois&OUTPUTFORMAT=application/json&BBOX=39,116,40,117,urn:ogc:def:crs:EPSG::4326")
+	json.Unmarshal(w.Body.Bytes(), &fc)
+	if fc.NumberMatched != 2 {
+		t.Errorf("bbox should match two features, got %s", w.Body.String())
+	}
+	if w := get("REQUEST=GetFeature&TYPENAMES=none"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "ExceptionReport") {
+		t.Errorf("unknown type should raise exception, got %d", w.Code)
+	}
+
+	tx := `<wfs:Transaction service="WFS" version="2.0.0" xmlns:wfs="http://www.opengis.net/wfs/2.0" xmlns:fes="http://www.opengis.net/fes/2.0" xmlns:gml="http://www.opengis.net/gml/3.2" xmlns:atlas="http://www.atlasdata.cn/atlas">
+<wfs:Insert><atlas:pois><atlas:geom><gml:Point srsName="urn:ogc:def:crs:EPSG::4326"><gml:pos>30 120</gml:pos></gml:Point></atlas:geom><atlas:name>p4</atlas:name><atlas:rank>2</atlas:rank></atlas:pois></wfs:Insert>
+<wfs:Update typeName="atlas:pois"><wfs:Property><wfs:ValueReference>rank</wfs:ValueReference><wfs:Value>5</wfs:Value></wfs:Property>
+<fes:Filter><fes:ResourceId rid="pois.1"/></fes:Filter></wfs:Update>
+<wfs:Delete typeName="atlas:pois"><fes:Filter><fes:BBOX><fes:ValueReference>geom</fes:ValueReference><gml:Envelope srsName="EPSG:4326"><gml:lowerCorner>121 31</gml:lowerCorner><gml:upperCorner>122 32</gml:upperCorner></gml:Envelope></fes:BBOX></fes:Filter></wfs:Delete>
+</wfs:Transaction>`
+	w = post(tx)
+	body = w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "<wfs:totalInserted>1</wfs:totalInserted><wfs:totalUpdated>1</wfs:totalUpdated>") ||
+		!strings.Contains(body, "<wfs:totalDeleted>1</wfs:totalDeleted>") || !strings.Contains(body, `rid="pois.4"`) {
+		t.Fatalf("unexpected transaction response %s", body)
+	}
+	var rank, n int
+	var minx float64
+	dataDB.DB().QueryRow(`SELECT rank FROM pois WHERE fid = 1`).Scan(&rank)
+	dataDB.DB().QueryRow(`SELECT count(*) FROM rtree_pois_geom`).Scan(&n)
+	dataDB.DB().QueryRow(`SELECT minx FROM rtree_pois_geom WHERE id = 4`).Scan(&minx)
+	if rank != 5 || n != 3 || minx != 120 {
+		t.Errorf("unexpected data after transaction, rank %d rtree %d minx %f", rank, n, minx)
+	}
+	saved := &Dataset{}
+	tdb.Where("id = ?", "pois").First(saved)
+	if dt.Total != 3 || saved.Total != 3 {
+		t.Errorf("total should be updated, got %d %d", dt.Total, saved.Total)
+	}
+
+	if w := post(`<wfs:Transaction service="WFS" version="2.0.0" xmlns:wfs="http://www.opengis.net/wfs/2.0"><wfs:Delete typeName="atlas:pois"/></wfs:Transaction>`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "MissingParameterValue") {
+		t.Errorf("delete without filter should be rejected, got %d %s", w.Code, w.Body.String())
+	}
+	dataDB.DB().QueryRow(`SELECT count(*) FROM pois`).Scan(&n)
+	if n != 3 {
+		t.Errorf("delete without filter should not remove features, got %d", n)
+	}
+	if w := post(`<wfs:Transaction service="WFS" version="2.0.0" xmlns:wfs="http://www.opengis.net/wfs/2.0"><wfs:Update typeName="atlas:pois"><wfs:Property><wfs:ValueReference>rank</wfs:ValueReference><wfs:Value>9</wfs:Value></wfs:Property></wfs:Update></wfs:Transaction>`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "MissingParameterValue") {
+		t.Errorf("update without filter should be rejected, got %d %s", w.Code, w.Body.String())
+	}
+	dataDB.DB().QueryRow(`SELECT count(*) FROM pois WHERE rank = 9`).Scan(&n)
+	if n != 0 {
+		t.Errorf("update without filter should not change features, got %d", n)
+	}
+
+	//字段名转换为NCName
+	dataDB.Exec(`ALTER TABLE pois ADD COLUMN "2nd name (cn)" TEXT`)
+	dt.Fields, _ = json.Marshal([]Field{{Name: "fid", Type: Int}, {Name: "geom", Type: Geojson}, {Name: "name", Type: String}, {Name: "rank", Type: Int}, {Name: "2nd name (cn)", Type: String}})
+	if w := get("REQUEST=DescribeFeatureType&TYPENAMES=atlas:pois"); !strings.Contains(w.Body.String(), `name="_2nd_name__cn_" type="xsd:string"`) {
+		t.Errorf("field name should be mapped to NCName, got %s", w.Body.String())
+	}
+	w = post(`<wfs:Transaction service="WFS" version="2.0.0" xmlns:wfs="http://www.opengis.net/wfs/2.0" xmlns:fes="http://www.opengis.net/fes/2.0" xmlns:atlas="http://www.atlasdata.cn/atlas">
+<wfs:Update typeName="atlas:pois"><wfs:Property><wfs:ValueReference>_2nd_name__cn_</wfs:ValueReference><wfs:Value>二</wfs:Value></wfs:Property><fes:Filter><fes:ResourceId rid="pois.1"/></fes:Filter></wfs:Update></wfs:Transaction>`)
+	if !strings.Contains(w.Body.String(), "<wfs:totalUpdated>1</wfs:totalUpdated>") {
+		t.Fatalf("update by mapped name failed %s", w.Body.String())
+	}
+	if w := get("REQUEST=GetFeature&TYPENAMES=pois&RESOURCEID=pois.1"); !strings.Contains(w.Body.String(), "<atlas:_2nd_name__cn_>二</atlas:_2nd_name__cn_>") {
+		t.Errorf("unexpected gml with mapped field %s", w.Body.String())
+	}
+
+	//公开数据集只读
+	dt.Owner = ATLAS
+	if w := post(tx); w.Code != http.StatusForbidden {
+		t.Errorf("non-owner transaction should be forbidden, got %d %s", w.Code, w.Body.String())
+	}
+}
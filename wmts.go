@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+	log "github.com/sirupsen/logrus"
+)
+
+//WMTS/TMS 常量
+const (
+	wmtsPath = "/ogc/wmts"
+	tmsPath  = "/tms/1.0.0"
+)
+
+//tilesetMeta 瓦片集范围、级别及瓦片矩阵集,元数据缺失时为矩阵集的全部范围及级别
+type tilesetMeta struct {
+	bound   orb.Bound
+	minZoom int
+	maxZoom int
+	matrix  *TileMatrixSet
+}
+
+//meta 瓦片集范围、级别及瓦片矩阵集,优先使用加载服务时解析的结果
+func (ts *Tileset) meta() (*tilesetMeta, error) {
+	if ts.db != nil && ts.tmeta != nil {
+		return ts.tmeta, nil
+	}
+	return ts.loadMeta()
+}
+
+//loadMeta 读取瓦片集范围、级别及瓦片矩阵集,未记录矩阵集的为WebMercatorQuad
+func (ts *Tileset) loadMeta() (*tilesetMeta, error) {
+	if ts.db == nil {
+		return nil, fmt.Errorf("tileset %s not loaded", ts.ID)
+	}
+	info, err := ts.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	id, _ := info["tilematrixset"].(string)
+	ms := getTileMatrixSet(id)
+	if ms == nil {
+		return nil, fmt.Errorf("tileset %s has unsupported tilematrixset %s", ts.ID, id)
+	}
+	lat := 90.0
+	if !ms.Geographic {
+		lat = maxMercatorLat
+	}
+	m := &tilesetMeta{
+		bound:   orb.Bound{Min: orb.Point{-180, -lat}, Max: orb.Point{180, lat}},
+		minZoom: ms.MinZoom,
+		maxZoom: ms.MaxZoom,
+		matrix:  ms,
+	}
+	if b, ok := info["bounds"].([]float64); ok && len(b) == 4 {
+		m.bound = orb.Bound{
+			Min: orb.Point{math.Max(b[0], -180), math.Max(b[1], -lat)},
+			Max: orb.Point{math.Min(b[2], 180), math.Min(b[3], lat)},
+		}
+	}
+	if z, ok := info["minzoom"].(int); ok && z >= ms.MinZoom && z <= ms.MaxZoom {
+		m.minZoom = z
+	}
+	if z, ok := info["maxzoom"].(int); ok && z >= m.minZoom && z <= ms.MaxZoom {
+		m.maxZoom = z
+	}
+	return m, nil
+}
+
+//wmtsFormat 瓦片格式对应的WMTS格式
+func wmtsFormat(f TileFormat) string {
+	if f == PBF {
+		return "application/vnd.mapbox-vector-tile"
+	}
+	return f.ContentType()
+}
+
+//parseTileIndex 解析并按瓦片矩阵集校验级别及行列号,行列号可带扩展名
+func parseTileIndex(ms *TileMatrixSet, zs, xs, ys string) (z int, x, y uint32, ok bool) {
+	zv, err := strconv.Atoi(zs)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	xv, err := strconv.ParseUint(strings.Split(xs, ".")[0], 10, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	yv, err := strconv.ParseUint(strings.Split(ys, ".")[0], 10, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	if !ms.Contains(zv, uint32(xv), uint32(yv)) {
+		return 0, 0, 0, false
+	}
+	return zv, uint32(xv), uint32(yv), true
+}
+
+//serveWMTS WMTS KVP服务入口,参数名不区分大小写
+func serveWMTS(c *gin.Context) {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	kvp := make(map[string]string)
+	for k, v := range c.Request.URL.Query() {
+		kvp[strings.ToLower(k)] = v[0]
+	}
+	var err error
+	switch {
+	case kvp["service"] != "" && !strings.EqualFold(kvp["service"], "WMTS"):
+		err = owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "service", "unsupported service %s", kvp["service"])
+	case strings.EqualFold(kvp["request"], "GetCapabilities"):
+		err = wmtsCapabilities(c, uid)
+	case strings.EqualFold(kvp["request"], "GetTile"):
+		err = wmtsGetTile(c, uid, kvp["layer"], kvp["tilematrixset"], kvp["tilematrix"], kvp["tilerow"], kvp["tilecol"])
+	case kvp["request"] == "":
+		err = owsErrorf(http.StatusBadRequest, "MissingParameterValue", "request", "request is required")
+	default:
+		err = owsErrorf(http.StatusBadRequest, "OperationNotSupported", "request", "unsupported request %s", kvp["request"])
+	}
+	if err != nil {
+		writeOWSError(c, "serveWMTS", "1.0.0", err)
+	}
+}
+
+//getWMTSCapabilities RESTful能力文档
+func getWMTSCapabilities(c *gin.Context) {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	if err := wmtsCapabilities(c, uid); err != nil {
+		writeOWSError(c, "getWMTSCapabilities", "1.0.0", err)
+	}
+}
+
+//getWMTSTile RESTful瓦片,/tile/{layer}/{style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.{ext}
+func getWMTSTile(c *gin.Context) {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	err := wmtsGetTile(c, uid, c.Param("layer"), c.Param("set"), c.Param("z"), c.Param("row"), c.Param("col"))
+	if err != nil {
+		writeOWSError(c, "getWMTSTile", "1.0.0", err)
+	}
+}
+
+//wmtsGetTile 输出瓦片,WMTS行号自上而下,需翻转为mbtiles行号
+func wmtsGetTile(c *gin.Context, uid, layer, set, matrix, row, col string) error {
+	if layer == "" {
+		return owsErrorf(http.StatusBadRequest, "MissingParameterValue", "layer", "layer is required")
+	}
+	ts := userSet.tileset(uid, layer)
+	if ts == nil {
+		return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "layer", "unknown layer %s", layer)
+	}
+	m, err := ts.meta()
+	if err != nil {
+		return err
+	}
+	if set == "" {
+		return owsErrorf(http.StatusBadRequest, "MissingParameterValue", "tileMatrixSet", "tileMatrixSet is required")
+	}
+	if ms := getTileMatrixSet(set); ms != m.matrix {
+		return owsErrorf(http.StatusBadRequest, "InvalidParameterValue", "tileMatrixSet", "unknown tile matrix set %s", set)
+	}
+	z, x, y, ok := parseTileIndex(m.matrix, matrix, col, row)
+	if !ok {
+		return owsErrorf(http.StatusBadRequest, "TileOutOfRange", "tileMatrix", "tile %s/%s/%s out of range", matrix, row, col)
+	}
+	writeTilesetTile(c, ts, uint(z), uint(x), uint(m.matrix.FlipY(z, y)))
+	return nil
+}
+
+//wmtsCapabilities 能力文档,列出用户可访问的全部瓦片集
+func wmtsCapabilities(c *gin.Context, uid string) error {
+	kvp := xmlText(serviceURL(c, wmtsPath, nil))
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">`)
+	b.WriteString(`<ows:ServiceIdentification><ows:Title>atlas WMTS</ows:Title><ows:ServiceType>OGC WMTS</ows:ServiceType><ows:ServiceTypeVersion>1.0.0</ows:ServiceTypeVersion></ows:ServiceIdentification>`)
+	b.WriteString(`<ows:OperationsMetadata>`)
+	for _, op := range []string{"GetCapabilities", "GetTile"} {
+		fmt.Fprintf(&b, `<ows:Operation name="%s"><ows:DCP><ows:HTTP><ows:Get xlink:href="%s"><ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>KVP</ows:Value></ows:AllowedValues></ows:Constraint></ows:Get></ows:HTTP></ows:DCP></ows:Operation>`, op, kvp)
+	}
+	b.WriteString(`</ows:OperationsMetadata><Contents>`)
+	for _, ts := range userSet.tilesets(uid) {
+		m, err := ts.meta()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, `<Layer><ows:Title>%s</ows:Title><ows:WGS84BoundingBox><ows:LowerCorner>%s %s</ows:LowerCorner><ows:UpperCorner>%s %s</ows:UpperCorner></ows:WGS84BoundingBox>`,
+			xmlText(ts.Name), gmlNum(m.bound.Min.X()), gmlNum(m.bound.Min.Y()), gmlNum(m.bound.Max.X()), gmlNum(m.bound.Max.Y()))
+		fmt.Fprintf(&b, `<ows:Identifier>%s</ows:Identifier><Style isDefault="true"><ows:Identifier>default</ows:Identifier></Style><Format>%s</Format>`, xmlText(ts.ID), wmtsFormat(ts.Format))
+		fmt.Fprintf(&b, `<TileMatrixSetLink><TileMatrixSet>%s</TileMatrixSet><TileMatrixSetLimits>`, m.matrix.ID)
+		for z := m.minZoom; z <= m.maxZoom; z++ {
+			minCol, minRow, maxCol, maxRow := m.matrix.TileRange(m.bound, z)
+			fmt.Fprintf(&b, `<TileMatrixLimits><TileMatrix>%d</TileMatrix><MinTileRow>%d</MinTileRow><MaxTileRow>%d</MaxTileRow><MinTileCol>%d</MinTileCol><MaxTileCol>%d</MaxTileCol></TileMatrixLimits>`,
+				z, minRow, maxRow, minCol, maxCol)
+		}
+		b.WriteString(`</TileMatrixSetLimits></TileMatrixSetLink>`)
+		tpl := serviceURL(c, fmt.Sprintf("%s/tile/%s/{Style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.%s", wmtsPath, ts.ID, ts.Format), nil)
+		fmt.Fprintf(&b, `<ResourceURL format="%s" resourceType="tile" template="%s"/></Layer>`, wmtsFormat(ts.Format), xmlText(tpl))
+	}
+	for _, ms := range tileMatrixSets {
+		fmt.Fprintf(&b, `<TileMatrixSet><ows:Identifier>%s</ows:Identifier><ows:SupportedCRS>%s</ows:SupportedCRS>`, ms.ID, ms.SRS)
+		//WMTS 1.0只认urn形式的比例尺集
+		if strings.HasPrefix(ms.WellKnown, "urn:") {
+			fmt.Fprintf(&b, `<WellKnownScaleSet>%s</WellKnownScaleSet>`, ms.WellKnown)
+		}
+		for z := ms.MinZoom; z <= ms.MaxZoom; z++ {
+			tm := ms.Matrix(z)
+			fmt.Fprintf(&b, `<TileMatrix><ows:Identifier>%s</ows:Identifier><ScaleDenominator>%s</ScaleDenominator><TopLeftCorner>%s %s</TopLeftCorner><TileWidth>%d</TileWidth><TileHeight>%d</TileHeight><MatrixWidth>%d</MatrixWidth><MatrixHeight>%d</MatrixHeight></TileMatrix>`,
+				tm.ID, gmlNum(tm.ScaleDenominator), gmlNum(tm.PointOfOrigin[0]), gmlNum(tm.PointOfOrigin[1]), tm.TileWidth, tm.TileHeight, tm.MatrixWidth, tm.MatrixHeight)
+		}
+		b.WriteString(`</TileMatrixSet>`)
+	}
+	fmt.Fprintf(&b, `</Contents><ServiceMetadataURL xlink:href="%s"/></Capabilities>`, xmlText(serviceURL(c, wmtsPath+"/1.0.0/WMTSCapabilities.xml", nil)))
+	c.Data(http.StatusOK, "application/xml", b.Bytes())
+	return nil
+}
+
+//getTMSService TMS服务,列出用户可访问的瓦片集
+func getTMSService(c *gin.Context) {
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<TileMapService version="1.0.0"><Title>atlas TMS</Title><TileMaps>`)
+	for _, ts := range userSet.tilesets(uid) {
+		m, err := ts.meta()
+		if err != nil {
+			continue
+		}
+		srs, profile := tmsProfile(m.matrix)
+		fmt.Fprintf(&b, `<TileMap title="%s" srs="%s" profile="%s" href="%s"/>`,
+			xmlText(ts.Name), srs, profile, xmlText(serviceURL(c, tmsPath+"/"+ts.ID, nil)))
+	}
+	b.WriteString(`</TileMaps></TileMapService>`)
+	c.Data(http.StatusOK, "application/xml", b.Bytes())
+}
+
+//getTMSTileMap TMS瓦片地图描述,原点在左下角
+func getTMSTileMap(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	tid := c.Param("id")
+	ts := userSet.tileset(uid, tid)
+	if ts == nil {
+		log.Warnf("getTMSTileMap, %s's tilesets (%s) not found ^^", uid, tid)
+		res.Fail(c, 4045)
+		return
+	}
+	m, err := ts.meta()
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	min, max, origin := m.bound.Min, m.bound.Max, orb.Point{-180, -90}
+	if !m.matrix.Geographic {
+		min, max = project.WGS84.ToMercator(min), project.WGS84.ToMercator(max)
+		origin = orb.Point{-webMercatorExtent, -webMercatorExtent}
+	}
+	srs, profile := tmsProfile(m.matrix)
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<TileMap version="1.0.0" tilemapservice="%s"><Title>%s</Title><Abstract></Abstract><SRS>%s</SRS>`,
+		xmlText(serviceURL(c, tmsPath+"/", nil)), xmlText(ts.Name), srs)
+	fmt.Fprintf(&b, `<BoundingBox minx="%s" miny="%s" maxx="%s" maxy="%s"/><Origin x="%s" y="%s"/>`,
+		gmlNum(min.X()), gmlNum(min.Y()), gmlNum(max.X()), gmlNum(max.Y()), gmlNum(origin.X()), gmlNum(origin.Y()))
+	fmt.Fprintf(&b, `<TileFormat width="256" height="256" mime-type="%s" extension="%s"/><TileSets profile="%s">`, wmtsFormat(ts.Format), ts.Format, profile)
+	for z := m.minZoom; z <= m.maxZoom; z++ {
+		fmt.Fprintf(&b, `<TileSet href="%s" units-per-pixel="%s" order="%d"/>`,
+			xmlText(serviceURL(c, fmt.Sprintf("%s/%s/%d", tmsPath, ts.ID, z), nil)), gmlNum(m.matrix.Resolution(z)), z)
+	}
+	b.WriteString(`</TileSets></TileMap>`)
+	c.Data(http.StatusOK, "application/xml", b.Bytes())
+}
+
+//getTMSTile TMS瓦片,行号自下而上与mbtiles一致,无需翻转
+func getTMSTile(c *gin.Context) {
+	res := NewRes()
+	uid := c.GetString(userKey)
+	if uid == "" {
+		uid = c.GetString(identityKey)
+	}
+	tid := c.Param("id")
+	ts := userSet.tileset(uid, tid)
+	if ts == nil {
+		log.Errorf("getTMSTile, %s's tilesets (%s) not found ^^", uid, tid)
+		res.Fail(c, 4045)
+		return
+	}
+	m, err := ts.meta()
+	if err != nil {
+		res.FailErr(c, err)
+		return
+	}
+	z, x, y, ok := parseTileIndex(m.matrix, c.Param("z"), c.Param("x"), c.Param("y"))
+	if !ok {
+		res.Fail(c, 4003)
+		return
+	}
+	writeTilesetTile(c, ts, uint(z), uint(x), uint(y))
+}
+
+//tmsProfile 瓦片矩阵集对应的TMS坐标系及profile
+func tmsProfile(ms *TileMatrixSet) (string, string) {
+	switch ms {
+	case WorldCRS84Quad:
+		return "EPSG:4326", "global-geodetic"
+	case CGCS2000Quad:
+		return "EPSG:4490", "global-geodetic"
+	}
+	return "EPSG:3857", "global-mercator"
+}
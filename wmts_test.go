@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin"
+	"github.com/gin-gonic/gin"
+)
+
+//newTestTileset 创建png瓦片集并加入用户服务集,仅有1级瓦片1/1/0(XYZ行号)
+func newTestTileset(t *testing.T, uid string) *Tileset {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "base.mbtiles")
+	mdb, err := CreateMBTileTables(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`INSERT INTO metadata VALUES ('bounds', '10,10,170,80')`,
+		`INSERT INTO metadata VALUES ('minzoom', '1')`,
+		`INSERT INTO metadata VALUES ('maxzoom', '2')`,
+		`INSERT INTO tiles VALUES (1, 1, 1, X'89504E470D0A1A0A01')`,
+	} {
+		if _, err := mdb.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mdb.Close()
+	ts := &Tileset{ID: "base", Name: "底图", Owner: uid, Format: PNG, Public: true, Path: path}
+	if err := ts.Service(); err != nil {
+		t.Fatal(err)
+	}
+	oldEnf := casEnf
+	if casEnf == nil {
+		casEnf = casbin.NewEnforcer("auth.conf")
+	}
+	set := &ServiceSet{Owner: uid}
+	set.T.Store(ts.ID, ts)
+	userSet.Store(uid, set)
+	t.Cleanup(func() {
+		ts.Close()
+		casEnf = oldEnf
+		userSet.Delete(uid)
+	})
+	return ts
+}
+
+func TestWMTS(t *testing.T) {
+	newTestTileset(t, ATLAS)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(userKey, ATLAS) })
+	r.GET(wmtsPath, serveWMTS)
+	r.GET(wmtsPath+"/tile/:layer/:style/:set/:z/:row/:col", getWMTSTile)
+	r.GET(tmsPath+"/:id", getTMSTileMap)
+	r.GET(tmsPath+"/:id/:z/:x/:y", getTMSTile)
+	get := func(uri string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", uri, nil))
+		return w
+	}
+	tile := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x01}
+
+	w := get(wmtsPath + "?service=WMTS&request=GetCapabilities&access_token=abc")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "<ows:Identifier>base</ows:Identifier>") ||
+		!strings.Contains(body, "<TileMatrix>1</TileMatrix><MinTileRow>0</MinTileRow><MaxTileRow>0</MaxTileRow><MinTileCol>1</MinTileCol><MaxTileCol>1</MaxTileCol>") ||
+		!strings.Contains(body, "<TileMatrixSet>WebMercatorQuad</TileMatrixSet>") ||
+		!strings.Contains(body, "<ows:Identifier>CGCS2000Quad</ows:Identifier><ows:SupportedCRS>urn:ogc:def:crs:EPSG::4490</ows:SupportedCRS><TileMatrix><ows:Identifier>1</ows:Identifier>") ||
+		!strings.Contains(body, "/ogc/wmts/tile/base/{Style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png?access_token=abc") {
+		t.Fatalf("unexpected capabilities %s", body)
+	}
+	//WMTS与XYZ行号一致,自上而下
+	w = get(wmtsPath + "?SERVICE=WMTS&REQUEST=GetTile&LAYER=base&STYLE=default&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=1&TILEROW=0&TILECOL=1&FORMAT=image/png")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), tile) {
+		t.Errorf("unexpected kvp tile %d %v", w.Code, w.Body.Bytes())
+	}
+	if w := get(wmtsPath + "/tile/base/default/GoogleMapsCompatible/1/0/1.png"); !bytes.Equal(w.Body.Bytes(), tile) {
+		t.Errorf("unexpected restful tile %v", w.Body.Bytes())
+	}
+	if w := get(wmtsPath + "?REQUEST=GetTile&LAYER=base&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=1&TILEROW=2&TILECOL=1"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "TileOutOfRange") {
+		t.Errorf("out of range tile should raise exception, got %d", w.Code)
+	}
+	if w := get(wmtsPath + "?REQUEST=GetTile&LAYER=base&TILEMATRIX=1&TILEROW=0&TILECOL=1"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "MissingParameterValue") {
+		t.Errorf("missing tile matrix set should raise exception, got %d", w.Code)
+	}
+	if w := get(wmtsPath + "?REQUEST=GetTile&LAYER=none&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=1&TILEROW=0&TILECOL=1"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown layer should raise exception, got %d", w.Code)
+	}
+
+	//TMS行号自下而上,1级第1行即XYZ第0行
+	if w := get(tmsPath + "/base/1/1/1.png"); !bytes.Equal(w.Body.Bytes(), tile) {
+		t.Errorf("unexpected tms tile %v", w.Body.Bytes())
+	}
+	if w := get(tmsPath + "/base/1/1/0.png"); !bytes.Equal(w.Body.Bytes(), BlankPNG()) {
+		t.Errorf("missing tms tile should be blank")
+	}
+	w = get(tmsPath + "/base")
+	if !strings.Contains(w.Body.String(), `<TileSet href="http://example.com/tms/1.0.0/base/2"`) || !strings.Contains(w.Body.String(), `extension="png"`) {
+		t.Errorf("unexpected tile map %s", w.Body.String())
+	}
+}
+
+func TestTilesetMetaCache(t *testing.T) {
+	ts := newTestTileset(t, "meta_cache")
+	m, err := ts.meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.db.Exec(`UPDATE metadata SET value = '5' WHERE name = 'maxzoom'`); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := ts.meta(); cached != m || cached.maxZoom != 2 {
+		t.Errorf("meta should be parsed once per service, got maxzoom %d", cached.maxZoom)
+	}
+	//重新加载服务(替换瓦片集文件后注册)读取新的元数据
+	ts.Close()
+	if err := ts.Service(); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := ts.meta(); m.maxZoom != 5 {
+		t.Errorf("reloaded service should read new metadata, got maxzoom %d", m.maxZoom)
+	}
+}